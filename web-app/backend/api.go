@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// apiPrefix is where the current version of the API is served.
+const apiPrefix = "/api/v1"
+
+// Error codes let clients tell errors apart without parsing messages.
+const (
+	codeInvalidRequest   = "invalid_request"
+	codeValidationFailed = "validation_failed"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeConflict         = "conflict"
+	codePayloadTooLarge  = "payload_too_large"
+	codeBadGateway       = "bad_gateway"
+	codeUnavailable      = "unavailable"
+	codeInternal         = "internal_error"
+
+	// The driver or network mode does not support what was asked for
+	codeUnsupported = "unsupported"
+
+	codeContainerNotFound    = "container_not_found"
+	codeLearningPathNotFound = "learning_path_not_found"
+	codeImageNotFound        = "image_not_found"
+	codeImageInUse           = "image_in_use"
+	codeCheckpointNotFound   = "checkpoint_not_found"
+	codeTemplateNotFound     = "template_not_found"
+	codeProcessNotFound      = "process_not_found"
+	codeFileNotFound         = "file_not_found"
+)
+
+// APIError is what every failed API request responds with, wrapped in an
+// ErrorResponse.
+type APIError struct {
+	status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Details lists the invalid fields of a request that failed
+	// validation
+	Details []FieldError `json:"details,omitempty"`
+}
+
+type ErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func apiError(status int, code, message string) *APIError {
+	return &APIError{status: status, Code: code, Message: message}
+}
+
+// invalidField reports a single invalid field or query parameter.
+func invalidField(field, message string) *APIError {
+	return &APIError{
+		status:  http.StatusBadRequest,
+		Code:    codeValidationFailed,
+		Message: "Invalid " + field,
+		Details: []FieldError{{Field: field, Message: message}},
+	}
+}
+
+func internalError(format string, args ...interface{}) *APIError {
+	return apiError(http.StatusInternalServerError, codeInternal, fmt.Sprintf(format, args...))
+}
+
+var errContainerNotFound = apiError(http.StatusNotFound, codeContainerNotFound, "Container not found")
+
+// statusErrorCode is the code of errors that only carry a status, such as
+// those of the router.
+func statusErrorCode(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusForbidden:
+		return codeForbidden
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusMethodNotAllowed:
+		return codeMethodNotAllowed
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusRequestEntityTooLarge:
+		return codePayloadTooLarge
+	case http.StatusBadGateway:
+		return codeBadGateway
+	case http.StatusServiceUnavailable:
+		return codeUnavailable
+	}
+	if status >= http.StatusInternalServerError {
+		return codeInternal
+	}
+	return codeInvalidRequest
+}
+
+// handleError writes the errors handlers and middleware return as an
+// ErrorResponse.
+func handleError(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+	var apiErr *APIError
+	var httpErr *echo.HTTPError
+	switch {
+	case errors.As(err, &apiErr):
+	case errors.As(err, &httpErr):
+		message, ok := httpErr.Message.(string)
+		if !ok {
+			message = http.StatusText(httpErr.Code)
+		}
+		apiErr = apiError(httpErr.Code, statusErrorCode(httpErr.Code), message)
+	default:
+		apiErr = internalError("%v", err)
+	}
+
+	if c.Request().Method == http.MethodHead {
+		c.NoContent(apiErr.status)
+		return
+	}
+	c.JSON(apiErr.status, ErrorResponse{Error: apiErr})
+}
+
+// bindRequest reads the request body into req and validates it.
+func bindRequest(c echo.Context, req interface{}) error {
+	if err := c.Bind(req); err != nil {
+		message := "Invalid request body"
+		var httpErr *echo.HTTPError
+		if errors.As(err, &httpErr) {
+			message += fmt.Sprintf(": %v", httpErr.Message)
+		}
+		return apiError(http.StatusBadRequest, codeInvalidRequest, message)
+	}
+	return c.Validate(req)
+}
+
+// requestValidator checks bound requests against the validate tags of
+// their fields, which also end up in the OpenAPI document:
+//
+//	required      the field is not empty
+//	oneof=a b     the field is one of the values
+//	min=n, max=n  the number lies within the bound
+//	ip            the field is an IP address
+//
+// Apart from required, rules only apply to fields that are set. Requests
+// implementing validator are checked further by it.
+type requestValidator struct{}
+
+type validator interface {
+	validate() []FieldError
+}
+
+func (requestValidator) Validate(i interface{}) error {
+	errs := validateValue(reflect.ValueOf(i), "")
+	if v, ok := i.(validator); ok {
+		errs = append(errs, v.validate()...)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &APIError{
+		status:  http.StatusBadRequest,
+		Code:    codeValidationFailed,
+		Message: "Invalid request",
+		Details: errs,
+	}
+}
+
+// validateValue checks the fields of structs in v, naming them by their
+// path in the JSON document.
+func validateValue(v reflect.Value, path string) []FieldError {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	var errs []FieldError
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			errs = append(errs, validateValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case reflect.Struct:
+		for _, f := range jsonFields(v.Type()) {
+			field := v.FieldByIndex(f.index)
+			name := f.name
+			if path != "" {
+				name = path + "." + f.name
+			}
+			if message := checkRules(field, f.rules); message != "" {
+				errs = append(errs, FieldError{Field: name, Message: message})
+				continue
+			}
+			errs = append(errs, validateValue(field, name)...)
+		}
+	}
+	return errs
+}
+
+// checkRules returns what is wrong with v, if anything.
+func checkRules(v reflect.Value, rules []validateRule) string {
+	if v.IsZero() {
+		for _, rule := range rules {
+			if rule.name == "required" {
+				return "is required"
+			}
+		}
+		return ""
+	}
+	for v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	for _, rule := range rules {
+		switch rule.name {
+		case "required":
+		case "oneof":
+			if !containsString(strings.Fields(rule.arg), v.String()) {
+				return "must be one of " + strings.Join(strings.Fields(rule.arg), ", ")
+			}
+		case "min", "max":
+			bound, _ := strconv.ParseFloat(rule.arg, 64)
+			var n float64
+			switch {
+			case v.CanInt():
+				n = float64(v.Int())
+			case v.CanUint():
+				n = float64(v.Uint())
+			case v.CanFloat():
+				n = v.Float()
+			}
+			if rule.name == "min" && n < bound {
+				return "must be at least " + rule.arg
+			}
+			if rule.name == "max" && n > bound {
+				return "must be at most " + rule.arg
+			}
+		case "ip":
+			if net.ParseIP(v.String()) == nil {
+				return "must be an IP address"
+			}
+		}
+	}
+	return ""
+}
+
+type validateRule struct {
+	name, arg string
+}
+
+// jsonField is a struct field as encoding/json sees it.
+type jsonField struct {
+	name      string
+	index     []int
+	typ       reflect.Type
+	omitEmpty bool
+	rules     []validateRule
+}
+
+// jsonFields lists the fields of a struct that are encoded, including
+// those of embedded structs.
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if sf.Anonymous && name == "" {
+			embedded := sf.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for _, f := range jsonFields(embedded) {
+					f.index = append([]int{i}, f.index...)
+					fields = append(fields, f)
+				}
+				continue
+			}
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		f := jsonField{
+			name:      name,
+			index:     []int{i},
+			typ:       sf.Type,
+			omitEmpty: strings.Contains(","+options+",", ",omitempty,"),
+		}
+		if rules := sf.Tag.Get("validate"); rules != "" {
+			for _, rule := range strings.Split(rules, ",") {
+				name, arg, _ := strings.Cut(rule, "=")
+				switch name {
+				case "required", "oneof", "min", "max", "ip":
+				default:
+					panic(fmt.Sprintf("%s.%s: unknown validate rule %q", t.Name(), sf.Name, name))
+				}
+				f.rules = append(f.rules, validateRule{name: name, arg: arg})
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestHandleError(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		err        error
+		wantStatus int
+		wantCode   string
+		wantMsg    string
+	}{
+		{
+			name:       "API error",
+			err:        apiError(http.StatusConflict, codeImageInUse, "Image is in use"),
+			wantStatus: http.StatusConflict,
+			wantCode:   codeImageInUse,
+			wantMsg:    "Image is in use",
+		},
+		{
+			name:       "wrapped API error",
+			err:        fmt.Errorf("deleting: %w", errContainerNotFound),
+			wantStatus: http.StatusNotFound,
+			wantCode:   codeContainerNotFound,
+			wantMsg:    "Container not found",
+		},
+		{
+			name:       "router error",
+			err:        echo.ErrMethodNotAllowed,
+			wantStatus: http.StatusMethodNotAllowed,
+			wantCode:   codeMethodNotAllowed,
+			wantMsg:    "Method Not Allowed",
+		},
+		{
+			name:       "HTTP error without a message",
+			err:        echo.NewHTTPError(http.StatusServiceUnavailable, errors.New("draining")),
+			wantStatus: http.StatusServiceUnavailable,
+			wantCode:   codeUnavailable,
+			wantMsg:    "Service Unavailable",
+		},
+		{
+			name:       "HTTP error of another status",
+			err:        echo.NewHTTPError(http.StatusTeapot, "short and stout"),
+			wantStatus: http.StatusTeapot,
+			wantCode:   codeInvalidRequest,
+			wantMsg:    "short and stout",
+		},
+		{
+			name:       "other error",
+			err:        errors.New("disk on fire"),
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   codeInternal,
+			wantMsg:    "disk on fire",
+		},
+		{
+			name:       "HEAD request",
+			method:     http.MethodHead,
+			err:        errContainerNotFound,
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(method, "/", nil), rec)
+			handleError(tt.err, c)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantCode == "" {
+				if rec.Body.Len() != 0 {
+					t.Errorf("body = %q, want none", rec.Body)
+				}
+				return
+			}
+			var resp ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Error == nil {
+				t.Fatalf("body %q is no error response: %v", rec.Body, err)
+			}
+			if resp.Error.Code != tt.wantCode || resp.Error.Message != tt.wantMsg {
+				t.Errorf("error = %s %q, want %s %q", resp.Error.Code, resp.Error.Message, tt.wantCode, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestHandleErrorCommitted(t *testing.T) {
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	c.String(http.StatusOK, "partial")
+	handleError(errors.New("late failure"), c)
+	if rec.Code != http.StatusOK || rec.Body.String() != "partial" {
+		t.Errorf("response = %d %q, want the committed one untouched", rec.Code, rec.Body)
+	}
+}
+
+// validatedRequest exercises every rule of requestValidator.
+type validatedRequest struct {
+	Name    string          `json:"name" validate:"required"`
+	Mode    string          `json:"mode" validate:"oneof=fast slow"`
+	Count   int             `json:"count" validate:"min=1,max=10"`
+	Ratio   *float64        `json:"ratio" validate:"max=1"`
+	Address string          `json:"address" validate:"ip"`
+	Items   []validatedItem `json:"items"`
+	Nested  *validatedItem  `json:"nested"`
+	Ignored string          `json:"-" validate:"required"`
+}
+
+type validatedItem struct {
+	Port int `json:"port" validate:"required,min=1,max=65535"`
+}
+
+func TestRequestValidator(t *testing.T) {
+	ratio := 1.5
+	tests := []struct {
+		name string
+		req  interface{}
+		want []FieldError
+	}{
+		{
+			name: "valid",
+			req:  &validatedRequest{Name: "a", Mode: "fast", Count: 3, Address: "10.0.0.1", Items: []validatedItem{{Port: 80}}},
+		},
+		{
+			name: "unset optional fields",
+			req:  &validatedRequest{Name: "a"},
+		},
+		{
+			name: "missing required field",
+			req:  &validatedRequest{},
+			want: []FieldError{{Field: "name", Message: "is required"}},
+		},
+		{
+			name: "rule violations",
+			req:  &validatedRequest{Name: "a", Mode: "medium", Count: 11, Ratio: &ratio, Address: "10.0.0"},
+			want: []FieldError{
+				{Field: "mode", Message: "must be one of fast, slow"},
+				{Field: "count", Message: "must be at most 10"},
+				{Field: "ratio", Message: "must be at most 1"},
+				{Field: "address", Message: "must be an IP address"},
+			},
+		},
+		{
+			name: "below the minimum",
+			req:  &validatedRequest{Name: "a", Count: -1},
+			want: []FieldError{{Field: "count", Message: "must be at least 1"}},
+		},
+		{
+			name: "nested fields",
+			req:  &validatedRequest{Name: "a", Items: []validatedItem{{Port: 80}, {}, {Port: 70000}}, Nested: &validatedItem{}},
+			want: []FieldError{
+				{Field: "items[1].port", Message: "is required"},
+				{Field: "items[2].port", Message: "must be at most 65535"},
+				{Field: "nested.port", Message: "is required"},
+			},
+		},
+		{
+			name: "validate method",
+			req:  &CommitRequest{Reference: "alpine@sha256:" + strings.Repeat("ab", 32)},
+			want: []FieldError{{Field: "reference", Message: "must be an image name without digest"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := requestValidator{}.Validate(tt.req)
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("Validate = %v, want no error", err)
+				}
+				return
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("Validate = %v, want an APIError", err)
+			}
+			if apiErr.status != http.StatusBadRequest || apiErr.Code != codeValidationFailed {
+				t.Errorf("Validate = %d %s, want %d %s", apiErr.status, apiErr.Code, http.StatusBadRequest, codeValidationFailed)
+			}
+			if !reflect.DeepEqual(apiErr.Details, tt.want) {
+				t.Errorf("details = %+v, want %+v", apiErr.Details, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommitRequestValidate(t *testing.T) {
+	tests := []struct {
+		reference string
+		ok        bool
+	}{
+		{"", true},
+		{"alpine", true},
+		{"my-section:v2", true},
+		{"registry.example.com:5000/team/image:1.0", true},
+		{"alpine@sha256:" + strings.Repeat("ab", 32), false},
+		{"sha256:" + strings.Repeat("ab", 32), false},
+		{"two words", false},
+		{"tab\tseparated", false},
+		{"line\nbreak", false},
+	}
+	for _, tt := range tests {
+		req := CommitRequest{Reference: tt.reference}
+		if errs := req.validate(); (len(errs) == 0) != tt.ok {
+			t.Errorf("validate(%q) = %v, want ok %v", tt.reference, errs, tt.ok)
+		}
+	}
+}
+
+func TestBindRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantCode string
+	}{
+		{name: "valid", body: `{"name": "a", "count": 2}`},
+		{name: "malformed JSON", body: `{"name": `, wantCode: codeInvalidRequest},
+		{name: "wrong type", body: `{"name": 5}`, wantCode: codeInvalidRequest},
+		{name: "invalid field", body: `{"name": "a", "mode": "medium"}`, wantCode: codeValidationFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			e.Validator = requestValidator{}
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			c := e.NewContext(req, httptest.NewRecorder())
+
+			var body validatedRequest
+			err := bindRequest(c, &body)
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Errorf("bindRequest = %v, want no error", err)
+				}
+				return
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.Code != tt.wantCode || apiErr.status != http.StatusBadRequest {
+				t.Errorf("bindRequest = %#v, want a %s error", err, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cgroupRoot is where the cgroup hierarchies are mounted. With cgroup v2
+// it is the unified hierarchy itself, with v1 it holds one directory per
+// controller.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupV1Controllers are the v1 hierarchies containers are placed in.
+// cpuacct accounts the CPU time reported by /metrics, devices holds the
+// allowlist of native containers.
+var cgroupV1Controllers = []string{"memory", "cpu", "cpuacct", "pids", "devices"}
+
+// cgroupResources are the limits a container's cgroup enforces, taken
+// from the linux.resources section of an OCI spec.
+type cgroupResources struct {
+	Memory *cgroupMemory `json:"memory,omitempty"`
+	CPU    *cgroupCPU    `json:"cpu,omitempty"`
+	Pids   *cgroupPids   `json:"pids,omitempty"`
+}
+
+type cgroupMemory struct {
+	Limit       *int64 `json:"limit,omitempty"`
+	Reservation *int64 `json:"reservation,omitempty"`
+	Swap        *int64 `json:"swap,omitempty"`
+}
+
+type cgroupCPU struct {
+	Shares *uint64 `json:"shares,omitempty"`
+	Quota  *int64  `json:"quota,omitempty"`
+	Period *uint64 `json:"period,omitempty"`
+}
+
+type cgroupPids struct {
+	Limit int64 `json:"limit"`
+}
+
+// cgroup is a container's control group, named by its path relative to
+// the root of each hierarchy.
+type cgroup struct {
+	Path string `json:"path"`
+}
+
+// Every container of the native and rootless drivers has a cgroup holding
+// its limits. Its processes live in leaves below it, as cgroup v2 only
+// lets a group without processes of its own delegate controllers.
+const (
+	cgroupProcessesLeaf = "processes"
+	cgroupOCILeaf       = "oci"
+)
+
+func containerCgroupPath(containerID string) string {
+	return filepath.Join("lcw", containerID)
+}
+
+// leaf returns the cgroup named name below cg.
+func (cg *cgroup) leaf(name string) *cgroup {
+	return &cgroup{Path: filepath.Join(cg.Path, name)}
+}
+
+func cgroupV2() bool {
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	return err == nil
+}
+
+// dirs lists the directories making up the cgroup, one per hierarchy.
+func (cg *cgroup) dirs() []string {
+	if cgroupV2() {
+		return []string{filepath.Join(cgroupRoot, cg.Path)}
+	}
+	var dirs []string
+	for _, controller := range cgroupV1Controllers {
+		dirs = append(dirs, filepath.Join(cgroupRoot, controller, cg.Path))
+	}
+	return dirs
+}
+
+// createCgroup creates the cgroup at path and applies resources to it.
+func createCgroup(path string, resources *cgroupResources) (*cgroup, error) {
+	cg := &cgroup{Path: filepath.Join("/", path)}
+	if cgroupV2() {
+		if err := enableControllers(cg.Path); err != nil {
+			return nil, err
+		}
+	}
+	for _, dir := range cg.dirs() {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create cgroup: %w", err)
+		}
+	}
+	if resources != nil {
+		if err := cg.apply(resources); err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+	return cg, nil
+}
+
+// enableControllers creates path in the v2 hierarchy, delegating the
+// controllers containers need to it from the root down.
+func enableControllers(path string) error {
+	available, err := os.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	var enable []string
+	for _, controller := range strings.Fields(string(available)) {
+		if controller == "memory" || controller == "cpu" || controller == "pids" {
+			enable = append(enable, "+"+controller)
+		}
+	}
+
+	dir := cgroupRoot
+	for _, part := range strings.Split(strings.Trim(path, "/"), "/") {
+		if err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0); err != nil {
+			return fmt.Errorf("failed to enable cgroup controllers in %s: %w", dir, err)
+		}
+		dir = filepath.Join(dir, part)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply writes the limits to the cgroup's interface files.
+func (cg *cgroup) apply(r *cgroupResources) error {
+	files := make(map[string]string)
+	if cgroupV2() {
+		if m := r.Memory; m != nil {
+			if m.Limit != nil {
+				files["memory.max"] = cgroupLimit(*m.Limit)
+			}
+			if m.Reservation != nil {
+				files["memory.low"] = cgroupLimit(*m.Reservation)
+			}
+			// v1 counts swap together with memory, v2 on its own
+			if m.Swap != nil && m.Limit != nil && *m.Swap > 0 {
+				files["memory.swap.max"] = strconv.FormatInt(*m.Swap-*m.Limit, 10)
+			}
+		}
+		if c := r.CPU; c != nil {
+			if c.Shares != nil && *c.Shares > 0 {
+				files["cpu.weight"] = strconv.FormatUint(1+((*c.Shares-2)*9999)/262142, 10)
+			}
+			if c.Quota != nil || c.Period != nil {
+				quota, period := "max", uint64(100000)
+				if c.Quota != nil && *c.Quota > 0 {
+					quota = strconv.FormatInt(*c.Quota, 10)
+				}
+				if c.Period != nil && *c.Period > 0 {
+					period = *c.Period
+				}
+				files["cpu.max"] = fmt.Sprintf("%s %d", quota, period)
+			}
+		}
+		if r.Pids != nil {
+			files["pids.max"] = cgroupLimit(r.Pids.Limit)
+		}
+		return cg.write(filepath.Join(cgroupRoot, cg.Path), files)
+	}
+
+	dir := func(controller string) string { return filepath.Join(cgroupRoot, controller, cg.Path) }
+	if m := r.Memory; m != nil {
+		if m.Limit != nil {
+			files[filepath.Join(dir("memory"), "memory.limit_in_bytes")] = strconv.FormatInt(*m.Limit, 10)
+		}
+		if m.Reservation != nil {
+			files[filepath.Join(dir("memory"), "memory.soft_limit_in_bytes")] = strconv.FormatInt(*m.Reservation, 10)
+		}
+		if m.Swap != nil {
+			files[filepath.Join(dir("memory"), "memory.memsw.limit_in_bytes")] = strconv.FormatInt(*m.Swap, 10)
+		}
+	}
+	if c := r.CPU; c != nil {
+		if c.Shares != nil {
+			files[filepath.Join(dir("cpu"), "cpu.shares")] = strconv.FormatUint(*c.Shares, 10)
+		}
+		if c.Period != nil {
+			files[filepath.Join(dir("cpu"), "cpu.cfs_period_us")] = strconv.FormatUint(*c.Period, 10)
+		}
+		if c.Quota != nil {
+			files[filepath.Join(dir("cpu"), "cpu.cfs_quota_us")] = strconv.FormatInt(*c.Quota, 10)
+		}
+	}
+	if r.Pids != nil {
+		files[filepath.Join(dir("pids"), "pids.max")] = cgroupLimit(r.Pids.Limit)
+	}
+	return cg.write("", files)
+}
+
+func (cg *cgroup) write(dir string, files map[string]string) error {
+	for name, value := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0); err != nil {
+			return fmt.Errorf("failed to set %s to %s: %w", filepath.Base(name), value, err)
+		}
+	}
+	return nil
+}
+
+// cgroupLimit spells a limit the way the kernel does, with -1 or 0 meaning
+// no limit.
+func cgroupLimit(limit int64) string {
+	if limit <= 0 {
+		return "max"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+// addProcess moves a process and its future children into the cgroup.
+func (cg *cgroup) addProcess(pid int) error {
+	for _, dir := range cg.dirs() {
+		if err := os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0); err != nil {
+			return fmt.Errorf("failed to add process %d to cgroup: %w", pid, err)
+		}
+	}
+	return nil
+}
+
+// remove deletes the cgroup, which only works once it has no processes
+// left.
+func (cg *cgroup) remove() error {
+	var errs []error
+	for _, dir := range cg.dirs() {
+		if err := syscall.Rmdir(dir); err != nil && !errors.Is(err, syscall.ENOENT) {
+			errs = append(errs, fmt.Errorf("failed to remove cgroup %s: %w", dir, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// removeExited removes the cgroup once the processes just killed in it
+// are gone, which the kernel may still be tearing down.
+func (cg *cgroup) removeExited() error {
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = cg.remove(); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return err
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Kinds of filesystem changes
+const (
+	changeAdded    = "added"
+	changeModified = "modified"
+	changeDeleted  = "deleted"
+)
+
+// baselineFile records the snapshot directory as the template left it.
+const baselineFile = "baseline.json"
+
+// Change is a path the learner added, modified or deleted.
+type Change struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+}
+
+// fileState is what tells two versions of a file apart.
+type fileState struct {
+	Mode   uint32 `json:"mode"`
+	Size   int64  `json:"size"`
+	Mtime  int64  `json:"mtime"`
+	UID    uint32 `json:"uid"`
+	GID    uint32 `json:"gid"`
+	Rdev   uint64 `json:"rdev,omitempty"`
+	Opaque bool   `json:"opaque,omitempty"`
+}
+
+// whiteout reports whether the state is an OverlayFS whiteout.
+func (st fileState) whiteout() bool {
+	return st.Mode&syscall.S_IFMT == syscall.S_IFCHR && st.Rdev == 0
+}
+
+// scanTree records the state of every path below dir, keyed by its
+// absolute path inside the tree.
+func scanTree(dir string) (map[string]fileState, error) {
+	states := make(map[string]fileState)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files may disappear while the tree is scanned
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		var st syscall.Stat_t
+		if err := syscall.Lstat(p, &st); err != nil {
+			return nil
+		}
+		state := fileState{
+			Mode:  st.Mode,
+			Size:  st.Size,
+			Mtime: st.Mtim.Nano(),
+			UID:   st.Uid,
+			GID:   st.Gid,
+			Rdev:  uint64(st.Rdev),
+		}
+		if d.IsDir() {
+			state.Opaque = isOpaque(p)
+		}
+		states["/"+filepath.ToSlash(rel)] = state
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return states, nil
+	}
+	return states, err
+}
+
+func isOpaque(dir string) bool {
+	value := make([]byte, 1)
+	n, err := syscall.Getxattr(dir, opaqueXattr(), value)
+	return err == nil && n == 1 && value[0] == 'y'
+}
+
+// recordBaseline remembers the snapshot directory once the template has
+// been applied, so its files are not reported as the learner's changes.
+func (info *ContainerInfo) recordBaseline() error {
+	states, err := scanTree(info.snapshotDir())
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(containerDir(info.ID), baselineFile), data, 0600)
+}
+
+// changes compares the snapshot directory with its baseline. Overlay
+// containers interpret whiteouts and opaque directories and consult the
+// image's layers to tell modified paths from added ones; local
+// containers are compared as plain trees.
+func (info *ContainerInfo) changes() ([]Change, error) {
+	baseline := make(map[string]fileState)
+	data, err := os.ReadFile(filepath.Join(containerDir(info.ID), baselineFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &baseline); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	current, err := scanTree(info.snapshotDir())
+	if err != nil {
+		return nil, err
+	}
+	var lowers []string
+	if info.isolated() {
+		if lowers, err = info.imageLayers(); err != nil {
+			return nil, err
+		}
+	}
+
+	kinds := make(map[string]string)
+	for p, st := range current {
+		base, known := baseline[p]
+		if known && base == st {
+			continue
+		}
+		switch {
+		case st.whiteout():
+			kinds[p] = changeDeleted
+		case known || lowerExists(lowers, p):
+			kinds[p] = changeModified
+		default:
+			kinds[p] = changeAdded
+		}
+		// Replacing a directory hides everything the image had in it
+		if st.Opaque && !(known && base.Opaque) {
+			for _, child := range lowerChildren(lowers, p) {
+				if _, ok := current[child]; !ok {
+					kinds[child] = changeDeleted
+				}
+			}
+		}
+	}
+	// Paths only the template created vanish without a whiteout
+	for p, base := range baseline {
+		if _, ok := current[p]; !ok && !base.whiteout() {
+			kinds[p] = changeDeleted
+		}
+	}
+
+	changes := []Change{}
+	for p, kind := range kinds {
+		// A deleted directory stands for everything that was in it
+		if parent, ok := kinds[path.Dir(p)]; ok && parent == changeDeleted && kind == changeDeleted {
+			continue
+		}
+		changes = append(changes, Change{Path: p, Kind: kind})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// lowerExists reports whether the image's layers, topmost first, provide
+// p, taking whiteouts and opaque directories in higher layers into
+// account.
+func lowerExists(lowers []string, p string) bool {
+	for _, lower := range lowers {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(filepath.Join(lower, p), &st); err == nil {
+			return !fileState{Mode: st.Mode, Rdev: uint64(st.Rdev)}.whiteout()
+		}
+		if lowerHides(lower, p) {
+			return false
+		}
+	}
+	return false
+}
+
+// lowerHides reports whether a layer removes p through a whiteout or an
+// opaque directory above it.
+func lowerHides(lower, p string) bool {
+	for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(filepath.Join(lower, dir), &st); err != nil {
+			continue
+		}
+		if (fileState{Mode: st.Mode, Rdev: uint64(st.Rdev)}).whiteout() {
+			return true
+		}
+		if st.Mode&syscall.S_IFMT == syscall.S_IFDIR && isOpaque(filepath.Join(lower, dir)) {
+			return true
+		}
+	}
+	return false
+}
+
+// lowerChildren lists the paths the image's layers provide directly
+// inside dir.
+func lowerChildren(lowers []string, dir string) []string {
+	seen := make(map[string]bool)
+	var children []string
+	for _, lower := range lowers {
+		entries, _ := os.ReadDir(filepath.Join(lower, dir))
+		for _, e := range entries {
+			child := path.Join(dir, e.Name())
+			if !seen[child] && lowerExists(lowers, child) {
+				children = append(children, child)
+			}
+			seen[child] = true
+		}
+	}
+	return children
+}
+
+func getContainerChanges(c echo.Context) error {
+	containerId := c.Param("id")
+
+	containersMux.RLock()
+	containerInfo, exists := containers[containerId]
+	containersMux.RUnlock()
+
+	if !exists {
+		return errContainerNotFound
+	}
+
+	changes, err := containerInfo.changes()
+	if err != nil {
+		return internalError("Failed to compute changes: %v", err)
+	}
+	if kind := c.QueryParam("kind"); kind != "" {
+		filtered := []Change{}
+		for _, change := range changes {
+			if strings.EqualFold(change.Kind, kind) {
+				filtered = append(filtered, change)
+			}
+		}
+		changes = filtered
+	}
+	return c.JSON(http.StatusOK, changes)
+}
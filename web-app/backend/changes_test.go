@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// writeTree creates files with the given content below dir; names
+// ending in a slash are directories.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if name[len(name)-1] == '/' {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestChangesLocal(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = defaultConfig()
+	config.Backend.StateDir = t.TempDir()
+
+	info := &ContainerInfo{ID: "local", Driver: driverLocal}
+	workspace := info.snapshotDir()
+	writeTree(t, workspace, map[string]string{
+		"kept":       "same",
+		"edited":     "before",
+		"removed":    "gone",
+		"dir/nested": "gone too",
+	})
+	if err := info.recordBaseline(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTree(t, workspace, map[string]string{"edited": "after the learner", "added": "new"})
+	os.Remove(filepath.Join(workspace, "removed"))
+	os.RemoveAll(filepath.Join(workspace, "dir"))
+
+	got, err := info.changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{Path: "/added", Kind: changeAdded},
+		{Path: "/dir", Kind: changeDeleted},
+		{Path: "/edited", Kind: changeModified},
+		{Path: "/removed", Kind: changeDeleted},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changes = %+v, want %+v", got, want)
+	}
+}
+
+func TestChangesOverlay(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("whiteouts and trusted xattrs require root")
+	}
+	saved := config
+	defer func() { config = saved }()
+	config = defaultConfig()
+	config.Backend.StateDir = t.TempDir()
+
+	info := &ContainerInfo{ID: "overlay", Driver: driverNative, Image: "test:1"}
+	lower := filepath.Join(rootfsDir(), "test_1")
+	writeTree(t, lower, map[string]string{
+		"etc/hosts":   "127.0.0.1 localhost",
+		"etc/motd":    "welcome",
+		"opt/app/one": "1",
+		"opt/app/two": "2",
+		"srv/":        "",
+	})
+
+	// What the overlay leaves in the upper directory after the learner
+	// edited /etc/hosts, deleted /etc/motd, replaced /opt/app and added
+	// /new
+	upper := info.snapshotDir()
+	writeTree(t, upper, map[string]string{
+		"etc/hosts":     "127.0.0.1 localhost box",
+		"opt/app/three": "3",
+		"new":           "added",
+	})
+	if err := syscall.Mknod(filepath.Join(upper, "etc/motd"), syscall.S_IFCHR, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Setxattr(filepath.Join(upper, "opt/app"), opaqueXattr(), []byte("y"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := info.changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{Path: "/etc", Kind: changeModified},
+		{Path: "/etc/hosts", Kind: changeModified},
+		{Path: "/etc/motd", Kind: changeDeleted},
+		{Path: "/new", Kind: changeAdded},
+		{Path: "/opt", Kind: changeModified},
+		{Path: "/opt/app", Kind: changeModified},
+		{Path: "/opt/app/one", Kind: changeDeleted},
+		{Path: "/opt/app/three", Kind: changeAdded},
+		{Path: "/opt/app/two", Kind: changeDeleted},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changes = %+v, want %+v", got, want)
+	}
+}
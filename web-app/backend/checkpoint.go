@@ -0,0 +1,435 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/sys/unix"
+)
+
+// Files making up a checkpoint directory
+const (
+	checkpointMetadata = "checkpoint.json"
+	checkpointRootfs   = "rootfs.tar.gz"
+	checkpointCRIU     = "criu"
+)
+
+var checkpointIDPattern = regexp.MustCompile(`^checkpoint-\d+$`)
+
+// checkpointMu serialises checkpoint creation and deletion.
+var checkpointMu sync.Mutex
+
+// Checkpoint is a saved copy of a container: the changes made to its
+// filesystem, the template it was created from and, when CRIU is
+// installed, the state of its processes. New containers can be restored
+// from it any number of times.
+type Checkpoint struct {
+	ID          string             `json:"id"`
+	Name        string             `json:"name,omitempty"`
+	ContainerID string             `json:"containerId"`
+	SectionID   string             `json:"sectionId"`
+	Image       string             `json:"image"`
+	ImageDigest string             `json:"imageDigest,omitempty"`
+	Driver      string             `json:"driver"`
+	Network     string             `json:"network"`
+	Template    *ContainerTemplate `json:"template"`
+	Processes   bool               `json:"processes"`
+	Size        int64              `json:"size"`
+	CreatedAt   time.Time          `json:"createdAt"`
+	// Warning explains why process state was not included
+	Warning string `json:"warning,omitempty"`
+}
+
+type CheckpointRequest struct {
+	Name string `json:"name"`
+	// Processes asks for process state as well; it is only saved when
+	// CRIU is installed and the container uses the native driver
+	Processes *bool `json:"processes"`
+}
+
+type RestoreRequest struct {
+	Checkpoint string        `json:"checkpoint" validate:"required"`
+	Network    string        `json:"network" validate:"oneof=none bridge host"`
+	Ports      []PortMapping `json:"ports"`
+}
+
+func checkpointsDir() string {
+	return filepath.Join(config.Backend.StateDir, "checkpoints")
+}
+
+func checkpointDir(id string) string {
+	return filepath.Join(checkpointsDir(), id)
+}
+
+// snapshotDir is the directory holding everything a learner changed: the
+// overlay upper directory, or the workspace of local containers.
+func (info *ContainerInfo) snapshotDir() string {
+	if info.isolated() {
+		return filepath.Join(containerDir(info.ID), "upper")
+	}
+	return filepath.Join(containerDir(info.ID), "workspace")
+}
+
+// criuPath finds the criu binary, which process checkpoints need.
+func criuPath() (string, error) {
+	return exec.LookPath("criu")
+}
+
+// checkpointContainer saves the container's filesystem changes and,
+// if asked and possible, its processes. The container keeps running.
+func checkpointContainer(info *ContainerInfo, req CheckpointRequest) (*Checkpoint, error) {
+	cp := &Checkpoint{
+		ID:          fmt.Sprintf("checkpoint-%d", time.Now().UnixNano()),
+		Name:        req.Name,
+		ContainerID: info.ID,
+		SectionID:   info.SectionID,
+		Image:       info.Image,
+		ImageDigest: info.ImageDigest,
+		Driver:      info.Driver,
+		Network:     info.Network.Mode,
+		Template:    info.Template,
+		CreatedAt:   time.Now(),
+	}
+	dir := checkpointDir(cp.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := writeCheckpoint(info, cp, dir, req.Processes == nil || *req.Processes); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return cp, nil
+}
+
+func writeCheckpoint(info *ContainerInfo, cp *Checkpoint, dir string, processes bool) error {
+	// Processes are dumped first so the filesystem is saved as they left it
+	if processes {
+		if err := dumpProcesses(info, filepath.Join(dir, checkpointCRIU)); err != nil {
+			cp.Warning = fmt.Sprintf("process state not saved: %v", err)
+			os.RemoveAll(filepath.Join(dir, checkpointCRIU))
+		} else {
+			cp.Processes = true
+		}
+	}
+
+	f, err := os.Create(filepath.Join(dir, checkpointRootfs))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	if err := packLayer(zw, info.snapshotDir()); err != nil {
+		return fmt.Errorf("failed to archive filesystem: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	cp.Size = fi.Size()
+
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, checkpointMetadata), data, 0600)
+}
+
+// dumpProcesses saves the process trees of the container's inits with
+// CRIU, leaving them running.
+func dumpProcesses(info *ContainerInfo, dir string) error {
+	criu, err := criuPath()
+	if err != nil {
+		return errors.New("criu is not installed")
+	}
+	if info.Driver != driverNative {
+		return fmt.Errorf("the %s driver does not support process checkpoints", info.Driver)
+	}
+
+	info.processMu.Lock()
+	var pids []int
+	for cmd := range info.processes {
+		pids = append(pids, cmd.Process.Pid)
+	}
+	info.processMu.Unlock()
+	if len(pids) == 0 {
+		return errors.New("the container has no running processes")
+	}
+	sort.Ints(pids)
+
+	for i, pid := range pids {
+		images := filepath.Join(dir, strconv.Itoa(i))
+		if err := os.MkdirAll(images, 0700); err != nil {
+			return err
+		}
+		cmd := exec.Command(criu, "dump",
+			"--tree", strconv.Itoa(pid),
+			"--images-dir", images,
+			"--leave-running",
+			"--shell-job",
+			"--tcp-established",
+			"--ext-unix-sk",
+			"--file-locks",
+			"--manage-cgroups=ignore",
+		)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("criu dump of pid %d failed: %v: %s", pid, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// restoreProcesses brings back the process trees saved in the
+// container's checkpoint, rooted at its new filesystem.
+func restoreProcesses(info *ContainerInfo) error {
+	criu, err := criuPath()
+	if err != nil {
+		return errors.New("criu is not installed")
+	}
+	if info.Driver != driverNative {
+		return fmt.Errorf("the %s driver does not support process checkpoints", info.Driver)
+	}
+
+	dirs, err := os.ReadDir(filepath.Join(checkpointDir(info.checkpoint.ID), checkpointCRIU))
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		images := filepath.Join(checkpointDir(info.checkpoint.ID), checkpointCRIU, d.Name())
+		pidFile := filepath.Join(containerDir(info.ID), "criu-"+d.Name()+".pid")
+		cmd := exec.Command(criu, "restore",
+			"--images-dir", images,
+			"--root", info.rootfsPath(),
+			"--restore-detached",
+			"--shell-job",
+			"--tcp-established",
+			"--ext-unix-sk",
+			"--file-locks",
+			"--manage-cgroups=ignore",
+			"--pidfile", pidFile,
+		)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("criu restore failed: %v: %s", err, strings.TrimSpace(string(output)))
+		}
+		data, err := os.ReadFile(pidFile)
+		if err != nil {
+			return err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return err
+		}
+		info.restored = append(info.restored, pid)
+	}
+
+	// CRIU leaves the processes in its own cgroup
+	if cg := info.processCgroup(); cg != nil {
+		procs, err := info.containerProcesses()
+		if err != nil {
+			return err
+		}
+		for _, p := range procs {
+			if err := cg.addProcess(p.PID); err != nil && !errors.Is(err, syscall.ESRCH) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// killRestored stops process trees CRIU restored, which are not children
+// of the backend and so are not tracked as the container's processes.
+func (info *ContainerInfo) killRestored() {
+	for _, pid := range info.restored {
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+	info.restored = nil
+}
+
+// restoreFilesystem unpacks the checkpoint's filesystem changes into
+// the container's snapshot directory before its root filesystem is
+// mounted.
+func (info *ContainerInfo) restoreFilesystem() error {
+	f, err := os.Open(filepath.Join(checkpointDir(info.checkpoint.ID), checkpointRootfs))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dir := info.snapshotDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := unpackLayer(f, dir); err != nil {
+		return fmt.Errorf("failed to restore filesystem: %w", err)
+	}
+	return removeNetworkFileLinks(dir)
+}
+
+// removeNetworkFileLinks deletes symlinks a restored filesystem has in
+// place of the generated network files, so they are written anew rather
+// than through the links.
+func removeNetworkFileLinks(dir string) error {
+	root, err := os.OpenFile(dir, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	for _, name := range networkFiles {
+		parent, err := openInRoot(int(root.Fd()), filepath.Dir(name), unix.O_PATH|unix.O_DIRECTORY, 0)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to restore filesystem: %w", err)
+		}
+		base := filepath.Base(name)
+		var st unix.Stat_t
+		err = unix.Fstatat(int(parent.Fd()), base, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if err == nil && st.Mode&unix.S_IFMT == unix.S_IFLNK {
+			err = unix.Unlinkat(int(parent.Fd()), base, 0)
+		} else if err == unix.ENOENT {
+			err = nil
+		}
+		parent.Close()
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func loadCheckpoint(id string) (*Checkpoint, error) {
+	if !checkpointIDPattern.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(filepath.Join(checkpointDir(id), checkpointMetadata))
+	if err != nil {
+		return nil, err
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+func listCheckpoints() []*Checkpoint {
+	entries, _ := os.ReadDir(checkpointsDir())
+	checkpoints := []*Checkpoint{}
+	for _, e := range entries {
+		if cp, err := loadCheckpoint(e.Name()); err == nil {
+			checkpoints = append(checkpoints, cp)
+		}
+	}
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return checkpoints[i].CreatedAt.Before(checkpoints[j].CreatedAt)
+	})
+	return checkpoints
+}
+
+// imageInCheckpoint reports whether restoring a checkpoint needs the image.
+func imageInCheckpoint(digest string) bool {
+	for _, cp := range listCheckpoints() {
+		if cp.ImageDigest == digest {
+			return true
+		}
+	}
+	return false
+}
+
+func createCheckpoint(c echo.Context) error {
+	containerId := c.Param("id")
+
+	containersMux.RLock()
+	containerInfo, exists := containers[containerId]
+	containersMux.RUnlock()
+
+	if !exists {
+		return errContainerNotFound
+	}
+
+	var req CheckpointRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	checkpointMu.Lock()
+	defer checkpointMu.Unlock()
+	cp, err := checkpointContainer(containerInfo, req)
+	if err != nil {
+		return internalError("Failed to checkpoint container: %v", err)
+	}
+	if cp.Warning != "" {
+		log.Printf("Checkpoint %s of container %s: %s", cp.ID, containerId, cp.Warning)
+	}
+	return c.JSON(http.StatusCreated, cp)
+}
+
+// restoreContainer creates a new container from a checkpoint. The
+// container it was taken from may still be running, which forks it.
+func restoreContainer(c echo.Context) error {
+	var req RestoreRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	cp, err := loadCheckpoint(req.Checkpoint)
+	if err != nil {
+		return apiError(http.StatusNotFound, codeCheckpointNotFound, "Checkpoint not found")
+	}
+	// The snapshot is either an overlay upper directory or a workspace
+	isolated := cp.Driver == driverNative || cp.Driver == driverRootless
+	if isolated != (containerDriver == driverNative || containerDriver == driverRootless) {
+		return apiError(http.StatusBadRequest, codeUnsupported,
+			fmt.Sprintf("Checkpoint of a %s container can not be restored with the %s driver", cp.Driver, containerDriver))
+	}
+
+	image := cp.Image
+	if cp.ImageDigest != "" {
+		image = cp.ImageDigest
+	}
+	network := cp.Network
+	if req.Network != "" {
+		network = req.Network
+	}
+	return launchContainer(c, ContainerRequest{
+		SectionID: cp.SectionID,
+		Image:     image,
+		Network:   network,
+		Ports:     req.Ports,
+	}, cp.Template, cp)
+}
+
+func getCheckpoints(c echo.Context) error {
+	return c.JSON(http.StatusOK, listCheckpoints())
+}
+
+func deleteCheckpoint(c echo.Context) error {
+	id := c.Param("id")
+	if _, err := loadCheckpoint(id); err != nil {
+		return apiError(http.StatusNotFound, codeCheckpointNotFound, "Checkpoint not found")
+	}
+
+	checkpointMu.Lock()
+	defer checkpointMu.Unlock()
+	if err := os.RemoveAll(checkpointDir(id)); err != nil {
+		return internalError("Failed to delete checkpoint: %v", err)
+	}
+	return c.JSON(http.StatusOK, StatusMessage{Message: "Checkpoint " + id + " deleted"})
+}
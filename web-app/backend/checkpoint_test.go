@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveNetworkFileLinks(t *testing.T) {
+	dir, outside := t.TempDir(), t.TempDir()
+	target := filepath.Join(outside, "shadow")
+	if err := os.WriteFile(target, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	etc := filepath.Join(dir, "etc")
+	if err := os.Mkdir(etc, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(etc, "hosts")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("hosts", filepath.Join(etc, "resolv.conf")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(etc, "hostname"), []byte("learner\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeNetworkFileLinks(dir); err != nil {
+		t.Fatalf("removeNetworkFileLinks: %v", err)
+	}
+	for _, name := range []string{"hosts", "resolv.conf"} {
+		if _, err := os.Lstat(filepath.Join(etc, name)); !os.IsNotExist(err) {
+			t.Errorf("symlink /etc/%s was kept", name)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(etc, "hostname")); err != nil || string(data) != "learner\n" {
+		t.Errorf("regular /etc/hostname changed: %q, %v", data, err)
+	}
+	if data, err := os.ReadFile(target); err != nil || string(data) != "secret" {
+		t.Errorf("link target changed: %q, %v", data, err)
+	}
+
+	// Without an /etc there is nothing to remove
+	if err := removeNetworkFileLinks(t.TempDir()); err != nil {
+		t.Errorf("removeNetworkFileLinks without /etc: %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type CommitRequest struct {
+	// Reference names the new image, "<sectionId>:latest" by default
+	Reference string `json:"reference"`
+	Comment   string `json:"comment"`
+	// Template registers the image as the section's template, which
+	// new containers of the section are then created from
+	Template *bool `json:"template"`
+}
+
+func (r *CommitRequest) validate() []FieldError {
+	if strings.ContainsAny(r.Reference, " \t\n@") || strings.HasPrefix(r.Reference, "sha256:") {
+		return []FieldError{{Field: "reference", Message: "must be an image name without digest"}}
+	}
+	return nil
+}
+
+type CommitResponse struct {
+	Image    Image              `json:"image"`
+	Template *ContainerTemplate `json:"template,omitempty"`
+}
+
+// Commit creates an image from base with the directories in layers, each
+// packed as a new layer on top of base's. base may be nil, in which case
+// the image consists of the new layers only. Paths in exclude are left out
+// of every new layer.
+func (s *ImageStore) Commit(base *Image, layers, exclude []string, reference, comment string) (*Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.collectGarbage()
+
+	imageConfig := map[string]interface{}{
+		"architecture": runtime.GOARCH,
+		"os":           runtime.GOOS,
+		"config":       map[string]interface{}{},
+	}
+	manifest := ociManifest{SchemaVersion: 2, MediaType: mediaTypeOCIManifest}
+	if base != nil {
+		if err := s.readJSONBlob(base.Config, &imageConfig); err != nil {
+			return nil, fmt.Errorf("invalid config of image %s: %w", base.Digest, err)
+		}
+		var baseManifest ociManifest
+		if err := s.readJSONBlob(base.Digest, &baseManifest); err != nil {
+			return nil, fmt.Errorf("invalid manifest %s: %w", base.Digest, err)
+		}
+		manifest.Layers = baseManifest.Layers
+	}
+
+	rootfs, _ := imageConfig["rootfs"].(map[string]interface{})
+	if rootfs == nil {
+		rootfs = map[string]interface{}{"type": "layers"}
+	}
+	diffIDs, _ := rootfs["diff_ids"].([]interface{})
+	history, _ := imageConfig["history"].([]interface{})
+	created := time.Now().UTC().Format(time.RFC3339Nano)
+	for _, dir := range layers {
+		desc, diffID, err := s.writeLayer(dir, exclude)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+		diffIDs = append(diffIDs, diffID)
+		history = append(history, map[string]interface{}{
+			"created":    created,
+			"created_by": "linux-containers-web commit",
+			"comment":    comment,
+		})
+	}
+	rootfs["diff_ids"] = diffIDs
+	imageConfig["rootfs"] = rootfs
+	imageConfig["history"] = history
+	imageConfig["created"] = created
+
+	data, err := json.Marshal(imageConfig)
+	if err != nil {
+		return nil, err
+	}
+	configDigest, configSize, err := s.writeBlob(strings.NewReader(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	manifest.Config = ociDescriptor{MediaType: mediaTypeOCIConfig, Digest: configDigest, Size: configSize}
+
+	data, err = json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	digest, _, err := s.writeBlob(strings.NewReader(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	img, err := s.imageFromManifest(digest)
+	if err != nil {
+		return nil, err
+	}
+	img.References = []string{normalizeReference(reference)}
+	if err := s.unpackImage(img); err != nil {
+		return nil, err
+	}
+	s.addImage(img)
+	return img, s.saveIndex()
+}
+
+// writeLayer stores dir as a gzip compressed layer blob and returns its
+// descriptor and the digest of the uncompressed tarball, the layer's
+// diff ID.
+func (s *ImageStore) writeLayer(dir string, exclude []string) (ociDescriptor, string, error) {
+	pr, pw := io.Pipe()
+	h := sha256.New()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		err := packLayer(io.MultiWriter(zw, h), dir, exclude...)
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+
+	digest, size, err := s.writeBlob(pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return ociDescriptor{}, "", fmt.Errorf("failed to archive %s: %w", dir, err)
+	}
+	desc := ociDescriptor{MediaType: mediaTypeOCILayerGz, Digest: digest, Size: size}
+	return desc, "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// commit turns the changes made in the container into an image.
+// Containers whose image has no entry in the image store get the root
+// filesystem directory they were created from as the image's base layer.
+func (info *ContainerInfo) commit(reference, comment string) (*Image, error) {
+	var base *Image
+	layers := []string{info.snapshotDir()}
+	if info.ImageDigest != "" {
+		img, ok := imageStore.Resolve(info.ImageDigest)
+		if !ok {
+			return nil, fmt.Errorf("image %s is no longer in the image store", info.ImageDigest)
+		}
+		base = img
+	} else {
+		lowers, err := info.imageLayers()
+		if err != nil {
+			return nil, err
+		}
+		layers = append(lowers, layers...)
+	}
+	// The network files are generated for each container
+	var exclude []string
+	for _, name := range networkFiles {
+		exclude = append(exclude, strings.TrimPrefix(name, "/"))
+	}
+	return imageStore.Commit(base, layers, exclude, reference, comment)
+}
+
+// Registered templates are kept as <sectionId>.json in templatesDir.
+func templatesDir() string {
+	return filepath.Join(config.Backend.StateDir, "templates")
+}
+
+// loadRegisteredTemplate returns the template registered for a section by
+// a commit, if there is one.
+func loadRegisteredTemplate(sectionID string) (*ContainerTemplate, error) {
+	data, err := os.ReadFile(filepath.Join(templatesDir(), sectionID+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var tmpl ContainerTemplate
+	if err := json.Unmarshal(data, &tmpl); err != nil {
+		return nil, fmt.Errorf("invalid registered template for section %s: %w", sectionID, err)
+	}
+	return &tmpl, nil
+}
+
+// registerTemplate makes tmpl the template of its section.
+func registerTemplate(tmpl *ContainerTemplate) error {
+	if err := os.MkdirAll(templatesDir(), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(tmpl, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(templatesDir(), tmpl.SectionID+".json")
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func listRegisteredTemplates() []*ContainerTemplate {
+	templates := []*ContainerTemplate{}
+	for sectionID := range getSectionTemplates() {
+		if tmpl, err := loadRegisteredTemplate(sectionID); err == nil {
+			templates = append(templates, tmpl)
+		}
+	}
+	return templates
+}
+
+// imageInTemplate reports whether a registered template needs the image.
+func imageInTemplate(digest string) bool {
+	for _, tmpl := range listRegisteredTemplates() {
+		if img, ok := imageStore.Resolve(tmpl.Image); ok && img.Digest == digest {
+			return true
+		}
+	}
+	return false
+}
+
+func commitContainer(c echo.Context) error {
+	containerId := c.Param("id")
+
+	containersMux.RLock()
+	containerInfo, exists := containers[containerId]
+	containersMux.RUnlock()
+
+	if !exists {
+		return errContainerNotFound
+	}
+	if !containerInfo.isolated() {
+		return apiError(http.StatusBadRequest, codeUnsupported, "Commits require the native or rootless driver")
+	}
+
+	var req CommitRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+	reference := req.Reference
+	if reference == "" {
+		reference = containerInfo.SectionID
+	}
+
+	img, err := containerInfo.commit(reference, req.Comment)
+	if err != nil {
+		return internalError("Failed to commit container: %v", err)
+	}
+	log.Printf("Committed container %s as %s (%s)", containerId, img.References[0], img.Digest)
+
+	resp := CommitResponse{Image: *img}
+	if req.Template == nil || *req.Template {
+		// Template files and the startup script's changes are part of
+		// the image now, so only the runtime settings carry over
+		tmpl := *containerInfo.Template
+		tmpl.Image = img.References[0]
+		tmpl.Files = nil
+		tmpl.Startup = ""
+		if err := registerTemplate(&tmpl); err != nil {
+			return internalError("Failed to register template: %v", err)
+		}
+		resp.Template = &tmpl
+	}
+	return c.JSON(http.StatusCreated, resp)
+}
+
+func getRegisteredTemplates(c echo.Context) error {
+	return c.JSON(http.StatusOK, listRegisteredTemplates())
+}
+
+// deleteRegisteredTemplate reverts a section to its content or built-in
+// template. The committed image is kept.
+func deleteRegisteredTemplate(c echo.Context) error {
+	sectionID := c.Param("sectionId")
+	if _, known := getSectionTemplates()[sectionID]; !known {
+		return apiError(http.StatusNotFound, codeTemplateNotFound, "Template not found")
+	}
+	err := os.Remove(filepath.Join(templatesDir(), sectionID+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return apiError(http.StatusNotFound, codeTemplateNotFound, "Template not found")
+	}
+	if err != nil {
+		return internalError("Failed to delete template: %v", err)
+	}
+	return c.JSON(http.StatusOK, StatusMessage{Message: "Template of section " + sectionID + " deleted"})
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the backend's configuration. Settings are taken from the
+// defaults, then the YAML file given with -config or LCW_CONFIG, then
+// environment variables such as LCW_SERVER_LISTEN, then flags such as
+// -server.listen.
+type Config struct {
+	Server   ServerConfig   `yaml:"server"`
+	TLS      TLSConfig      `yaml:"tls"`
+	Auth     AuthConfig     `yaml:"auth"`
+	Backend  BackendConfig  `yaml:"backend"`
+	Shell    ShellConfig    `yaml:"shell"`
+	Limits   LimitsConfig   `yaml:"limits"`
+	Timeouts TimeoutsConfig `yaml:"timeouts"`
+	Reaper   ReaperConfig   `yaml:"reaper"`
+}
+
+type ServerConfig struct {
+	// Listen is the plain HTTP address; empty disables it
+	Listen string `yaml:"listen"`
+	// Socket is a Unix domain socket to serve on as well, created with
+	// SocketMode and, if set, owned by SocketGroup
+	Socket      string `yaml:"socket"`
+	SocketMode  string `yaml:"socketMode"`
+	SocketGroup string `yaml:"socketGroup"`
+	// AllowedOrigins may call the API from a browser; "*" allows any
+	// but the admin API, which without a token needs the origin listed
+	AllowedOrigins  []string      `yaml:"allowedOrigins"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	// KeepContainers leaves containers running on shutdown for the next
+	// start to adopt
+	KeepContainers bool `yaml:"keepContainers"`
+}
+
+// TLSConfig serves HTTPS on its own address once a certificate is set.
+// The certificate is reloaded when its files change.
+type TLSConfig struct {
+	Listen   string `yaml:"listen"`
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+type AuthConfig struct {
+	// AdminToken guards /api/v1/admin, the other admin routes, events and
+	// metrics. Without one only local clients may use them.
+	AdminToken string `yaml:"adminToken" secret:"true"`
+}
+
+type BackendConfig struct {
+	// Driver is local, native or rootless; empty picks the most isolated
+	// one the backend's privileges allow
+	Driver string `yaml:"driver"`
+	// AllowSysAdmin lets sections needing CAP_SYS_ADMIN run under the
+	// native driver, which has no user namespace to confine it: their
+	// learners are root on the host
+	AllowSysAdmin bool   `yaml:"allowSysAdmin"`
+	StateDir      string `yaml:"stateDir"`
+	ContentDir    string `yaml:"contentDir"`
+}
+
+type ShellConfig struct {
+	// Path is the shell of sections whose template names none
+	Path   string `yaml:"path"`
+	Term   string `yaml:"term"`
+	Prompt string `yaml:"prompt"`
+}
+
+// LimitsConfig are the cgroup limits of every native and rootless
+// container. Zero means unlimited.
+type LimitsConfig struct {
+	MemoryBytes int64   `yaml:"memoryBytes"`
+	CPUs        float64 `yaml:"cpus"`
+	Pids        int64   `yaml:"pids"`
+}
+
+type TimeoutsConfig struct {
+	StartupScript time.Duration `yaml:"startupScript"`
+	// Hook applies to template hooks without a timeout of their own
+	Hook      time.Duration `yaml:"hook"`
+	StopGrace time.Duration `yaml:"stopGrace"`
+}
+
+// ReaperConfig deletes containers left behind by learners. Zero disables
+// a timeout.
+type ReaperConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	// IdleTimeout is how long a container may go without a terminal
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+	MaxLifetime time.Duration `yaml:"maxLifetime"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Listen:          ":8080",
+			SocketMode:      "0660",
+			AllowedOrigins:  []string{"http://localhost:5173", "http://127.0.0.1:5173"},
+			ShutdownTimeout: 30 * time.Second,
+		},
+		TLS: TLSConfig{
+			Listen: ":8443",
+		},
+		Backend: BackendConfig{
+			StateDir:   filepath.Join(os.TempDir(), "linux-containers-web"),
+			ContentDir: "../..",
+		},
+		Shell: ShellConfig{
+			Path:   "/bin/bash",
+			Term:   "xterm-256color",
+			Prompt: "learning-container:$ ",
+		},
+		Timeouts: TimeoutsConfig{
+			StartupScript: 30 * time.Second,
+			Hook:          30 * time.Second,
+			StopGrace:     5 * time.Second,
+		},
+		Reaper: ReaperConfig{
+			Interval: time.Minute,
+		},
+	}
+}
+
+// config is the effective configuration. Processes the backend re-executes
+// itself as keep the defaults.
+var config = defaultConfig()
+
+// configField is a setting, named by its path of YAML keys.
+type configField struct {
+	path   []string
+	value  reflect.Value
+	secret bool
+}
+
+// fields lists every setting of the configuration.
+func (cfg *Config) fields() []configField {
+	var fields []configField
+	var walk func(v reflect.Value, path []string)
+	walk = func(v reflect.Value, path []string) {
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			p := append(append([]string(nil), path...), f.Tag.Get("yaml"))
+			if f.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), p)
+				continue
+			}
+			fields = append(fields, configField{path: p, value: v.Field(i), secret: f.Tag.Get("secret") == "true"})
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), nil)
+	return fields
+}
+
+// splitWords splits a camel case key into its lower case words.
+func splitWords(key string) []string {
+	var words []string
+	start := 0
+	for i, r := range key {
+		if i > 0 && unicode.IsUpper(r) && !unicode.IsUpper(rune(key[i-1])) {
+			words = append(words, strings.ToLower(key[start:i]))
+			start = i
+		}
+	}
+	return append(words, strings.ToLower(key[start:]))
+}
+
+// envName is the variable overriding the field, e.g. LCW_SERVER_ALLOWED_ORIGINS.
+func (f configField) envName() string {
+	var words []string
+	for _, key := range f.path {
+		words = append(words, splitWords(key)...)
+	}
+	return "LCW_" + strings.ToUpper(strings.Join(words, "_"))
+}
+
+// flagName is the flag overriding the field, e.g. -server.allowed-origins.
+func (f configField) flagName() string {
+	keys := make([]string, len(f.path))
+	for i, key := range f.path {
+		keys[i] = strings.Join(splitWords(key), "-")
+	}
+	return strings.Join(keys, ".")
+}
+
+func (f configField) String() string {
+	return strings.Join(f.path, ".")
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// set parses s into the field. Lists are comma separated.
+func (f configField) set(s string) error {
+	v := f.value
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case v.Kind() == reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case v.Kind() == reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// configFlag records a flag's value to apply once the file and
+// environment have been read.
+type configFlag struct {
+	field configField
+	set   *[]func() error
+}
+
+func (f configFlag) String() string { return "" }
+
+func (f configFlag) Set(s string) error {
+	*f.set = append(*f.set, func() error {
+		if err := f.field.set(s); err != nil {
+			return fmt.Errorf("-%s: %w", f.field.flagName(), err)
+		}
+		return nil
+	})
+	return nil
+}
+
+func (f configFlag) IsBoolFlag() bool {
+	return f.field.value.Kind() == reflect.Bool
+}
+
+// loadConfig builds the configuration from the file, environment and
+// command line and validates it.
+func loadConfig(args []string) (*Config, error) {
+	cfg := defaultConfig()
+	fields := cfg.fields()
+
+	flags := flag.NewFlagSet("linux-containers-web", flag.ExitOnError)
+	path := flags.String("config", os.Getenv("LCW_CONFIG"), "YAML configuration file (env LCW_CONFIG)")
+	var overrides []func() error
+	for _, field := range fields {
+		flags.Var(configFlag{field: field, set: &overrides}, field.flagName(),
+			fmt.Sprintf("overrides %s (env %s)", field, field.envName()))
+	}
+	flags.Parse(args)
+
+	if *path != "" {
+		f, err := os.Open(*path)
+		if err != nil {
+			return nil, err
+		}
+		dec := yaml.NewDecoder(f)
+		// Misspelt keys would otherwise be silently ignored
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+		f.Close()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%s: %w", *path, err)
+		}
+	}
+
+	for _, field := range fields {
+		if s, ok := os.LookupEnv(field.envName()); ok {
+			if err := field.set(s); err != nil {
+				return nil, fmt.Errorf("%s: %w", field.envName(), err)
+			}
+		}
+	}
+	for _, apply := range overrides {
+		if err := apply(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) validate() error {
+	var errs []error
+	invalid := func(key, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+
+	if cfg.Server.Listen == "" && cfg.Server.Socket == "" && cfg.TLS.CertFile == "" {
+		invalid("server", "listen, socket or a TLS certificate is required")
+	}
+	if cfg.Server.Listen != "" {
+		if _, _, err := net.SplitHostPort(cfg.Server.Listen); err != nil {
+			invalid("server.listen", "%v", err)
+		}
+	}
+	if cfg.Server.Socket != "" && !filepath.IsAbs(cfg.Server.Socket) {
+		invalid("server.socket", "must be an absolute path")
+	}
+	if _, err := cfg.Server.socketMode(); err != nil {
+		invalid("server.socketMode", "%v", err)
+	}
+	if cfg.Server.SocketGroup != "" {
+		if _, err := lookupGroup(cfg.Server.SocketGroup); err != nil {
+			invalid("server.socketGroup", "%v", err)
+		}
+	}
+	if len(cfg.Server.AllowedOrigins) == 0 {
+		invalid("server.allowedOrigins", "at least one origin is required")
+	}
+	if cfg.Server.ShutdownTimeout <= 0 {
+		invalid("server.shutdownTimeout", "must be positive")
+	}
+
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		invalid("tls", "certFile and keyFile must be set together")
+	}
+	if cfg.TLS.CertFile != "" {
+		if _, _, err := net.SplitHostPort(cfg.TLS.Listen); err != nil {
+			invalid("tls.listen", "%v", err)
+		} else if cfg.TLS.Listen == cfg.Server.Listen {
+			invalid("tls.listen", "must differ from server.listen")
+		}
+	}
+	for key, file := range map[string]string{"tls.certFile": cfg.TLS.CertFile, "tls.keyFile": cfg.TLS.KeyFile} {
+		if file == "" {
+			continue
+		}
+		if f, err := os.Open(file); err != nil {
+			invalid(key, "%v", err)
+		} else {
+			f.Close()
+		}
+	}
+
+	switch cfg.Backend.Driver {
+	case "", driverLocal:
+	case driverNative:
+		if os.Geteuid() != 0 {
+			invalid("backend.driver", "the native driver requires root")
+		}
+	case driverRootless:
+		if !userNamespacesAvailable() {
+			invalid("backend.driver", "the rootless driver requires unprivileged user namespaces")
+		}
+	default:
+		invalid("backend.driver", "unknown driver %q", cfg.Backend.Driver)
+	}
+	if !filepath.IsAbs(cfg.Backend.StateDir) {
+		invalid("backend.stateDir", "must be an absolute path")
+	}
+	if fi, err := os.Stat(cfg.Backend.ContentDir); err != nil {
+		invalid("backend.contentDir", "%v", err)
+	} else if !fi.IsDir() {
+		invalid("backend.contentDir", "%s is not a directory", cfg.Backend.ContentDir)
+	}
+
+	if cfg.Shell.Path == "" {
+		invalid("shell.path", "is required")
+	}
+
+	if cfg.Limits.MemoryBytes < 0 {
+		invalid("limits.memoryBytes", "must not be negative")
+	}
+	if cfg.Limits.CPUs < 0 {
+		invalid("limits.cpus", "must not be negative")
+	}
+	if cfg.Limits.Pids < 0 {
+		invalid("limits.pids", "must not be negative")
+	}
+
+	for key, d := range map[string]time.Duration{
+		"timeouts.startupScript": cfg.Timeouts.StartupScript,
+		"timeouts.hook":          cfg.Timeouts.Hook,
+		"timeouts.stopGrace":     cfg.Timeouts.StopGrace,
+	} {
+		if d <= 0 {
+			invalid(key, "must be positive")
+		}
+	}
+
+	if cfg.Reaper.IdleTimeout < 0 {
+		invalid("reaper.idleTimeout", "must not be negative")
+	}
+	if cfg.Reaper.MaxLifetime < 0 {
+		invalid("reaper.maxLifetime", "must not be negative")
+	}
+	if cfg.Reaper.Interval <= 0 {
+		invalid("reaper.interval", "must be positive")
+	}
+	return errors.Join(errs...)
+}
+
+func (s ServerConfig) socketMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid permissions %q", s.SocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// lookupGroup resolves a group name or ID.
+func lookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(group.Gid)
+}
+
+// redacted returns the configuration as nested maps with secrets hidden.
+func (cfg *Config) redacted() map[string]interface{} {
+	out := make(map[string]interface{})
+	for _, field := range cfg.fields() {
+		m := out
+		for _, key := range field.path[:len(field.path)-1] {
+			if _, ok := m[key]; !ok {
+				m[key] = make(map[string]interface{})
+			}
+			m = m[key].(map[string]interface{})
+		}
+		var value interface{} = field.value.Interface()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		if field.secret && field.value.String() != "" {
+			value = "<redacted>"
+		}
+		m[field.path[len(field.path)-1]] = value
+	}
+	return out
+}
+
+// defaultResources fills in the configured limits r leaves unset.
+func (cfg *Config) defaultResources(r *cgroupResources) *cgroupResources {
+	l := cfg.Limits
+	if l.MemoryBytes == 0 && l.CPUs == 0 && l.Pids == 0 {
+		return r
+	}
+	if r == nil {
+		r = &cgroupResources{}
+	}
+	if r.Memory == nil && l.MemoryBytes > 0 {
+		limit := l.MemoryBytes
+		r.Memory = &cgroupMemory{Limit: &limit}
+	}
+	if r.CPU == nil && l.CPUs > 0 {
+		period := uint64(100000)
+		quota := int64(l.CPUs * float64(period))
+		r.CPU = &cgroupCPU{Quota: &quota, Period: &period}
+	}
+	if r.Pids == nil && l.Pids > 0 {
+		r.Pids = &cgroupPids{Limit: l.Pids}
+	}
+	return r
+}
+
+// allowedOrigin reports whether a browser on origin may use the API.
+func allowedOrigin(origin string) bool {
+	if origin == "" {
+		// Not a browser
+		return true
+	}
+	for _, allowed := range config.Server.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// listedOrigin reports whether a request comes from a program or from a
+// browser on an origin AllowedOrigins names explicitly. Browsers leave
+// out the origin of some cross-site requests, but mark them as such.
+func listedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		site := r.Header.Get("Sec-Fetch-Site")
+		return site == "" || site == "same-origin" || site == "none"
+	}
+	for _, allowed := range config.Server.AllowedOrigins {
+		if strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// adminAuth admits requests bearing the admin token or, without one
+// configured, coming from the host itself: over loopback or the Unix
+// socket, whose permissions decide who may connect. Any web page the
+// host's browser opens could reach loopback too, so browsers have to be
+// on a listed origin.
+func adminAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if token := config.Auth.AdminToken; token != "" {
+			given, _ := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				return apiError(http.StatusUnauthorized, codeUnauthorized, "Invalid admin token")
+			}
+			return next(c)
+		}
+		if !listedOrigin(c.Request()) {
+			return apiError(http.StatusForbidden, codeForbidden, "The admin API is not available to this origin unless an admin token is configured")
+		}
+		if addr, ok := c.Request().Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+			return next(c)
+		}
+		host, _, err := net.SplitHostPort(c.Request().RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			return apiError(http.StatusForbidden, codeForbidden, "The admin API is only available locally unless an admin token is configured")
+		}
+		return next(c)
+	}
+}
+
+// getAdminConfig shows the effective configuration.
+func getAdminConfig(c echo.Context) error {
+	return c.JSON(http.StatusOK, config.redacted())
+}
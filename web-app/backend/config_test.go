@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := "server:\n  listen: \":9000\"\n  shutdownTimeout: 10s\nreaper:\n  idleTimeout: 5m\n"
+	if err := os.WriteFile(file, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defaultOrigins := defaultConfig().Server.AllowedOrigins
+
+	tests := []struct {
+		name         string
+		env          map[string]string
+		args         []string
+		wantListen   string
+		wantShutdown time.Duration
+		wantIdle     time.Duration
+		wantOrigins  []string
+	}{
+		{
+			name:         "defaults",
+			wantListen:   ":8080",
+			wantShutdown: 30 * time.Second,
+			wantOrigins:  defaultOrigins,
+		},
+		{
+			name:         "file",
+			args:         []string{"-config", file},
+			wantListen:   ":9000",
+			wantShutdown: 10 * time.Second,
+			wantIdle:     5 * time.Minute,
+			wantOrigins:  defaultOrigins,
+		},
+		{
+			name:         "file named by the environment",
+			env:          map[string]string{"LCW_CONFIG": file},
+			wantListen:   ":9000",
+			wantShutdown: 10 * time.Second,
+			wantIdle:     5 * time.Minute,
+			wantOrigins:  defaultOrigins,
+		},
+		{
+			name: "environment over file",
+			env: map[string]string{
+				"LCW_SERVER_LISTEN":          ":9001",
+				"LCW_SERVER_ALLOWED_ORIGINS": "https://a.example, https://b.example",
+			},
+			args:         []string{"-config", file},
+			wantListen:   ":9001",
+			wantShutdown: 10 * time.Second,
+			wantIdle:     5 * time.Minute,
+			wantOrigins:  []string{"https://a.example", "https://b.example"},
+		},
+		{
+			name: "flag over environment",
+			env:  map[string]string{"LCW_SERVER_LISTEN": ":9001", "LCW_REAPER_IDLE_TIMEOUT": "1m"},
+			args: []string{
+				"-server.listen", ":9002",
+				"-config", file,
+				"-server.allowed-origins", "https://c.example",
+			},
+			wantListen:   ":9002",
+			wantShutdown: 10 * time.Second,
+			wantIdle:     time.Minute,
+			wantOrigins:  []string{"https://c.example"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			cfg, err := loadConfig(tt.args)
+			if err != nil {
+				t.Fatalf("loadConfig = %v", err)
+			}
+			if cfg.Server.Listen != tt.wantListen {
+				t.Errorf("server.listen = %q, want %q", cfg.Server.Listen, tt.wantListen)
+			}
+			if cfg.Server.ShutdownTimeout != tt.wantShutdown {
+				t.Errorf("server.shutdownTimeout = %v, want %v", cfg.Server.ShutdownTimeout, tt.wantShutdown)
+			}
+			if cfg.Reaper.IdleTimeout != tt.wantIdle {
+				t.Errorf("reaper.idleTimeout = %v, want %v", cfg.Reaper.IdleTimeout, tt.wantIdle)
+			}
+			if !reflect.DeepEqual(cfg.Server.AllowedOrigins, tt.wantOrigins) {
+				t.Errorf("server.allowedOrigins = %q, want %q", cfg.Server.AllowedOrigins, tt.wantOrigins)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	misspelt := filepath.Join(dir, "misspelt.yaml")
+	if err := os.WriteFile(misspelt, []byte("server:\n  listne: \":9000\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+	}{
+		{name: "missing file", args: []string{"-config", filepath.Join(dir, "missing.yaml")}},
+		{name: "misspelt key", args: []string{"-config", misspelt}},
+		{name: "malformed environment value", env: map[string]string{"LCW_REAPER_IDLE_TIMEOUT": "soon"}},
+		{name: "malformed flag value", args: []string{"-server.shutdown-timeout", "soon"}},
+		{name: "invalid setting", args: []string{"-reaper.max-lifetime", "-1h"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			if _, err := loadConfig(tt.args); err == nil {
+				t.Error("loadConfig succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	tests := []struct {
+		name       string
+		token      string
+		remoteAddr string
+		unix       bool
+		header     map[string]string
+		wantStatus int
+	}{
+		{name: "loopback", remoteAddr: "127.0.0.1:4000", wantStatus: http.StatusOK},
+		{name: "IPv6 loopback", remoteAddr: "[::1]:4000", wantStatus: http.StatusOK},
+		{name: "Unix socket", remoteAddr: "@", unix: true, wantStatus: http.StatusOK},
+		{name: "remote", remoteAddr: "192.0.2.7:4000", wantStatus: http.StatusForbidden},
+		{
+			name:       "listed origin",
+			remoteAddr: "127.0.0.1:4000",
+			header:     map[string]string{"Origin": "http://localhost:5173"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "unlisted origin",
+			remoteAddr: "127.0.0.1:4000",
+			header:     map[string]string{"Origin": "https://evil.example"},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "unlisted origin over the Unix socket",
+			remoteAddr: "@",
+			unix:       true,
+			header:     map[string]string{"Origin": "https://evil.example"},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "cross-site request without an origin",
+			remoteAddr: "127.0.0.1:4000",
+			header:     map[string]string{"Sec-Fetch-Site": "cross-site"},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "typed into the address bar",
+			remoteAddr: "127.0.0.1:4000",
+			header:     map[string]string{"Sec-Fetch-Site": "none"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "token",
+			token:      "s3cret",
+			remoteAddr: "192.0.2.7:4000",
+			header:     map[string]string{"Authorization": "Bearer s3cret", "Origin": "https://evil.example"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "wrong token",
+			token:      "s3cret",
+			remoteAddr: "192.0.2.7:4000",
+			header:     map[string]string{"Authorization": "Bearer guess"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "token required on loopback",
+			token:      "s3cret",
+			remoteAddr: "127.0.0.1:4000",
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = defaultConfig()
+			config.Auth.AdminToken = tt.token
+
+			req := httptest.NewRequest(http.MethodGet, "/admin/config", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.unix {
+				addr := &net.UnixAddr{Name: "/run/lcw.sock", Net: "unix"}
+				req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, addr))
+			}
+			for key, value := range tt.header {
+				req.Header.Set(key, value)
+			}
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+
+			err := adminAuth(func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			})(c)
+			if tt.wantStatus == http.StatusOK {
+				if err != nil {
+					t.Errorf("adminAuth = %v, want the request admitted", err)
+				}
+				return
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.status != tt.wantStatus {
+				t.Errorf("adminAuth = %v, want status %d", err, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// deviceRule allows access to a device, with -1 standing for any major
+// or minor number.
+type deviceRule struct {
+	Type         byte
+	Major, Minor int64
+	Access       string
+}
+
+// defaultDeviceRules are the devices native containers may use, the
+// same Docker allows: creating any node, but only reading and writing
+// the ones populateDev provides and the pseudo terminals.
+var defaultDeviceRules = []deviceRule{
+	{Type: 'c', Major: -1, Minor: -1, Access: "m"},
+	{Type: 'b', Major: -1, Minor: -1, Access: "m"},
+	{Type: 'c', Major: 1, Minor: 3, Access: "rwm"},    // null
+	{Type: 'c', Major: 1, Minor: 5, Access: "rwm"},    // zero
+	{Type: 'c', Major: 1, Minor: 7, Access: "rwm"},    // full
+	{Type: 'c', Major: 1, Minor: 8, Access: "rwm"},    // random
+	{Type: 'c', Major: 1, Minor: 9, Access: "rwm"},    // urandom
+	{Type: 'c', Major: 5, Minor: 0, Access: "rwm"},    // tty
+	{Type: 'c', Major: 5, Minor: 2, Access: "rwm"},    // ptmx
+	{Type: 'c', Major: 136, Minor: -1, Access: "rwm"}, // pts
+}
+
+// String spells the rule the way v1's devices.allow takes it.
+func (r deviceRule) String() string {
+	number := func(n int64) string {
+		if n < 0 {
+			return "*"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	return fmt.Sprintf("%c %s:%s %s", r.Type, number(r.Major), number(r.Minor), r.Access)
+}
+
+// restrictDevices denies the cgroup's processes every device but the
+// ones in defaultDeviceRules. It has to run before the cgroup gets
+// processes or children.
+func (cg *cgroup) restrictDevices() error {
+	if cgroupV2() {
+		return attachDeviceFilter(filepath.Join(cgroupRoot, cg.Path), defaultDeviceRules)
+	}
+	dir := filepath.Join(cgroupRoot, "devices", cg.Path)
+	if err := os.WriteFile(filepath.Join(dir, "devices.deny"), []byte("a"), 0); err != nil {
+		return fmt.Errorf("failed to deny devices: %w", err)
+	}
+	for _, rule := range defaultDeviceRules {
+		if err := os.WriteFile(filepath.Join(dir, "devices.allow"), []byte(rule.String()), 0); err != nil {
+			return fmt.Errorf("failed to allow devices %s: %w", rule, err)
+		}
+	}
+	return nil
+}
+
+// bpfInsn is an eBPF instruction.
+type bpfInsn struct {
+	Code byte
+	Regs byte // destination register in the low, source in the high nibble
+	Off  int16
+	Imm  int32
+}
+
+// eBPF opcodes not spelled out in x/sys/unix
+const (
+	bpfLoadWord  = unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W
+	bpfAnd32     = unix.BPF_ALU | unix.BPF_AND | unix.BPF_K
+	bpfRsh32     = unix.BPF_ALU | unix.BPF_RSH | unix.BPF_K
+	bpfMov32Reg  = unix.BPF_ALU | unix.BPF_MOV | unix.BPF_X
+	bpfMov64     = unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K
+	bpfJumpNotEq = unix.BPF_JMP | unix.BPF_JNE | unix.BPF_K
+	bpfExit      = unix.BPF_JMP | unix.BPF_EXIT
+)
+
+// compileDeviceFilter builds a BPF_PROG_TYPE_CGROUP_DEVICE program that
+// allows the accesses rules allow and denies every other. The program
+// gets a struct bpf_cgroup_dev_ctx: the access type, holding the device
+// type in its low and the access in its high 16 bits, then major and
+// minor.
+func compileDeviceFilter(rules []deviceRule) []bpfInsn {
+	prog := []bpfInsn{
+		{Code: bpfLoadWord, Regs: 2 | 1<<4, Off: 0},
+		{Code: bpfAnd32, Regs: 2, Imm: 0xffff},
+		{Code: bpfLoadWord, Regs: 3 | 1<<4, Off: 0},
+		{Code: bpfRsh32, Regs: 3, Imm: 16},
+		{Code: bpfLoadWord, Regs: 4 | 1<<4, Off: 4},
+		{Code: bpfLoadWord, Regs: 5 | 1<<4, Off: 8},
+	}
+	for _, rule := range rules {
+		devType := int32(unix.BPF_DEVCG_DEV_CHAR)
+		if rule.Type == 'b' {
+			devType = unix.BPF_DEVCG_DEV_BLOCK
+		}
+		var access int32
+		for _, c := range rule.Access {
+			switch c {
+			case 'r':
+				access |= unix.BPF_DEVCG_ACC_READ
+			case 'w':
+				access |= unix.BPF_DEVCG_ACC_WRITE
+			case 'm':
+				access |= unix.BPF_DEVCG_ACC_MKNOD
+			}
+		}
+
+		// Each check jumps to the next rule when it does not match
+		var block []bpfInsn
+		block = append(block, bpfInsn{Code: bpfJumpNotEq, Regs: 2, Imm: devType})
+		if denied := ^access & 7; denied != 0 {
+			block = append(block,
+				bpfInsn{Code: bpfMov32Reg, Regs: 1 | 3<<4},
+				bpfInsn{Code: bpfAnd32, Regs: 1, Imm: denied},
+				bpfInsn{Code: bpfJumpNotEq, Regs: 1, Imm: 0},
+			)
+		}
+		if rule.Major >= 0 {
+			block = append(block, bpfInsn{Code: bpfJumpNotEq, Regs: 4, Imm: int32(rule.Major)})
+		}
+		if rule.Minor >= 0 {
+			block = append(block, bpfInsn{Code: bpfJumpNotEq, Regs: 5, Imm: int32(rule.Minor)})
+		}
+		block = append(block, bpfInsn{Code: bpfMov64, Imm: 1}, bpfInsn{Code: bpfExit})
+		for i := range block {
+			if block[i].Code == bpfJumpNotEq {
+				block[i].Off = int16(len(block) - i - 1)
+			}
+		}
+		prog = append(prog, block...)
+	}
+	return append(prog, bpfInsn{Code: bpfMov64, Imm: 0}, bpfInsn{Code: bpfExit})
+}
+
+// bpfProgLoadAttr and bpfProgAttachAttr are the leading fields of union
+// bpf_attr the BPF_PROG_LOAD and BPF_PROG_ATTACH commands use.
+type bpfProgLoadAttr struct {
+	ProgType    uint32
+	InsnCnt     uint32
+	Insns       uint64
+	License     uint64
+	LogLevel    uint32
+	LogSize     uint32
+	LogBuf      uint64
+	KernVersion uint32
+	ProgFlags   uint32
+}
+
+type bpfProgAttachAttr struct {
+	TargetFd    uint32
+	AttachBpfFd uint32
+	AttachType  uint32
+	AttachFlags uint32
+}
+
+// loadDeviceFilter loads the device program for rules into the kernel.
+func loadDeviceFilter(rules []deviceRule) (int, error) {
+	prog := compileDeviceFilter(rules)
+	insns := make([]byte, 0, 8*len(prog))
+	for _, insn := range prog {
+		insns = append(insns, insn.Code, insn.Regs)
+		insns = binary.LittleEndian.AppendUint16(insns, uint16(insn.Off))
+		insns = binary.LittleEndian.AppendUint32(insns, uint32(insn.Imm))
+	}
+	license := []byte("GPL\x00")
+	verifierLog := make([]byte, 64*1024)
+	attr := bpfProgLoadAttr{
+		ProgType: unix.BPF_PROG_TYPE_CGROUP_DEVICE,
+		InsnCnt:  uint32(len(prog)),
+		Insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		License:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		LogLevel: 1,
+		LogSize:  uint32(len(verifierLog)),
+		LogBuf:   uint64(uintptr(unsafe.Pointer(&verifierLog[0]))),
+	}
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_LOAD, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(verifierLog)
+	if errno != 0 {
+		return -1, fmt.Errorf("failed to load device filter: %w: %s", errno, unix.ByteSliceToString(verifierLog))
+	}
+	return int(fd), nil
+}
+
+// attachDeviceFilter attaches the device program for rules to the v2
+// cgroup at dir. BPF_F_ALLOW_MULTI keeps the programs of the cgroups
+// above in effect, an access has to pass all of them.
+func attachDeviceFilter(dir string, rules []deviceRule) error {
+	progFd, err := loadDeviceFilter(rules)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(progFd)
+	cgroupFd, err := unix.Open(dir, unix.O_DIRECTORY|unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(cgroupFd)
+	attr := bpfProgAttachAttr{
+		TargetFd:    uint32(cgroupFd),
+		AttachBpfFd: uint32(progFd),
+		AttachType:  unix.BPF_CGROUP_DEVICE,
+		AttachFlags: unix.BPF_F_ALLOW_MULTI,
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_ATTACH, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr)); errno != 0 {
+		return fmt.Errorf("failed to attach device filter: %w", errno)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDeviceRuleString(t *testing.T) {
+	tests := []struct {
+		rule deviceRule
+		want string
+	}{
+		{deviceRule{Type: 'c', Major: 1, Minor: 3, Access: "rwm"}, "c 1:3 rwm"},
+		{deviceRule{Type: 'c', Major: 136, Minor: -1, Access: "rwm"}, "c 136:* rwm"},
+		{deviceRule{Type: 'b', Major: -1, Minor: -1, Access: "m"}, "b *:* m"},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestLoadDeviceFilter(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("loading BPF programs needs root")
+	}
+	fd, err := loadDeviceFilter(defaultDeviceRules)
+	if err != nil {
+		t.Fatalf("loadDeviceFilter: %v", err)
+	}
+	unix.Close(fd)
+}
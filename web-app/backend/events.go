@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// Container lifecycle event types
+const (
+	eventCreated   = "created"
+	eventStarted   = "started"
+	eventDied      = "died"
+	eventDestroyed = "destroyed"
+	eventAttached  = "attached"
+	eventDetached  = "detached"
+	eventOOM       = "oom"
+	eventPidsLimit = "pids-limit"
+)
+
+var eventTypes = []string{
+	eventCreated, eventStarted, eventDied, eventDestroyed,
+	eventAttached, eventDetached, eventOOM, eventPidsLimit,
+}
+
+// eventKeepAlive is how often idle event streams get a heartbeat so
+// proxies do not close them.
+const eventKeepAlive = 15 * time.Second
+
+// Event is something that happened to a container.
+type Event struct {
+	Type        string            `json:"type"`
+	ContainerID string            `json:"containerId"`
+	SectionID   string            `json:"sectionId"`
+	Time        time.Time         `json:"time"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+}
+
+var (
+	eventsMux        sync.Mutex
+	eventSubscribers = make(map[chan Event]struct{})
+)
+
+// emitEvent sends an event to every subscriber. Subscribers that fall
+// behind are dropped rather than holding up the container.
+func emitEvent(info *ContainerInfo, typ string, attributes map[string]string) {
+	event := Event{
+		Type:        typ,
+		ContainerID: info.ID,
+		SectionID:   info.SectionID,
+		Time:        time.Now().UTC(),
+		Attributes:  attributes,
+	}
+
+	eventsMux.Lock()
+	defer eventsMux.Unlock()
+	for ch := range eventSubscribers {
+		select {
+		case ch <- event:
+		default:
+			close(ch)
+			delete(eventSubscribers, ch)
+		}
+	}
+}
+
+func subscribeEvents() chan Event {
+	ch := make(chan Event, 64)
+	eventsMux.Lock()
+	eventSubscribers[ch] = struct{}{}
+	eventsMux.Unlock()
+	return ch
+}
+
+func unsubscribeEvents(ch chan Event) {
+	eventsMux.Lock()
+	defer eventsMux.Unlock()
+	if _, ok := eventSubscribers[ch]; ok {
+		close(ch)
+		delete(eventSubscribers, ch)
+	}
+}
+
+// eventFilter selects events by container, section and type. Each
+// criterion may list several values; an empty one matches everything.
+type eventFilter struct {
+	containers map[string]bool
+	sections   map[string]bool
+	types      map[string]bool
+}
+
+func parseEventFilter(c echo.Context) (eventFilter, error) {
+	values := func(name string) map[string]bool {
+		set := make(map[string]bool)
+		for _, param := range c.QueryParams()[name] {
+			for _, v := range strings.Split(param, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					set[v] = true
+				}
+			}
+		}
+		return set
+	}
+	f := eventFilter{
+		containers: values("container"),
+		sections:   values("section"),
+		types:      values("type"),
+	}
+	for typ := range f.types {
+		if !containsString(eventTypes, typ) {
+			return f, fmt.Errorf("unknown event type %q", typ)
+		}
+	}
+	return f, nil
+}
+
+func (f eventFilter) match(e Event) bool {
+	return (len(f.containers) == 0 || f.containers[e.ContainerID]) &&
+		(len(f.sections) == 0 || f.sections[e.SectionID]) &&
+		(len(f.types) == 0 || f.types[e.Type])
+}
+
+// getEvents streams events as server-sent events, or over a WebSocket
+// when the request asks for an upgrade.
+func getEvents(c echo.Context) error {
+	filter, err := parseEventFilter(c)
+	if err != nil {
+		return invalidField("type", err.Error())
+	}
+
+	if websocket.IsWebSocketUpgrade(c.Request()) {
+		return streamEventsWebSocket(c, filter)
+	}
+
+	ch := subscribeEvents()
+	defer unsubscribeEvents(ch)
+
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, "text/event-stream")
+	resp.Header().Set(echo.HeaderCacheControl, "no-cache")
+	resp.Header().Set(echo.HeaderConnection, "keep-alive")
+	resp.WriteHeader(http.StatusOK)
+	resp.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	ctx := c.Request().Context()
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if !filter.match(event) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			// Unnamed events all reach the EventSource's onmessage
+			if _, err := fmt.Fprintf(resp, "data: %s\n\n", data); err != nil {
+				return nil
+			}
+			resp.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(resp, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+			resp.Flush()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func streamEventsWebSocket(c echo.Context, filter eventFilter) error {
+	ws, err := upgrader.Upgrade(c.Response().Writer, c.Request(), nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return err
+	}
+	defer ws.Close()
+
+	ch := subscribeEvents()
+	defer unsubscribeEvents(ch)
+
+	// The client only ever closes the connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if filter.match(event) {
+				if err := ws.WriteJSON(event); err != nil {
+					return nil
+				}
+			}
+		case <-closed:
+			return nil
+		case <-c.Request().Context().Done():
+			return nil
+		}
+	}
+}
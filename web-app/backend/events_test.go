@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestEventFilter(t *testing.T) {
+	events := []Event{
+		{Type: eventCreated, ContainerID: "a", SectionID: "01-process-management"},
+		{Type: eventDied, ContainerID: "a", SectionID: "01-process-management"},
+		{Type: eventCreated, ContainerID: "b", SectionID: "02-namespaces"},
+		{Type: eventOOM, ContainerID: "c", SectionID: "02-namespaces"},
+	}
+	tests := []struct {
+		name    string
+		query   string
+		want    []int
+		wantErr bool
+	}{
+		{name: "no filter", query: "", want: []int{0, 1, 2, 3}},
+		{name: "container", query: "container=a", want: []int{0, 1}},
+		{name: "section", query: "section=02-namespaces", want: []int{2, 3}},
+		{name: "type", query: "type=created", want: []int{0, 2}},
+		{name: "comma separated values", query: "container=a,%20c", want: []int{0, 1, 3}},
+		{name: "repeated parameter", query: "type=died&type=oom", want: []int{1, 3}},
+		{name: "criteria combine", query: "section=02-namespaces&type=created,died", want: []int{2}},
+		{name: "empty values are ignored", query: "container=,&type=", want: []int{0, 1, 2, 3}},
+		{name: "no match", query: "container=z", want: nil},
+		{name: "unknown type", query: "type=created,exploded", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/events?"+tt.query, nil)
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			filter, err := parseEventFilter(c)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("parseEventFilter succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseEventFilter = %v", err)
+			}
+			var got []int
+			for i, e := range events {
+				if filter.match(e) {
+					got = append(got, i)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matched events %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
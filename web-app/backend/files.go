@@ -0,0 +1,519 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/sys/unix"
+)
+
+// maxUploadSize bounds files and archives uploaded into a container.
+const maxUploadSize = 512 << 20
+
+// FileEntry describes a file in a container directory listing.
+type FileEntry struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"` // "file", "dir", "symlink" or "other"
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	UID     uint32    `json:"uid"`
+	GID     uint32    `json:"gid"`
+	ModTime time.Time `json:"modTime"`
+	Target  string    `json:"target,omitempty"`
+}
+
+// filesystemRoot is the directory the file API resolves paths in: the
+// container's root filesystem, or the workspace of local containers,
+// which have no root of their own.
+func (info *ContainerInfo) filesystemRoot() string {
+	if info.isolated() {
+		return info.hostPath("/")
+	}
+	return filepath.Join(containerDir(info.ID), "workspace")
+}
+
+// openInRoot opens name relative to the directory dirfd as if that
+// directory were the filesystem root, so neither ".." nor symlinks,
+// including ones swapped in while the path is resolved, lead outside it.
+func openInRoot(dirfd int, name string, flags int, mode uint32) (*os.File, error) {
+	how := &unix.OpenHow{
+		Flags:   uint64(flags | unix.O_CLOEXEC),
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	}
+	if flags&unix.O_CREAT != 0 {
+		how.Mode = uint64(mode)
+	}
+	for {
+		fd, err := unix.Openat2(dirfd, name, how)
+		if err == unix.EINTR || err == unix.EAGAIN {
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		return os.NewFile(uintptr(fd), name), nil
+	}
+}
+
+// openInContainer opens a path inside the container's filesystem root.
+func openInContainer(info *ContainerInfo, name string, flags int, mode uint32) (*os.File, error) {
+	root, err := os.OpenFile(info.filesystemRoot(), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return openInRoot(int(root.Fd()), name, flags, mode)
+}
+
+// cleanContainerPath makes a client supplied path absolute and clean.
+func cleanContainerPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// fileEntry describes name inside the directory dirfd without following
+// it if it is a symlink.
+func fileEntry(dirfd int, name string) (FileEntry, error) {
+	var st unix.Stat_t
+	if err := unix.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return FileEntry{}, err
+	}
+	entry := FileEntry{
+		Name:    name,
+		Size:    st.Size,
+		Mode:    fmt.Sprintf("%04o", st.Mode&07777),
+		UID:     st.Uid,
+		GID:     st.Gid,
+		ModTime: time.Unix(st.Mtim.Unix()),
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFREG:
+		entry.Type = "file"
+	case unix.S_IFDIR:
+		entry.Type = "dir"
+	case unix.S_IFLNK:
+		entry.Type = "symlink"
+		buf := make([]byte, unix.PathMax)
+		if n, err := unix.Readlinkat(dirfd, name, buf); err == nil {
+			entry.Target = string(buf[:n])
+		}
+	default:
+		entry.Type = "other"
+	}
+	return entry, nil
+}
+
+// FileListing is the content of a container directory.
+type FileListing struct {
+	Path    string      `json:"path"`
+	Entries []FileEntry `json:"entries"`
+}
+
+type UploadResult struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+type ArchiveResult struct {
+	Path string `json:"path"`
+	// Entries counts the archive entries extracted
+	Entries int `json:"entries"`
+}
+
+// fileError maps filesystem errors to API errors.
+func fileError(err error) error {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return apiError(http.StatusNotFound, codeFileNotFound, "No such file or directory")
+	case errors.Is(err, syscall.ENOTDIR):
+		return apiError(http.StatusBadRequest, codeInvalidRequest, "Not a directory")
+	case errors.Is(err, syscall.EISDIR):
+		return apiError(http.StatusBadRequest, codeInvalidRequest, "Is a directory")
+	case errors.Is(err, syscall.ELOOP), errors.Is(err, syscall.EXDEV):
+		return apiError(http.StatusBadRequest, codeInvalidRequest, "Path resolves outside the container")
+	case errors.Is(err, os.ErrPermission), errors.Is(err, syscall.EROFS):
+		return apiError(http.StatusForbidden, codeForbidden, err.Error())
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return apiError(http.StatusRequestEntityTooLarge, codePayloadTooLarge, "Upload too large")
+	}
+	return internalError("%v", err)
+}
+
+// lookupFileContainer finds the container a file request is for.
+func lookupFileContainer(c echo.Context) (*ContainerInfo, bool) {
+	containersMux.RLock()
+	info, exists := containers[c.Param("id")]
+	containersMux.RUnlock()
+	return info, exists
+}
+
+func listFiles(c echo.Context) error {
+	info, exists := lookupFileContainer(c)
+	if !exists {
+		return errContainerNotFound
+	}
+	name := cleanContainerPath(c.QueryParam("path"))
+
+	dir, err := openInContainer(info, name, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return fileError(err)
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return fileError(err)
+	}
+	sort.Strings(names)
+
+	entries := []FileEntry{}
+	for _, n := range names {
+		// Files may disappear while the directory is listed
+		if entry, err := fileEntry(int(dir.Fd()), n); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return c.JSON(http.StatusOK, FileListing{Path: name, Entries: entries})
+}
+
+func downloadFile(c echo.Context) error {
+	info, exists := lookupFileContainer(c)
+	if !exists {
+		return errContainerNotFound
+	}
+	name := cleanContainerPath(c.QueryParam("path"))
+
+	f, err := openInContainer(info, name, unix.O_RDONLY, 0)
+	if err != nil {
+		return fileError(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fileError(err)
+	}
+	if !fi.Mode().IsRegular() {
+		return apiError(http.StatusBadRequest, codeInvalidRequest, "Not a regular file")
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", path.Base(name)))
+	http.ServeContent(c.Response(), c.Request(), path.Base(name), fi.ModTime(), f)
+	return nil
+}
+
+// uploadFile replaces a file with the request body. The content is
+// written next to it first so readers never see a partial file.
+func uploadFile(c echo.Context) error {
+	info, exists := lookupFileContainer(c)
+	if !exists {
+		return errContainerNotFound
+	}
+	name := cleanContainerPath(c.QueryParam("path"))
+	if name == "/" {
+		return invalidField("path", "is required")
+	}
+	mode := uint64(0644)
+	if m := c.QueryParam("mode"); m != "" {
+		var err error
+		if mode, err = strconv.ParseUint(m, 8, 32); err != nil || mode > 0777 {
+			return invalidField("mode", "must be an octal file mode")
+		}
+	}
+
+	dir, err := openInContainer(info, path.Dir(name), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return fileError(err)
+	}
+	defer dir.Close()
+	base := path.Base(name)
+	tmp := fmt.Sprintf(".%s.upload-%d", base, time.Now().UnixNano())
+	fd, err := unix.Openat(int(dir.Fd()), tmp, unix.O_CREAT|unix.O_EXCL|unix.O_WRONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(mode))
+	if err != nil {
+		return fileError(&os.PathError{Op: "create", Path: name, Err: err})
+	}
+	f := os.NewFile(uintptr(fd), tmp)
+
+	body := http.MaxBytesReader(c.Response(), c.Request().Body, maxUploadSize)
+	n, err := io.Copy(f, body)
+	if err == nil {
+		// The umask may have narrowed the mode
+		err = f.Chmod(os.FileMode(mode))
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = unix.Renameat(int(dir.Fd()), tmp, int(dir.Fd()), base)
+	}
+	if err != nil {
+		unix.Unlinkat(int(dir.Fd()), tmp, 0)
+		return fileError(err)
+	}
+	return c.JSON(http.StatusOK, UploadResult{Path: name, Size: n})
+}
+
+// exportArchive streams a directory of the container as a tar archive.
+// Symlinks are archived as links, never followed.
+func exportArchive(c echo.Context) error {
+	info, exists := lookupFileContainer(c)
+	if !exists {
+		return errContainerNotFound
+	}
+	name := cleanContainerPath(c.QueryParam("path"))
+
+	dir, err := openInContainer(info, name, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return fileError(err)
+	}
+	defer dir.Close()
+
+	archive := path.Base(name)
+	if name == "/" {
+		archive = "root"
+	}
+	c.Response().Header().Set(echo.HeaderContentType, "application/x-tar")
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", archive+".tar"))
+	c.Response().WriteHeader(http.StatusOK)
+
+	tw := tar.NewWriter(c.Response())
+	if err := archiveDir(tw, dir, ""); err != nil {
+		// The status is already sent; a truncated archive is all the
+		// client can be told
+		return err
+	}
+	return tw.Close()
+}
+
+// archiveDir adds the contents of dir to tw under prefix, walking by
+// file descriptor so nothing outside dir is reached.
+func archiveDir(tw *tar.Writer, dir *os.File, prefix string) error {
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	dirfd := int(dir.Fd())
+
+	for _, n := range names {
+		var st unix.Stat_t
+		if err := unix.Fstatat(dirfd, n, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			continue
+		}
+		hdr := &tar.Header{
+			Name:    prefix + n,
+			Mode:    int64(st.Mode & 07777),
+			Uid:     int(st.Uid),
+			Gid:     int(st.Gid),
+			ModTime: time.Unix(st.Mtim.Unix()),
+			Format:  tar.FormatPAX,
+		}
+
+		switch st.Mode & unix.S_IFMT {
+		case unix.S_IFDIR:
+			fd, err := unix.Openat(dirfd, n, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+			if err != nil {
+				continue
+			}
+			sub := os.NewFile(uintptr(fd), n)
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			err = tw.WriteHeader(hdr)
+			if err == nil {
+				err = archiveDir(tw, sub, hdr.Name)
+			}
+			sub.Close()
+			if err != nil {
+				return err
+			}
+		case unix.S_IFREG:
+			fd, err := unix.Openat(dirfd, n, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+			if err != nil {
+				continue
+			}
+			f := os.NewFile(uintptr(fd), n)
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = st.Size
+			err = tw.WriteHeader(hdr)
+			if err == nil {
+				// A file growing while it is archived is cut at its size
+				_, err = io.CopyN(tw, f, st.Size)
+			}
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case unix.S_IFLNK:
+			buf := make([]byte, unix.PathMax)
+			size, err := unix.Readlinkat(dirfd, n, buf)
+			if err != nil {
+				continue
+			}
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = string(buf[:size])
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+		}
+		// Devices, sockets and fifos have no content worth exporting
+	}
+	return nil
+}
+
+// importArchive extracts a tar archive into a directory of the container.
+// Entries are created relative to that directory as if it were the root,
+// so an archive can not place files outside it.
+func importArchive(c echo.Context) error {
+	info, exists := lookupFileContainer(c)
+	if !exists {
+		return errContainerNotFound
+	}
+	name := cleanContainerPath(c.QueryParam("path"))
+
+	dir, err := openInContainer(info, name, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return fileError(err)
+	}
+	defer dir.Close()
+
+	body, err := decompress(http.MaxBytesReader(c.Response(), c.Request().Body, maxUploadSize))
+	if err != nil {
+		return apiError(http.StatusBadRequest, codeInvalidRequest, err.Error())
+	}
+	tr := tar.NewReader(body)
+	count := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fileError(fmt.Errorf("invalid archive: %w", err))
+		}
+		if err := extractInRoot(int(dir.Fd()), tr, hdr); err != nil {
+			return fileError(fmt.Errorf("failed to extract %s: %w", hdr.Name, err))
+		}
+		count++
+	}
+	return c.JSON(http.StatusOK, ArchiveResult{Path: name, Entries: count})
+}
+
+// extractInRoot creates one archive entry below rootfd. Ownership is not
+// restored and only permission bits are kept.
+func extractInRoot(rootfd int, tr *tar.Reader, hdr *tar.Header) error {
+	name := path.Clean("/" + hdr.Name)
+	if name == "/" {
+		return nil
+	}
+	parent, err := openInRoot(rootfd, path.Dir(name), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		// Archives do not have to list parent directories
+		if err = mkdirAllInRoot(rootfd, path.Dir(name)); err == nil {
+			parent, err = openInRoot(rootfd, path.Dir(name), unix.O_PATH|unix.O_DIRECTORY, 0)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	pfd := int(parent.Fd())
+	base := path.Base(name)
+	mode := uint32(hdr.Mode & 0777)
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := unix.Mkdirat(pfd, base, mode); err != nil && err != unix.EEXIST {
+			return err
+		}
+	case tar.TypeReg:
+		// Entries replace existing files, but never directories
+		unix.Unlinkat(pfd, base, 0)
+		fd, err := unix.Openat(pfd, base, unix.O_CREAT|unix.O_EXCL|unix.O_WRONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, mode)
+		if err != nil {
+			return err
+		}
+		f := os.NewFile(uintptr(fd), base)
+		_, err = io.Copy(f, tr)
+		if err == nil {
+			err = f.Chmod(os.FileMode(mode))
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	case tar.TypeSymlink:
+		unix.Unlinkat(pfd, base, 0)
+		return unix.Symlinkat(hdr.Linkname, pfd, base)
+	case tar.TypeLink:
+		target, err := openInRoot(rootfd, hdr.Linkname, unix.O_PATH|unix.O_NOFOLLOW, 0)
+		if err != nil {
+			return err
+		}
+		defer target.Close()
+		unix.Unlinkat(pfd, base, 0)
+		// Linking through the descriptor's proc entry needs no privileges,
+		// unlike AT_EMPTY_PATH
+		return unix.Linkat(unix.AT_FDCWD, fmt.Sprintf("/proc/self/fd/%d", target.Fd()), pfd, base, unix.AT_SYMLINK_FOLLOW)
+	}
+	// Devices and fifos are skipped
+	return nil
+}
+
+// mkdirAllInRoot creates a directory and its missing parents below rootfd.
+func mkdirAllInRoot(rootfd int, name string) error {
+	current := "/"
+	for _, part := range strings.Split(strings.Trim(name, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		parent, err := openInRoot(rootfd, current, unix.O_PATH|unix.O_DIRECTORY, 0)
+		if err != nil {
+			return err
+		}
+		err = unix.Mkdirat(int(parent.Fd()), part, 0755)
+		parent.Close()
+		if err != nil && err != unix.EEXIST {
+			return err
+		}
+		current = path.Join(current, part)
+	}
+	return nil
+}
+
+// writeFileInRoot replaces name below rootfd with a regular file holding
+// data, creating missing parent directories. A symlink in its place is
+// replaced, never followed.
+func writeFileInRoot(rootfd int, name string, data []byte, mode os.FileMode) error {
+	name = path.Clean("/" + name)
+	if err := mkdirAllInRoot(rootfd, path.Dir(name)); err != nil {
+		return err
+	}
+	parent, err := openInRoot(rootfd, path.Dir(name), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	base := path.Base(name)
+	unix.Unlinkat(int(parent.Fd()), base, 0)
+	fd, err := unix.Openat(int(parent.Fd()), base, unix.O_CREAT|unix.O_EXCL|unix.O_WRONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(mode.Perm()))
+	if err != nil {
+		return &os.PathError{Op: "create", Path: name, Err: err}
+	}
+	f := os.NewFile(uintptr(fd), name)
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestWriteFileInRoot(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(root, outside string) error
+		path  string
+		// want is where the file has to end up, relative to the root
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "new file in missing directories",
+			path: "/a/b/file",
+			want: "a/b/file",
+		},
+		{
+			name: "relative path",
+			path: "workspace/file",
+			want: "workspace/file",
+		},
+		{
+			name: "dot dot stays in root",
+			path: "/../../file",
+			want: "file",
+		},
+		{
+			// The target does not exist inside the root
+			name: "absolute symlinked directory",
+			setup: func(root, outside string) error {
+				return os.Symlink(outside, filepath.Join(root, "dir"))
+			},
+			path:    "/dir/file",
+			wantErr: true,
+		},
+		{
+			name: "relative symlinked directory",
+			setup: func(root, outside string) error {
+				return os.Symlink("../../../../../../../..", filepath.Join(root, "dir"))
+			},
+			path: "/dir/file",
+			want: "file",
+		},
+		{
+			name: "symlinked file is replaced",
+			setup: func(root, outside string) error {
+				if err := os.Mkdir(filepath.Join(root, "etc"), 0755); err != nil {
+					return err
+				}
+				return os.Symlink(filepath.Join(outside, "shadow"), filepath.Join(root, "etc/hosts"))
+			},
+			path: "/etc/hosts",
+			want: "etc/hosts",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, outside := t.TempDir(), t.TempDir()
+			if tt.setup != nil {
+				if err := tt.setup(root, outside); err != nil {
+					t.Fatal(err)
+				}
+			}
+			rootf, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rootf.Close()
+
+			err = writeFileInRoot(int(rootf.Fd()), tt.path, []byte("data"), 0600)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("writeFileInRoot(%q) succeeded, want an error", tt.path)
+				}
+			} else if err != nil {
+				t.Fatalf("writeFileInRoot(%q): %v", tt.path, err)
+			} else if fi, err := os.Lstat(filepath.Join(root, tt.want)); err != nil {
+				t.Errorf("file not written to %s: %v", tt.want, err)
+			} else if !fi.Mode().IsRegular() {
+				t.Errorf("%s is %v, want a regular file", tt.want, fi.Mode())
+			}
+			entries, err := os.ReadDir(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("wrote %s outside the root", entries[0].Name())
+			}
+		})
+	}
+}
+
+func TestExtractInRoot(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(root, outside string) error
+		entries []tarEntry
+		// want lists the files that have to end up in the root with
+		// their content
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "files in unlisted directories",
+			entries: []tarEntry{
+				{name: "a/", typeflag: tar.TypeDir},
+				{name: "a/one", typeflag: tar.TypeReg, content: "1"},
+				{name: "b/c/two", typeflag: tar.TypeReg, content: "2"},
+			},
+			want: map[string]string{"a/one": "1", "b/c/two": "2"},
+		},
+		{
+			name:    "dot dot stays in root",
+			entries: []tarEntry{{name: "../../evil", typeflag: tar.TypeReg, content: "x"}},
+			want:    map[string]string{"evil": "x"},
+		},
+		{
+			name: "file through an archived symlink",
+			entries: []tarEntry{
+				{name: "link", typeflag: tar.TypeSymlink, linkname: "/"},
+				{name: "link/evil", typeflag: tar.TypeReg, content: "x"},
+			},
+			want: map[string]string{"evil": "x"},
+		},
+		{
+			// The target does not exist inside the root
+			name: "file through an existing symlink",
+			setup: func(root, outside string) error {
+				return os.Symlink(outside, filepath.Join(root, "link"))
+			},
+			entries: []tarEntry{{name: "link/evil", typeflag: tar.TypeReg, content: "x"}},
+			wantErr: true,
+		},
+		{
+			name: "hard link inside the root",
+			entries: []tarEntry{
+				{name: "file", typeflag: tar.TypeReg, content: "x"},
+				{name: "hard", typeflag: tar.TypeLink, linkname: "/file"},
+			},
+			want: map[string]string{"file": "x", "hard": "x"},
+		},
+		{
+			name: "hard link to a file outside the root",
+			setup: func(root, outside string) error {
+				return os.WriteFile(filepath.Join(outside, "secret"), []byte("s"), 0600)
+			},
+			entries: []tarEntry{{name: "hard", typeflag: tar.TypeLink, linkname: "../secret"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, outside := t.TempDir(), t.TempDir()
+			if tt.setup != nil {
+				if err := tt.setup(root, outside); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before, err := os.ReadDir(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rootf, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rootf.Close()
+
+			tr := tar.NewReader(buildLayer(t, tt.entries))
+			var extractErr error
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if extractErr = extractInRoot(int(rootf.Fd()), tr, hdr); extractErr != nil {
+					break
+				}
+			}
+			if tt.wantErr != (extractErr != nil) {
+				t.Fatalf("extractInRoot = %v, want error %v", extractErr, tt.wantErr)
+			}
+			for name, want := range tt.want {
+				if data, err := os.ReadFile(filepath.Join(root, name)); err != nil || string(data) != want {
+					t.Errorf("%s = %q, %v, want %q", name, data, err, want)
+				}
+			}
+			after, err := os.ReadDir(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(after) != len(before) {
+				t.Errorf("extracted %d files outside the root", len(after)-len(before))
+			}
+		})
+	}
+}
+
+func TestArchiveDir(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	for name, data := range map[string]string{"top": "t", "sub/inner": "i"} {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0755)
+		if err := os.WriteFile(filepath.Join(root, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("s"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.Open(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := archiveDir(tw, dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+
+	var got []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tr)
+		got = append(got, fmt.Sprintf("%c %s %s%s", hdr.Typeflag, hdr.Name, hdr.Linkname, data))
+	}
+	want := []string{
+		"2 link " + outside,
+		"5 sub/ ",
+		"0 sub/inner i",
+		"0 top t",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("archive = %q, want %q", got, want)
+	}
+}
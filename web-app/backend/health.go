@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/sys/unix"
+)
+
+// HealthCheck is the outcome of one readiness check.
+type HealthCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// Diagnostics describes what the host offers containers, to tell whether a
+// lab machine is set up right.
+type Diagnostics struct {
+	Kernel         KernelInfo      `json:"kernel"`
+	Driver         string          `json:"driver"`
+	Cgroup         CgroupInfo      `json:"cgroup"`
+	Namespaces     map[string]bool `json:"namespaces"`
+	UserNamespaces UserNSInfo      `json:"userNamespaces"`
+	Overlay        OverlayInfo     `json:"overlay"`
+	Checks         []HealthCheck   `json:"checks"`
+}
+
+type KernelInfo struct {
+	Release string `json:"release"`
+	Version string `json:"version"`
+	Arch    string `json:"arch"`
+}
+
+type CgroupInfo struct {
+	Version     int      `json:"version"`
+	Controllers []string `json:"controllers"`
+	Writable    bool     `json:"writable"`
+}
+
+type UserNSInfo struct {
+	Supported bool `json:"supported"`
+	// Unprivileged is whether users other than root may create them
+	Unprivileged      bool `json:"unprivileged"`
+	MaxUserNamespaces int  `json:"maxUserNamespaces"`
+}
+
+type OverlayInfo struct {
+	Available bool `json:"available"`
+}
+
+// namespaceTypes are the namespaces containers use, by their name in
+// /proc/self/ns.
+var namespaceTypes = []string{"mnt", "pid", "uts", "ipc", "net", "user"}
+
+func namespaceAvailable(name string) bool {
+	_, err := os.Stat(filepath.Join("/proc/self/ns", name))
+	return err == nil
+}
+
+// requiredNamespaces are the namespaces the driver creates for every
+// container.
+func requiredNamespaces(driver string) []string {
+	switch driver {
+	case driverNative:
+		return []string{"mnt", "pid", "uts", "ipc"}
+	case driverRootless:
+		return []string{"user", "mnt", "pid", "uts", "ipc"}
+	}
+	return nil
+}
+
+// cgroupControllers lists the controllers the host's cgroups offer.
+func cgroupControllers() []string {
+	if cgroupV2() {
+		data, err := os.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+		if err != nil {
+			return nil
+		}
+		return strings.Fields(string(data))
+	}
+	f, err := os.Open("/proc/cgroups")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var controllers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// subsys_name hierarchy num_cgroups enabled
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 4 && !strings.HasPrefix(fields[0], "#") && fields[3] == "1" {
+			controllers = append(controllers, fields[0])
+		}
+	}
+	return controllers
+}
+
+// checkCgroups checks that the hierarchies container cgroups are created
+// in are mounted and writable.
+func checkCgroups() HealthCheck {
+	check := HealthCheck{Name: "cgroups"}
+	dirs := []string{cgroupRoot}
+	if !cgroupV2() {
+		dirs = nil
+		for _, controller := range cgroupV1Controllers {
+			dirs = append(dirs, filepath.Join(cgroupRoot, controller))
+		}
+	}
+	for _, dir := range dirs {
+		var st unix.Statfs_t
+		if err := unix.Statfs(dir, &st); err != nil || (st.Type != unix.CGROUP2_SUPER_MAGIC && st.Type != unix.CGROUP_SUPER_MAGIC) {
+			check.Message = dir + " is not a mounted cgroup hierarchy"
+			return check
+		}
+		if err := unix.Access(dir, unix.W_OK); err != nil {
+			check.Message = fmt.Sprintf("%s is not writable: %v", dir, err)
+			return check
+		}
+	}
+	check.OK = true
+	return check
+}
+
+// readinessChecks checks what the container driver needs to create
+// containers.
+func readinessChecks() []HealthCheck {
+	state := HealthCheck{Name: "state", OK: true}
+	if imageStore == nil || ipam == nil {
+		state = HealthCheck{Name: "state", Message: "state is not loaded yet"}
+	} else if err := unix.Access(config.Backend.StateDir, unix.W_OK); err != nil {
+		state = HealthCheck{Name: "state", Message: fmt.Sprintf("%s is not writable: %v", config.Backend.StateDir, err)}
+	}
+	checks := []HealthCheck{state}
+
+	// Native containers need a cgroup, rootless ones run without one
+	// where the backend may not create it
+	if containerDriver == driverNative {
+		checks = append(checks, checkCgroups())
+	}
+
+	namespaces := HealthCheck{Name: "namespaces", OK: true}
+	var missing []string
+	for _, ns := range requiredNamespaces(containerDriver) {
+		if !namespaceAvailable(ns) {
+			missing = append(missing, ns)
+		}
+	}
+	if len(missing) > 0 {
+		namespaces = HealthCheck{Name: "namespaces", Message: "kernel lacks namespaces: " + strings.Join(missing, ", ")}
+	} else if containerDriver == driverRootless && !userNamespacesAvailable() {
+		namespaces = HealthCheck{Name: "namespaces", Message: "unprivileged user namespaces are disabled"}
+	}
+	return append(checks, namespaces)
+}
+
+// getHealthz reports that the backend is alive.
+func getHealthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// getReadyz reports whether the backend can create containers, failing
+// with 503 while it cannot.
+func getReadyz(c echo.Context) error {
+	checks := readinessChecks()
+	status, code := "ready", http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			status, code = "not ready", http.StatusServiceUnavailable
+		}
+	}
+	return c.JSON(code, map[string]interface{}{
+		"status": status,
+		"driver": containerDriver,
+		"checks": checks,
+	})
+}
+
+// getDiagnostics reports the host's container capabilities.
+func getDiagnostics(c echo.Context) error {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return internalError("Failed to read kernel version: %v", err)
+	}
+
+	d := Diagnostics{
+		Kernel: KernelInfo{
+			Release: unix.ByteSliceToString(uts.Release[:]),
+			Version: unix.ByteSliceToString(uts.Version[:]),
+			Arch:    runtime.GOARCH,
+		},
+		Driver:     containerDriver,
+		Namespaces: make(map[string]bool),
+		Checks:     readinessChecks(),
+	}
+
+	d.Cgroup.Version = 1
+	if cgroupV2() {
+		d.Cgroup.Version = 2
+	}
+	d.Cgroup.Controllers = cgroupControllers()
+	d.Cgroup.Writable = checkCgroups().OK
+
+	for _, ns := range namespaceTypes {
+		d.Namespaces[ns] = namespaceAvailable(ns)
+	}
+
+	d.UserNamespaces.Supported = namespaceAvailable("user")
+	d.UserNamespaces.Unprivileged = userNamespacesAvailable()
+	if data, err := os.ReadFile("/proc/sys/user/max_user_namespaces"); err == nil {
+		d.UserNamespaces.MaxUserNamespaces, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+
+	if data, err := os.ReadFile("/proc/filesystems"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if fields := strings.Fields(line); len(fields) > 0 && fields[len(fields)-1] == "overlay" {
+				d.Overlay.Available = true
+			}
+		}
+	}
+
+	return c.JSON(http.StatusOK, d)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestGetReadyz(t *testing.T) {
+	savedConfig, savedDriver, savedStore, savedIPAM := config, containerDriver, imageStore, ipam
+	defer func() {
+		config, containerDriver, imageStore, ipam = savedConfig, savedDriver, savedStore, savedIPAM
+	}()
+	containerDriver = driverLocal
+
+	tests := []struct {
+		name       string
+		loaded     bool
+		stateDir   string
+		wantStatus int
+		wantChecks []HealthCheck
+	}{
+		{
+			name:       "ready",
+			loaded:     true,
+			wantStatus: http.StatusOK,
+			wantChecks: []HealthCheck{{Name: "state", OK: true}, {Name: "namespaces", OK: true}},
+		},
+		{
+			name:       "state not loaded",
+			wantStatus: http.StatusServiceUnavailable,
+			wantChecks: []HealthCheck{{Name: "state", Message: "state is not loaded yet"}, {Name: "namespaces", OK: true}},
+		},
+		{
+			name:       "state directory missing",
+			loaded:     true,
+			stateDir:   "missing",
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = defaultConfig()
+			config.Backend.StateDir = filepath.Join(t.TempDir(), tt.stateDir)
+			imageStore, ipam = nil, nil
+			if tt.loaded {
+				imageStore, ipam = &ImageStore{}, &IPAM{}
+			}
+
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/readyz", nil), rec)
+			if err := getReadyz(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			var resp struct {
+				Status string        `json:"status"`
+				Driver string        `json:"driver"`
+				Checks []HealthCheck `json:"checks"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if wantReady := tt.wantStatus == http.StatusOK; (resp.Status == "ready") != wantReady || resp.Driver != driverLocal {
+				t.Errorf("response = %s %s, want ready %v on %s", resp.Status, resp.Driver, wantReady, driverLocal)
+			}
+			if tt.wantChecks == nil {
+				if resp.Checks[0].OK || resp.Checks[0].Message == "" {
+					t.Errorf("state check = %+v, want a failure", resp.Checks[0])
+				}
+				return
+			}
+			if !reflect.DeepEqual(resp.Checks, tt.wantChecks) {
+				t.Errorf("checks = %+v, want %+v", resp.Checks, tt.wantChecks)
+			}
+		})
+	}
+}
+
+func TestRequiredNamespaces(t *testing.T) {
+	for _, driver := range []string{driverNative, driverRootless} {
+		for _, ns := range requiredNamespaces(driver) {
+			if !containsString(namespaceTypes, ns) {
+				t.Errorf("%s driver requires %s, which diagnostics do not report", driver, ns)
+			}
+		}
+	}
+	if ns := requiredNamespaces(driverLocal); len(ns) != 0 {
+		t.Errorf("local driver requires namespaces %v, want none", ns)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// Hook kinds, in the order they run during a container's lifecycle
+const (
+	hookPrestart        = "prestart"
+	hookCreateRuntime   = "createRuntime"
+	hookCreateContainer = "createContainer"
+	hookStartContainer  = "startContainer"
+	hookPoststart       = "poststart"
+	hookPoststop        = "poststop"
+)
+
+var hookKinds = []string{hookPrestart, hookCreateRuntime, hookCreateContainer, hookStartContainer, hookPoststart, hookPoststop}
+
+// hookWaitDelay bounds how long a timed out hook's leftover children may
+// keep its output open.
+const hookWaitDelay = time.Second
+
+// list returns the hooks of a kind; a nil set has none.
+func (h *ociHooks) list(kind string) []ociHook {
+	if h == nil {
+		return nil
+	}
+	switch kind {
+	case hookPrestart:
+		return h.Prestart
+	case hookCreateRuntime:
+		return h.CreateRuntime
+	case hookCreateContainer:
+		return h.CreateContainer
+	case hookStartContainer:
+		return h.StartContainer
+	case hookPoststart:
+		return h.Poststart
+	case hookPoststop:
+		return h.Poststop
+	}
+	return nil
+}
+
+func (h *ociHooks) validate() error {
+	for _, kind := range hookKinds {
+		for _, hook := range h.list(kind) {
+			if !filepath.IsAbs(hook.Path) {
+				return fmt.Errorf("%s hook path %q must be absolute", kind, hook.Path)
+			}
+			if hook.Timeout != nil && *hook.Timeout <= 0 {
+				return fmt.Errorf("%s hook %s: timeout must be positive", kind, hook.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// run executes the hook with the container state on its stdin. A hook
+// still running when its timeout expires is killed and counts as failed.
+// command builds the hook's process for a context.
+func (hook ociHook) run(kind string, state []byte, command func(context.Context, ociHook) *exec.Cmd) error {
+	ctx := context.Background()
+	if hook.Timeout != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(*hook.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	cmd := command(ctx, hook)
+	cmd.Stdin = bytes.NewReader(state)
+	cmd.WaitDelay = hookWaitDelay
+	output, err := cmd.CombinedOutput()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s hook %s timed out after %ds", kind, hook.Path, *hook.Timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook %s failed: %w: %s", kind, hook.Path, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// hostHookCommand runs a hook as a plain child of the current process.
+func hostHookCommand(ctx context.Context, hook ociHook) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, hook.Path)
+	if len(hook.Args) > 0 {
+		cmd.Args = hook.Args
+	}
+	// Hooks only get the environment they ask for
+	cmd.Env = append([]string{}, hook.Env...)
+	return cmd
+}
+
+// runHooks runs the hooks of a kind in order, stopping at the first one
+// that fails. Whether a failure is fatal is up to the caller: the spec
+// makes it so up to startContainer and only worth a warning afterwards.
+func runHooks(hooks *ociHooks, kind string, state ociState) error {
+	return runHooksWith(hooks, kind, state, hostHookCommand)
+}
+
+func runHooksWith(hooks *ociHooks, kind string, state ociState, command func(context.Context, ociHook) *exec.Cmd) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks.list(kind) {
+		if err := hook.run(kind, data, command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runHooks runs the container's hooks of a kind with its current state.
+func (ctr *ociContainer) runHooks(kind string) error {
+	return runHooks(ctr.Spec.Hooks, kind, ctr.ociState)
+}
+
+// hookState describes a template container to its hooks in the state
+// format of the runtime spec. The bundle is the container's directory.
+func (info *ContainerInfo) hookState(status string) ociState {
+	state := ociState{
+		OCIVersion: ociVersion,
+		ID:         info.ID,
+		Status:     status,
+		Bundle:     containerDir(info.ID),
+		Annotations: map[string]string{
+			"sectionId": info.SectionID,
+			"image":     info.Image,
+			"driver":    info.Driver,
+			"network":   info.Network.Mode,
+		},
+	}
+	if info.isolated() {
+		state.Annotations["rootfs"] = info.hostPath("/")
+	}
+	if info.Network.IPAddress != "" {
+		state.Annotations["ipAddress"] = info.Network.IPAddress
+	}
+	if info.sandbox != nil {
+		state.Pid = info.sandbox.Process.Pid
+	}
+	return state
+}
+
+// runTemplateHooks runs the template's hooks of a kind. createContainer
+// and startContainer hooks run inside the container with its environment
+// and resolve their paths there; the others run on the host.
+func (info *ContainerInfo) runTemplateHooks(kind, status string) error {
+	command := hostHookCommand
+	if kind == hookCreateContainer || kind == hookStartContainer {
+		command = func(ctx context.Context, hook ociHook) *exec.Cmd {
+			args := []string{hook.Path}
+			if len(hook.Args) > 1 {
+				args = append(args, hook.Args[1:]...)
+			}
+			return containerCommandEnv(ctx, info, append(info.environ(), hook.Env...), args)
+		}
+	}
+	return runHooksWith(info.Template.Hooks, kind, info.hookState(status), command)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHooksValidate(t *testing.T) {
+	zero, five := 0, 5
+	tests := []struct {
+		name    string
+		hooks   *ociHooks
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "empty", hooks: &ociHooks{}},
+		{name: "valid", hooks: &ociHooks{
+			Prestart: []ociHook{{Path: "/bin/true", Timeout: &five}},
+			Poststop: []ociHook{{Path: "/usr/bin/env", Args: []string{"env"}}},
+		}},
+		{name: "relative path", hooks: &ociHooks{CreateRuntime: []ociHook{{Path: "true"}}}, wantErr: true},
+		{name: "zero timeout", hooks: &ociHooks{Poststart: []ociHook{{Path: "/bin/true", Timeout: &zero}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.hooks.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	dir := t.TempDir()
+	record := func(name string) ociHook {
+		return ociHook{
+			Path: "/bin/sh",
+			Args: []string{"sh", "-c", `cat > "$OUT/` + name + `"; echo "$HOME" >> "$OUT/order"`},
+			Env:  []string{"OUT=" + dir, "HOME=" + name},
+		}
+	}
+	one := 1
+	failing := ociHook{Path: "/bin/sh", Args: []string{"sh", "-c", "echo broken >&2; exit 2"}}
+	hanging := ociHook{Path: "/bin/sleep", Args: []string{"sleep", "10"}, Timeout: &one}
+
+	state := ociState{OCIVersion: ociVersion, ID: "c1", Status: "creating", Bundle: "/bundle"}
+	tests := []struct {
+		name      string
+		hooks     []ociHook
+		wantOrder string
+		wantErr   string
+	}{
+		{name: "in order", hooks: []ociHook{record("first"), record("second")}, wantOrder: "first\nsecond\n"},
+		{name: "failure stops the rest", hooks: []ociHook{record("first"), failing, record("second")}, wantOrder: "first\n", wantErr: "broken"},
+		{name: "timeout", hooks: []ociHook{hanging, record("first")}, wantErr: "timed out after 1s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(filepath.Join(dir, "order"))
+			err := runHooks(&ociHooks{Prestart: tt.hooks}, hookPrestart, state)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("runHooks = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("runHooks = %v, want an error mentioning %q", err, tt.wantErr)
+			}
+			order, _ := os.ReadFile(filepath.Join(dir, "order"))
+			if string(order) != tt.wantOrder {
+				t.Errorf("hooks ran as %q, want %q", order, tt.wantOrder)
+			}
+		})
+	}
+
+	// Each hook reads the container state on its stdin
+	data, err := os.ReadFile(filepath.Join(dir, "first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got ociState
+	if err := json.Unmarshal(data, &got); err != nil || got.ID != "c1" || got.Status != "creating" || got.Bundle != "/bundle" {
+		t.Errorf("hook read state %s, want %+v", data, state)
+	}
+}
@@ -0,0 +1,726 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// OCI media types the store writes or understands
+const (
+	mediaTypeOCIIndex    = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIConfig   = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCILayer    = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeOCILayerGz  = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeDockerList  = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	annotationRefName = "org.opencontainers.image.ref.name"
+)
+
+var digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// maxImportSize bounds image archives sent to the API.
+const maxImportSize = 8 << 30
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// dockerManifest is an entry of manifest.json in a `docker save` tarball
+type dockerManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// Image is an image known to the local store, identified by the digest of
+// its manifest.
+type Image struct {
+	Digest     string    `json:"digest"`
+	References []string  `json:"references"`
+	Config     string    `json:"config"`
+	Layers     []string  `json:"layers"`
+	Size       int64     `json:"size"`
+	ImportedAt time.Time `json:"importedAt"`
+}
+
+// ImageStore keeps image blobs by sha256 digest under blobs/sha256 and
+// the unpacked layers under snapshots, one directory per layer digest.
+type ImageStore struct {
+	root   string
+	mu     sync.RWMutex
+	images map[string]*Image
+	// imports counts the imports in progress. The blobs and snapshots
+	// they wrote are not in the index yet, so garbage is only collected
+	// once none is left.
+	imports int
+}
+
+var imageStore *ImageStore
+
+func openImageStore(root string) (*ImageStore, error) {
+	// Leftovers of imports the backend did not get to finish
+	os.RemoveAll(filepath.Join(root, "tmp"))
+	for _, dir := range []string{"blobs/sha256", "snapshots", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &ImageStore{root: root, images: make(map[string]*Image)}
+	data, err := os.ReadFile(s.indexPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var images []*Image
+	if err := json.Unmarshal(data, &images); err != nil {
+		return nil, fmt.Errorf("corrupt image index: %w", err)
+	}
+	for _, img := range images {
+		s.images[img.Digest] = img
+	}
+	return s, nil
+}
+
+func (s *ImageStore) indexPath() string {
+	return filepath.Join(s.root, "images.json")
+}
+
+func (s *ImageStore) blobPath(digest string) string {
+	return filepath.Join(s.root, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+func (s *ImageStore) snapshotPath(digest string) string {
+	return filepath.Join(s.root, "snapshots", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// saveIndex must be called with the write lock held.
+func (s *ImageStore) saveIndex() error {
+	images := make([]*Image, 0, len(s.images))
+	for _, img := range s.images {
+		images = append(images, img)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Digest < images[j].Digest })
+
+	data, err := json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.indexPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.indexPath())
+}
+
+// writeBlob stores content under its sha256 digest. Content that is
+// already present is not written twice.
+func (s *ImageStore) writeBlob(r io.Reader) (string, int64, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.root, "tmp"), "blob-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	digest := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if _, err := os.Stat(s.blobPath(digest)); err == nil {
+		return digest, size, nil
+	}
+	return digest, size, os.Rename(tmp.Name(), s.blobPath(digest))
+}
+
+// checkDigest refuses digests read from archives that are not sha256
+// digests, as the store builds paths from them.
+func checkDigest(digest string) error {
+	if !digestPattern.MatchString(digest) {
+		return fmt.Errorf("invalid digest %q", digest)
+	}
+	return nil
+}
+
+func (s *ImageStore) readJSONBlob(digest string, v interface{}) error {
+	if err := checkDigest(digest); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(s.blobPath(digest))
+	if err != nil {
+		return fmt.Errorf("missing blob %s", digest)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// List returns all images sorted by import time, newest first.
+func (s *ImageStore) List() []Image {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	images := make([]Image, 0, len(s.images))
+	for _, img := range s.images {
+		images = append(images, *img)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].ImportedAt.After(images[j].ImportedAt) })
+	return images
+}
+
+// Resolve finds an image by reference ("name:tag", "name" meaning
+// "name:latest") or by manifest digest.
+func (s *ImageStore) Resolve(ref string) (*Image, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if img, ok := s.images[normalizeDigest(ref)]; ok {
+		return img, true
+	}
+	ref = normalizeReference(ref)
+	for _, img := range s.images {
+		for _, r := range img.References {
+			if r == ref {
+				return img, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// LayerDirs returns the unpacked layers of an image, topmost first, as
+// expected by OverlayFS lowerdir.
+func (s *ImageStore) LayerDirs(img *Image) []string {
+	dirs := make([]string, len(img.Layers))
+	for i, layer := range img.Layers {
+		dirs[len(img.Layers)-1-i] = s.snapshotPath(layer)
+	}
+	return dirs
+}
+
+// Import reads an OCI image layout or `docker save` tarball. Every regular
+// file of the archive becomes a blob; the metadata files then tell which
+// blobs make up each image. When reference is set it tags the imported
+// image, overriding any names found in the archive. The store is only
+// locked to index the images, not while the archive is read.
+func (s *ImageStore) Import(r io.Reader, reference string) ([]Image, error) {
+	s.mu.Lock()
+	s.imports++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.imports--
+		s.collectGarbage()
+		s.mu.Unlock()
+	}()
+
+	files := make(map[string]string)
+	links := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid archive: %w", err)
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			digest, _, err := s.writeBlob(tr)
+			if err != nil {
+				return nil, err
+			}
+			if sum, ok := strings.CutPrefix(name, "blobs/sha256/"); ok && digest != "sha256:"+sum {
+				return nil, fmt.Errorf("blob %s does not match its digest", name)
+			}
+			files[name] = digest
+		case tar.TypeSymlink:
+			// Older `docker save` output links duplicate layers together
+			links[name] = path.Join(path.Dir(name), hdr.Linkname)
+		}
+	}
+	for name, target := range links {
+		if digest, ok := files[target]; ok {
+			files[name] = digest
+		}
+	}
+
+	var imported []*Image
+	var err error
+	if digest, ok := files["index.json"]; ok {
+		imported, err = s.importOCILayout(files, digest)
+	} else if digest, ok := files["manifest.json"]; ok {
+		imported, err = s.importDockerSave(files, digest)
+	} else {
+		err = errors.New("archive is neither an OCI image layout nor a docker save tarball")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(imported) == 0 {
+		return nil, errors.New("archive contains no images")
+	}
+
+	for _, img := range imported {
+		if reference != "" {
+			img.References = []string{normalizeReference(reference)}
+		}
+		if err := s.unpackImage(img); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]Image, 0, len(imported))
+	for _, img := range imported {
+		s.addImage(img)
+		result = append(result, *img)
+	}
+	return result, s.saveIndex()
+}
+
+func (s *ImageStore) importOCILayout(files map[string]string, indexDigest string) ([]*Image, error) {
+	var index ociIndex
+	if err := s.readJSONBlob(indexDigest, &index); err != nil {
+		return nil, fmt.Errorf("invalid index.json: %w", err)
+	}
+
+	var images []*Image
+	for _, desc := range index.Manifests {
+		if err := checkDigest(desc.Digest); err != nil {
+			return nil, err
+		}
+		if _, ok := files[path.Join("blobs", "sha256", strings.TrimPrefix(desc.Digest, "sha256:"))]; !ok {
+			return nil, fmt.Errorf("manifest %s is missing from the archive", desc.Digest)
+		}
+		manifestDigest, err := s.selectManifest(desc)
+		if err != nil {
+			return nil, err
+		}
+		img, err := s.imageFromManifest(manifestDigest)
+		if err != nil {
+			return nil, err
+		}
+		if name := desc.Annotations[annotationRefName]; name != "" {
+			img.References = append(img.References, normalizeReference(name))
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// selectManifest descends into nested indexes, picking the manifest for
+// the platform the backend runs on.
+func (s *ImageStore) selectManifest(desc ociDescriptor) (string, error) {
+	if err := checkDigest(desc.Digest); err != nil {
+		return "", err
+	}
+	if desc.MediaType != mediaTypeOCIIndex && desc.MediaType != mediaTypeDockerList {
+		return desc.Digest, nil
+	}
+	var index ociIndex
+	if err := s.readJSONBlob(desc.Digest, &index); err != nil {
+		return "", err
+	}
+	for _, m := range index.Manifests {
+		if m.Platform == nil || (m.Platform.OS == runtime.GOOS && m.Platform.Architecture == runtime.GOARCH) {
+			return s.selectManifest(m)
+		}
+	}
+	return "", fmt.Errorf("image index %s has no manifest for %s/%s", desc.Digest, runtime.GOOS, runtime.GOARCH)
+}
+
+func (s *ImageStore) imageFromManifest(digest string) (*Image, error) {
+	var manifest ociManifest
+	if err := s.readJSONBlob(digest, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", digest, err)
+	}
+
+	if err := checkDigest(manifest.Config.Digest); err != nil {
+		return nil, fmt.Errorf("invalid config of manifest %s: %w", digest, err)
+	}
+	img := &Image{Digest: digest, Config: manifest.Config.Digest}
+	for _, layer := range manifest.Layers {
+		if err := checkDigest(layer.Digest); err != nil {
+			return nil, fmt.Errorf("invalid layer of manifest %s: %w", digest, err)
+		}
+		if _, err := os.Stat(s.blobPath(layer.Digest)); err != nil {
+			return nil, fmt.Errorf("layer %s is missing", layer.Digest)
+		}
+		img.Layers = append(img.Layers, layer.Digest)
+		img.Size += layer.Size
+	}
+	return img, nil
+}
+
+// importDockerSave converts the entries of a `docker save` manifest.json
+// into OCI manifests.
+func (s *ImageStore) importDockerSave(files map[string]string, manifestDigest string) ([]*Image, error) {
+	var entries []dockerManifest
+	if err := s.readJSONBlob(manifestDigest, &entries); err != nil {
+		return nil, fmt.Errorf("invalid manifest.json: %w", err)
+	}
+
+	var images []*Image
+	for _, entry := range entries {
+		configDigest, ok := files[path.Clean(entry.Config)]
+		if !ok {
+			return nil, fmt.Errorf("config %s is missing from the archive", entry.Config)
+		}
+		configInfo, err := os.Stat(s.blobPath(configDigest))
+		if err != nil {
+			return nil, err
+		}
+
+		manifest := ociManifest{
+			SchemaVersion: 2,
+			MediaType:     mediaTypeOCIManifest,
+			Config:        ociDescriptor{MediaType: mediaTypeOCIConfig, Digest: configDigest, Size: configInfo.Size()},
+		}
+		for _, name := range entry.Layers {
+			layerDigest, ok := files[path.Clean(name)]
+			if !ok {
+				return nil, fmt.Errorf("layer %s is missing from the archive", name)
+			}
+			desc, err := s.layerDescriptor(layerDigest)
+			if err != nil {
+				return nil, err
+			}
+			manifest.Layers = append(manifest.Layers, desc)
+		}
+
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			return nil, err
+		}
+		digest, _, err := s.writeBlob(strings.NewReader(string(data)))
+		if err != nil {
+			return nil, err
+		}
+		img, err := s.imageFromManifest(digest)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range entry.RepoTags {
+			img.References = append(img.References, normalizeReference(tag))
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+func (s *ImageStore) layerDescriptor(digest string) (ociDescriptor, error) {
+	f, err := os.Open(s.blobPath(digest))
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	magic := make([]byte, 2)
+	io.ReadFull(f, magic)
+
+	mediaType := mediaTypeOCILayer
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		mediaType = mediaTypeOCILayerGz
+	}
+	return ociDescriptor{MediaType: mediaType, Digest: digest, Size: fi.Size()}, nil
+}
+
+// unpackImage extracts every layer of img that has not been unpacked by
+// a previous import. Layers are unpacked below tmp, so imports unpacking
+// the same layer at once do not get in each other's way.
+func (s *ImageStore) unpackImage(img *Image) error {
+	for _, layer := range img.Layers {
+		dir := s.snapshotPath(layer)
+		if _, err := os.Stat(dir); err == nil {
+			continue
+		}
+
+		f, err := os.Open(s.blobPath(layer))
+		if err != nil {
+			return err
+		}
+		tmp, err := os.MkdirTemp(filepath.Join(s.root, "tmp"), "layer-")
+		if err != nil {
+			f.Close()
+			return err
+		}
+		os.Chmod(tmp, 0755)
+		err = unpackLayer(f, tmp)
+		f.Close()
+		if err != nil {
+			os.RemoveAll(tmp)
+			return fmt.Errorf("failed to unpack layer %s: %w", layer, err)
+		}
+		if err := os.Rename(tmp, dir); err != nil {
+			os.RemoveAll(tmp)
+			// Another import got there first
+			if _, statErr := os.Stat(dir); statErr == nil {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// addImage registers img, moving its references away from any image that
+// held them before. Must be called with the write lock held.
+func (s *ImageStore) addImage(img *Image) {
+	for _, other := range s.images {
+		var kept []string
+		for _, ref := range other.References {
+			if !containsString(img.References, ref) {
+				kept = append(kept, ref)
+			}
+		}
+		other.References = kept
+	}
+	if existing, ok := s.images[img.Digest]; ok {
+		for _, ref := range existing.References {
+			if !containsString(img.References, ref) {
+				img.References = append(img.References, ref)
+			}
+		}
+	}
+	img.ImportedAt = time.Now()
+	s.images[img.Digest] = img
+}
+
+// Delete removes an image and every blob and snapshot no other image uses.
+func (s *ImageStore) Delete(digest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.images[digest]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.images, digest)
+	if err := s.saveIndex(); err != nil {
+		return err
+	}
+	s.collectGarbage()
+	return nil
+}
+
+// collectGarbage removes unreferenced blobs and snapshots unless an
+// import is in progress. Must be called with the write lock held.
+func (s *ImageStore) collectGarbage() {
+	if s.imports > 0 {
+		return
+	}
+	used := make(map[string]bool)
+	for _, img := range s.images {
+		used[strings.TrimPrefix(img.Digest, "sha256:")] = true
+		used[strings.TrimPrefix(img.Config, "sha256:")] = true
+		for _, layer := range img.Layers {
+			used[strings.TrimPrefix(layer, "sha256:")] = true
+		}
+	}
+
+	for _, dir := range []string{filepath.Join(s.root, "blobs", "sha256"), filepath.Join(s.root, "snapshots")} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !used[entry.Name()] {
+				if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+					log.Printf("Failed to remove unused image data %s: %v", entry.Name(), err)
+				}
+			}
+		}
+	}
+}
+
+func normalizeReference(ref string) string {
+	name := ref
+	if i := strings.LastIndex(ref, "/"); i >= 0 {
+		name = ref[i+1:]
+	}
+	if !strings.Contains(name, ":") && !strings.Contains(name, "@") {
+		return ref + ":latest"
+	}
+	return ref
+}
+
+func normalizeDigest(digest string) string {
+	if !strings.HasPrefix(digest, "sha256:") {
+		digest = "sha256:" + digest
+	}
+	return digest
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// imageUseMu keeps containers from starting to use an image while it is
+// being deleted. imagesInCreation counts the containers being created
+// from each image, which are not in containers yet.
+var (
+	imageUseMu       sync.Mutex
+	imagesInCreation = make(map[string]int)
+)
+
+// reserveImage keeps the image from being deleted until releaseImage. It
+// fails if the image is already gone.
+func reserveImage(digest string) bool {
+	imageUseMu.Lock()
+	defer imageUseMu.Unlock()
+	if _, ok := imageStore.Resolve(digest); !ok {
+		return false
+	}
+	imagesInCreation[digest]++
+	return true
+}
+
+func releaseImage(digest string) {
+	imageUseMu.Lock()
+	defer imageUseMu.Unlock()
+	if imagesInCreation[digest]--; imagesInCreation[digest] <= 0 {
+		delete(imagesInCreation, digest)
+	}
+}
+
+// imageInUse must be called with imageUseMu held.
+func imageInUse(digest string) bool {
+	if imagesInCreation[digest] > 0 {
+		return true
+	}
+
+	containersMux.RLock()
+	defer containersMux.RUnlock()
+	for _, info := range containers {
+		if info.ImageDigest == digest {
+			return true
+		}
+	}
+	return false
+}
+
+func getImages(c echo.Context) error {
+	return c.JSON(http.StatusOK, imageStore.List())
+}
+
+var errImportTooLarge = apiError(http.StatusRequestEntityTooLarge, codePayloadTooLarge,
+	fmt.Sprintf("Image archive exceeds %d GiB", maxImportSize>>30))
+
+// importImage accepts the tarball either as the raw request body or as
+// the "file" field of a multipart form.
+func importImage(c echo.Context) error {
+	req := c.Request()
+	req.Body = http.MaxBytesReader(c.Response(), req.Body, maxImportSize)
+	var body io.Reader = req.Body
+	var tooLarge *http.MaxBytesError
+	if strings.HasPrefix(req.Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		fh, err := c.FormFile("file")
+		if errors.As(err, &tooLarge) {
+			return errImportTooLarge
+		}
+		if err != nil {
+			return invalidField("file", "is required")
+		}
+		f, err := fh.Open()
+		if err != nil {
+			return apiError(http.StatusBadRequest, codeInvalidRequest, "Failed to read image archive")
+		}
+		defer f.Close()
+		body = f
+	}
+
+	images, err := imageStore.Import(body, c.QueryParam("reference"))
+	if errors.As(err, &tooLarge) {
+		return errImportTooLarge
+	}
+	if err != nil {
+		return apiError(http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Failed to import image: %v", err))
+	}
+	return c.JSON(http.StatusCreated, images)
+}
+
+func deleteImage(c echo.Context) error {
+	digest := normalizeDigest(c.Param("digest"))
+	if !digestPattern.MatchString(digest) {
+		return invalidField("digest", "must be a sha256 digest")
+	}
+
+	imageUseMu.Lock()
+	defer imageUseMu.Unlock()
+	if imageInUse(digest) {
+		return apiError(http.StatusConflict, codeImageInUse, "Image is used by a container")
+	}
+	if imageInCheckpoint(digest) {
+		return apiError(http.StatusConflict, codeImageInUse, "Image is used by a checkpoint")
+	}
+	if imageInTemplate(digest) {
+		return apiError(http.StatusConflict, codeImageInUse, "Image is used by a section template")
+	}
+
+	if err := imageStore.Delete(digest); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return apiError(http.StatusNotFound, codeImageNotFound, "Image not found")
+		}
+		return internalError("Failed to delete image: %v", err)
+	}
+
+	return c.JSON(http.StatusOK, StatusMessage{Message: "Image " + digest + " deleted"})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckDigest(t *testing.T) {
+	valid := "sha256:" + strings.Repeat("ab", 32)
+	tests := []struct {
+		digest string
+		ok     bool
+	}{
+		{valid, true},
+		{strings.ToUpper(valid), false},
+		{strings.TrimPrefix(valid, "sha256:"), false},
+		{valid[:len(valid)-1], false},
+		{valid + "0", false},
+		{"sha512:" + strings.Repeat("ab", 64), false},
+		{"sha256:../../../../..", false},
+		{"sha256:" + strings.Repeat("ab", 31) + "/.", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if err := checkDigest(tt.digest); (err == nil) != tt.ok {
+			t.Errorf("checkDigest(%q) = %v, want ok %v", tt.digest, err, tt.ok)
+		}
+	}
+}
+
+func TestNormalizeReference(t *testing.T) {
+	tests := []struct {
+		ref, want string
+	}{
+		{"alpine", "alpine:latest"},
+		{"alpine:3.20", "alpine:3.20"},
+		{"library/alpine", "library/alpine:latest"},
+		{"registry.example.com:5000/alpine", "registry.example.com:5000/alpine:latest"},
+		{"registry.example.com:5000/alpine:edge", "registry.example.com:5000/alpine:edge"},
+		{"alpine@sha256:" + strings.Repeat("ab", 32), "alpine@sha256:" + strings.Repeat("ab", 32)},
+	}
+	for _, tt := range tests {
+		if got := normalizeReference(tt.ref); got != tt.want {
+			t.Errorf("normalizeReference(%q) = %q, want %q", tt.ref, got, tt.want)
+		}
+	}
+}
+
+// testLayout builds OCI image layouts for import.
+type testLayout struct {
+	files map[string][]byte
+}
+
+func newTestLayout() *testLayout {
+	return &testLayout{files: make(map[string][]byte)}
+}
+
+// blob adds data to the layout and returns its descriptor.
+func (l *testLayout) blob(mediaType string, data []byte) ociDescriptor {
+	sum := sha256.Sum256(data)
+	l.files["blobs/sha256/"+hex.EncodeToString(sum[:])] = data
+	return ociDescriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(data))}
+}
+
+func (l *testLayout) jsonBlob(t *testing.T, mediaType string, v interface{}) ociDescriptor {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l.blob(mediaType, data)
+}
+
+func (l *testLayout) index(t *testing.T, manifests ...ociDescriptor) {
+	data, err := json.Marshal(ociIndex{SchemaVersion: 2, Manifests: manifests})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.files["index.json"] = data
+}
+
+func (l *testLayout) tarball(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, data := range l.files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// testLayer is a layer holding a single file.
+func testLayer(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	content := []byte("hello\n")
+	if err := tw.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(content)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImportValidatesDigests(t *testing.T) {
+	traversal := "sha256:../../../../.."
+	tests := []struct {
+		name string
+		// modify breaks the descriptors of an otherwise valid image
+		modify  func(manifest, config *ociDescriptor, layers []ociDescriptor)
+		wantErr bool
+	}{
+		{
+			name:   "valid",
+			modify: func(manifest, config *ociDescriptor, layers []ociDescriptor) {},
+		},
+		{
+			name:    "layer",
+			modify:  func(manifest, config *ociDescriptor, layers []ociDescriptor) { layers[0].Digest = traversal },
+			wantErr: true,
+		},
+		{
+			name:    "config",
+			modify:  func(manifest, config *ociDescriptor, layers []ociDescriptor) { config.Digest = traversal },
+			wantErr: true,
+		},
+		{
+			name:    "manifest",
+			modify:  func(manifest, config *ociDescriptor, layers []ociDescriptor) { manifest.Digest = traversal },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := openImageStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			layout := newTestLayout()
+			config := layout.blob(mediaTypeOCIConfig, []byte("{}"))
+			layers := []ociDescriptor{layout.blob(mediaTypeOCILayer, testLayer(t))}
+			var manifest ociDescriptor
+			tt.modify(&manifest, &config, layers)
+			broken := manifest.Digest
+			manifest = layout.jsonBlob(t, mediaTypeOCIManifest, ociManifest{
+				SchemaVersion: 2,
+				MediaType:     mediaTypeOCIManifest,
+				Config:        config,
+				Layers:        layers,
+			})
+			if broken != "" {
+				manifest.Digest = broken
+			}
+			manifest.Annotations = map[string]string{annotationRefName: "test:1"}
+			layout.index(t, manifest)
+
+			images, err := store.Import(layout.tarball(t), "")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Import succeeded, want an error")
+				}
+				if len(store.List()) != 0 {
+					t.Errorf("failed import left images in the store")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Import: %v", err)
+			}
+			if len(images) != 1 || images[0].References[0] != "test:1" {
+				t.Fatalf("Import = %+v, want the image test:1", images)
+			}
+			data, err := os.ReadFile(filepath.Join(store.LayerDirs(&images[0])[0], "hello.txt"))
+			if err != nil || string(data) != "hello\n" {
+				t.Errorf("layer not unpacked: %q, %v", data, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// initExitFdEnv names the descriptor on which the init (or the attach
+// client standing in for it) reports the exit code of the container's
+// main process.
+const initExitFdEnv = "_LCW_EXIT_FD"
+
+// reportExit makes cmd write its main process' exit code to w. The
+// caller closes w once cmd has started.
+func reportExit(cmd *exec.Cmd, w *os.File) {
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", initExitFdEnv, 2+len(cmd.ExtraFiles)))
+}
+
+// readExitCode waits for the exit code reported on r. It fails if the
+// reporting process died before writing one.
+func readExitCode(r io.Reader) (int, bool) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, false
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	return code, err == nil
+}
+
+// writeExitCode reports code on the descriptor named in initExitFdEnv,
+// if there is one.
+func writeExitCode(code int) {
+	fd, err := strconv.Atoi(os.Getenv(initExitFdEnv))
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "exit")
+	fmt.Fprintf(f, "%d", code)
+	f.Close()
+}
+
+// runContainerInit is the entry point of a container's PID 1. It sets up
+// the container's root filesystem, starts the container setup as its
+// only child, forwards signals to the child's process group and reaps
+// every process that gets reparented to it. When the main process exits
+// the init exits with its code, which takes down the PID namespace.
+func runContainerInit() {
+	runtime.LockOSThread()
+
+	setup := readContainerSetup("container init")
+
+	// Joined while the host's cgroup hierarchy is still mounted, and
+	// before anything is forked that would escape it
+	if setup.Cgroup != "" {
+		cg := &cgroup{Path: setup.Cgroup}
+		if err := cg.addProcess(0); err != nil {
+			log.Fatalf("container init: %v", err)
+		}
+	}
+
+	// Joined first so the fresh /sys reflects the container's interfaces
+	if setup.Netns != "" {
+		if err := joinNetns(setup.Netns); err != nil {
+			log.Fatalf("container init: %v", err)
+		}
+	}
+	if err := setupRootfs(setup.Rootfs); err != nil {
+		log.Fatalf("container init: %v", err)
+	}
+	if err := syscall.Sethostname([]byte(setup.Hostname)); err != nil {
+		log.Fatalf("container init: failed to set hostname: %v", err)
+	}
+
+	// The terminal can only be the controlling terminal of one session.
+	// Giving it up hangs up our own process group, so ignore that.
+	_, ttyErr := unix.IoctlGetTermios(0, unix.TCGETS)
+	tty := ttyErr == nil
+	if tty {
+		signal.Ignore(syscall.SIGHUP)
+		unix.IoctlSetInt(0, unix.TIOCNOTTY, 0)
+	}
+
+	// Subscribed before the child exists so its SIGCHLD is not missed
+	signals := make(chan os.Signal, 64)
+	signal.Notify(signals)
+
+	child, err := os.StartProcess("/proc/self/exe", []string{os.Args[0], containerSetupCommand}, &os.ProcAttr{
+		Env:   []string{containerSetupEnv + "=" + os.Getenv(containerSetupEnv)},
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+		Sys: &syscall.SysProcAttr{
+			Setsid:  tty,
+			Setctty: tty,
+			Setpgid: !tty,
+		},
+	})
+	if err != nil {
+		log.Fatalf("container init: %v", err)
+	}
+
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGCHLD:
+			if status, exited := reap(child.Pid); exited {
+				code := status.ExitStatus()
+				if status.Signaled() {
+					code = 128 + int(status.Signal())
+				}
+				writeExitCode(code)
+				os.Exit(code)
+			}
+		case syscall.SIGURG:
+			// Used by the Go runtime for preemption
+		default:
+			syscall.Kill(-child.Pid, sig.(syscall.Signal))
+		}
+	}
+}
+
+// reap collects every exited child, reporting whether main was one of them.
+func reap(main int) (status syscall.WaitStatus, exited bool) {
+	for {
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if pid <= 0 || err != nil {
+			return status, exited
+		}
+		if pid == main {
+			status, exited = ws, true
+		}
+	}
+}
+
+// addProcess tracks a running process of the container so deleting the
+// container can stop it.
+func (info *ContainerInfo) addProcess(cmd *exec.Cmd) {
+	info.processMu.Lock()
+	defer info.processMu.Unlock()
+	if info.processes == nil {
+		info.processes = make(map[*exec.Cmd]chan struct{})
+	}
+	info.processes[cmd] = make(chan struct{})
+	info.Status = "running"
+}
+
+// removeProcess is called once cmd has been waited for and exited with
+// code. The container counts as exited once its last process has.
+func (info *ContainerInfo) removeProcess(cmd *exec.Cmd, code int) {
+	info.processMu.Lock()
+	defer info.processMu.Unlock()
+	done, ok := info.processes[cmd]
+	if !ok {
+		return
+	}
+	// Emitted before done is closed, which lets a deletion go ahead
+	emitEvent(info, eventDied, map[string]string{"pid": strconv.Itoa(cmd.Process.Pid), "exitCode": strconv.Itoa(code)})
+	close(done)
+	delete(info.processes, cmd)
+	if len(info.processes) == 0 {
+		info.Status = "exited"
+	}
+}
+
+// status is the container's tracked status.
+func (info *ContainerInfo) status() string {
+	info.processMu.Lock()
+	defer info.processMu.Unlock()
+	return info.Status
+}
+
+// stopProcesses sends SIGTERM to the container's processes, which their
+// inits forward, and kills whatever is left after timeouts.stopGrace.
+func (info *ContainerInfo) stopProcesses() {
+	info.processMu.Lock()
+	running := make(map[*exec.Cmd]chan struct{}, len(info.processes))
+	for cmd, done := range info.processes {
+		running[cmd] = done
+		cmd.Process.Signal(syscall.SIGTERM)
+	}
+	info.processMu.Unlock()
+
+	deadline := time.NewTimer(config.Timeouts.StopGrace)
+	defer deadline.Stop()
+	expired := false
+	for cmd, done := range running {
+		if !expired {
+			select {
+			case <-done:
+				continue
+			case <-deadline.C:
+				expired = true
+			}
+		}
+		cmd.Process.Kill()
+		<-done
+	}
+}
+
+// containerProcess is a tracked process started in a container.
+type containerProcess struct {
+	info *ContainerInfo
+	cmd  *exec.Cmd
+	exit *os.File
+}
+
+// startContainerProcess starts cmd through start, which lets callers
+// attach a pty, and tracks it until it is waited for.
+func startContainerProcess(info *ContainerInfo, cmd *exec.Cmd, start func() error) (*containerProcess, error) {
+	p := &containerProcess{info: info, cmd: cmd}
+
+	// Only containers with an init report exit codes
+	var exitW *os.File
+	if info.isolated() {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		reportExit(cmd, w)
+		p.exit, exitW = r, w
+	}
+
+	err := start()
+	if exitW != nil {
+		exitW.Close()
+	}
+	if err != nil {
+		if p.exit != nil {
+			p.exit.Close()
+		}
+		return nil, err
+	}
+	info.addProcess(cmd)
+	return p, nil
+}
+
+// wait returns the exit code of the container's main process, as
+// reported by its init or, failing that, taken from cmd's own status.
+func (p *containerProcess) wait() int {
+	code, reported := 0, false
+	if p.exit != nil {
+		code, reported = readExitCode(p.exit)
+		p.exit.Close()
+	}
+	p.cmd.Wait()
+	if !reported {
+		code = exitCode(p.cmd.ProcessState)
+	}
+	p.info.removeProcess(p.cmd, code)
+	return code
+}
+
+// exitCode reports signals the way shells do, as 128 + the signal number.
+func exitCode(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
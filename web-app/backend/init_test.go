@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestReadExitCode(t *testing.T) {
+	tests := []struct {
+		data     string
+		wantCode int
+		wantOK   bool
+	}{
+		{"0", 0, true},
+		{"137", 137, true},
+		{" 3\n", 3, true},
+		{"", 0, false},
+		{"exited", 0, false},
+	}
+	for _, tt := range tests {
+		code, ok := readExitCode(strings.NewReader(tt.data))
+		if code != tt.wantCode || ok != tt.wantOK {
+			t.Errorf("readExitCode(%q) = %d, %v, want %d, %v", tt.data, code, ok, tt.wantCode, tt.wantOK)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		script string
+		want   int
+	}{
+		{"exit 0", 0},
+		{"exit 3", 3},
+		{"kill -TERM $$", 128 + 15},
+		{"kill -KILL $$", 128 + 9},
+	}
+	for _, tt := range tests {
+		cmd := exec.Command("/bin/sh", "-c", tt.script)
+		cmd.Run()
+		if got := exitCode(cmd.ProcessState); got != tt.want {
+			t.Errorf("exit code of %q = %d, want %d", tt.script, got, tt.want)
+		}
+	}
+}
+
+func TestReportExit(t *testing.T) {
+	tests := []struct {
+		script   string
+		wantCode int
+		wantOK   bool
+	}{
+		{`printf 42 >&$` + initExitFdEnv + `; exit 1`, 42, true},
+		{`kill -KILL $$`, 0, false},
+	}
+	for _, tt := range tests {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("/bin/sh", "-c", tt.script)
+		reportExit(cmd, w)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		code, ok := readExitCode(r)
+		r.Close()
+		cmd.Wait()
+		if code != tt.wantCode || ok != tt.wantOK {
+			t.Errorf("exit code reported by %q = %d, %v, want %d, %v", tt.script, code, ok, tt.wantCode, tt.wantOK)
+		}
+	}
+}
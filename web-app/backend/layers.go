@@ -0,0 +1,308 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Whiteout markers used by OCI layers to record deletions
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// opaqueXattr is the attribute marking opaque directories. Overlay mounts
+// made in a user namespace only honour the user.* namespace, which is
+// also the only one unprivileged users may set.
+func opaqueXattr() string {
+	if os.Geteuid() != 0 {
+		return "user.overlay.opaque"
+	}
+	return "trusted.overlay.opaque"
+}
+
+// unpackLayer extracts a layer tarball into dir, converting OCI whiteouts
+// into their OverlayFS equivalents (0:0 character devices and the opaque
+// xattr) so the directory can be stacked as an overlay lower layer.
+func unpackLayer(r io.Reader, dir string) error {
+	layer, err := decompress(r)
+	if err != nil {
+		return err
+	}
+
+	var dirs []*tar.Header
+	tr := tar.NewReader(layer)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(hdr.Name)
+		if !filepath.IsLocal(name) {
+			if name == "." {
+				continue
+			}
+			return fmt.Errorf("layer entry %q escapes the layer root", hdr.Name)
+		}
+		parent, base := filepath.Split(name)
+		parentPath, err := securePath(dir, parent)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(parentPath, 0755); err != nil {
+			return err
+		}
+		path := filepath.Join(parentPath, base)
+
+		if base == whiteoutOpaque {
+			if err := syscall.Setxattr(parentPath, opaqueXattr(), []byte("y"), 0); err != nil {
+				return fmt.Errorf("failed to mark %s opaque: %w", parent, err)
+			}
+			continue
+		}
+		if hidden, ok := strings.CutPrefix(base, whiteoutPrefix); ok {
+			if err := syscall.Mknod(filepath.Join(parentPath, hidden), syscall.S_IFCHR, 0); err != nil {
+				return fmt.Errorf("failed to create whiteout for %s: %w", hidden, err)
+			}
+			continue
+		}
+
+		// Later entries replace earlier ones, except directories which merge
+		if fi, err := os.Lstat(path); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+
+		if err := extractEntry(tr, hdr, dir, path); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+		}
+	}
+
+	// Directory times are restored last, since extracting their
+	// children modifies them
+	for _, hdr := range dirs {
+		path := filepath.Join(dir, filepath.Clean(hdr.Name))
+		os.Chtimes(path, hdr.AccessTime, hdr.ModTime)
+	}
+	return nil
+}
+
+func extractEntry(tr *tar.Reader, hdr *tar.Header, root, path string) error {
+	mode := hdr.FileInfo().Mode()
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(path, mode.Perm()); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		target, err := securePath(root, filepath.Clean(hdr.Linkname))
+		if err != nil {
+			return err
+		}
+		if err := os.Link(target, path); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devMode := uint32(mode.Perm())
+		switch hdr.Typeflag {
+		case tar.TypeChar:
+			devMode |= syscall.S_IFCHR
+		case tar.TypeBlock:
+			devMode |= syscall.S_IFBLK
+		default:
+			devMode |= syscall.S_IFIFO
+		}
+		dev := int((hdr.Devmajor << 8) | (hdr.Devminor & 0xff) | ((hdr.Devminor &^ 0xff) << 12))
+		if err := syscall.Mknod(path, devMode, dev); err != nil {
+			return err
+		}
+	default:
+		// Other entry types carry no filesystem content
+		return nil
+	}
+
+	if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil && !errors.Is(err, syscall.EPERM) {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		// chown clears setuid/setgid bits, so the mode is applied afterwards
+		if err := os.Chmod(path, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+		os.Chtimes(path, hdr.AccessTime, hdr.ModTime)
+	}
+	return nil
+}
+
+// securePath resolves name inside root, refusing to follow symlinks that
+// an earlier archive entry could have planted to escape root.
+func securePath(root, name string) (string, error) {
+	path := root
+	for _, part := range strings.Split(filepath.Clean(name), string(filepath.Separator)) {
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			return "", fmt.Errorf("path %q escapes %s", name, root)
+		}
+		path = filepath.Join(path, part)
+		fi, err := os.Lstat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("path %q traverses a symlink", name)
+		}
+	}
+	return path, nil
+}
+
+// packLayer writes dir, an overlay upper directory, as an OCI layer
+// tarball. OverlayFS whiteouts and opaque directories become OCI
+// whiteout entries again, so unpackLayer restores the same directory.
+// Paths in exclude, relative to dir, are left out of the layer.
+func packLayer(w io.Writer, dir string, exclude ...string) error {
+	tw := tar.NewWriter(w)
+	links := make(map[[2]uint64]string)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if containsString(exclude, name) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		st, _ := fi.Sys().(*syscall.Stat_t)
+
+		if fi.Mode()&os.ModeCharDevice != 0 && st != nil && st.Rdev == 0 {
+			parent, base := filepath.Split(name)
+			return tw.WriteHeader(&tar.Header{
+				Name:     parent + whiteoutPrefix + base,
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+				ModTime:  fi.ModTime(),
+			})
+		}
+
+		var target string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if target, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, target)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.Format = tar.FormatPAX
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if fi.Mode().IsRegular() && st != nil && st.Nlink > 1 {
+			key := [2]uint64{uint64(st.Dev), st.Ino}
+			if first, ok := links[key]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				links[key] = name
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			f.Close()
+			return err
+		}
+		if fi.IsDir() {
+			value := make([]byte, 1)
+			if n, err := syscall.Getxattr(path, opaqueXattr(), value); err == nil && n == 1 && value[0] == 'y' {
+				return tw.WriteHeader(&tar.Header{
+					Name:     name + "/" + whiteoutOpaque,
+					Typeflag: tar.TypeReg,
+					Mode:     0644,
+					ModTime:  fi.ModTime(),
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// decompress transparently handles gzip compressed layers.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return nil, errors.New("zstd compressed layers are not supported")
+	}
+	return br, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSecurePath(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		// want is relative to the root, empty when an error is expected
+		want string
+	}{
+		{name: "root", path: "", want: "."},
+		{name: "nested", path: "a/b/c", want: "a/b/c"},
+		{name: "absolute", path: "/a/b", want: "a/b"},
+		{name: "existing directory", path: "dir/file", want: "dir/file"},
+		{name: "dot dot", path: "../etc/passwd"},
+		{name: "dot dot after cleaning", path: "a/../../etc/passwd"},
+		{name: "symlinked directory", path: "link/file"},
+		{name: "symlink", path: "link"},
+	}
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := securePath(root, tt.path)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("securePath(%q) = %s, want an error", tt.path, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("securePath(%q): %v", tt.path, err)
+			}
+			if want := filepath.Join(root, tt.want); got != want {
+				t.Errorf("securePath(%q) = %s, want %s", tt.path, got, want)
+			}
+		})
+	}
+}
+
+// tarEntry is an entry of a layer built by buildLayer.
+type tarEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+}
+
+func buildLayer(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644, Size: int64(len(e.content))}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func isWhiteout(path string) bool {
+	var st syscall.Stat_t
+	return syscall.Lstat(path, &st) == nil && st.Mode&syscall.S_IFMT == syscall.S_IFCHR && st.Rdev == 0
+}
+
+func TestUnpackLayer(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("whiteouts are device nodes, which need root")
+	}
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		wantErr bool
+		check   func(t *testing.T, dir string)
+	}{
+		{
+			name: "whiteout",
+			entries: []tarEntry{
+				{name: "etc/", typeflag: tar.TypeDir},
+				{name: "etc/.wh.motd", typeflag: tar.TypeReg},
+			},
+			check: func(t *testing.T, dir string) {
+				if !isWhiteout(filepath.Join(dir, "etc/motd")) {
+					t.Errorf("etc/motd is no whiteout device")
+				}
+				if _, err := os.Lstat(filepath.Join(dir, "etc/.wh.motd")); !os.IsNotExist(err) {
+					t.Errorf("whiteout marker was extracted")
+				}
+			},
+		},
+		{
+			name: "whiteout in a missing directory",
+			entries: []tarEntry{
+				{name: "var/lib/.wh.apt", typeflag: tar.TypeReg},
+			},
+			check: func(t *testing.T, dir string) {
+				if !isWhiteout(filepath.Join(dir, "var/lib/apt")) {
+					t.Errorf("var/lib/apt is no whiteout device")
+				}
+			},
+		},
+		{
+			name: "opaque directory",
+			entries: []tarEntry{
+				{name: "srv/", typeflag: tar.TypeDir},
+				{name: "srv/.wh..wh..opq", typeflag: tar.TypeReg},
+				{name: "srv/index.html", typeflag: tar.TypeReg, content: "hi"},
+			},
+			check: func(t *testing.T, dir string) {
+				if !isOpaque(filepath.Join(dir, "srv")) {
+					t.Errorf("srv is not marked opaque")
+				}
+				if _, err := os.Lstat(filepath.Join(dir, "srv/.wh..wh..opq")); !os.IsNotExist(err) {
+					t.Errorf("opaque marker was extracted")
+				}
+				if data, err := os.ReadFile(filepath.Join(dir, "srv/index.html")); err != nil || string(data) != "hi" {
+					t.Errorf("srv/index.html = %q, %v", data, err)
+				}
+			},
+		},
+		{
+			name: "later entries replace earlier ones",
+			entries: []tarEntry{
+				{name: "file", typeflag: tar.TypeReg, content: "old"},
+				{name: "file", typeflag: tar.TypeSymlink, linkname: "other"},
+			},
+			check: func(t *testing.T, dir string) {
+				if target, err := os.Readlink(filepath.Join(dir, "file")); err != nil || target != "other" {
+					t.Errorf("file = %q, %v, want a symlink to other", target, err)
+				}
+			},
+		},
+		{
+			name:    "entry outside the root",
+			entries: []tarEntry{{name: "../escape", typeflag: tar.TypeReg}},
+			wantErr: true,
+		},
+		{
+			name: "entry through a symlink",
+			entries: []tarEntry{
+				{name: "etc", typeflag: tar.TypeSymlink, linkname: "/etc"},
+				{name: "etc/escape", typeflag: tar.TypeReg},
+			},
+			wantErr: true,
+		},
+		{
+			name: "whiteout through a symlink",
+			entries: []tarEntry{
+				{name: "etc", typeflag: tar.TypeSymlink, linkname: "/etc"},
+				{name: "etc/.wh.passwd", typeflag: tar.TypeReg},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "hard link outside the root",
+			entries: []tarEntry{{name: "passwd", typeflag: tar.TypeLink, linkname: "../../../../etc/passwd"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := unpackLayer(buildLayer(t, tt.entries), dir)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("unpackLayer succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unpackLayer: %v", err)
+			}
+			tt.check(t, dir)
+		})
+	}
+}
+
+func TestPackLayer(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("whiteouts are device nodes, which need root")
+	}
+	upper := t.TempDir()
+	for _, dir := range []string{"etc", "srv/www"} {
+		if err := os.MkdirAll(filepath.Join(upper, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range map[string]string{
+		"etc/hosts":          "127.0.0.1 localhost\n",
+		"etc/resolv.conf":    "nameserver 10.88.0.1\n",
+		"etc/motd":           "welcome\n",
+		"srv/www/index.html": "hi\n",
+	} {
+		if err := os.WriteFile(filepath.Join(upper, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(upper, "etc/motd"), filepath.Join(upper, "etc/issue")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mknod(filepath.Join(upper, "etc/shadow"), syscall.S_IFCHR, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Setxattr(filepath.Join(upper, "srv"), opaqueXattr(), []byte("y"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var layer bytes.Buffer
+	if err := packLayer(&layer, upper, "etc/hosts", "etc/resolv.conf", "etc/hostname"); err != nil {
+		t.Fatalf("packLayer: %v", err)
+	}
+	dir := t.TempDir()
+	if err := unpackLayer(&layer, dir); err != nil {
+		t.Fatalf("unpackLayer: %v", err)
+	}
+
+	for _, name := range []string{"etc/hosts", "etc/resolv.conf"} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("excluded %s was packed", name)
+		}
+	}
+	for _, name := range []string{"etc/motd", "etc/issue", "srv/www/index.html"} {
+		want, _ := os.ReadFile(filepath.Join(upper, name))
+		if got, err := os.ReadFile(filepath.Join(dir, name)); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	var motd, issue syscall.Stat_t
+	if syscall.Stat(filepath.Join(dir, "etc/motd"), &motd) != nil || syscall.Stat(filepath.Join(dir, "etc/issue"), &issue) != nil || motd.Ino != issue.Ino {
+		t.Errorf("hard link etc/issue was not restored")
+	}
+	if !isWhiteout(filepath.Join(dir, "etc/shadow")) {
+		t.Errorf("whiteout etc/shadow was not restored")
+	}
+	if !isOpaque(filepath.Join(dir, "srv")) {
+		t.Errorf("opaque srv was not restored")
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// LimitEvents counts how often a container ran into the limits of its
+// cgroup.
+type LimitEvents struct {
+	OOMKills      uint64     `json:"oomKills"`
+	PidsLimitHits uint64     `json:"pidsLimitHits"`
+	LastOOMKill   *time.Time `json:"lastOomKill,omitempty"`
+	LastPidsLimit *time.Time `json:"lastPidsLimit,omitempty"`
+}
+
+// readKeyedFile returns the value of key in a flat keyed cgroup file such
+// as memory.events.
+func readKeyedFile(path, key string) uint64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			n, _ := strconv.ParseUint(fields[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// controllerFile is the path of an interface file of the cgroup.
+func (cg *cgroup) controllerFile(controller, name string) string {
+	if cgroupV2() {
+		return filepath.Join(cgroupRoot, cg.Path, name)
+	}
+	return filepath.Join(cgroupRoot, controller, cg.Path, name)
+}
+
+// limitCounters reads how many processes the OOM killer ended in the
+// cgroup and how often forking failed on its pids limit.
+func (cg *cgroup) limitCounters() (oomKills, pidsMax uint64) {
+	if cgroupV2() {
+		oomKills = readKeyedFile(cg.controllerFile("memory", "memory.events"), "oom_kill")
+		return oomKills, readKeyedFile(cg.controllerFile("pids", "pids.events"), "max")
+	}
+	// v1 counts a kill in the victim's cgroup and a refused fork in the
+	// one whose limit refused it, either of which may be a leaf below
+	cgroups := []*cgroup{cg}
+	entries, _ := os.ReadDir(filepath.Join(cgroupRoot, "memory", cg.Path))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			cgroups = append(cgroups, cg.leaf(entry.Name()))
+		}
+	}
+	for _, c := range cgroups {
+		oomKills += readKeyedFile(c.controllerFile("memory", "memory.oom_control"), "oom_kill")
+		pidsMax += readKeyedFile(c.controllerFile("pids", "pids.events"), "max")
+	}
+	return oomKills, pidsMax
+}
+
+// readLimit returns the content of a limit file, or "" when there is no
+// limit.
+func readLimit(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	value := strings.TrimSpace(string(data))
+	// v1 spells "no memory limit" as the largest page aligned value
+	if n, err := strconv.ParseInt(value, 10, 64); value == "max" || (err == nil && n >= 1<<62) {
+		return ""
+	}
+	return value
+}
+
+func (cg *cgroup) memoryLimit() string {
+	name := "memory.max"
+	if !cgroupV2() {
+		name = "memory.limit_in_bytes"
+	}
+	limit := readLimit(cg.controllerFile("memory", name))
+	if n, err := strconv.ParseInt(limit, 10, 64); err == nil {
+		return fmt.Sprintf("%d MiB", n>>20)
+	}
+	return limit
+}
+
+// limitPollInterval is how often counters without change notifications
+// are read.
+const limitPollInterval = time.Second
+
+// watchLimits watches the cgroup for OOM kills and forks refused by its
+// pids limit. The kernel signals changes of memory.events and
+// pids.events through inotify. cgroup v1 has no memory.events and
+// reports OOMs on an eventfd registered with cgroup.event_control; its
+// pids.events raises no inotify events and is polled.
+func (info *ContainerInfo) watchLimits(cg *cgroup) error {
+	inotify, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	stop, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		unix.Close(inotify)
+		return err
+	}
+	fds := []unix.PollFd{{Fd: int32(stop), Events: unix.POLLIN}, {Fd: int32(inotify), Events: unix.POLLIN}}
+
+	watched := []string{cg.controllerFile("pids", "pids.events")}
+	if cgroupV2() {
+		watched = append(watched, cg.controllerFile("memory", "memory.events"))
+	} else if oom, err := registerOOMEventfd(cg); err == nil {
+		fds = append(fds, unix.PollFd{Fd: int32(oom), Events: unix.POLLIN})
+	} else {
+		log.Printf("Container %s: OOM notifications unavailable: %v", info.ID, err)
+	}
+	for _, path := range watched {
+		// Files of controllers the hierarchy lacks do not exist
+		if _, err := unix.InotifyAddWatch(inotify, path, unix.IN_MODIFY); err != nil && !os.IsNotExist(err) {
+			log.Printf("Container %s: failed to watch %s: %v", info.ID, path, err)
+		}
+	}
+
+	var once sync.Once
+	info.stopLimitWatch = func() {
+		once.Do(func() {
+			unix.Write(stop, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+		})
+	}
+
+	timeout := -1
+	if !cgroupV2() {
+		timeout = int(limitPollInterval / time.Millisecond)
+	}
+	lastOOM, lastPids := cg.limitCounters()
+	go func() {
+		defer func() {
+			// Uses up once, so stopLimitWatch never writes to stop once
+			// it is closed, even when the watch failed by itself
+			once.Do(func() {})
+			for _, fd := range fds {
+				unix.Close(int(fd.Fd))
+			}
+		}()
+		buf := make([]byte, 4096)
+		for {
+			if _, err := unix.Poll(fds, timeout); err != nil {
+				if err == unix.EINTR {
+					continue
+				}
+				log.Printf("Container %s: limit watch failed: %v", info.ID, err)
+				return
+			}
+			if fds[0].Revents != 0 {
+				return
+			}
+			for _, fd := range fds[1:] {
+				if fd.Revents != 0 {
+					unix.Read(int(fd.Fd), buf)
+				}
+			}
+
+			oom, pids := cg.limitCounters()
+			// v1 signals the OOM before the victim is killed and counted
+			for i := 0; i < 10 && len(fds) > 2 && fds[2].Revents != 0 && oom == lastOOM; i++ {
+				time.Sleep(50 * time.Millisecond)
+				oom, _ = cg.limitCounters()
+			}
+			if oom > lastOOM {
+				info.recordOOMKill(cg, oom)
+			}
+			if pids > lastPids {
+				info.recordPidsLimit(cg, pids)
+			}
+			lastOOM, lastPids = oom, pids
+		}
+	}()
+	return nil
+}
+
+// registerOOMEventfd asks a v1 memory cgroup to signal OOMs on an eventfd.
+func registerOOMEventfd(cg *cgroup) (int, error) {
+	control, err := os.Open(cg.controllerFile("memory", "memory.oom_control"))
+	if err != nil {
+		return -1, err
+	}
+	defer control.Close()
+	efd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return -1, err
+	}
+	registration := fmt.Sprintf("%d %d", efd, control.Fd())
+	if err := os.WriteFile(cg.controllerFile("memory", "cgroup.event_control"), []byte(registration), 0); err != nil {
+		unix.Close(efd)
+		return -1, err
+	}
+	return efd, nil
+}
+
+func (info *ContainerInfo) recordOOMKill(cg *cgroup, total uint64) {
+	now := time.Now()
+	info.limitMu.Lock()
+	info.limits.OOMKills = total
+	info.limits.LastOOMKill = &now
+	info.limitMu.Unlock()
+
+	limit := cg.memoryLimit()
+	if limit != "" {
+		limit = " of " + limit
+	}
+	info.reportLimit(eventOOM, total, fmt.Sprintf(
+		"Out of memory: the container reached its cgroup memory limit%s, so the kernel's OOM killer ended a process in it.", limit))
+}
+
+func (info *ContainerInfo) recordPidsLimit(cg *cgroup, total uint64) {
+	now := time.Now()
+	info.limitMu.Lock()
+	info.limits.PidsLimitHits = total
+	info.limits.LastPidsLimit = &now
+	info.limitMu.Unlock()
+
+	message := "Process limit reached: the kernel refused to create another process in the container."
+	if limit := readLimit(cg.controllerFile("pids", "pids.max")); limit != "" {
+		message = fmt.Sprintf("Process limit reached: the container may only run %s processes, so the kernel refused to create another one.", limit)
+	}
+	info.reportLimit(eventPidsLimit, total, message)
+}
+
+// reportLimit tells the event stream and the learner's terminals that a
+// limit was hit.
+func (info *ContainerInfo) reportLimit(typ string, total uint64, message string) {
+	log.Printf("Container %s: %s", info.ID, message)
+	emitEvent(info, typ, map[string]string{"count": strconv.FormatUint(total, 10)})
+	info.notifyTerminals(TerminalMessage{Type: "error", Data: message})
+}
+
+// limitEvents returns a copy of the container's limit counters.
+func (info *ContainerInfo) limitEvents() LimitEvents {
+	info.limitMu.Lock()
+	defer info.limitMu.Unlock()
+	return info.limits
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// certReloadInterval is how often the TLS certificate files are checked
+// for changes.
+const certReloadInterval = 10 * time.Second
+
+// certReloader serves the certificate in its files, reloading it when
+// they change so renewed certificates need no restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	version string
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// fileVersion identifies the files' content by their modification times
+// and sizes, following symlinks swapped by tools such as cert-manager.
+func (r *certReloader) fileVersion() (string, error) {
+	var version string
+	for _, path := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		version += fmt.Sprintf("%d:%d;", fi.ModTime().UnixNano(), fi.Size())
+	}
+	return version, nil
+}
+
+func (r *certReloader) load() error {
+	version, err := r.fileVersion()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert, r.version = &cert, version
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// watch reloads the certificate whenever its files change until ctx is
+// done. A certificate that fails to load, e.g. while only one of the
+// files has been replaced, leaves the current one in use.
+func (r *certReloader) watch(ctx context.Context) {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		version, err := r.fileVersion()
+		r.mu.RLock()
+		changed := err == nil && version != r.version
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := r.load(); err != nil {
+			log.Printf("Failed to reload TLS certificate: %v", err)
+			continue
+		}
+		log.Printf("Reloaded TLS certificate from %s", r.certFile)
+	}
+}
+
+// listenUnix creates the API socket with the configured permissions.
+func listenUnix(path string) (net.Listener, error) {
+	// A socket left by a backend that did not shut down cleanly is in
+	// the way, one that still answers is not ours to take
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	mode, _ := config.Server.socketMode()
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if config.Server.SocketGroup != "" {
+		gid, _ := lookupGroup(config.Server.SocketGroup)
+		if err := os.Chown(path, -1, gid); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// startServers listens on every configured address and serves the API
+// there: plain HTTP and the Unix socket through e.Server, HTTPS through
+// e.TLSServer.
+func startServers(e *echo.Echo) error {
+	var once sync.Once
+	for _, srv := range []*http.Server{e.Server, e.TLSServer} {
+		srv.Handler = e
+		srv.BaseContext = func(net.Listener) context.Context { return serverCtx }
+		srv.RegisterOnShutdown(func() { once.Do(endSessions) })
+	}
+
+	type listener struct {
+		net.Listener
+		srv   *http.Server
+		tls   bool
+		where string
+	}
+	var listeners []listener
+	fail := func(err error) error {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return err
+	}
+
+	if addr := config.Server.Listen; addr != "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fail(err)
+		}
+		listeners = append(listeners, listener{ln, e.Server, false, "http://" + addr})
+	}
+	if path := config.Server.Socket; path != "" {
+		ln, err := listenUnix(path)
+		if err != nil {
+			return fail(err)
+		}
+		listeners = append(listeners, listener{ln, e.Server, false, "unix://" + path})
+	}
+	if config.TLS.CertFile != "" {
+		certs, err := newCertReloader(config.TLS.CertFile, config.TLS.KeyFile)
+		if err != nil {
+			return fail(fmt.Errorf("failed to load TLS certificate: %w", err))
+		}
+		go certs.watch(serverCtx)
+		e.TLSServer.TLSConfig = &tls.Config{
+			GetCertificate: certs.getCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+		ln, err := net.Listen("tcp", config.TLS.Listen)
+		if err != nil {
+			return fail(err)
+		}
+		listeners = append(listeners, listener{ln, e.TLSServer, true, "https://" + config.TLS.Listen})
+	}
+
+	for _, l := range listeners {
+		log.Printf("Server listening on %s", l.where)
+		go func(l listener) {
+			var err error
+			if l.tls {
+				err = l.srv.ServeTLS(l.Listener, "", "")
+			} else {
+				err = l.srv.Serve(l.Listener)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("Server on %s failed: %v", l.where, err)
+			}
+		}(l)
+	}
+	return nil
+}
+
+// shutdownServers stops both servers at once, so neither keeps accepting
+// while the other drains.
+func shutdownServers(ctx context.Context, e *echo.Echo) error {
+	errs := make(chan error, 2)
+	for _, srv := range []*http.Server{e.Server, e.TLSServer} {
+		go func(srv *http.Server) { errs <- srv.Shutdown(ctx) }(srv)
+	}
+	return errors.Join(<-errs, <-errs)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate for name and its key.
+func writeCertificate(t *testing.T, certFile, keyFile, name string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, "first")
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servedName := func() string {
+		cert, err := r.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	if name := servedName(); name != "first" {
+		t.Fatalf("serving %s, want first", name)
+	}
+	version := r.version
+
+	// Renewed files change the version and are served once loaded
+	writeCertificate(t, certFile, keyFile, "second")
+	// File times are as coarse as the kernel tick
+	renewed := time.Now().Add(time.Minute)
+	if err := os.Chtimes(certFile, renewed, renewed); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := r.fileVersion(); err != nil || v == version {
+		t.Errorf("file version = %q, %v, want it changed from %q", v, err, version)
+	}
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(); name != "second" {
+		t.Errorf("serving %s, want second", name)
+	}
+
+	// A certificate replaced without its key keeps the current one
+	writeCertificate(t, certFile, filepath.Join(dir, "other-key.pem"), "third")
+	if err := r.load(); err == nil {
+		t.Error("loaded a certificate that does not match its key")
+	}
+	if name := servedName(); name != "second" {
+		t.Errorf("serving %s, want second", name)
+	}
+
+	if _, err := newCertReloader(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Error("newCertReloader succeeded without a certificate")
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = defaultConfig()
+	config.Server.SocketMode = "0640"
+	config.Server.SocketGroup = strconv.Itoa(os.Getgid())
+
+	path := filepath.Join(t.TempDir(), "run", "lcw.sock")
+	ln, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode&0777 != 0640 || int(st.Gid) != os.Getgid() {
+		t.Errorf("socket mode %o group %d, want 640 and %d", st.Mode&0777, st.Gid, os.Getgid())
+	}
+
+	// A socket that still answers belongs to another backend
+	if _, err := listenUnix(path); err == nil {
+		t.Error("listenUnix took over a socket in use")
+	}
+
+	// One left behind by a backend that died is replaced
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = listenUnix(path)
+	if err != nil {
+		t.Fatalf("listenUnix over a stale socket: %v", err)
+	}
+	ln.Close()
+}
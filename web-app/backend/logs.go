@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Container logs are JSON lines in logFileName, rotated once they reach
+// maxLogSize. Up to maxLogFiles files, the current one included, are kept.
+const (
+	logFileName = "container.log"
+	maxLogSize  = 10 << 20
+	maxLogFiles = 3
+	// Output without a newline is logged once this much has accumulated
+	maxLogLine = 16 << 10
+)
+
+// LogEntry is a chunk of output, usually a line, of a container process.
+type LogEntry struct {
+	Stream    string    `json:"stream"`
+	Timestamp time.Time `json:"timestamp"`
+	Data      string    `json:"data"`
+}
+
+// containerLog writes the output of a container's main process and lets
+// clients follow it for as long as there are streams writing to it.
+type containerLog struct {
+	path string
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	streams  int
+	watchers map[chan LogEntry]struct{}
+	closed   bool
+}
+
+func openContainerLog(dir string) (*containerLog, error) {
+	l := &containerLog{path: filepath.Join(dir, logFileName), watchers: make(map[chan LogEntry]struct{})}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *containerLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, fi.Size()
+	return nil
+}
+
+// rotate shifts the log files by one, dropping the oldest. Must be called
+// with the lock held.
+func (l *containerLog) rotate() error {
+	l.file.Close()
+	for i := maxLogFiles - 1; i > 0; i-- {
+		from := l.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", l.path, i-1)
+		}
+		os.Rename(from, fmt.Sprintf("%s.%d", l.path, i))
+	}
+	return l.open()
+}
+
+func (l *containerLog) write(entry LogEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	if l.size > 0 && l.size+int64(len(data)) > maxLogSize {
+		if err := l.rotate(); err != nil {
+			log.Printf("Failed to rotate %s: %v", l.path, err)
+			l.closed = true
+			return
+		}
+	}
+	n, _ := l.file.Write(data)
+	l.size += int64(n)
+
+	for ch := range l.watchers {
+		select {
+		case ch <- entry:
+		default:
+			// Followers that fall behind are cut off rather than
+			// holding up the container
+			close(ch)
+			delete(l.watchers, ch)
+		}
+	}
+}
+
+// stream returns a writer logging everything written to it as entries of
+// the named stream, one per line.
+func (l *containerLog) stream(name string) *logStream {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.streams++
+	return &logStream{log: l, name: name}
+}
+
+// endStream ends every follow once the last stream is closed.
+func (l *containerLog) endStream() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.streams--
+	if l.streams > 0 {
+		return
+	}
+	for ch := range l.watchers {
+		close(ch)
+		delete(l.watchers, ch)
+	}
+}
+
+// follow returns the entries logged so far and a channel receiving the
+// ones logged from then on. The channel is closed when no stream is left
+// to write to the log or the follower falls behind; unfollow stops it
+// early.
+func (l *containerLog) follow() ([]LogEntry, chan LogEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries, err := l.read()
+	if err != nil {
+		return nil, nil, err
+	}
+	ch := make(chan LogEntry, 256)
+	if l.closed || l.streams == 0 {
+		close(ch)
+	} else {
+		l.watchers[ch] = struct{}{}
+	}
+	return entries, ch, nil
+}
+
+func (l *containerLog) unfollow(ch chan LogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.watchers[ch]; ok {
+		close(ch)
+		delete(l.watchers, ch)
+	}
+}
+
+// read returns every entry of the log files, oldest first. Must be called
+// with the lock held.
+func (l *containerLog) read() ([]LogEntry, error) {
+	var entries []LogEntry
+	for i := maxLogFiles - 1; i >= 0; i-- {
+		path := l.path
+		if i > 0 {
+			path = fmt.Sprintf("%s.%d", l.path, i)
+		}
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		// JSON spells control characters in six bytes each
+		scanner.Buffer(make([]byte, 0, 64<<10), 6*maxLogLine+1024)
+		for scanner.Scan() {
+			var entry LogEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+				entries = append(entries, entry)
+			}
+		}
+		f.Close()
+	}
+	return entries, nil
+}
+
+// close ends every follow. Entries written afterwards are dropped.
+func (l *containerLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	l.file.Close()
+	for ch := range l.watchers {
+		close(ch)
+	}
+	l.watchers = nil
+}
+
+// logStream splits what a process writes into lines.
+type logStream struct {
+	log  *containerLog
+	name string
+	buf  []byte
+}
+
+func (s *logStream) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	for {
+		i := bytes.IndexByte(s.buf, '\n')
+		if i < 0 && len(s.buf) < maxLogLine {
+			break
+		}
+		if i < 0 || i >= maxLogLine {
+			i = maxLogLine - 1
+		}
+		s.log.write(LogEntry{Stream: s.name, Timestamp: time.Now().UTC(), Data: string(s.buf[:i+1])})
+		s.buf = s.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Close logs output left without a final newline. Nothing may be
+// written afterwards.
+func (s *logStream) Close() error {
+	if len(s.buf) > 0 {
+		s.log.write(LogEntry{Stream: s.name, Timestamp: time.Now().UTC(), Data: string(s.buf)})
+		s.buf = nil
+	}
+	s.log.endStream()
+	return nil
+}
+
+// parseSince accepts an RFC 3339 timestamp, Unix seconds or a duration
+// relative to now, as docker logs does.
+func parseSince(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(secs*float64(time.Second))), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid since %q", s)
+}
+
+// boolParam parses an optional boolean query parameter.
+func boolParam(c echo.Context, name string, def bool) (bool, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return b, nil
+}
+
+// getContainerLogs writes the container's log as JSON lines. With follow
+// the response stays open while the main process runs, sending entries as
+// they are logged.
+func getContainerLogs(c echo.Context) error {
+	containerId := c.Param("id")
+
+	containersMux.RLock()
+	containerInfo, exists := containers[containerId]
+	containersMux.RUnlock()
+
+	if !exists {
+		return errContainerNotFound
+	}
+
+	follow, err := boolParam(c, "follow", false)
+	if err != nil {
+		return invalidField("follow", err.Error())
+	}
+	streams := make(map[string]bool)
+	for _, stream := range []string{"stdout", "stderr"} {
+		if streams[stream], err = boolParam(c, stream, true); err != nil {
+			return invalidField(stream, err.Error())
+		}
+	}
+	tail := -1
+	if v := c.QueryParam("tail"); v != "" && v != "all" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return invalidField("tail", "must be a number or all")
+		}
+		tail = n
+	}
+	var since time.Time
+	if v := c.QueryParam("since"); v != "" {
+		t, err := parseSince(v)
+		if err != nil {
+			return invalidField("since", err.Error())
+		}
+		since = t
+	}
+	wanted := func(entry LogEntry) bool {
+		return streams[entry.Stream] && !entry.Timestamp.Before(since)
+	}
+
+	entries, ch, err := containerInfo.logs.follow()
+	if err != nil {
+		return internalError("Failed to read logs: %v", err)
+	}
+	defer containerInfo.logs.unfollow(ch)
+
+	var matched []LogEntry
+	for _, entry := range entries {
+		if wanted(entry) {
+			matched = append(matched, entry)
+		}
+	}
+	if tail >= 0 && len(matched) > tail {
+		matched = matched[len(matched)-tail:]
+	}
+
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	resp.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(resp)
+	for _, entry := range matched {
+		if err := enc.Encode(entry); err != nil {
+			return nil
+		}
+	}
+	resp.Flush()
+	if !follow {
+		return nil
+	}
+
+	ctx := c.Request().Context()
+	for {
+		select {
+		case entry, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if !wanted(entry) {
+				continue
+			}
+			if err := enc.Encode(entry); err != nil {
+				return nil
+			}
+			resp.Flush()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logData returns the data of the entries, prefixed with their stream.
+func logData(entries []LogEntry) []string {
+	var data []string
+	for _, e := range entries {
+		data = append(data, e.Stream+":"+e.Data)
+	}
+	return data
+}
+
+func TestLogStream(t *testing.T) {
+	l, err := openContainerLog(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+
+	stdout, stderr := l.stream("stdout"), l.stream("stderr")
+	stdout.Write([]byte("one\ntw"))
+	stderr.Write([]byte("oops\n"))
+	stdout.Write([]byte("o\nthree\n"))
+	binary := strings.Repeat("\x01", maxLogLine)
+	stdout.Write([]byte(binary))
+	stdout.Write([]byte("no newline"))
+	stdout.Close()
+	long := strings.Repeat("x", maxLogLine+10)
+	stderr.Write([]byte(long))
+	stderr.Close()
+
+	l.mu.Lock()
+	entries, err := l.read()
+	l.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"stdout:one\n",
+		"stderr:oops\n",
+		"stdout:two\n",
+		"stdout:three\n",
+		"stdout:" + binary,
+		"stdout:no newline",
+		"stderr:" + long[:maxLogLine],
+		"stderr:" + long[maxLogLine:],
+	}
+	if got := logData(entries); !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %.80q, want %.80q", got, want)
+	}
+}
+
+func TestContainerLogRotate(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openContainerLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+
+	// Enough to fill the current file and most of the next one
+	line := strings.Repeat("x", maxLogLine)
+	n := (maxLogSize/len(line))*3/2 + 1
+	for i := 0; i < n; i++ {
+		l.write(LogEntry{Stream: "stdout", Data: fmt.Sprintf("%d %s", i, line)})
+	}
+
+	if _, err := os.Stat(l.path + ".1"); err != nil {
+		t.Errorf("log was not rotated: %v", err)
+	}
+	if fi, err := os.Stat(l.path); err != nil || fi.Size() > maxLogSize {
+		t.Errorf("current log is %v, want at most %d bytes: %v", fi.Size(), maxLogSize, err)
+	}
+	l.mu.Lock()
+	entries, err := l.read()
+	l.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != n {
+		t.Fatalf("read %d entries, want %d", len(entries), n)
+	}
+	for i, e := range entries {
+		if !strings.HasPrefix(e.Data, fmt.Sprintf("%d ", i)) {
+			t.Fatalf("entry %d is %.20q, want the entries in order", i, e.Data)
+		}
+	}
+}
+
+func TestContainerLogFollow(t *testing.T) {
+	l, err := openContainerLog(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+
+	stdout := l.stream("stdout")
+	stdout.Write([]byte("before\n"))
+	entries, ch, err := l.follow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := logData(entries); !reflect.DeepEqual(got, []string{"stdout:before\n"}) {
+		t.Errorf("backlog = %q, want the entry written before", got)
+	}
+
+	stdout.Write([]byte("after\n"))
+	select {
+	case e := <-ch:
+		if e.Data != "after\n" {
+			t.Errorf("followed %q, want %q", e.Data, "after\n")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no entry followed")
+	}
+
+	// The follow ends with the last stream
+	stdout.Close()
+	if _, open := <-ch; open {
+		t.Error("follow still open after the last stream closed")
+	}
+	if _, ch, _ := l.follow(); ch != nil {
+		if _, open := <-ch; open {
+			t.Error("follow of a finished log is open")
+		}
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		since   string
+		want    time.Time
+		wantErr bool
+	}{
+		{since: "2024-05-01T12:00:00Z", want: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+		{since: "2024-05-01T12:00:00.5+02:00", want: time.Date(2024, 5, 1, 10, 0, 0, 5e8, time.UTC)},
+		{since: "1714564800", want: time.Unix(1714564800, 0)},
+		{since: "1714564800.25", want: time.Unix(1714564800, 25e7)},
+		{since: "10m", want: now.Add(-10 * time.Minute)},
+		{since: "yesterday", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSince(tt.since)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSince(%q) = %v, want an error", tt.since, got)
+			}
+			continue
+		}
+		if err != nil || got.Sub(tt.want).Abs() > time.Second {
+			t.Errorf("parseSince(%q) = %v, %v, want %v", tt.since, got, err, tt.want)
+		}
+	}
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/creack/pty"
@@ -35,12 +41,50 @@ type Section struct {
 }
 
 type ContainerRequest struct {
-	SectionID string `json:"sectionId"`
+	SectionID string        `json:"sectionId" validate:"required"`
+	Image     string        `json:"image"`
+	Network   string        `json:"network" validate:"oneof=none bridge host"`
+	Ports     []PortMapping `json:"ports"`
+	// OCI runs a process described by an OCI runtime spec as the
+	// container's main process instead of leaving it idle
+	OCI *ociSpec `json:"oci,omitempty"`
+}
+
+func (r *ContainerRequest) validate() []FieldError {
+	if _, known := getSectionTemplates()[r.SectionID]; r.SectionID != "" && !known {
+		return []FieldError{{Field: "sectionId", Message: "unknown section " + r.SectionID}}
+	}
+	return nil
 }
 
 type ContainerResponse struct {
-	ContainerID string `json:"containerId"`
-	Status      string `json:"status"`
+	ContainerID string        `json:"containerId"`
+	Status      string        `json:"status"`
+	Image       string        `json:"image"`
+	Token       string        `json:"token"`
+	Ports       []PortMapping `json:"ports"`
+}
+
+// ContainerDetails is a container as shown by getContainer. Containers
+// running an OCI spec also report its state, those with a cgroup their
+// limit events.
+type ContainerDetails struct {
+	ID           string        `json:"id"`
+	Status       string        `json:"status"`
+	SectionID    string        `json:"sectionId"`
+	Image        string        `json:"image"`
+	Driver       string        `json:"driver"`
+	Network      *NetworkInfo  `json:"network"`
+	Ports        []PortMapping `json:"ports"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	RestoredFrom string        `json:"restoredFrom,omitempty"`
+	OCI          *ociState     `json:"oci,omitempty"`
+	Limits       *LimitEvents  `json:"limits,omitempty"`
+}
+
+// StatusMessage confirms requests that have nothing else to return.
+type StatusMessage struct {
+	Message string `json:"message"`
 }
 
 // Global state management
@@ -49,16 +93,50 @@ var (
 	containersMux = sync.RWMutex{}
 	upgrader      = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
-			return true // Allow connections from any origin in development
+			return allowedOrigin(r.Header.Get("Origin"))
 		},
 	}
 )
 
 type ContainerInfo struct {
-	ID        string
-	SectionID string
-	Status    string
-	CreatedAt time.Time
+	ID          string
+	SectionID   string
+	Image       string
+	ImageDigest string
+	Driver      string
+	Status      string
+	CreatedAt   time.Time
+	Template    *ContainerTemplate
+	Network     *NetworkInfo
+	Ports       []PortMapping
+	Token       string
+
+	proxies  []*portProxy
+	security *setupSecurity
+	sandbox  *exec.Cmd
+	oci      *ociContainer
+	logs     *containerLog
+
+	// checkpoint is what the container was restored from, if anything
+	checkpoint *Checkpoint
+	restored   []int
+
+	processMu sync.Mutex
+	processes map[*exec.Cmd]chan struct{}
+
+	terminalMu sync.Mutex
+	terminals  map[*terminal]struct{}
+	// idleSince is when the last terminal detached, zero while one is
+	// attached
+	idleSince time.Time
+
+	// cgroup enforces the container's limits, nil for local containers
+	// and rootless ones the backend may not create cgroups for
+	cgroup *cgroup
+	// limits counts OOM kills and refused forks in the container's cgroup
+	limitMu        sync.Mutex
+	limits         LimitEvents
+	stopLimitWatch func()
 }
 
 type TerminalMessage struct {
@@ -67,36 +145,97 @@ type TerminalMessage struct {
 }
 
 func main() {
+	// The backend re-executes itself to set up native containers
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case containerInitCommand:
+			runContainerInit()
+			return
+		case containerSetupCommand:
+			runContainerSetup()
+			return
+		case containerSandboxCommand:
+			runContainerSandbox()
+			return
+		case containerAttachCommand:
+			runContainerAttach()
+			return
+		case ociInitCommand:
+			runOCIInit()
+			return
+		}
+		// Invoked as an OCI runtime
+		if ociCLICommand(os.Args[1:]) != "" {
+			runOCICLI(os.Args[1:])
+			return
+		}
+	}
+
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	config = cfg
+	if config.Backend.Driver != "" {
+		containerDriver = config.Backend.Driver
+	}
+	config.Backend.Driver = containerDriver
+
 	e := echo.New()
 
 	// Middleware
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
-	e.Use(middleware.CORS())
+	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins: config.Server.AllowedOrigins,
+	}))
+	e.Use(metricsMiddleware)
+
+	e.HTTPErrorHandler = handleError
+	e.Validator = requestValidator{}
 
 	// Routes
 	e.GET("/", func(c echo.Context) error {
 		return c.JSON(http.StatusOK, map[string]string{
 			"message": "Linux Containerization Learning Platform API",
-			"version": "1.0.0",
+			"version": apiVersion,
+			"openapi": apiPrefix + "/openapi.json",
 		})
 	})
+	registerAPI(e.Group(apiPrefix))
+
+	// Prometheus metrics, which name every container
+	e.GET("/metrics", getMetrics, adminAuth)
+
+	// Health checks
+	e.GET("/healthz", getHealthz)
+	e.GET("/readyz", getReadyz)
+
+	imageStore, err = openImageStore(filepath.Join(config.Backend.StateDir, "images"))
+	if err != nil {
+		log.Fatalf("Failed to open image store: %v", err)
+	}
 
-	// Learning paths
-	e.GET("/api/learning-paths", getLearningPaths)
-	e.GET("/api/learning-paths/:id", getLearningPath)
-	e.GET("/api/learning-paths/:id/sections/:sectionId", getSection)
+	ipam, err = openIPAM(filepath.Join(config.Backend.StateDir, "network", "leases.json"), bridgeSubnet)
+	if err != nil {
+		log.Fatalf("Failed to open IP address leases: %v", err)
+	}
 
-	// Container management
-	e.POST("/api/containers/create", createContainer)
-	e.GET("/api/containers/:id", getContainer)
-	e.DELETE("/api/containers/:id", deleteContainer)
+	log.Printf("Using %s container driver", containerDriver)
+	adoptContainers()
+	go runReaper()
 
-	// Terminal/Shell endpoints
-	e.GET("/api/terminal/:containerId/ws", handleWebSocket)
+	if err := startServers(e); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
 
-	log.Println("Server starting on :8080...")
-	e.Logger.Fatal(e.Start(":8080"))
+	// A second signal kills the backend right away
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	signal.Stop(signals)
+	log.Printf("Received %v, shutting down...", sig)
+	shutdown(e)
 }
 
 func getLearningPaths(c echo.Context) error {
@@ -153,7 +292,7 @@ func getLearningPath(c echo.Context) error {
 		return c.JSON(http.StatusOK, path)
 	}
 
-	return c.JSON(http.StatusNotFound, map[string]string{"error": "Learning path not found"})
+	return apiError(http.StatusNotFound, codeLearningPathNotFound, "Learning path not found")
 }
 
 func getSection(c echo.Context) error {
@@ -174,75 +313,236 @@ func getSection(c echo.Context) error {
 
 func createContainer(c echo.Context) error {
 	var req ContainerRequest
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	template, err := loadSectionTemplate(req.SectionID)
+	if err != nil {
+		return internalError("Failed to load template: %v", err)
+	}
+	return launchContainer(c, req, template, nil)
+}
+
+// launchContainer creates a container from a template, optionally with
+// the filesystem of a checkpoint, and writes the response.
+func launchContainer(c echo.Context, req ContainerRequest, template *ContainerTemplate, checkpoint *Checkpoint) (err error) {
+	defer func(start time.Time) {
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		containerCreateDuration.observe(time.Since(start).Seconds(), result)
+	}(time.Now())
+
+	// The image requested by the client wins over the template's default
+	image := template.Image
+	if req.Image != "" {
+		image = req.Image
+	}
+
+	networkMode := template.Network
+	if req.Network != "" {
+		networkMode = req.Network
+	}
+	if !validNetworkMode(networkMode) {
+		return apiError(http.StatusBadRequest, codeInvalidRequest, "Invalid network mode "+networkMode)
+	}
+
+	var digest string
+	if containerDriver != driverLocal {
+		if digest, _, err = resolveImage(image); err != nil {
+			return apiError(http.StatusBadRequest, codeImageNotFound, err.Error())
+		}
+	}
+	if containerDriver == driverRootless && networkMode == networkBridge {
+		// Attaching to the host bridge needs privileges rootless
+		// containers do not have
+		if req.Network == networkBridge {
+			return apiError(http.StatusBadRequest, codeUnsupported, "Network mode bridge requires the native driver")
+		}
+		networkMode = networkNone
+	}
+	if containerDriver == driverLocal {
+		// Shells of the local driver always share the host's network
+		if req.Network != "" && req.Network != networkHost {
+			return apiError(http.StatusBadRequest, codeUnsupported, "Network mode "+req.Network+" requires the native driver")
+		}
+		networkMode = networkHost
+	}
+
+	if req.OCI != nil && containerDriver != driverNative {
+		return apiError(http.StatusBadRequest, codeUnsupported, "OCI specs require the native driver")
+	}
+	if containerDriver == driverNative && !config.Backend.AllowSysAdmin {
+		// Without a user namespace CAP_SYS_ADMIN is root on the host
+		if caps, err := template.capabilitySet(); err == nil && caps["CAP_SYS_ADMIN"] {
+			return apiError(http.StatusBadRequest, codeUnsupported,
+				"Section "+req.SectionID+" needs CAP_SYS_ADMIN, which the native driver only grants with backend.allowSysAdmin")
+		}
+	}
+
+	defaultPortMappings(req.Ports)
+	if len(req.Ports) > 0 && networkMode != networkBridge {
+		return apiError(http.StatusBadRequest, codeUnsupported, "Publishing ports requires the bridge network")
+	}
+
+	token, err := newContainerToken()
+	if err != nil {
+		return internalError("Failed to generate container token")
+	}
+
+	containerID, err := newContainerID()
+	if err != nil {
+		return internalError("Failed to generate container ID")
 	}
 
-	// Generate a mock container ID
-	containerID := fmt.Sprintf("mock-container-%d", time.Now().Unix())
+	// The container is only in containers once it is ready, until then
+	// the reservation keeps its image from being deleted
+	if digest != "" {
+		if !reserveImage(digest) {
+			return apiError(http.StatusBadRequest, codeImageNotFound, "Image "+image+" was deleted")
+		}
+		defer releaseImage(digest)
+	}
+
+	containerInfo := &ContainerInfo{
+		ID:          containerID,
+		SectionID:   req.SectionID,
+		Image:       image,
+		ImageDigest: digest,
+		Driver:      containerDriver,
+		Status:      "running",
+		CreatedAt:   time.Now(),
+		Template:    template,
+		Network:     &NetworkInfo{Mode: networkMode},
+		Ports:       req.Ports,
+		Token:       token,
+
+		checkpoint: checkpoint,
+		idleSince:  time.Now(),
+	}
+	if err := prepareContainer(containerInfo); err != nil {
+		cleanupContainer(containerInfo)
+		return internalError("Failed to prepare container: %v", err)
+	}
+	emitEvent(containerInfo, eventCreated, map[string]string{"image": image, "driver": containerDriver})
+	emitEvent(containerInfo, eventStarted, nil)
+	if req.OCI != nil {
+		if err := runOCIContainer(containerInfo, req.OCI); err != nil {
+			containerInfo.stopProcesses()
+			cleanupContainer(containerInfo)
+			emitEvent(containerInfo, eventDestroyed, nil)
+			return apiError(http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Failed to run OCI spec: %v", err))
+		}
+	}
+
+	if checkpoint != nil && checkpoint.Processes {
+		// The filesystem alone still makes a usable container
+		if err := restoreProcesses(containerInfo); err != nil {
+			log.Printf("Failed to restore processes of container %s: %v", containerID, err)
+		}
+	}
+
+	if err := containerInfo.runTemplateHooks(hookPoststart, ociRunning); err != nil {
+		log.Printf("Container %s: %v", containerID, err)
+	}
 
 	// Store container info
 	containersMux.Lock()
-	containers[containerID] = &ContainerInfo{
-		ID:        containerID,
-		SectionID: req.SectionID,
-		Status:    "running",
-		CreatedAt: time.Now(),
-	}
+	containers[containerID] = containerInfo
 	containersMux.Unlock()
 
 	return c.JSON(http.StatusOK, ContainerResponse{
 		ContainerID: containerID,
 		Status:      "created",
+		Image:       image,
+		Token:       token,
+		Ports:       containerInfo.Ports,
 	})
 }
 
+// newContainerID generates a random container ID. Knowing one is enough to
+// attach to the container, like a token.
+func newContainerID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 func getContainer(c echo.Context) error {
 	containerId := c.Param("id")
-	
+
 	containersMux.RLock()
 	containerInfo, exists := containers[containerId]
 	containersMux.RUnlock()
-	
+
 	if !exists {
-		return c.JSON(http.StatusNotFound, map[string]string{
-			"error": "Container not found",
-		})
+		return errContainerNotFound
 	}
 
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"id":        containerInfo.ID,
-		"status":    containerInfo.Status,
-		"sectionId": containerInfo.SectionID,
-		"createdAt": containerInfo.CreatedAt,
-	})
+	response := ContainerDetails{
+		ID:        containerInfo.ID,
+		Status:    containerInfo.status(),
+		SectionID: containerInfo.SectionID,
+		Image:     containerInfo.Image,
+		Driver:    containerInfo.Driver,
+		Network:   containerInfo.Network,
+		Ports:     containerInfo.Ports,
+		CreatedAt: containerInfo.CreatedAt,
+	}
+	if containerInfo.checkpoint != nil {
+		response.RestoredFrom = containerInfo.checkpoint.ID
+	}
+	if oci := containerInfo.oci; oci != nil {
+		oci.refresh()
+		state := oci.ociState
+		response.OCI = &state
+	}
+	if containerInfo.cgroup != nil || response.OCI != nil {
+		limits := containerInfo.limitEvents()
+		response.Limits = &limits
+	}
+	return c.JSON(http.StatusOK, response)
 }
 
 func deleteContainer(c echo.Context) error {
 	containerId := c.Param("id")
-	
+	start := time.Now()
+
 	// Remove from our tracking
 	containersMux.Lock()
-	_, exists := containers[containerId]
+	containerInfo, exists := containers[containerId]
 	if exists {
 		delete(containers, containerId)
 	}
 	containersMux.Unlock()
 
 	if !exists {
-		return c.JSON(http.StatusNotFound, map[string]string{
-			"error": "Container not found",
-		})
+		return errContainerNotFound
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{
-		"message": "Container " + containerId + " deleted",
-	})
+	destroyContainer(containerInfo, nil)
+	containerDeleteDuration.observe(time.Since(start).Seconds())
+
+	return c.JSON(http.StatusOK, StatusMessage{Message: "Container " + containerId + " deleted"})
+}
+
+// destroyContainer stops and cleans up a container that has been removed
+// from the containers map.
+func destroyContainer(info *ContainerInfo, attributes map[string]string) {
+	info.stopProcesses()
+	if err := cleanupContainer(info); err != nil {
+		log.Printf("Failed to clean up container %s: %v", info.ID, err)
+	}
+	emitEvent(info, eventDestroyed, attributes)
 }
 
 func handleWebSocket(c echo.Context) error {
 	containerId := c.Param("containerId")
-	
+
 	// Upgrade HTTP connection to WebSocket
 	ws, err := upgrader.Upgrade(c.Response().Writer, c.Request(), nil)
 	if err != nil {
@@ -255,7 +555,7 @@ func handleWebSocket(c echo.Context) error {
 	containersMux.RLock()
 	containerInfo, exists := containers[containerId]
 	containersMux.RUnlock()
-	
+
 	if !exists {
 		ws.WriteJSON(TerminalMessage{
 			Type: "error",
@@ -268,29 +568,88 @@ func handleWebSocket(c echo.Context) error {
 	return handleLocalTerminal(ws, containerInfo)
 }
 
+// terminal is an attached terminal's WebSocket. Messages come from the
+// PTY and from the backend itself, so writes are serialised.
+type terminal struct {
+	ws *websocket.Conn
+	mu sync.Mutex
+}
+
+func (t *terminal) send(msg TerminalMessage) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ws.WriteJSON(msg)
+}
+
+// close sends a last message and closes the WebSocket, which ends the
+// terminal's session.
+func (t *terminal) close(msg TerminalMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	deadline := time.Now().Add(time.Second)
+	t.ws.SetWriteDeadline(deadline)
+	t.ws.WriteJSON(msg)
+	t.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, msg.Data), deadline)
+	t.ws.Close()
+}
+
+func (info *ContainerInfo) addTerminal(t *terminal) {
+	info.terminalMu.Lock()
+	defer info.terminalMu.Unlock()
+	if info.terminals == nil {
+		info.terminals = make(map[*terminal]struct{})
+	}
+	info.terminals[t] = struct{}{}
+	info.idleSince = time.Time{}
+}
+
+func (info *ContainerInfo) removeTerminal(t *terminal) {
+	info.terminalMu.Lock()
+	defer info.terminalMu.Unlock()
+	delete(info.terminals, t)
+	if len(info.terminals) == 0 {
+		info.idleSince = time.Now()
+	}
+}
+
+// notifyTerminals sends a message to every attached terminal.
+func (info *ContainerInfo) notifyTerminals(msg TerminalMessage) {
+	info.terminalMu.Lock()
+	defer info.terminalMu.Unlock()
+	for t := range info.terminals {
+		t.send(msg)
+	}
+}
+
 func handleLocalTerminal(ws *websocket.Conn, containerInfo *ContainerInfo) error {
-	// Create a local bash session with PTY for demonstration
-	cmd := exec.Command("/bin/bash")
-	
-	// Set environment variables
-	cmd.Env = append(os.Environ(),
-		"TERM=xterm-256color",
-		fmt.Sprintf("SECTION_ID=%s", containerInfo.SectionID),
-		"PS1=learning-container:$ ",
-	)
-	
+	terminalSessions.Add(1)
+	defer terminalSessions.Done()
+
+	// Create a local shell session with PTY in the container's environment
+	cmd := containerCommand(context.Background(), containerInfo, containerInfo.Template.Shell)
+	term := &terminal{ws: ws}
+
 	// Start the command with a pty
-	ptmx, err := pty.Start(cmd)
+	var ptmx *os.File
+	proc, err := startContainerProcess(containerInfo, cmd, func() (err error) {
+		ptmx, err = pty.Start(cmd)
+		return err
+	})
 	if err != nil {
-		ws.WriteJSON(TerminalMessage{
+		ptyStartFailures.add(1)
+		term.send(TerminalMessage{
 			Type: "error",
 			Data: fmt.Sprintf("Failed to start terminal: %v", err),
 		})
 		return err
 	}
+	containerInfo.addTerminal(term)
+	emitEvent(containerInfo, eventAttached, map[string]string{"pid": strconv.Itoa(cmd.Process.Pid)})
 	defer func() {
+		containerInfo.removeTerminal(term)
 		ptmx.Close()
 		cmd.Process.Kill()
+		emitEvent(containerInfo, eventDetached, map[string]string{"pid": strconv.Itoa(cmd.Process.Pid)})
 	}()
 
 	// Handle bidirectional communication
@@ -300,20 +659,24 @@ func handleLocalTerminal(ws *websocket.Conn, containerInfo *ContainerInfo) error
 		for {
 			n, err := ptmx.Read(buf)
 			if err != nil {
-				if err == io.EOF {
-					return
-				}
-				log.Printf("PTY read error: %v", err)
+				// The terminal closes when the shell exits or is killed
+				code := proc.wait()
+				term.send(TerminalMessage{
+					Type: "exit",
+					Data: strconv.Itoa(code),
+				})
+				ws.Close()
 				return
 			}
-			
-			if err := ws.WriteJSON(TerminalMessage{
+
+			if err := term.send(TerminalMessage{
 				Type: "output",
 				Data: string(buf[:n]),
 			}); err != nil {
 				log.Printf("Failed to write to WebSocket: %v", err)
 				return
 			}
+			terminalBytes.add(float64(n), "out")
 		}
 	}()
 
@@ -333,6 +696,7 @@ func handleLocalTerminal(ws *websocket.Conn, containerInfo *ContainerInfo) error
 				log.Printf("Failed to write to PTY: %v", err)
 				break
 			}
+			terminalBytes.add(float64(len(msg.Data)), "in")
 		} else if msg.Type == "resize" {
 			// Handle terminal resize
 			var resizeData map[string]interface{}
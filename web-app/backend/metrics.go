@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Metrics are served in the Prometheus text exposition format. Counters
+// and histograms are updated as things happen; gauges are read from the
+// containers when scraped.
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricSeries renders label values as a Prometheus label set.
+func metricSeries(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counter is a monotonically increasing value per label set.
+type counter struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	c := &counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	if len(labels) == 0 {
+		// Report zero before the first increment
+		c.values[""] = 0
+	}
+	return c
+}
+
+func (c *counter) add(v float64, labelValues ...string) {
+	series := metricSeries(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[series] += v
+	c.mu.Unlock()
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, series := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, series, formatMetricValue(c.values[series]))
+	}
+}
+
+// histogram counts observations in cumulative buckets per label set.
+type histogram struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	return &histogram{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogram) observe(v float64, labelValues ...string) {
+	key := metricSeries(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		for i := 0; i <= len(h.buckets); i++ {
+			bound, count := math.Inf(1), s.count
+			if i < len(h.buckets) {
+				bound, count = h.buckets[i], s.counts[i]
+			}
+			values := append(append([]string(nil), s.labelValues...), formatMetricValue(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, metricSeries(labels, values), count)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatMetricValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// latencyBuckets suit operations taking from milliseconds to a minute.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+var (
+	containerCreateDuration = newHistogram("lcw_container_create_duration_seconds",
+		"Time taken to create a container.", latencyBuckets, "result")
+	containerDeleteDuration = newHistogram("lcw_container_delete_duration_seconds",
+		"Time taken to delete a container.", latencyBuckets)
+	terminalBytes = newCounter("lcw_terminal_bytes_total",
+		"Bytes passed through WebSocket terminals, in from the client and out from the PTY.", "direction")
+	ptyStartFailures = newCounter("lcw_pty_start_failures_total",
+		"Terminals whose PTY could not be started.")
+	httpRequestDuration = newHistogram("lcw_http_request_duration_seconds",
+		"Time taken to handle HTTP requests, by route.", latencyBuckets, "method", "route", "code")
+)
+
+// metricsMiddleware records how long each request took under its route
+// pattern, so container IDs do not make up new series.
+func metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		start := time.Now()
+		if err = next(c); err != nil {
+			// Have the error written so its status is recorded
+			c.Error(err)
+		}
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequestDuration.observe(time.Since(start).Seconds(),
+			c.Request().Method, route, strconv.Itoa(c.Response().Status))
+		return err
+	}
+}
+
+// usage returns the CPU time in seconds and the memory in bytes used
+// by the processes in the cgroup.
+func (cg *cgroup) usage() (cpu float64, memory uint64, err error) {
+	if cgroupV2() {
+		usec := readKeyedFile(cg.controllerFile("cpu", "cpu.stat"), "usage_usec")
+		cpu = float64(usec) / 1e6
+		memory, err = readUintFile(cg.controllerFile("memory", "memory.current"))
+		return cpu, memory, err
+	}
+	nsec, err := readUintFile(cg.controllerFile("cpuacct", "cpuacct.usage"))
+	if err != nil {
+		return 0, 0, err
+	}
+	memory, err = readUintFile(cg.controllerFile("memory", "memory.usage_in_bytes"))
+	return float64(nsec) / 1e9, memory, err
+}
+
+func readUintFile(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// containerState is the state a container is counted under: the OCI state
+// for containers running a spec, the tracked status otherwise.
+func (info *ContainerInfo) containerState() string {
+	if oci := info.oci; oci != nil {
+		oci.refresh()
+		return oci.Status
+	}
+	return info.status()
+}
+
+// getMetrics serves the metrics to Prometheus.
+func getMetrics(c echo.Context) error {
+	containersMux.RLock()
+	infos := make([]*ContainerInfo, 0, len(containers))
+	for _, info := range containers {
+		infos = append(infos, info)
+	}
+	containersMux.RUnlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+
+	states := make(map[string]int)
+	terminals := 0
+	for _, info := range infos {
+		states[info.containerState()]++
+		info.terminalMu.Lock()
+		terminals += len(info.terminals)
+		info.terminalMu.Unlock()
+	}
+
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	resp.WriteHeader(http.StatusOK)
+	w := bufio.NewWriter(resp)
+	defer w.Flush()
+
+	fmt.Fprint(w, "# HELP lcw_containers Containers by state.\n# TYPE lcw_containers gauge\n")
+	for _, state := range sortedKeys(states) {
+		fmt.Fprintf(w, "lcw_containers%s %d\n", metricSeries([]string{"state"}, []string{state}), states[state])
+	}
+	fmt.Fprint(w, "# HELP lcw_terminals_active WebSocket terminals attached to containers.\n# TYPE lcw_terminals_active gauge\n")
+	fmt.Fprintf(w, "lcw_terminals_active %d\n", terminals)
+
+	terminalBytes.write(w)
+	ptyStartFailures.write(w)
+	containerCreateDuration.write(w)
+	containerDeleteDuration.write(w)
+	httpRequestDuration.write(w)
+
+	// Local containers, and rootless ones on hosts that do not delegate
+	// cgroups to the backend, have no cgroup
+	var cpu, memory strings.Builder
+	for _, info := range infos {
+		cg := info.cgroup
+		if cg == nil {
+			continue
+		}
+		seconds, bytes, err := cg.usage()
+		if err != nil {
+			continue
+		}
+		series := metricSeries([]string{"container", "section"}, []string{info.ID, info.SectionID})
+		fmt.Fprintf(&cpu, "lcw_container_cpu_seconds_total%s %s\n", series, formatMetricValue(seconds))
+		fmt.Fprintf(&memory, "lcw_container_memory_bytes%s %d\n", series, bytes)
+	}
+	fmt.Fprint(w, "# HELP lcw_container_cpu_seconds_total CPU time used by the container's cgroup.\n# TYPE lcw_container_cpu_seconds_total counter\n")
+	fmt.Fprint(w, cpu.String())
+	fmt.Fprint(w, "# HELP lcw_container_memory_bytes Memory used by the container's cgroup.\n# TYPE lcw_container_memory_bytes gauge\n")
+	fmt.Fprint(w, memory.String())
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestMetricSeries(t *testing.T) {
+	tests := []struct {
+		names, values []string
+		want          string
+	}{
+		{nil, nil, ""},
+		{[]string{"result"}, []string{"success"}, `{result="success"}`},
+		{[]string{"method", "route"}, []string{"GET", "/api/v1/containers/:id"}, `{method="GET",route="/api/v1/containers/:id"}`},
+		{[]string{"reason"}, []string{"say \"hi\"\\\nbye"}, `{reason="say \"hi\"\\\nbye"}`},
+	}
+	for _, tt := range tests {
+		if got := metricSeries(tt.names, tt.values); got != tt.want {
+			t.Errorf("metricSeries(%q, %q) = %s, want %s", tt.names, tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestFormatMetricValue(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{0, "0"},
+		{42, "42"},
+		{0.005, "0.005"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+	}
+	for _, tt := range tests {
+		if got := formatMetricValue(tt.v); got != tt.want {
+			t.Errorf("formatMetricValue(%v) = %s, want %s", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestCounterWrite(t *testing.T) {
+	unlabelled := newCounter("test_failures_total", "Failures.")
+	var b strings.Builder
+	unlabelled.write(&b)
+	want := "# HELP test_failures_total Failures.\n" +
+		"# TYPE test_failures_total counter\n" +
+		"test_failures_total 0\n"
+	if b.String() != want {
+		t.Errorf("unlabelled counter before any increment =\n%s\nwant\n%s", b.String(), want)
+	}
+
+	labelled := newCounter("test_bytes_total", "Bytes.", "direction")
+	labelled.add(5, "out")
+	labelled.add(3, "in")
+	labelled.add(2, "out")
+	b.Reset()
+	labelled.write(&b)
+	want = "# HELP test_bytes_total Bytes.\n" +
+		"# TYPE test_bytes_total counter\n" +
+		"test_bytes_total{direction=\"in\"} 3\n" +
+		"test_bytes_total{direction=\"out\"} 7\n"
+	if b.String() != want {
+		t.Errorf("labelled counter =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestHistogramWrite(t *testing.T) {
+	h := newHistogram("test_duration_seconds", "Durations.", []float64{0.1, 1}, "result")
+	h.observe(0.05, "success")
+	h.observe(0.5, "success")
+	h.observe(3, "success")
+	h.observe(1, "error")
+
+	var b strings.Builder
+	h.write(&b)
+	want := "# HELP test_duration_seconds Durations.\n" +
+		"# TYPE test_duration_seconds histogram\n" +
+		"test_duration_seconds_bucket{result=\"error\",le=\"0.1\"} 0\n" +
+		"test_duration_seconds_bucket{result=\"error\",le=\"1\"} 1\n" +
+		"test_duration_seconds_bucket{result=\"error\",le=\"+Inf\"} 1\n" +
+		"test_duration_seconds_sum{result=\"error\"} 1\n" +
+		"test_duration_seconds_count{result=\"error\"} 1\n" +
+		"test_duration_seconds_bucket{result=\"success\",le=\"0.1\"} 1\n" +
+		"test_duration_seconds_bucket{result=\"success\",le=\"1\"} 2\n" +
+		"test_duration_seconds_bucket{result=\"success\",le=\"+Inf\"} 3\n" +
+		"test_duration_seconds_sum{result=\"success\"} 3.55\n" +
+		"test_duration_seconds_count{result=\"success\"} 3\n"
+	if b.String() != want {
+		t.Errorf("histogram =\n%s\nwant\n%s", b.String(), want)
+	}
+}
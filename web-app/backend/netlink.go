@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Attributes not exported by the syscall package
+const (
+	iflaInfoKind  = 1
+	iflaInfoData  = 2
+	vethInfoPeer  = 1
+	iflaNetNsFd   = 28
+	nlaFlagNested = 1 << 15
+)
+
+// netlinkConn is a minimal rtnetlink client, just enough to build the
+// bridge, veth pairs, addresses and routes containers need.
+type netlinkConn struct {
+	fd  int
+	seq uint32
+}
+
+// nlAttr is a route attribute; nested attributes are encoded into data.
+type nlAttr struct {
+	typ  uint16
+	data []byte
+}
+
+func openNetlink() (*netlinkConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &netlinkConn{fd: fd}, nil
+}
+
+func (c *netlinkConn) Close() error {
+	return syscall.Close(c.fd)
+}
+
+// request sends a message and waits for the kernel's acknowledgement,
+// returning the payload of any replies received before it.
+func (c *netlinkConn) request(msgType uint16, flags uint16, body []byte, attrs ...nlAttr) ([][]byte, error) {
+	c.seq++
+	payload := append(body, encodeAttrs(attrs)...)
+	msg := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(payload))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(syscall.NLMSG_HDRLEN+len(payload)))
+	binary.NativeEndian.PutUint16(msg[4:6], msgType)
+	binary.NativeEndian.PutUint16(msg[6:8], flags|syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	binary.NativeEndian.PutUint32(msg[8:12], c.seq)
+	msg = append(msg, payload...)
+
+	if err := syscall.Sendto(c.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var replies [][]byte
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != c.seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_ERROR:
+				if errno := int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				return replies, nil
+			case syscall.NLMSG_DONE:
+				return replies, nil
+			default:
+				// buf is reused by the next receive
+				replies = append(replies, append([]byte(nil), m.Data...))
+			}
+		}
+	}
+}
+
+func encodeAttrs(attrs []nlAttr) []byte {
+	var buf []byte
+	for _, a := range attrs {
+		length := syscall.SizeofRtAttr + len(a.data)
+		hdr := make([]byte, syscall.SizeofRtAttr)
+		binary.NativeEndian.PutUint16(hdr[0:2], uint16(length))
+		binary.NativeEndian.PutUint16(hdr[2:4], a.typ)
+		buf = append(buf, hdr...)
+		buf = append(buf, a.data...)
+		buf = append(buf, make([]byte, nlAlign(length)-length)...)
+	}
+	return buf
+}
+
+func nlAlign(length int) int {
+	return (length + syscall.NLMSG_ALIGNTO - 1) &^ (syscall.NLMSG_ALIGNTO - 1)
+}
+
+func nested(typ uint16, attrs ...nlAttr) nlAttr {
+	return nlAttr{typ: typ | nlaFlagNested, data: encodeAttrs(attrs)}
+}
+
+func stringAttr(typ uint16, s string) nlAttr {
+	return nlAttr{typ: typ, data: append([]byte(s), 0)}
+}
+
+func uint32Attr(typ uint16, v uint32) nlAttr {
+	data := make([]byte, 4)
+	binary.NativeEndian.PutUint32(data, v)
+	return nlAttr{typ: typ, data: data}
+}
+
+func ifInfoMsg(index int32, flags, change uint32) []byte {
+	msg := make([]byte, syscall.SizeofIfInfomsg)
+	msg[0] = syscall.AF_UNSPEC
+	binary.NativeEndian.PutUint32(msg[4:8], uint32(index))
+	binary.NativeEndian.PutUint32(msg[8:12], flags)
+	binary.NativeEndian.PutUint32(msg[12:16], change)
+	return msg
+}
+
+// LinkIndex looks up an interface in the connection's network namespace.
+func (c *netlinkConn) LinkIndex(name string) (int32, error) {
+	replies, err := c.request(syscall.RTM_GETLINK, 0, ifInfoMsg(0, 0, 0), stringAttr(syscall.IFLA_IFNAME, name))
+	if err != nil {
+		return 0, fmt.Errorf("link %s: %w", name, err)
+	}
+	if len(replies) == 0 || len(replies[0]) < syscall.SizeofIfInfomsg {
+		return 0, fmt.Errorf("link %s: no reply", name)
+	}
+	return int32(binary.NativeEndian.Uint32(replies[0][4:8])), nil
+}
+
+func (c *netlinkConn) AddBridge(name string) error {
+	_, err := c.request(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, ifInfoMsg(0, 0, 0),
+		stringAttr(syscall.IFLA_IFNAME, name),
+		nested(syscall.IFLA_LINKINFO, stringAttr(iflaInfoKind, "bridge")),
+	)
+	return err
+}
+
+// AddVeth creates a veth pair whose peer is created directly inside the
+// network namespace referred to by peerNetns.
+func (c *netlinkConn) AddVeth(name, peer string, peerNetns int) error {
+	peerInfo := append(ifInfoMsg(0, 0, 0), encodeAttrs([]nlAttr{
+		stringAttr(syscall.IFLA_IFNAME, peer),
+		uint32Attr(iflaNetNsFd, uint32(peerNetns)),
+	})...)
+	_, err := c.request(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, ifInfoMsg(0, 0, 0),
+		stringAttr(syscall.IFLA_IFNAME, name),
+		nested(syscall.IFLA_LINKINFO,
+			stringAttr(iflaInfoKind, "veth"),
+			nested(iflaInfoData, nlAttr{typ: vethInfoPeer, data: peerInfo}),
+		),
+	)
+	return err
+}
+
+func (c *netlinkConn) DeleteLink(name string) error {
+	index, err := c.LinkIndex(name)
+	if err != nil {
+		return err
+	}
+	_, err = c.request(syscall.RTM_DELLINK, 0, ifInfoMsg(index, 0, 0))
+	return err
+}
+
+func (c *netlinkConn) SetMaster(name, master string) error {
+	index, err := c.LinkIndex(name)
+	if err != nil {
+		return err
+	}
+	masterIndex, err := c.LinkIndex(master)
+	if err != nil {
+		return err
+	}
+	_, err = c.request(syscall.RTM_NEWLINK, 0, ifInfoMsg(index, 0, 0), uint32Attr(syscall.IFLA_MASTER, uint32(masterIndex)))
+	return err
+}
+
+func (c *netlinkConn) SetUp(name string) error {
+	index, err := c.LinkIndex(name)
+	if err != nil {
+		return err
+	}
+	_, err = c.request(syscall.RTM_NEWLINK, 0, ifInfoMsg(index, syscall.IFF_UP, syscall.IFF_UP))
+	return err
+}
+
+func (c *netlinkConn) AddAddress(name string, addr *net.IPNet) error {
+	index, err := c.LinkIndex(name)
+	if err != nil {
+		return err
+	}
+	ip := addr.IP.To4()
+	prefix, _ := addr.Mask.Size()
+
+	msg := make([]byte, syscall.SizeofIfAddrmsg)
+	msg[0] = syscall.AF_INET
+	msg[1] = byte(prefix)
+	binary.NativeEndian.PutUint32(msg[4:8], uint32(index))
+	_, err = c.request(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, msg,
+		nlAttr{typ: syscall.IFA_LOCAL, data: ip},
+		nlAttr{typ: syscall.IFA_ADDRESS, data: ip},
+	)
+	return err
+}
+
+func (c *netlinkConn) AddDefaultRoute(name string, gateway net.IP) error {
+	index, err := c.LinkIndex(name)
+	if err != nil {
+		return err
+	}
+
+	msg := make([]byte, syscall.SizeofRtMsg)
+	msg[0] = syscall.AF_INET
+	msg[4] = syscall.RT_TABLE_MAIN
+	msg[5] = syscall.RTPROT_BOOT
+	msg[6] = syscall.RT_SCOPE_UNIVERSE
+	msg[7] = syscall.RTN_UNICAST
+	_, err = c.request(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, msg,
+		nlAttr{typ: syscall.RTA_GATEWAY, data: gateway.To4()},
+		uint32Attr(syscall.RTA_OIF, uint32(index)),
+	)
+	return err
+}
+
+// inNetns runs fn on an OS thread that has joined the network namespace
+// bound at path. Netlink sockets opened by fn belong to that namespace.
+// The thread is never handed back to the Go scheduler, since it can not
+// be trusted to be in the right namespace any more.
+func inNetns(path string, fn func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		errCh <- func() error {
+			if err := joinNetns(path); err != nil {
+				return err
+			}
+			return fn()
+		}()
+	}()
+	return <-errCh
+}
+
+func joinNetns(path string) error {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if err := unix.Setns(fd, unix.CLONE_NEWNET); err != nil {
+		return fmt.Errorf("setns %s: %w", path, err)
+	}
+	return nil
+}
+
+// createNetns creates a network namespace and keeps it alive by bind
+// mounting it at path, like `ip netns add` does.
+func createNetns(path string) error {
+	f, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_CLOEXEC, 0444)
+	if err != nil {
+		return err
+	}
+	syscall.Close(f)
+
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		errCh <- func() error {
+			if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+				return err
+			}
+			nsPath := fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid())
+			return syscall.Mount(nsPath, path, "", syscall.MS_BIND, "")
+		}()
+	}()
+	if err := <-errCh; err != nil {
+		syscall.Unlink(path)
+		return fmt.Errorf("failed to create network namespace: %w", err)
+	}
+	return nil
+}
+
+func removeNetns(path string) error {
+	if err := syscall.Unmount(path, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL && err != syscall.ENOENT {
+		return err
+	}
+	if err := syscall.Unlink(path); err != nil && err != syscall.ENOENT {
+		return err
+	}
+	return nil
+}
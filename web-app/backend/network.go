@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Network modes a container can be created with
+const (
+	networkNone   = "none"
+	networkBridge = "bridge"
+	networkHost   = "host"
+)
+
+// The bridge every container in bridge mode is attached to
+var (
+	bridgeName   = "lcw0"
+	bridgeSubnet = "172.29.0.0/16"
+)
+
+// NetworkInfo describes how a container is connected.
+type NetworkInfo struct {
+	Mode          string `json:"mode"`
+	IPAddress     string `json:"ipAddress,omitempty"`
+	PrefixLength  int    `json:"prefixLength,omitempty"`
+	Gateway       string `json:"gateway,omitempty"`
+	Bridge        string `json:"bridge,omitempty"`
+	HostInterface string `json:"hostInterface,omitempty"`
+}
+
+func validNetworkMode(mode string) bool {
+	return mode == networkNone || mode == networkBridge || mode == networkHost
+}
+
+// IPAM hands out addresses from the bridge subnet. Leases are persisted
+// so addresses survive a backend restart.
+type IPAM struct {
+	mu      sync.Mutex
+	path    string
+	subnet  *net.IPNet
+	gateway net.IP
+	leases  map[string]string // IP -> container ID
+}
+
+var ipam *IPAM
+
+func openIPAM(path, subnet string) (*IPAM, error) {
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %s: %w", subnet, err)
+	}
+	if ipnet.IP.To4() == nil {
+		return nil, fmt.Errorf("subnet %s is not IPv4", subnet)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	a := &IPAM{
+		path:    path,
+		subnet:  ipnet,
+		gateway: nextIP(ipnet.IP),
+		leases:  make(map[string]string),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &a.leases); err != nil {
+		return nil, fmt.Errorf("corrupt IP leases: %w", err)
+	}
+	return a, nil
+}
+
+func (a *IPAM) save() error {
+	data, err := json.MarshalIndent(a.leases, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// Allocate returns the lowest free address in the subnet, skipping the
+// network address, the gateway and the broadcast address.
+func (a *IPAM) Allocate(containerID string) (*net.IPNet, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	broadcast := make(net.IP, len(a.subnet.IP.To4()))
+	for i, b := range a.subnet.IP.To4() {
+		broadcast[i] = b | ^a.subnet.Mask[i]
+	}
+
+	for ip := nextIP(a.gateway); a.subnet.Contains(ip) && !ip.Equal(broadcast); ip = nextIP(ip) {
+		if _, taken := a.leases[ip.String()]; taken {
+			continue
+		}
+		a.leases[ip.String()] = containerID
+		if err := a.save(); err != nil {
+			delete(a.leases, ip.String())
+			return nil, err
+		}
+		return &net.IPNet{IP: ip, Mask: a.subnet.Mask}, nil
+	}
+	return nil, fmt.Errorf("no free addresses left in %s", a.subnet)
+}
+
+// Release frees every address leased to a container.
+func (a *IPAM) Release(containerID string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for ip, owner := range a.leases {
+		if owner == containerID {
+			delete(a.leases, ip)
+		}
+	}
+	return a.save()
+}
+
+func (a *IPAM) Gateway() *net.IPNet {
+	return &net.IPNet{IP: a.gateway, Mask: a.subnet.Mask}
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip.To4()))
+	copy(next, ip.To4())
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func (info *ContainerInfo) netnsPath() string {
+	return filepath.Join(containerDir(info.ID), "netns")
+}
+
+// hostVethName derives a stable host-side interface name, kept within
+// the kernel's 15 character limit.
+func (info *ContainerInfo) hostVethName() string {
+	h := fnv.New32a()
+	h.Write([]byte(info.ID))
+	return fmt.Sprintf("veth%08x", h.Sum32())
+}
+
+// setupNetwork gives a native container its network namespace. In bridge
+// mode a veth pair connects it to the host bridge with an address from
+// the IPAM; in none mode it only gets a loopback interface.
+func setupNetwork(info *ContainerInfo) error {
+	network := info.Network
+	if network.Mode == networkHost {
+		return nil
+	}
+
+	if err := createNetns(info.netnsPath()); err != nil {
+		return err
+	}
+	err := inNetns(info.netnsPath(), func() error {
+		nl, err := openNetlink()
+		if err != nil {
+			return err
+		}
+		defer nl.Close()
+		return nl.SetUp("lo")
+	})
+	if err != nil || network.Mode == networkNone {
+		return err
+	}
+
+	if err := ensureBridge(); err != nil {
+		return err
+	}
+	addr, err := ipam.Allocate(info.ID)
+	if err != nil {
+		return err
+	}
+	gateway := ipam.Gateway()
+	prefix, _ := addr.Mask.Size()
+	network.IPAddress = addr.IP.String()
+	network.PrefixLength = prefix
+	network.Gateway = gateway.IP.String()
+	network.Bridge = bridgeName
+	network.HostInterface = info.hostVethName()
+
+	nsFd, err := syscall.Open(info.netnsPath(), syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(nsFd)
+
+	nl, err := openNetlink()
+	if err != nil {
+		return err
+	}
+	defer nl.Close()
+	if err := nl.AddVeth(network.HostInterface, "eth0", nsFd); err != nil {
+		return fmt.Errorf("failed to create veth pair: %w", err)
+	}
+	if err := nl.SetMaster(network.HostInterface, bridgeName); err != nil {
+		return err
+	}
+	if err := nl.SetUp(network.HostInterface); err != nil {
+		return err
+	}
+
+	return inNetns(info.netnsPath(), func() error {
+		nl, err := openNetlink()
+		if err != nil {
+			return err
+		}
+		defer nl.Close()
+		if err := nl.AddAddress("eth0", addr); err != nil {
+			return fmt.Errorf("failed to assign %s: %w", addr, err)
+		}
+		if err := nl.SetUp("eth0"); err != nil {
+			return err
+		}
+		if err := nl.AddDefaultRoute("eth0", gateway.IP); err != nil {
+			return fmt.Errorf("failed to add default route: %w", err)
+		}
+		return nil
+	})
+}
+
+// teardownNetwork undoes setupNetwork. Deleting the host end of the veth
+// pair also removes its peer.
+func teardownNetwork(info *ContainerInfo) error {
+	network := info.Network
+	if network == nil || network.Mode == networkHost {
+		return nil
+	}
+
+	var errs []error
+	if network.HostInterface != "" {
+		nl, err := openNetlink()
+		if err == nil {
+			if err := nl.DeleteLink(network.HostInterface); err != nil && !errors.Is(err, syscall.ENODEV) {
+				errs = append(errs, err)
+			}
+			nl.Close()
+		} else {
+			errs = append(errs, err)
+		}
+	}
+	if network.Mode == networkBridge {
+		errs = append(errs, ipam.Release(info.ID))
+	}
+	errs = append(errs, removeNetns(info.netnsPath()))
+	return errors.Join(errs...)
+}
+
+var bridgeMux sync.Mutex
+
+// ensureBridge creates the host bridge on first use, assigns it the
+// gateway address and enables forwarding and masquerading so containers
+// can reach the outside world.
+func ensureBridge() error {
+	bridgeMux.Lock()
+	defer bridgeMux.Unlock()
+
+	if _, err := net.InterfaceByName(bridgeName); err == nil {
+		return nil
+	}
+
+	nl, err := openNetlink()
+	if err != nil {
+		return err
+	}
+	defer nl.Close()
+	if err := nl.AddBridge(bridgeName); err != nil {
+		return fmt.Errorf("failed to create bridge %s: %w", bridgeName, err)
+	}
+	if err := nl.AddAddress(bridgeName, ipam.Gateway()); err != nil {
+		return err
+	}
+	if err := nl.SetUp(bridgeName); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		log.Printf("Failed to enable IP forwarding: %v", err)
+	}
+	rule := []string{"-t", "nat", "POSTROUTING", "-s", bridgeSubnet, "!", "-o", bridgeName, "-j", "MASQUERADE"}
+	check := append([]string{"-C"}, rule...)
+	if err := exec.Command("iptables", check...).Run(); err != nil {
+		add := append([]string{"-A"}, rule...)
+		if output, err := exec.Command("iptables", add...).CombinedOutput(); err != nil {
+			log.Printf("Failed to set up masquerading, containers will not reach the internet: %v: %s", err, output)
+		}
+	}
+	return nil
+}
+
+// networkFiles are the files writeNetworkFiles generates for each
+// container.
+var networkFiles = []string{"/etc/hosts", "/etc/hostname", "/etc/resolv.conf"}
+
+// writeNetworkFiles gives bridged containers name resolution. The files
+// are resolved inside the container's root, so an image or a learner
+// replacing them with symlinks can not redirect the writes to the host.
+func writeNetworkFiles(info *ContainerInfo) error {
+	root, err := os.OpenFile(info.filesystemRoot(), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	rootfd := int(root.Fd())
+
+	hosts := "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n"
+	if info.Network.IPAddress != "" {
+		hosts += fmt.Sprintf("%s\t%s\n", info.Network.IPAddress, info.hostname())
+	}
+	if err := writeFileInRoot(rootfd, "/etc/hosts", []byte(hosts), 0644); err != nil {
+		return err
+	}
+	if err := writeFileInRoot(rootfd, "/etc/hostname", []byte(info.hostname()+"\n"), 0644); err != nil {
+		return err
+	}
+
+	if info.Network.Mode == networkBridge {
+		// A local stub resolver is unreachable from the container's
+		// namespace, so prefer the upstream servers systemd-resolved uses
+		resolv, err := os.ReadFile("/run/systemd/resolve/resolv.conf")
+		if err != nil {
+			resolv, err = os.ReadFile("/etc/resolv.conf")
+		}
+		if err != nil {
+			return err
+		}
+		return writeFileInRoot(rootfd, "/etc/resolv.conf", resolv, 0644)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenIPAM(t *testing.T) {
+	tests := []struct {
+		subnet  string
+		gateway string
+		wantErr bool
+	}{
+		{subnet: "10.88.0.0/16", gateway: "10.88.0.1/16"},
+		{subnet: "10.88.5.7/24", gateway: "10.88.5.1/24"},
+		{subnet: "fd00::/64", wantErr: true},
+		{subnet: "10.88.0.0", wantErr: true},
+	}
+	for _, tt := range tests {
+		a, err := openIPAM(filepath.Join(t.TempDir(), "leases.json"), tt.subnet)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("openIPAM(%s) succeeded, want an error", tt.subnet)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("openIPAM(%s): %v", tt.subnet, err)
+		} else if got := a.Gateway().String(); got != tt.gateway {
+			t.Errorf("openIPAM(%s) gateway = %s, want %s", tt.subnet, got, tt.gateway)
+		}
+	}
+}
+
+func TestIPAMAllocate(t *testing.T) {
+	tests := []struct {
+		name   string
+		subnet string
+		// ops are "+id" to allocate for id and "-id" to release it
+		ops []string
+		// want are the addresses the allocations get, "" for an error
+		// and "*" for any
+		want []string
+	}{
+		{
+			name:   "lowest free address after the gateway",
+			subnet: "10.88.0.0/24",
+			ops:    []string{"+a", "+b", "+c"},
+			want:   []string{"10.88.0.2/24", "10.88.0.3/24", "10.88.0.4/24"},
+		},
+		{
+			name:   "released addresses are reused",
+			subnet: "10.88.0.0/24",
+			ops:    []string{"+a", "+b", "-a", "+c", "+d"},
+			want:   []string{"10.88.0.2/24", "10.88.0.3/24", "10.88.0.2/24", "10.88.0.4/24"},
+		},
+		{
+			name:   "release frees every lease of the container",
+			subnet: "10.88.0.0/24",
+			ops:    []string{"+a", "+a", "+b", "-a", "+c", "+d"},
+			want:   []string{"10.88.0.2/24", "10.88.0.3/24", "10.88.0.4/24", "10.88.0.2/24", "10.88.0.3/24"},
+		},
+		{
+			name:   "broadcast address is never handed out",
+			subnet: "10.88.0.0/30",
+			ops:    []string{"+a", "+b"},
+			want:   []string{"10.88.0.2/30", ""},
+		},
+		{
+			name:   "crossing an octet",
+			subnet: "10.88.0.0/23",
+			ops:    append(repeat("+x", 254), "+a"),
+			want:   append(repeat("*", 254), "10.88.1.0/23"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := openIPAM(filepath.Join(t.TempDir(), "leases.json"), tt.subnet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var allocated int
+			for _, op := range tt.ops {
+				id := op[1:]
+				if op[0] == '-' {
+					if err := a.Release(id); err != nil {
+						t.Fatalf("Release(%s): %v", id, err)
+					}
+					continue
+				}
+				want := tt.want[allocated]
+				allocated++
+				ip, err := a.Allocate(id)
+				if want == "" {
+					if err == nil {
+						t.Errorf("Allocate(%s) = %s, want an error", id, ip)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("Allocate(%s): %v", id, err)
+				}
+				if want != "*" && ip.String() != want {
+					t.Errorf("Allocate(%s) = %s, want %s", id, ip, want)
+				}
+			}
+		})
+	}
+}
+
+func repeat(s string, n int) []string {
+	list := make([]string, n)
+	for i := range list {
+		list[i] = s
+	}
+	return list
+}
+
+func TestIPAMPersistsLeases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	a, err := openIPAM(path, "10.88.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, err := a.Allocate(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted backend keeps b's address and hands out a's again
+	a, err = openIPAM(path, "10.88.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, err := a.Allocate("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.88.0.2/24" {
+		t.Errorf("Allocate after reopening = %s, want 10.88.0.2/24", ip)
+	}
+	ip, err = a.Allocate("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.88.0.4/24" {
+		t.Errorf("Allocate after reopening = %s, want 10.88.0.4/24", ip)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ociVersion is the version of the OCI runtime specification implemented.
+const ociVersion = "1.0.2"
+
+// ociSpec is the subset of an OCI runtime-spec config.json the native
+// driver understands. Unknown fields are ignored.
+type ociSpec struct {
+	OCIVersion  string            `json:"ociVersion"`
+	Process     *ociProcess       `json:"process,omitempty"`
+	Root        *ociRoot          `json:"root,omitempty"`
+	Hostname    string            `json:"hostname,omitempty"`
+	Mounts      []ociMount        `json:"mounts,omitempty"`
+	Hooks       *ociHooks         `json:"hooks,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Linux       *ociLinux         `json:"linux,omitempty"`
+}
+
+type ociProcess struct {
+	Terminal        bool             `json:"terminal,omitempty"`
+	User            ociUser          `json:"user"`
+	Args            []string         `json:"args"`
+	Env             []string         `json:"env,omitempty"`
+	Cwd             string           `json:"cwd"`
+	Capabilities    *ociCapabilities `json:"capabilities,omitempty"`
+	Rlimits         []ociRlimit      `json:"rlimits,omitempty"`
+	NoNewPrivileges bool             `json:"noNewPrivileges,omitempty"`
+	OOMScoreAdj     *int             `json:"oomScoreAdj,omitempty"`
+}
+
+type ociUser struct {
+	UID            uint32   `json:"uid"`
+	GID            uint32   `json:"gid"`
+	AdditionalGids []uint32 `json:"additionalGids,omitempty"`
+}
+
+type ociCapabilities struct {
+	Bounding    []string `json:"bounding,omitempty"`
+	Effective   []string `json:"effective,omitempty"`
+	Inheritable []string `json:"inheritable,omitempty"`
+	Permitted   []string `json:"permitted,omitempty"`
+	Ambient     []string `json:"ambient,omitempty"`
+}
+
+type ociRlimit struct {
+	Type string `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+type ociRoot struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+type ociMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type,omitempty"`
+	Source      string   `json:"source,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type ociHooks struct {
+	Prestart        []ociHook `json:"prestart,omitempty"`
+	CreateRuntime   []ociHook `json:"createRuntime,omitempty"`
+	CreateContainer []ociHook `json:"createContainer,omitempty"`
+	StartContainer  []ociHook `json:"startContainer,omitempty"`
+	Poststart       []ociHook `json:"poststart,omitempty"`
+	Poststop        []ociHook `json:"poststop,omitempty"`
+}
+
+type ociHook struct {
+	Path    string   `json:"path"`
+	Args    []string `json:"args,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	Timeout *int     `json:"timeout,omitempty"`
+}
+
+type ociLinux struct {
+	Namespaces        []ociNamespace    `json:"namespaces,omitempty"`
+	UIDMappings       []ociIDMapping    `json:"uidMappings,omitempty"`
+	GIDMappings       []ociIDMapping    `json:"gidMappings,omitempty"`
+	Devices           []ociDevice       `json:"devices,omitempty"`
+	CgroupsPath       string            `json:"cgroupsPath,omitempty"`
+	Resources         *cgroupResources  `json:"resources,omitempty"`
+	Sysctl            map[string]string `json:"sysctl,omitempty"`
+	Seccomp           *seccompProfile   `json:"seccomp,omitempty"`
+	RootfsPropagation string            `json:"rootfsPropagation,omitempty"`
+	MaskedPaths       []string          `json:"maskedPaths,omitempty"`
+	ReadonlyPaths     []string          `json:"readonlyPaths,omitempty"`
+}
+
+type ociNamespace struct {
+	Type string `json:"type"`
+	Path string `json:"path,omitempty"`
+}
+
+type ociIDMapping struct {
+	ContainerID uint32 `json:"containerID"`
+	HostID      uint32 `json:"hostID"`
+	Size        uint32 `json:"size"`
+}
+
+type ociDevice struct {
+	Type     string       `json:"type"`
+	Path     string       `json:"path"`
+	Major    int64        `json:"major"`
+	Minor    int64        `json:"minor"`
+	FileMode *os.FileMode `json:"fileMode,omitempty"`
+	UID      *uint32      `json:"uid,omitempty"`
+	GID      *uint32      `json:"gid,omitempty"`
+}
+
+// ociNamespaceFlags maps namespace types to their clone flags.
+var ociNamespaceFlags = map[string]uintptr{
+	"pid":     syscall.CLONE_NEWPID,
+	"network": syscall.CLONE_NEWNET,
+	"mount":   syscall.CLONE_NEWNS,
+	"ipc":     syscall.CLONE_NEWIPC,
+	"uts":     syscall.CLONE_NEWUTS,
+	"user":    syscall.CLONE_NEWUSER,
+	"cgroup":  unix.CLONE_NEWCGROUP,
+}
+
+// ociRlimits maps rlimit names to their resource numbers.
+var ociRlimits = map[string]int{
+	"RLIMIT_AS":         unix.RLIMIT_AS,
+	"RLIMIT_CORE":       unix.RLIMIT_CORE,
+	"RLIMIT_CPU":        unix.RLIMIT_CPU,
+	"RLIMIT_DATA":       unix.RLIMIT_DATA,
+	"RLIMIT_FSIZE":      unix.RLIMIT_FSIZE,
+	"RLIMIT_LOCKS":      unix.RLIMIT_LOCKS,
+	"RLIMIT_MEMLOCK":    unix.RLIMIT_MEMLOCK,
+	"RLIMIT_MSGQUEUE":   unix.RLIMIT_MSGQUEUE,
+	"RLIMIT_NICE":       unix.RLIMIT_NICE,
+	"RLIMIT_NOFILE":     unix.RLIMIT_NOFILE,
+	"RLIMIT_NPROC":      unix.RLIMIT_NPROC,
+	"RLIMIT_RSS":        unix.RLIMIT_RSS,
+	"RLIMIT_RTPRIO":     unix.RLIMIT_RTPRIO,
+	"RLIMIT_RTTIME":     unix.RLIMIT_RTTIME,
+	"RLIMIT_SIGPENDING": unix.RLIMIT_SIGPENDING,
+	"RLIMIT_STACK":      unix.RLIMIT_STACK,
+}
+
+var ociContainerID = regexp.MustCompile(`^[\w+.-]+$`)
+
+// loadBundle reads and validates the config.json of an OCI bundle. A
+// relative root path is resolved against the bundle.
+func loadBundle(bundle string) (*ociSpec, error) {
+	data, err := os.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return nil, err
+	}
+	var spec ociSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("invalid config.json: %w", err)
+	}
+	if spec.Root != nil && !filepath.IsAbs(spec.Root.Path) {
+		spec.Root.Path = filepath.Join(bundle, spec.Root.Path)
+	}
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// validate rejects specs the runtime can not honour.
+func (spec *ociSpec) validate() error {
+	if !strings.HasPrefix(spec.OCIVersion, "1.") {
+		return fmt.Errorf("unsupported OCI version %q", spec.OCIVersion)
+	}
+	if spec.Root == nil || spec.Root.Path == "" {
+		return errors.New("root.path is required")
+	}
+	if fi, err := os.Stat(spec.Root.Path); err != nil || !fi.IsDir() {
+		return fmt.Errorf("root filesystem %s is not a directory", spec.Root.Path)
+	}
+	if spec.Process == nil || len(spec.Process.Args) == 0 {
+		return errors.New("process.args is required")
+	}
+	if !filepath.IsAbs(spec.Process.Cwd) {
+		return errors.New("process.cwd must be an absolute path")
+	}
+	if spec.Linux == nil {
+		return errors.New("linux section is required")
+	}
+
+	seen := make(map[string]bool)
+	for _, ns := range spec.Linux.Namespaces {
+		if _, ok := ociNamespaceFlags[ns.Type]; !ok {
+			return fmt.Errorf("unknown namespace type %q", ns.Type)
+		}
+		if seen[ns.Type] {
+			return fmt.Errorf("namespace %s is listed twice", ns.Type)
+		}
+		seen[ns.Type] = true
+		// Joining these needs a single-threaded process, which a Go
+		// program never is
+		if ns.Path != "" && (ns.Type == "user" || ns.Type == "mount" || ns.Type == "pid") {
+			return fmt.Errorf("joining an existing %s namespace is not supported", ns.Type)
+		}
+	}
+	if spec.Hostname != "" && !seen["uts"] {
+		return errors.New("hostname requires a new uts namespace")
+	}
+	if !seen["mount"] {
+		return errors.New("a new mount namespace is required")
+	}
+	if seen["user"] && (len(spec.Linux.UIDMappings) == 0 || len(spec.Linux.GIDMappings) == 0) {
+		return errors.New("user namespace requires uid and gid mappings")
+	}
+
+	if caps := spec.Process.Capabilities; caps != nil {
+		for _, set := range [][]string{caps.Bounding, caps.Effective, caps.Inheritable, caps.Permitted, caps.Ambient} {
+			for _, name := range set {
+				if _, ok := capabilityByName(name); !ok {
+					return fmt.Errorf("unknown capability %q", name)
+				}
+			}
+		}
+	}
+	for _, rlimit := range spec.Process.Rlimits {
+		if _, ok := ociRlimits[rlimit.Type]; !ok {
+			return fmt.Errorf("unknown rlimit %q", rlimit.Type)
+		}
+	}
+	for _, m := range spec.Mounts {
+		if !filepath.IsAbs(m.Destination) {
+			return fmt.Errorf("mount destination %q must be absolute", m.Destination)
+		}
+	}
+	return spec.Hooks.validate()
+}
+
+// cloneFlags are the namespaces the init has to be created in; the ones
+// with a path are joined by the init instead.
+func (spec *ociSpec) cloneFlags() uintptr {
+	var flags uintptr
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Path == "" {
+			flags |= ociNamespaceFlags[ns.Type]
+		}
+	}
+	return flags
+}
+
+func (spec *ociSpec) hasNamespace(typ string) bool {
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// capabilitySets resolves the process' capability names.
+func (spec *ociSpec) capabilitySets() capabilitySets {
+	numbers := func(names []string) []uint {
+		var caps []uint
+		for _, name := range names {
+			capability, _ := capabilityByName(name)
+			caps = append(caps, capability)
+		}
+		return caps
+	}
+	caps := spec.Process.Capabilities
+	if caps == nil {
+		return capabilitySets{}
+	}
+	return capabilitySets{
+		Bounding:    numbers(caps.Bounding),
+		Effective:   numbers(caps.Effective),
+		Permitted:   numbers(caps.Permitted),
+		Inheritable: numbers(caps.Inheritable),
+		Ambient:     numbers(caps.Ambient),
+	}
+}
+
+// seccompFilter compiles linux.seccomp, which shares the format of
+// Docker's profiles, against the bounding capabilities.
+func (spec *ociSpec) seccompFilter() ([]unix.SockFilter, error) {
+	if spec.Linux.Seccomp == nil {
+		return nil, nil
+	}
+	caps := make(map[string]bool)
+	if spec.Process.Capabilities != nil {
+		for _, name := range spec.Process.Capabilities.Bounding {
+			caps[canonicalCapability(name)] = true
+		}
+	}
+	return compileSeccomp(spec.Linux.Seccomp, caps)
+}
+
+// sysProcAttr configures the namespaces and ID mappings of the init.
+func (spec *ociSpec) sysProcAttr() *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{Cloneflags: spec.cloneFlags()}
+	if attr.Cloneflags&syscall.CLONE_NEWUSER != 0 {
+		for _, m := range spec.Linux.UIDMappings {
+			attr.UidMappings = append(attr.UidMappings, syscall.SysProcIDMap{ContainerID: int(m.ContainerID), HostID: int(m.HostID), Size: int(m.Size)})
+		}
+		for _, m := range spec.Linux.GIDMappings {
+			attr.GidMappings = append(attr.GidMappings, syscall.SysProcIDMap{ContainerID: int(m.ContainerID), HostID: int(m.HostID), Size: int(m.Size)})
+		}
+		attr.GidMappingsEnableSetgroups = os.Geteuid() == 0
+	}
+	return attr
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ociCommands are the runtime operations the backend binary implements
+// when invoked as an OCI runtime, e.g. by the runtime conformance tests:
+//
+//	lcw-backend [--root DIR] create --bundle DIR [--console-socket PATH] [--pid-file PATH] ID
+//	lcw-backend [--root DIR] start|state ID
+//	lcw-backend [--root DIR] kill ID [SIGNAL]
+//	lcw-backend [--root DIR] delete [--force] ID
+var ociCommands = map[string]func(root string, args []string) error{
+	"create": ociCLICreate,
+	"start":  ociCLIStart,
+	"state":  ociCLIState,
+	"kill":   ociCLIKill,
+	"delete": ociCLIDelete,
+}
+
+// ociCLICommand returns the runtime operation named by the first
+// argument that is not a global flag, if any.
+func ociCLICommand(args []string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			if _, ok := ociCommands[arg]; ok {
+				return arg
+			}
+			return ""
+		}
+		// Global flags given as "--flag value" take the next argument
+		if !strings.Contains(arg, "=") && arg != "--debug" && arg != "--systemd-cgroup" {
+			i++
+		}
+	}
+	return ""
+}
+
+// runOCICLI runs a runtime operation and exits with its status.
+func runOCICLI(args []string) {
+	global := flag.NewFlagSet("runtime", flag.ExitOnError)
+	root := global.String("root", ociStateRoot(), "directory for container state")
+	logPath := global.String("log", "", "file to write errors to")
+	global.String("log-format", "text", "log format (text or json)")
+	global.Bool("debug", false, "enable debug output")
+	global.Bool("systemd-cgroup", false, "unsupported; accepted for compatibility")
+	global.Parse(args)
+
+	log.SetFlags(0)
+	if *logPath != "" {
+		f, err := os.OpenFile(*logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err == nil {
+			log.SetOutput(io.MultiWriter(os.Stderr, f))
+		}
+	}
+
+	rest := global.Args()
+	if err := ociCommands[rest[0]](*root, rest[1:]); err != nil {
+		log.Printf("%s: %v", rest[0], err)
+		os.Exit(1)
+	}
+}
+
+func ociCLICreate(root string, args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	bundle := fs.String("bundle", ".", "path to the bundle")
+	fs.StringVar(bundle, "b", ".", "path to the bundle")
+	consoleSocket := fs.String("console-socket", "", "socket to send the console's master to")
+	pidFile := fs.String("pid-file", "", "file to write the init's pid to")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a container id")
+	}
+
+	dir, err := filepath.Abs(*bundle)
+	if err != nil {
+		return err
+	}
+	spec, err := loadBundle(dir)
+	if err != nil {
+		return err
+	}
+	_, _, err = ociCreate(root, fs.Arg(0), dir, spec, ociCreateOptions{
+		ConsoleSocket: *consoleSocket,
+		PidFile:       *pidFile,
+		Stdin:         os.Stdin,
+		Stdout:        os.Stdout,
+		Stderr:        os.Stderr,
+	})
+	return err
+}
+
+func ociCLIStart(root string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a container id")
+	}
+	ctr, err := loadOCIContainer(root, args[0])
+	if err != nil {
+		return err
+	}
+	return ctr.start()
+}
+
+func ociCLIState(root string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a container id")
+	}
+	ctr, err := loadOCIContainer(root, args[0])
+	if err != nil {
+		return err
+	}
+	if ctr.Status == ociStopped {
+		ctr.Pid = 0
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(ctr.ociState)
+}
+
+func ociCLIKill(root string, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("expected a container id and optional signal")
+	}
+	ctr, err := loadOCIContainer(root, args[0])
+	if err != nil {
+		return err
+	}
+	signal := "SIGTERM"
+	if len(args) == 2 {
+		signal = args[1]
+	}
+	sig, err := parseSignal(signal)
+	if err != nil {
+		return err
+	}
+	return ctr.kill(sig)
+}
+
+func ociCLIDelete(root string, args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	force := fs.Bool("force", false, "kill the container if it is still running")
+	fs.BoolVar(force, "f", false, "kill the container if it is still running")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a container id")
+	}
+	ctr, err := loadOCIContainer(root, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return ctr.delete(*force)
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+// ociInitCommand is the argument the runtime re-executes itself with to
+// become the init of an OCI container. The init prepares the container,
+// waits for it to be started and then executes the container process.
+const ociInitCommand = "oci-init"
+
+// Descriptors the runtime hands to the OCI init
+const (
+	ociInitControlFd = 3 // configuration, then a byte to continue past the createRuntime hooks
+	ociInitStatusFd  = 4 // progress lines written back to the runtime
+	ociInitFifoFd    = 5 // exec.fifo opened with O_PATH, reopened for writing to wait for start
+)
+
+// Progress reported by the init on its status descriptor
+const (
+	ociInitMounted = "mounted"
+	ociInitCreated = "created"
+)
+
+// ociInitConfig is what the runtime sends the init.
+type ociInitConfig struct {
+	Spec          *ociSpec          `json:"spec"`
+	Seccomp       []unix.SockFilter `json:"seccomp,omitempty"`
+	ConsoleSocket string            `json:"consoleSocket,omitempty"`
+	// State is passed to the hooks the init runs itself
+	State ociState `json:"state"`
+}
+
+// ociMountFlags maps mount options to the flags they set or clear.
+var ociMountFlags = map[string]struct {
+	clear bool
+	flag  uintptr
+}{
+	"ro":            {false, syscall.MS_RDONLY},
+	"rw":            {true, syscall.MS_RDONLY},
+	"nosuid":        {false, syscall.MS_NOSUID},
+	"suid":          {true, syscall.MS_NOSUID},
+	"nodev":         {false, syscall.MS_NODEV},
+	"dev":           {true, syscall.MS_NODEV},
+	"noexec":        {false, syscall.MS_NOEXEC},
+	"exec":          {true, syscall.MS_NOEXEC},
+	"sync":          {false, syscall.MS_SYNCHRONOUS},
+	"async":         {true, syscall.MS_SYNCHRONOUS},
+	"dirsync":       {false, syscall.MS_DIRSYNC},
+	"remount":       {false, syscall.MS_REMOUNT},
+	"mand":          {false, syscall.MS_MANDLOCK},
+	"nomand":        {true, syscall.MS_MANDLOCK},
+	"noatime":       {false, syscall.MS_NOATIME},
+	"atime":         {true, syscall.MS_NOATIME},
+	"nodiratime":    {false, syscall.MS_NODIRATIME},
+	"diratime":      {true, syscall.MS_NODIRATIME},
+	"relatime":      {false, syscall.MS_RELATIME},
+	"norelatime":    {true, syscall.MS_RELATIME},
+	"strictatime":   {false, syscall.MS_STRICTATIME},
+	"nostrictatime": {true, syscall.MS_STRICTATIME},
+	"bind":          {false, syscall.MS_BIND},
+	"rbind":         {false, syscall.MS_BIND | syscall.MS_REC},
+}
+
+// ociPropagationFlags are applied with separate mount calls.
+var ociPropagationFlags = map[string]uintptr{
+	"private":     syscall.MS_PRIVATE,
+	"rprivate":    syscall.MS_PRIVATE | syscall.MS_REC,
+	"shared":      syscall.MS_SHARED,
+	"rshared":     syscall.MS_SHARED | syscall.MS_REC,
+	"slave":       syscall.MS_SLAVE,
+	"rslave":      syscall.MS_SLAVE | syscall.MS_REC,
+	"unbindable":  syscall.MS_UNBINDABLE,
+	"runbindable": syscall.MS_UNBINDABLE | syscall.MS_REC,
+}
+
+// parseMountOptions splits mount options into flags, propagation changes
+// and the filesystem specific data string.
+func parseMountOptions(options []string) (flags uintptr, propagation []uintptr, data string) {
+	var extra []string
+	for _, option := range options {
+		if f, ok := ociMountFlags[option]; ok {
+			if f.clear {
+				flags &^= f.flag
+			} else {
+				flags |= f.flag
+			}
+		} else if p, ok := ociPropagationFlags[option]; ok {
+			propagation = append(propagation, p)
+		} else {
+			extra = append(extra, option)
+		}
+	}
+	return flags, propagation, strings.Join(extra, ",")
+}
+
+// runOCIInit is the entry point of the OCI init. Errors before the
+// container is created are reported to the runtime, later ones on stderr.
+func runOCIInit() {
+	runtime.LockOSThread()
+
+	control := os.NewFile(ociInitControlFd, "control")
+	status := os.NewFile(ociInitStatusFd, "status")
+	fifo := os.NewFile(ociInitFifoFd, "exec.fifo")
+	fail := func(err error) {
+		fmt.Fprintf(status, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	decoder := json.NewDecoder(control)
+	var config ociInitConfig
+	if err := decoder.Decode(&config); err != nil {
+		fail(fmt.Errorf("invalid configuration: %w", err))
+	}
+	spec := config.Spec
+
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Path != "" {
+			if err := joinNamespace(ns.Path, int(ociNamespaceFlags[ns.Type])); err != nil {
+				fail(err)
+			}
+		}
+	}
+
+	// The console socket lives on the host, so connect before pivoting
+	var console *net.UnixConn
+	if spec.Process.Terminal {
+		if config.ConsoleSocket == "" {
+			fail(errors.New("process.terminal requires a console socket"))
+		}
+		conn, err := net.Dial("unix", config.ConsoleSocket)
+		if err != nil {
+			fail(fmt.Errorf("failed to connect to console socket: %w", err))
+		}
+		console = conn.(*net.UnixConn)
+	}
+
+	if err := setupOCIRootfs(spec); err != nil {
+		fail(err)
+	}
+
+	// createRuntime hooks run now, while the init still sees the host
+	fmt.Fprintln(status, ociInitMounted)
+	if _, err := io.ReadFull(io.MultiReader(decoder.Buffered(), control), make([]byte, 1)); err != nil {
+		os.Exit(1)
+	}
+	control.Close()
+
+	// createContainer hooks run in the container's namespaces, but still
+	// resolve their paths on the host
+	if err := runHooks(spec.Hooks, hookCreateContainer, config.State); err != nil {
+		fail(err)
+	}
+
+	if err := finishOCIRootfs(spec); err != nil {
+		fail(err)
+	}
+	if console != nil {
+		if err := setupConsole(console); err != nil {
+			fail(err)
+		}
+	}
+	if err := setupOCIProcess(spec.Process); err != nil {
+		fail(err)
+	}
+
+	fmt.Fprintln(status, ociInitCreated)
+	status.Close()
+
+	// Opening the fifo blocks until the runtime's start opens the other end
+	f, err := os.OpenFile(fmt.Sprintf("/proc/self/fd/%d", ociInitFifoFd), os.O_WRONLY, 0)
+	if err != nil {
+		log.Fatalf("oci init: failed to open exec fifo: %v", err)
+	}
+	fifo.Close()
+
+	// startContainer hooks run inside the container, so a failure goes
+	// back to start through the fifo instead of a zero byte
+	config.State.Status = ociCreated
+	if err := runHooks(spec.Hooks, hookStartContainer, config.State); err != nil {
+		f.Write([]byte(err.Error()))
+		os.Exit(1)
+	}
+	f.Write([]byte{0})
+	f.Close()
+
+	if err := execOCIProcess(spec, config.Seccomp); err != nil {
+		log.Fatalf("oci init: %v", err)
+	}
+}
+
+func joinNamespace(path string, flag int) error {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if err := unix.Setns(fd, flag); err != nil {
+		return fmt.Errorf("setns %s: %w", path, err)
+	}
+	return nil
+}
+
+// setupOCIRootfs performs the spec's mounts inside the root filesystem
+// and populates /dev, before pivoting into it.
+func setupOCIRootfs(spec *ociSpec) error {
+	propagation := uintptr(syscall.MS_REC | syscall.MS_PRIVATE)
+	if p, ok := ociPropagationFlags[spec.Linux.RootfsPropagation]; ok {
+		propagation = p
+	}
+	if err := syscall.Mount("", "/", "", propagation, ""); err != nil {
+		return fmt.Errorf("failed to set rootfs propagation: %w", err)
+	}
+
+	rootfs := spec.Root.Path
+	if err := syscall.Mount(rootfs, rootfs, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind mount rootfs: %w", err)
+	}
+	for _, m := range spec.Mounts {
+		if err := mountOCI(rootfs, m); err != nil {
+			return fmt.Errorf("failed to mount %s: %w", m.Destination, err)
+		}
+	}
+
+	dev := filepath.Join(rootfs, "dev")
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		return err
+	}
+	for _, d := range spec.Linux.Devices {
+		if err := createDevice(rootfs, d); err != nil {
+			return fmt.Errorf("failed to create device %s: %w", d.Path, err)
+		}
+	}
+	return populateDev(dev)
+}
+
+// mountOCI performs a single mount of the spec. Bind mounts need a second
+// call to apply flags such as ro.
+func mountOCI(rootfs string, m ociMount) error {
+	target, err := resolveInRoot(rootfs, m.Destination)
+	if err != nil {
+		return err
+	}
+	flags, propagation, data := parseMountOptions(m.Options)
+	bind := flags&syscall.MS_BIND != 0
+
+	if fi, err := os.Stat(m.Source); bind && err == nil && !fi.IsDir() {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644); err == nil {
+			f.Close()
+		}
+	} else if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+
+	switch {
+	case bind:
+		if err := syscall.Mount(m.Source, target, "", flags&(syscall.MS_BIND|syscall.MS_REC), ""); err != nil {
+			return err
+		}
+		if remount := flags &^ (syscall.MS_BIND | syscall.MS_REC | syscall.MS_REMOUNT); remount != 0 {
+			if err := syscall.Mount("", target, "", remount|syscall.MS_BIND|syscall.MS_REMOUNT, ""); err != nil {
+				return err
+			}
+		}
+	case m.Type == "cgroup" && !cgroupV2():
+		// The v1 hierarchies are made visible as they are on the host
+		if err := syscall.Mount(cgroupRoot, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return err
+		}
+		if err := syscall.Mount("", target, "", flags|syscall.MS_BIND|syscall.MS_REMOUNT, ""); err != nil {
+			return err
+		}
+	case m.Type == "cgroup":
+		if err := syscall.Mount("cgroup2", target, "cgroup2", flags, data); err != nil {
+			return err
+		}
+	default:
+		err := syscall.Mount(m.Source, target, m.Type, flags, data)
+		if err == syscall.EPERM && m.Type == "sysfs" {
+			// Only possible in a network namespace we own
+			err = syscall.Mount("/sys", target, "", syscall.MS_BIND|syscall.MS_REC, "")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, p := range propagation {
+		if err := syscall.Mount("", target, "", p, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveInRoot resolves path inside root, following symlinks as if root
+// were the filesystem root so they can not lead outside of it.
+func resolveInRoot(root, path string) (string, error) {
+	resolved := "/"
+	parts := strings.Split(path, "/")
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > 255 {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", path)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// createDevice makes a device node from linux.devices, falling back to
+// bind mounting the host's node where mknod is not permitted.
+func createDevice(rootfs string, d ociDevice) error {
+	path, err := resolveInRoot(rootfs, d.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	os.Remove(path)
+
+	mode := uint32(0666)
+	if d.FileMode != nil {
+		mode = uint32(*d.FileMode) & 0777
+	}
+	switch d.Type {
+	case "c", "u":
+		mode |= syscall.S_IFCHR
+	case "b":
+		mode |= syscall.S_IFBLK
+	case "p":
+		mode |= syscall.S_IFIFO
+	default:
+		return fmt.Errorf("unknown device type %q", d.Type)
+	}
+
+	err = syscall.Mknod(path, mode, int(unix.Mkdev(uint32(d.Major), uint32(d.Minor))))
+	if errors.Is(err, syscall.EPERM) {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		return syscall.Mount(d.Path, path, "", syscall.MS_BIND, "")
+	}
+	if err != nil {
+		return err
+	}
+	if d.UID != nil || d.GID != nil {
+		uid, gid := -1, -1
+		if d.UID != nil {
+			uid = int(*d.UID)
+		}
+		if d.GID != nil {
+			gid = int(*d.GID)
+		}
+		return os.Lchown(path, uid, gid)
+	}
+	return nil
+}
+
+// finishOCIRootfs pivots into the root filesystem and applies what has to
+// happen from inside it.
+func finishOCIRootfs(spec *ociSpec) error {
+	if spec.Hostname != "" {
+		if err := syscall.Sethostname([]byte(spec.Hostname)); err != nil {
+			return fmt.Errorf("failed to set hostname: %w", err)
+		}
+	}
+	if err := pivotRoot(spec.Root.Path); err != nil {
+		return err
+	}
+
+	for _, path := range spec.Linux.MaskedPaths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if fi.IsDir() {
+			err = syscall.Mount("tmpfs", path, "tmpfs", syscall.MS_RDONLY, "")
+		} else {
+			err = syscall.Mount("/dev/null", path, "", syscall.MS_BIND, "")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to mask %s: %w", path, err)
+		}
+	}
+	for _, path := range spec.Linux.ReadonlyPaths {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return err
+		}
+		if err := syscall.Mount("", path, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to make %s read-only: %w", path, err)
+		}
+	}
+
+	for key, value := range spec.Linux.Sysctl {
+		path := filepath.Join("/proc/sys", strings.ReplaceAll(key, ".", "/"))
+		if err := os.WriteFile(path, []byte(value), 0); err != nil {
+			return fmt.Errorf("failed to set sysctl %s: %w", key, err)
+		}
+	}
+
+	if spec.Root.Readonly {
+		if err := syscall.Mount("", "/", "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			return fmt.Errorf("failed to make rootfs read-only: %w", err)
+		}
+	}
+	return nil
+}
+
+// setupConsole allocates a pty inside the container, hands its master to
+// the console socket and makes the slave the init's controlling terminal.
+func setupConsole(conn *net.UnixConn) error {
+	defer conn.Close()
+	master, slave, err := pty.Open()
+	if err != nil {
+		return fmt.Errorf("failed to allocate console: %w", err)
+	}
+	defer master.Close()
+	defer slave.Close()
+
+	if _, _, err := conn.WriteMsgUnix([]byte(slave.Name()), unix.UnixRights(int(master.Fd())), nil); err != nil {
+		return fmt.Errorf("failed to send console: %w", err)
+	}
+
+	if f, err := os.OpenFile("/dev/console", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600); err == nil {
+		f.Close()
+	}
+	if err := syscall.Mount(slave.Name(), "/dev/console", "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind /dev/console: %w", err)
+	}
+
+	for fd := 0; fd <= 2; fd++ {
+		if err := unix.Dup3(int(slave.Fd()), fd, 0); err != nil {
+			return err
+		}
+	}
+	if _, err := unix.Setsid(); err != nil {
+		return fmt.Errorf("setsid: %w", err)
+	}
+	return unix.IoctlSetInt(0, unix.TIOCSCTTY, 0)
+}
+
+// setupOCIProcess applies the process' rlimits and OOM score adjustment,
+// which need privileges the process may not keep.
+func setupOCIProcess(process *ociProcess) error {
+	for _, r := range process.Rlimits {
+		limit := unix.Rlimit{Cur: r.Soft, Max: r.Hard}
+		if err := unix.Setrlimit(ociRlimits[r.Type], &limit); err != nil {
+			return fmt.Errorf("failed to set %s: %w", r.Type, err)
+		}
+	}
+	if process.OOMScoreAdj != nil {
+		if err := os.WriteFile("/proc/self/oom_score_adj", []byte(fmt.Sprint(*process.OOMScoreAdj)), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execOCIProcess switches to the process' user, applies its capabilities,
+// no_new_privs and seccomp filter and executes it.
+func execOCIProcess(spec *ociSpec, filter []unix.SockFilter) error {
+	process := spec.Process
+	if err := os.Chdir(process.Cwd); err != nil {
+		return err
+	}
+	path, err := lookPath(process.Args[0], process.Env)
+	if err != nil {
+		return err
+	}
+
+	// Without no_new_privs the filter needs CAP_SYS_ADMIN to go in
+	if !process.NoNewPrivileges {
+		if err := installSeccomp(filter); err != nil {
+			return err
+		}
+	}
+
+	// Keep the permitted set across the switch to a non-root user
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+		return err
+	}
+	groups := make([]int, len(process.User.AdditionalGids))
+	for i, gid := range process.User.AdditionalGids {
+		groups[i] = int(gid)
+	}
+	// setgroups may be denied in a user namespace; that only matters if
+	// groups were asked for
+	if err := syscall.Setgroups(groups); err != nil && len(groups) > 0 {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(int(process.User.GID)); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(int(process.User.UID)); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 0, 0, 0, 0); err != nil {
+		return err
+	}
+
+	if process.Capabilities != nil {
+		if err := applyCapabilities(spec.capabilitySets()); err != nil {
+			return err
+		}
+	}
+	if process.NoNewPrivileges {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return err
+		}
+		if err := installSeccomp(filter); err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Exec(path, process.Args, process.Env); err != nil {
+		return fmt.Errorf("exec %s: %w", path, err)
+	}
+	return nil
+}
+
+// readInitStatus waits for the init to report the given progress.
+func readInitStatus(r *bufio.Reader, want string) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return errors.New("container init exited unexpectedly")
+	}
+	line = strings.TrimSpace(line)
+	if msg, ok := strings.CutPrefix(line, "error: "); ok {
+		return errors.New(msg)
+	}
+	if line != want {
+		return fmt.Errorf("unexpected status %q from container init", line)
+	}
+	return nil
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// OCI container statuses
+const (
+	ociCreating = "creating"
+	ociCreated  = "created"
+	ociRunning  = "running"
+	ociStopped  = "stopped"
+)
+
+// ociState is the state of a container as the runtime spec defines it.
+// It is what `state` prints and what hooks receive on stdin.
+type ociState struct {
+	OCIVersion  string            `json:"ociVersion"`
+	ID          string            `json:"id"`
+	Status      string            `json:"status"`
+	Pid         int               `json:"pid,omitempty"`
+	Bundle      string            `json:"bundle"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociContainer is a container created by the runtime, persisted in
+// <root>/<id>/state.json so separate invocations of the CLI can find it.
+type ociContainer struct {
+	ociState
+	Created   time.Time `json:"created"`
+	StartTime uint64    `json:"startTime"`
+	Cgroup    *cgroup   `json:"cgroup,omitempty"`
+	Spec      *ociSpec  `json:"spec"`
+
+	root string
+}
+
+// ociCreateOptions are the parts of create that are not in the spec.
+type ociCreateOptions struct {
+	ConsoleSocket string
+	PidFile       string
+	Stdin         io.Reader
+	Stdout        io.Writer
+	Stderr        io.Writer
+}
+
+// ociStateRoot is where the runtime keeps container state by default.
+func ociStateRoot() string {
+	return filepath.Join(config.Backend.StateDir, "oci")
+}
+
+func (ctr *ociContainer) dir() string {
+	return filepath.Join(ctr.root, ctr.ID)
+}
+
+func (ctr *ociContainer) fifo() string {
+	return filepath.Join(ctr.dir(), "exec.fifo")
+}
+
+func (ctr *ociContainer) save() error {
+	data, err := json.Marshal(ctr)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(ctr.dir(), "state.json.tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(ctr.dir(), "state.json"))
+}
+
+// loadOCIContainer reads a container's state and refreshes its status.
+func loadOCIContainer(root, id string) (*ociContainer, error) {
+	if !ociContainerID.MatchString(id) {
+		return nil, fmt.Errorf("invalid container id %q", id)
+	}
+	data, err := os.ReadFile(filepath.Join(root, id, "state.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("container %s does not exist", id)
+	} else if err != nil {
+		return nil, err
+	}
+	ctr := &ociContainer{root: root}
+	if err := json.Unmarshal(data, ctr); err != nil {
+		return nil, fmt.Errorf("corrupt state for container %s: %w", id, err)
+	}
+	ctr.refresh()
+	return ctr, nil
+}
+
+// refresh derives the status from the init process. A pid that was reused
+// by another process is told apart by its start time.
+func (ctr *ociContainer) refresh() {
+	if ctr.Status == ociCreating || ctr.Status == ociStopped {
+		return
+	}
+	start, state, err := processStat(ctr.Pid)
+	if err != nil || start != ctr.StartTime || state == 'Z' || state == 'X' {
+		ctr.Status = ociStopped
+		return
+	}
+	if _, err := os.Stat(ctr.fifo()); err == nil {
+		ctr.Status = ociCreated
+	} else {
+		ctr.Status = ociRunning
+	}
+}
+
+// processStat returns the start time and state of a process from
+// /proc/<pid>/stat.
+func processStat(pid int) (start uint64, state byte, err error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	// The command name is in parentheses and may itself contain them
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return 0, 0, errors.New("malformed stat")
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 20 {
+		return 0, 0, errors.New("malformed stat")
+	}
+	start, err = strconv.ParseUint(fields[19], 10, 64)
+	return start, fields[0][0], err
+}
+
+// ociCreate creates a container from spec up to the point where only the
+// user process remains to be executed. The returned command is the init,
+// which the caller may wait for if it wants to reap it.
+func ociCreate(root, id, bundle string, spec *ociSpec, opts ociCreateOptions) (*ociContainer, *exec.Cmd, error) {
+	if !ociContainerID.MatchString(id) {
+		return nil, nil, fmt.Errorf("invalid container id %q", id)
+	}
+	filter, err := spec.seccompFilter()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, nil, err
+	}
+	ctr := &ociContainer{
+		ociState: ociState{
+			OCIVersion:  ociVersion,
+			ID:          id,
+			Status:      ociCreating,
+			Bundle:      bundle,
+			Annotations: spec.Annotations,
+		},
+		Created: time.Now().UTC(),
+		Spec:    spec,
+		root:    root,
+	}
+	if err := os.Mkdir(ctr.dir(), 0700); errors.Is(err, os.ErrExist) {
+		return nil, nil, fmt.Errorf("container %s already exists", id)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	cmd, err := ctr.startInit(filter, opts)
+	if err != nil {
+		ctr.destroy()
+		return nil, nil, err
+	}
+	return ctr, cmd, nil
+}
+
+func (ctr *ociContainer) startInit(filter []unix.SockFilter, opts ociCreateOptions) (*exec.Cmd, error) {
+	if err := unix.Mkfifo(ctr.fifo(), 0600); err != nil {
+		return nil, err
+	}
+	fifo, err := os.OpenFile(ctr.fifo(), unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer fifo.Close()
+	controlR, controlW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer controlR.Close()
+	defer controlW.Close()
+	statusR, statusW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer statusR.Close()
+	defer statusW.Close()
+
+	cmd := exec.Command("/proc/self/exe", ociInitCommand)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = opts.Stdin, opts.Stdout, opts.Stderr
+	cmd.ExtraFiles = []*os.File{controlR, statusW, fifo}
+	cmd.SysProcAttr = ctr.Spec.sysProcAttr()
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start container init: %w", err)
+	}
+	statusW.Close()
+	controlR.Close()
+	ctr.Pid = cmd.Process.Pid
+	// A failed create continues as a delete would, with the poststop hooks
+	fail := func(err error) (*exec.Cmd, error) {
+		cmd.Process.Kill()
+		cmd.Wait()
+		ctr.Status = ociStopped
+		if err := ctr.runHooks(hookPoststop); err != nil {
+			log.Printf("container %s: %v", ctr.ID, err)
+		}
+		return nil, err
+	}
+	if ctr.StartTime, _, err = processStat(ctr.Pid); err != nil {
+		return fail(err)
+	}
+
+	// The cgroup has to hold the init before it forks anything
+	path := ctr.Spec.Linux.CgroupsPath
+	if path == "" {
+		path = filepath.Join("lcw", ctr.ID)
+	}
+	if ctr.Cgroup, err = createCgroup(path, ctr.Spec.Linux.Resources); err != nil {
+		return fail(err)
+	}
+	if err := ctr.Cgroup.addProcess(ctr.Pid); err != nil {
+		return fail(err)
+	}
+
+	// Without a trailing newline, so the next byte is the one to continue
+	config, err := json.Marshal(ociInitConfig{Spec: ctr.Spec, Seccomp: filter, ConsoleSocket: opts.ConsoleSocket, State: ctr.ociState})
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := controlW.Write(config); err != nil {
+		return fail(err)
+	}
+	status := bufio.NewReader(statusR)
+	if err := readInitStatus(status, ociInitMounted); err != nil {
+		return fail(err)
+	}
+	if err := ctr.runHooks(hookPrestart); err != nil {
+		return fail(err)
+	}
+	if err := ctr.runHooks(hookCreateRuntime); err != nil {
+		return fail(err)
+	}
+	if _, err := controlW.Write([]byte{0}); err != nil {
+		return fail(err)
+	}
+	if err := readInitStatus(status, ociInitCreated); err != nil {
+		return fail(err)
+	}
+
+	ctr.Status = ociCreated
+	if err := ctr.save(); err != nil {
+		return fail(err)
+	}
+	if opts.PidFile != "" {
+		if err := os.WriteFile(opts.PidFile, []byte(strconv.Itoa(ctr.Pid)), 0644); err != nil {
+			return fail(err)
+		}
+	}
+	return cmd, nil
+}
+
+// start lets the init execute the user process.
+func (ctr *ociContainer) start() error {
+	if ctr.Status != ociCreated {
+		return fmt.Errorf("container %s is %s, not created", ctr.ID, ctr.Status)
+	}
+	// Opening the fifo for reading releases the init blocked on its
+	// write end; the byte it writes confirms it got there
+	f, err := os.OpenFile(ctr.fifo(), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	os.Remove(ctr.fifo())
+	buf := make([]byte, 4096)
+	n, err := f.Read(buf)
+	if err != nil {
+		return fmt.Errorf("container init exited before starting: %w", err)
+	}
+	if n > 1 || buf[0] != 0 {
+		// The container is stopped and only waits to be deleted
+		syscall.Kill(ctr.Pid, syscall.SIGKILL)
+		ctr.Status = ociStopped
+		ctr.save()
+		return errors.New(string(buf[:n]))
+	}
+
+	ctr.Status = ociRunning
+	if err := ctr.save(); err != nil {
+		return err
+	}
+	if err := ctr.runHooks(hookPoststart); err != nil {
+		log.Printf("container %s: %v", ctr.ID, err)
+	}
+	return nil
+}
+
+// kill sends a signal to the container's init.
+func (ctr *ociContainer) kill(sig syscall.Signal) error {
+	if ctr.Status != ociCreated && ctr.Status != ociRunning {
+		return fmt.Errorf("container %s is not running", ctr.ID)
+	}
+	return syscall.Kill(ctr.Pid, sig)
+}
+
+// delete removes a stopped container, killing it first if force is set.
+func (ctr *ociContainer) delete(force bool) error {
+	if ctr.Status == ociCreated || ctr.Status == ociRunning {
+		if !force {
+			return fmt.Errorf("container %s is %s", ctr.ID, ctr.Status)
+		}
+		syscall.Kill(ctr.Pid, syscall.SIGKILL)
+		for i := 0; i < 100 && ctr.Status != ociStopped; i++ {
+			time.Sleep(20 * time.Millisecond)
+			ctr.refresh()
+		}
+		if ctr.Status != ociStopped {
+			return fmt.Errorf("container %s did not stop", ctr.ID)
+		}
+	}
+	ctr.Status = ociStopped
+	if err := ctr.runHooks(hookPoststop); err != nil {
+		log.Printf("container %s: %v", ctr.ID, err)
+	}
+	return ctr.destroy()
+}
+
+func (ctr *ociContainer) destroy() error {
+	var errs []error
+	if ctr.Cgroup != nil {
+		errs = append(errs, ctr.Cgroup.removeExited())
+	}
+	errs = append(errs, os.RemoveAll(ctr.dir()))
+	return errors.Join(errs...)
+}
+
+// parseSignal accepts a signal number or name, with or without the SIG
+// prefix.
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil && n > 0 && n < 65 {
+		return syscall.Signal(n), nil
+	}
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig := unix.SignalNum(name); sig != 0 {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", s)
+}
+
+// defaultOCIMounts are the filesystems a spec sent to the API gets when it
+// lists no mounts of its own.
+var defaultOCIMounts = []ociMount{
+	{Destination: "/proc", Type: "proc", Source: "proc", Options: []string{"nosuid", "noexec", "nodev"}},
+	{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+	{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"}},
+	{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+	{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "ro"}},
+}
+
+// ociConfinedMountTypes are the filesystems a spec sent to the API may
+// mount. None of them exposes anything of the host.
+var ociConfinedMountTypes = map[string]bool{"proc": true, "sysfs": true, "tmpfs": true, "devpts": true, "mqueue": true}
+
+// confineSpec holds a spec sent to the API to what the container's
+// template allows its shells. The runtime runs as root on the host, so
+// the spec gets no hooks, host mounts, devices or host wide sysctls, no
+// capabilities beyond the template's and its seccomp profile, the
+// container's namespaces and a cgroup named after the container.
+func confineSpec(info *ContainerInfo, spec *ociSpec) error {
+	for _, kind := range hookKinds {
+		if len(spec.Hooks.list(kind)) > 0 {
+			return fmt.Errorf("%s hooks are not allowed", kind)
+		}
+	}
+
+	for i, m := range spec.Mounts {
+		if !ociConfinedMountTypes[m.Type] {
+			return fmt.Errorf("mount %s: type %q is not allowed", m.Destination, m.Type)
+		}
+		for _, option := range m.Options {
+			switch option {
+			case "bind", "rbind", "shared", "rshared":
+				return fmt.Errorf("mount %s: option %s is not allowed", m.Destination, option)
+			}
+		}
+		if m.Type == "sysfs" && !containsString(m.Options, "ro") {
+			spec.Mounts[i].Options = append(m.Options[:len(m.Options):len(m.Options)], "ro")
+		}
+	}
+	switch spec.Linux.RootfsPropagation {
+	case "shared", "rshared":
+		return fmt.Errorf("rootfs propagation %s is not allowed", spec.Linux.RootfsPropagation)
+	}
+	if len(spec.Linux.Devices) > 0 {
+		return errors.New("linux.devices is not allowed")
+	}
+	for key := range spec.Linux.Sysctl {
+		if !namespacedSysctl(key, info.Network.Mode == networkHost) {
+			return fmt.Errorf("sysctl %s is not allowed", key)
+		}
+	}
+
+	// Only user and cgroup namespaces may be added to the container's
+	var namespaces []ociNamespace
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Path != "" {
+			return fmt.Errorf("joining a %s namespace is not allowed", ns.Type)
+		}
+		if ns.Type == "user" || ns.Type == "cgroup" {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	for _, typ := range []string{"pid", "mount", "uts", "ipc"} {
+		namespaces = append(namespaces, ociNamespace{Type: typ})
+	}
+	if info.Network.Mode != networkHost {
+		namespaces = append(namespaces, ociNamespace{Type: "network", Path: info.netnsPath()})
+	}
+	spec.Linux.Namespaces = namespaces
+	// Below the container's cgroup, whose limits the spec can only tighten
+	spec.Linux.CgroupsPath = filepath.Join(containerCgroupPath(info.ID), cgroupOCILeaf)
+
+	allowed, err := info.Template.capabilitySet()
+	if err != nil {
+		return err
+	}
+	if caps := spec.Process.Capabilities; caps != nil {
+		for _, set := range [][]string{caps.Bounding, caps.Effective, caps.Inheritable, caps.Permitted, caps.Ambient} {
+			for _, name := range set {
+				if !allowed[canonicalCapability(name)] {
+					return fmt.Errorf("capability %s is not allowed in section %s", name, info.SectionID)
+				}
+			}
+		}
+	} else {
+		var names []string
+		for name := range allowed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		spec.Process.Capabilities = &ociCapabilities{Bounding: names, Effective: names, Permitted: names}
+	}
+	if info.security.NoNewPrivileges {
+		spec.Process.NoNewPrivileges = true
+	}
+	spec.Linux.Seccomp, err = info.Template.loadSeccomp()
+	return err
+}
+
+// namespacedSysctl reports whether a sysctl only affects the container's
+// own IPC or network namespace.
+func namespacedSysctl(key string, hostNetwork bool) bool {
+	if strings.Contains(key, "/") {
+		return false
+	}
+	switch key {
+	case "kernel.msgmax", "kernel.msgmnb", "kernel.msgmni", "kernel.sem",
+		"kernel.shmall", "kernel.shmmax", "kernel.shmmni", "kernel.shm_rmid_forced":
+		return true
+	}
+	if strings.HasPrefix(key, "fs.mqueue.") {
+		return true
+	}
+	return strings.HasPrefix(key, "net.") && !hostNetwork
+}
+
+// runOCIContainer creates and starts spec as the main process of a native
+// container. The container provides the root filesystem and network, and
+// whatever else the spec leaves out; confineSpec limits the rest.
+func runOCIContainer(info *ContainerInfo, spec *ociSpec) error {
+	if spec.OCIVersion == "" {
+		spec.OCIVersion = ociVersion
+	}
+	readonly := spec.Root != nil && spec.Root.Readonly
+	spec.Root = &ociRoot{Path: info.rootfsPath(), Readonly: readonly}
+
+	if spec.Process == nil {
+		spec.Process = &ociProcess{}
+	}
+	process := spec.Process
+	if process.Terminal {
+		return errors.New("process.terminal is not supported, use the container's terminal instead")
+	}
+	if len(process.Args) == 0 {
+		return errors.New("process.args is required")
+	}
+	if process.Cwd == "" {
+		process.Cwd = info.workingDir()
+	}
+	if process.Env == nil {
+		process.Env = info.environ()
+	}
+
+	if spec.Linux == nil {
+		spec.Linux = &ociLinux{}
+	}
+	if spec.Mounts == nil {
+		spec.Mounts = defaultOCIMounts
+	}
+	if err := confineSpec(info, spec); err != nil {
+		return err
+	}
+	if spec.Hostname == "" {
+		spec.Hostname = info.hostname()
+	}
+	if err := spec.validate(); err != nil {
+		return err
+	}
+
+	bundle := filepath.Join(containerDir(info.ID), "bundle")
+	if err := os.MkdirAll(bundle, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), data, 0644); err != nil {
+		return err
+	}
+
+	// The process' output goes to the container's log
+	stdout, stderr := info.logs.stream("stdout"), info.logs.stream("stderr")
+	ctr, cmd, err := ociCreate(ociStateRoot(), info.ID, bundle, spec, ociCreateOptions{Stdout: stdout, Stderr: stderr})
+	if err != nil {
+		return err
+	}
+	info.oci = ctr
+	info.addProcess(cmd)
+	go func() {
+		cmd.Wait()
+		stdout.Close()
+		stderr.Close()
+		code := exitCode(cmd.ProcessState)
+		log.Printf("OCI process of container %s exited with code %d", info.ID, code)
+		info.removeProcess(cmd, code)
+	}()
+	return ctr.start()
+}
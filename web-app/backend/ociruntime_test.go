@@ -0,0 +1,195 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfineSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		spec    func(spec *ociSpec)
+		// wantErr is part of the error expected, empty if none is
+		wantErr string
+		check   func(t *testing.T, spec *ociSpec)
+	}{
+		{
+			name: "defaults",
+			spec: func(spec *ociSpec) {},
+			check: func(t *testing.T, spec *ociSpec) {
+				caps := spec.Process.Capabilities
+				if caps == nil || !containsString(caps.Bounding, "CAP_CHOWN") || containsString(caps.Bounding, "CAP_SYS_ADMIN") {
+					t.Errorf("capabilities = %+v, want the template's", caps)
+				}
+				if !spec.Process.NoNewPrivileges {
+					t.Errorf("no_new_privs not set")
+				}
+				if spec.Linux.Seccomp == nil {
+					t.Errorf("seccomp profile not set")
+				}
+			},
+		},
+		{
+			name:    "hooks",
+			spec:    func(spec *ociSpec) { spec.Hooks = &ociHooks{Poststop: []ociHook{{Path: "/bin/sh"}}} },
+			wantErr: "poststop hooks",
+		},
+		{
+			name: "bind mount",
+			spec: func(spec *ociSpec) {
+				spec.Mounts = []ociMount{{Destination: "/host", Type: "bind", Source: "/", Options: []string{"rbind"}}}
+			},
+			wantErr: "type \"bind\"",
+		},
+		{
+			name: "bind option",
+			spec: func(spec *ociSpec) {
+				spec.Mounts = []ociMount{{Destination: "/host", Type: "tmpfs", Source: "/", Options: []string{"rbind"}}}
+			},
+			wantErr: "option rbind",
+		},
+		{
+			name: "block device mount",
+			spec: func(spec *ociSpec) {
+				spec.Mounts = []ociMount{{Destination: "/disk", Type: "ext4", Source: "/dev/sda1"}}
+			},
+			wantErr: "type \"ext4\"",
+		},
+		{
+			name: "sysfs is read-only",
+			spec: func(spec *ociSpec) {
+				spec.Mounts = []ociMount{{Destination: "/sys", Type: "sysfs", Source: "sysfs"}}
+			},
+			check: func(t *testing.T, spec *ociSpec) {
+				if !containsString(spec.Mounts[0].Options, "ro") {
+					t.Errorf("sysfs options = %v, want ro", spec.Mounts[0].Options)
+				}
+			},
+		},
+		{
+			name:    "shared propagation",
+			spec:    func(spec *ociSpec) { spec.Linux.RootfsPropagation = "rshared" },
+			wantErr: "propagation",
+		},
+		{
+			name:    "devices",
+			spec:    func(spec *ociSpec) { spec.Linux.Devices = []ociDevice{{Type: "b", Path: "/dev/sda", Major: 8}} },
+			wantErr: "linux.devices",
+		},
+		{
+			name:    "host sysctl",
+			spec:    func(spec *ociSpec) { spec.Linux.Sysctl = map[string]string{"kernel.core_pattern": "|/tmp/x"} },
+			wantErr: "sysctl",
+		},
+		{
+			name:    "sysctl path traversal",
+			spec:    func(spec *ociSpec) { spec.Linux.Sysctl = map[string]string{"net./../kernel/core_pattern": "|/tmp/x"} },
+			wantErr: "sysctl",
+		},
+		{
+			name: "network sysctl",
+			spec: func(spec *ociSpec) { spec.Linux.Sysctl = map[string]string{"net.ipv4.ip_forward": "1"} },
+		},
+		{
+			name:    "network sysctl on the host network",
+			network: networkHost,
+			spec:    func(spec *ociSpec) { spec.Linux.Sysctl = map[string]string{"net.ipv4.ip_forward": "1"} },
+			wantErr: "sysctl",
+		},
+		{
+			name: "capability beyond the template",
+			spec: func(spec *ociSpec) {
+				spec.Process.Capabilities = &ociCapabilities{Bounding: []string{"CAP_SYS_MODULE"}}
+			},
+			wantErr: "CAP_SYS_MODULE",
+		},
+		{
+			name: "capabilities within the template",
+			spec: func(spec *ociSpec) {
+				spec.Process.Capabilities = &ociCapabilities{Bounding: []string{"chown"}, Effective: []string{"CAP_KILL"}}
+			},
+			check: func(t *testing.T, spec *ociSpec) {
+				if caps := spec.Process.Capabilities; len(caps.Bounding) != 1 || len(caps.Effective) != 1 {
+					t.Errorf("capabilities = %+v, want them unchanged", caps)
+				}
+			},
+		},
+		{
+			name: "joining a namespace",
+			spec: func(spec *ociSpec) {
+				spec.Linux.Namespaces = []ociNamespace{{Type: "ipc", Path: "/proc/1/ns/ipc"}}
+			},
+			wantErr: "joining a ipc namespace",
+		},
+		{
+			name: "namespaces and cgroup come from the container",
+			spec: func(spec *ociSpec) {
+				spec.Linux.Namespaces = []ociNamespace{{Type: "user"}, {Type: "mount"}}
+				spec.Linux.CgroupsPath = "system.slice"
+			},
+			check: func(t *testing.T, spec *ociSpec) {
+				for _, typ := range []string{"user", "pid", "mount", "uts", "ipc", "network"} {
+					if !spec.hasNamespace(typ) {
+						t.Errorf("namespace %s missing from %v", typ, spec.Linux.Namespaces)
+					}
+				}
+				if len(spec.Linux.Namespaces) != 6 {
+					t.Errorf("namespaces = %v, want 6", spec.Linux.Namespaces)
+				}
+				if spec.Linux.CgroupsPath != "lcw/test-container/oci" {
+					t.Errorf("cgroups path = %q, want lcw/test-container/oci", spec.Linux.CgroupsPath)
+				}
+			},
+		},
+		{
+			name:    "host network",
+			network: networkHost,
+			spec:    func(spec *ociSpec) {},
+			check: func(t *testing.T, spec *ociSpec) {
+				if spec.hasNamespace("network") {
+					t.Errorf("namespaces = %v, want the host's network", spec.Linux.Namespaces)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network := tt.network
+			if network == "" {
+				network = networkBridge
+			}
+			tmpl := &ContainerTemplate{SectionID: "test"}
+			security, err := resolveSecurity(tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := &ContainerInfo{
+				ID:        "test-container",
+				SectionID: "test",
+				Template:  tmpl,
+				Network:   &NetworkInfo{Mode: network},
+				security:  security,
+			}
+			spec := &ociSpec{
+				Process: &ociProcess{Args: []string{"sh"}},
+				Linux:   &ociLinux{},
+			}
+			tt.spec(spec)
+
+			err = confineSpec(info, spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("confineSpec = %v, want an error about %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("confineSpec: %v", err)
+			}
+			if tt.check != nil {
+				tt.check(t, spec)
+			}
+		})
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// apiVersion is the version of the API served under apiPrefix.
+const apiVersion = "1.0.0"
+
+// apiRoute is an endpoint of the API. Routes are registered and
+// documented from the same table so the document can not drift from
+// what is served.
+type apiRoute struct {
+	method, path string
+	handler      echo.HandlerFunc
+	tag, summary string
+	// admin guards the route with adminAuth
+	admin bool
+	query []apiParam
+	// request and response are values of the types of JSON bodies.
+	// Bodies of other media types are raw data unless a type is given.
+	request      interface{}
+	requestType  string
+	response     interface{}
+	responseType string
+	// status is the status of success, 200 unless set
+	status int
+}
+
+type apiParam struct {
+	name, description string
+	// typ is the parameter's JSON schema type, string unless set
+	typ string
+}
+
+var (
+	containerPathParam = apiParam{name: "path", description: "Path inside the container, / by default"}
+	signalParam        = apiParam{name: "signal", description: "Signal name or number"}
+)
+
+// apiRoutes lists the routes served under apiPrefix.
+func apiRoutes() []apiRoute {
+	return []apiRoute{
+		{method: http.MethodGet, path: "/learning-paths", handler: getLearningPaths,
+			tag: "learning-paths", summary: "List learning paths",
+			response: []LearningPath{}},
+		{method: http.MethodGet, path: "/learning-paths/:id", handler: getLearningPath,
+			tag: "learning-paths", summary: "Get a learning path",
+			response: LearningPath{}},
+		{method: http.MethodGet, path: "/learning-paths/:id/sections/:sectionId", handler: getSection,
+			tag: "learning-paths", summary: "Get a section of a learning path",
+			response: Section{}},
+
+		{method: http.MethodGet, path: "/images", handler: getImages,
+			tag: "images", summary: "List images",
+			response: []Image{}},
+		{method: http.MethodPost, path: "/images/import", handler: importImage, admin: true,
+			tag: "images", summary: "Import an OCI layout or docker save tarball, sent raw or as the file field of a multipart form",
+			query:       []apiParam{{name: "reference", description: "Name for images the archive does not name"}},
+			requestType: "application/x-tar", response: []Image{}, status: http.StatusCreated},
+		{method: http.MethodDelete, path: "/images/:digest", handler: deleteImage, admin: true,
+			tag: "images", summary: "Delete an image",
+			response: StatusMessage{}},
+
+		{method: http.MethodPost, path: "/containers/create", handler: createContainer,
+			tag: "containers", summary: "Create a container for a section",
+			request: ContainerRequest{}, response: ContainerResponse{}},
+		{method: http.MethodGet, path: "/containers/:id", handler: getContainer,
+			tag: "containers", summary: "Get a container",
+			response: ContainerDetails{}},
+		{method: http.MethodDelete, path: "/containers/:id", handler: deleteContainer,
+			tag: "containers", summary: "Delete a container",
+			response: StatusMessage{}},
+		{method: http.MethodGet, path: "/containers/:id/top", handler: getContainerTop,
+			tag: "containers", summary: "List the container's processes as a tree",
+			response: []*Process{}},
+		{method: http.MethodPost, path: "/containers/:id/processes/:pid/signal", handler: signalProcess,
+			tag: "containers", summary: "Signal a process of the container",
+			request: SignalRequest{}, response: SignalResponse{}},
+		{method: http.MethodPost, path: "/containers/:id/kill", handler: killContainer,
+			tag: "containers", summary: "Signal every process of the container, SIGKILL by default",
+			query:    []apiParam{signalParam},
+			response: KillResponse{}},
+		{method: http.MethodGet, path: "/containers/:id/logs", handler: getContainerLogs,
+			tag: "containers", summary: "Read the container's log as JSON lines",
+			query: []apiParam{
+				{name: "follow", description: "Keep sending entries while the main process runs", typ: "boolean"},
+				{name: "stdout", description: "Include standard output, true by default", typ: "boolean"},
+				{name: "stderr", description: "Include standard error, true by default", typ: "boolean"},
+				{name: "tail", description: "Number of entries to send from the end, or all"},
+				{name: "since", description: "RFC 3339 time, Unix seconds or duration to send entries since"},
+			},
+			response: LogEntry{}, responseType: "application/x-ndjson"},
+		{method: http.MethodGet, path: "/containers/:id/changes", handler: getContainerChanges,
+			tag: "containers", summary: "List changes to the container's filesystem",
+			query:    []apiParam{{name: "kind", description: "Only list changes of this kind"}},
+			response: []Change{}},
+		{method: http.MethodPost, path: "/containers/:id/commit", handler: commitContainer, admin: true,
+			tag: "containers", summary: "Commit the container to an image",
+			request: CommitRequest{}, response: CommitResponse{}, status: http.StatusCreated},
+
+		{method: http.MethodGet, path: "/containers/:id/fs", handler: listFiles,
+			tag: "files", summary: "List a directory of the container",
+			query:    []apiParam{containerPathParam},
+			response: FileListing{}},
+		{method: http.MethodGet, path: "/containers/:id/fs/content", handler: downloadFile,
+			tag: "files", summary: "Download a file from the container",
+			query:        []apiParam{containerPathParam},
+			responseType: "application/octet-stream"},
+		{method: http.MethodPut, path: "/containers/:id/fs/content", handler: uploadFile,
+			tag: "files", summary: "Upload a file into the container",
+			query: []apiParam{
+				containerPathParam,
+				{name: "mode", description: "Octal file mode, 0644 by default"},
+			},
+			requestType: "application/octet-stream", response: UploadResult{}},
+		{method: http.MethodGet, path: "/containers/:id/fs/archive", handler: exportArchive,
+			tag: "files", summary: "Download a directory of the container as a tar archive",
+			query:        []apiParam{containerPathParam},
+			responseType: "application/x-tar"},
+		{method: http.MethodPut, path: "/containers/:id/fs/archive", handler: importArchive,
+			tag: "files", summary: "Extract a tar archive into a directory of the container",
+			query:       []apiParam{containerPathParam},
+			requestType: "application/x-tar", response: ArchiveResult{}},
+
+		{method: http.MethodGet, path: "/templates", handler: getRegisteredTemplates,
+			tag: "templates", summary: "List templates registered by commits",
+			response: []*ContainerTemplate{}},
+		{method: http.MethodDelete, path: "/templates/:sectionId", handler: deleteRegisteredTemplate, admin: true,
+			tag: "templates", summary: "Revert a section to its default template",
+			response: StatusMessage{}},
+
+		{method: http.MethodPost, path: "/containers/:id/checkpoint", handler: createCheckpoint,
+			tag: "checkpoints", summary: "Checkpoint a container",
+			request: CheckpointRequest{}, response: Checkpoint{}, status: http.StatusCreated},
+		{method: http.MethodPost, path: "/containers/restore", handler: restoreContainer,
+			tag: "checkpoints", summary: "Create a container from a checkpoint",
+			request: RestoreRequest{}, response: ContainerResponse{}},
+		{method: http.MethodGet, path: "/checkpoints", handler: getCheckpoints,
+			tag: "checkpoints", summary: "List checkpoints",
+			response: []*Checkpoint{}},
+		{method: http.MethodDelete, path: "/checkpoints/:id", handler: deleteCheckpoint,
+			tag: "checkpoints", summary: "Delete a checkpoint",
+			response: StatusMessage{}},
+
+		{method: http.MethodGet, path: "/terminal/:containerId/ws", handler: handleWebSocket,
+			tag: "terminal", summary: "Attach a terminal over a WebSocket exchanging TerminalMessages",
+			status: http.StatusSwitchingProtocols},
+		{method: http.MethodGet, path: "/events", handler: getEvents, admin: true,
+			tag: "events", summary: "Stream container events as server-sent events, or over a WebSocket",
+			query: []apiParam{
+				{name: "container", description: "Comma separated container IDs"},
+				{name: "section", description: "Comma separated section IDs"},
+				{name: "type", description: "Comma separated event types"},
+			},
+			response: Event{}, responseType: "text/event-stream"},
+
+		{method: http.MethodGet, path: "/diagnostics", handler: getDiagnostics,
+			tag: "host", summary: "Describe the host's container capabilities",
+			response: Diagnostics{}},
+		{method: http.MethodGet, path: "/admin/config", handler: getAdminConfig, admin: true,
+			tag: "admin", summary: "Show the effective configuration, secrets redacted",
+			response: map[string]interface{}{}},
+		{method: http.MethodGet, path: "/openapi.json", handler: getOpenAPI,
+			tag: "meta", summary: "Get this OpenAPI document",
+			response: map[string]interface{}{}},
+	}
+}
+
+// openAPISpec is the OpenAPI document of the routes, encoded once they
+// are registered.
+var openAPISpec []byte
+
+// registerAPI adds the API routes to g.
+func registerAPI(g *echo.Group) {
+	routes := apiRoutes()
+	for _, r := range routes {
+		var middleware []echo.MiddlewareFunc
+		if r.admin {
+			middleware = append(middleware, adminAuth)
+		}
+		g.Add(r.method, r.path, r.handler, middleware...)
+	}
+	// Proxied requests belong to the learner's service, whatever their
+	// method, and are not part of the document
+	g.Any("/containers/:id/proxy/:port/*", proxyContainer)
+
+	spec, err := json.Marshal(openAPIDocument(routes))
+	if err != nil {
+		log.Fatalf("Failed to generate OpenAPI document: %v", err)
+	}
+	openAPISpec = spec
+}
+
+func getOpenAPI(c echo.Context) error {
+	return c.JSONBlob(http.StatusOK, openAPISpec)
+}
+
+var routeParamPattern = regexp.MustCompile(`:(\w+)`)
+
+// openAPIDocument describes the routes as an OpenAPI 3 document.
+func openAPIDocument(routes []apiRoute) map[string]interface{} {
+	g := &schemaGenerator{schemas: make(map[string]interface{})}
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content": map[string]interface{}{
+			echo.MIMEApplicationJSON: map[string]interface{}{"schema": g.schema(reflect.TypeOf(ErrorResponse{}))},
+		},
+	}
+
+	// Request bodies go first so the types they share with responses
+	// are documented as requests
+	requestBodies := make([]map[string]interface{}, len(routes))
+	g.request = true
+	for i, r := range routes {
+		switch {
+		case r.request != nil:
+			requestBodies[i] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					echo.MIMEApplicationJSON: map[string]interface{}{"schema": g.schema(reflect.TypeOf(r.request))},
+				},
+			}
+		case r.requestType != "":
+			requestBodies[i] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					r.requestType: map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}},
+				},
+			}
+		}
+	}
+	g.request = false
+
+	paths := make(map[string]interface{})
+	for i, r := range routes {
+		path := routeParamPattern.ReplaceAllString(r.path, "{$1}")
+		var params []interface{}
+		for _, m := range routeParamPattern.FindAllStringSubmatch(r.path, -1) {
+			params = append(params, map[string]interface{}{
+				"name": m[1], "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, q := range r.query {
+			typ := q.typ
+			if typ == "" {
+				typ = "string"
+			}
+			params = append(params, map[string]interface{}{
+				"name": q.name, "in": "query", "description": q.description,
+				"schema": map[string]interface{}{"type": typ},
+			})
+		}
+
+		status := r.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]interface{}{"description": http.StatusText(status)}
+		responseType := r.responseType
+		if responseType == "" && r.response != nil {
+			responseType = echo.MIMEApplicationJSON
+		}
+		if responseType != "" {
+			schema := map[string]interface{}{"type": "string", "format": "binary"}
+			if r.response != nil {
+				schema = g.schema(reflect.TypeOf(r.response))
+			}
+			success["content"] = map[string]interface{}{responseType: map[string]interface{}{"schema": schema}}
+		}
+
+		op := map[string]interface{}{
+			"operationId": handlerName(r.handler),
+			"summary":     r.summary,
+			"tags":        []string{r.tag},
+			"responses": map[string]interface{}{
+				strconv.Itoa(status): success,
+				"default":            errorResponse,
+			},
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if requestBodies[i] != nil {
+			op["requestBody"] = requestBodies[i]
+		}
+		if r.admin {
+			op["security"] = []interface{}{map[string]interface{}{"adminToken": []string{}}}
+		}
+
+		item, _ := paths[path].(map[string]interface{})
+		if item == nil {
+			item = make(map[string]interface{})
+			paths[path] = item
+		}
+		item[strings.ToLower(r.method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Linux Containerization Learning Platform API",
+			"version": apiVersion,
+		},
+		"servers": []interface{}{map[string]interface{}{"url": apiPrefix}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]interface{}{
+				"adminToken": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// handlerName is the name of a handler function, which serves as the
+// operation ID.
+func handlerName(h echo.HandlerFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// schemaGenerator derives JSON schemas from Go types the way
+// encoding/json encodes them. Named structs become components.
+type schemaGenerator struct {
+	schemas map[string]interface{}
+	// request is set while request bodies are described. Fields of
+	// request types are only required when validation requires them,
+	// those of responses whenever they are not omitted when empty.
+	request bool
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := g.schemas[name]; !ok {
+			// Claimed before the fields are described, which may refer
+			// back to the type
+			g.schemas[name] = nil
+			g.schemas[name] = g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	// Interfaces hold anything
+	return map[string]interface{}{}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	for _, f := range jsonFields(t) {
+		schema := g.schema(f.typ)
+		isRequired := !g.request && !f.omitEmpty
+		for _, rule := range f.rules {
+			switch rule.name {
+			case "required":
+				isRequired = true
+			case "oneof":
+				schema["enum"] = strings.Fields(rule.arg)
+			case "min":
+				schema["minimum"], _ = strconv.ParseFloat(rule.arg, 64)
+			case "max":
+				schema["maximum"], _ = strconv.ParseFloat(rule.arg, 64)
+			case "ip":
+				schema["description"] = "IPv4 or IPv6 address"
+			}
+		}
+		properties[f.name] = schema
+		if isRequired {
+			required = append(required, f.name)
+		}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if required != nil {
+		schema["required"] = required
+	}
+	return schema
+}
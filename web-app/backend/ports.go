@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// proxyTokenCookie lets a browser that opened a proxied service with
+// ?token= keep loading its assets without repeating the token.
+const proxyTokenCookie = "lcw_proxy_token"
+
+// PortMapping publishes a TCP port of a bridged container on the host.
+// A zero HostPort picks a free port; HostIP defaults to loopback so
+// learner services are not exposed to the network by accident.
+type PortMapping struct {
+	ContainerPort int    `json:"containerPort" validate:"required,min=1,max=65535"`
+	HostPort      int    `json:"hostPort" validate:"min=0,max=65535"`
+	HostIP        string `json:"hostIp" validate:"ip"`
+	// Only tcp ports can be published
+	Protocol string `json:"protocol" validate:"oneof=tcp"`
+}
+
+// defaultPortMappings fills in what validated port mappings leave out.
+func defaultPortMappings(ports []PortMapping) {
+	for i := range ports {
+		p := &ports[i]
+		if p.Protocol == "" {
+			p.Protocol = "tcp"
+		}
+		if p.HostIP == "" {
+			p.HostIP = "127.0.0.1"
+		}
+	}
+}
+
+// portProxy forwards connections accepted on a host port to the
+// container, copying bytes in userspace.
+type portProxy struct {
+	listener net.Listener
+	target   string
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func startPortProxy(listenAddr, target string) (*portProxy, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	p := &portProxy{
+		listener: listener,
+		target:   target,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	go p.serve()
+	return p, nil
+}
+
+func (p *portProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Port proxy for %s stopped: %v", p.target, err)
+			}
+			return
+		}
+		go p.forward(conn)
+	}
+}
+
+func (p *portProxy) forward(client net.Conn) {
+	upstream, err := net.Dial("tcp", p.target)
+	if err != nil {
+		client.Close()
+		return
+	}
+	if !p.track(client, upstream) {
+		return
+	}
+	defer p.untrack(client, upstream)
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		// Propagate half-closes so request/response protocols finish
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(upstream, client)
+	go pipe(client, upstream)
+	<-done
+	<-done
+}
+
+// track registers a connection pair, refusing it if the proxy is closed.
+func (p *portProxy) track(conns ...net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns == nil {
+		for _, c := range conns {
+			c.Close()
+		}
+		return false
+	}
+	for _, c := range conns {
+		p.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (p *portProxy) untrack(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+		delete(p.conns, c)
+	}
+}
+
+// Close stops accepting and drops every forwarded connection.
+func (p *portProxy) Close() error {
+	err := p.listener.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+	return err
+}
+
+// publishPorts starts a proxy per mapping, filling in the host ports that
+// were picked automatically.
+func publishPorts(info *ContainerInfo) error {
+	for i := range info.Ports {
+		mapping := &info.Ports[i]
+		target := net.JoinHostPort(info.Network.IPAddress, strconv.Itoa(mapping.ContainerPort))
+		listenAddr := net.JoinHostPort(mapping.HostIP, strconv.Itoa(mapping.HostPort))
+
+		proxy, err := startPortProxy(listenAddr, target)
+		if err != nil {
+			return fmt.Errorf("failed to publish port %d: %w", mapping.ContainerPort, err)
+		}
+		mapping.HostPort = proxy.listener.Addr().(*net.TCPAddr).Port
+		info.proxies = append(info.proxies, proxy)
+	}
+	return nil
+}
+
+func unpublishPorts(info *ContainerInfo) {
+	for _, proxy := range info.proxies {
+		proxy.Close()
+	}
+	info.proxies = nil
+}
+
+func newContainerToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// requestToken extracts the container token from the Authorization
+// header, the token query parameter or the proxy cookie.
+func requestToken(c echo.Context) string {
+	if auth := c.Request().Header.Get(echo.HeaderAuthorization); auth != "" {
+		if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+			return token
+		}
+	}
+	if token := c.QueryParam("token"); token != "" {
+		return token
+	}
+	if cookie, err := c.Cookie(proxyTokenCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func validToken(info *ContainerInfo, token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(info.Token), []byte(token)) == 1
+}
+
+// proxyContainer forwards HTTP (including WebSocket upgrades) to a port of
+// a bridged container, so browser-based learners can open their services.
+func proxyContainer(c echo.Context) error {
+	containerId := c.Param("id")
+
+	containersMux.RLock()
+	containerInfo, exists := containers[containerId]
+	containersMux.RUnlock()
+
+	if !exists {
+		return errContainerNotFound
+	}
+
+	token := requestToken(c)
+	if !validToken(containerInfo, token) {
+		return apiError(http.StatusUnauthorized, codeUnauthorized, "Invalid container token")
+	}
+
+	port, err := strconv.Atoi(c.Param("port"))
+	if err != nil || port < 1 || port > 65535 {
+		return invalidField("port", "must be a port number")
+	}
+	if containerInfo.Network.Mode != networkBridge {
+		return apiError(http.StatusBadRequest, codeUnsupported, "Only containers on the bridge network can be proxied")
+	}
+
+	prefix := fmt.Sprintf("%s/containers/%s/proxy/%d/", apiPrefix, containerId, port)
+	if c.QueryParam("token") != "" {
+		c.SetCookie(&http.Cookie{
+			Name:     proxyTokenCookie,
+			Value:    token,
+			Path:     prefix,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	target := &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(containerInfo.Network.IPAddress, strconv.Itoa(port)),
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+			r.Out.URL.Path = "/" + c.Param("*")
+			r.Out.URL.RawPath = ""
+			query := r.Out.URL.Query()
+			query.Del("token")
+			r.Out.URL.RawQuery = query.Encode()
+			r.Out.Header.Set("X-Forwarded-Prefix", strings.TrimSuffix(prefix, "/"))
+			r.Out.Header.Del(echo.HeaderAuthorization)
+			removeCookie(r.Out, proxyTokenCookie)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			c.Error(apiError(http.StatusBadGateway, codeBadGateway, fmt.Sprintf("Container port %d is not reachable: %v", port, err)))
+		},
+	}
+	proxy.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// removeCookie keeps the proxy token from reaching the learner's service.
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			r.AddCookie(cookie)
+		}
+	}
+}
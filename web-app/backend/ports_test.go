@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestProxyContainerToken(t *testing.T) {
+	var upstream *http.Request
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+	host, port, err := net.SplitHostPort(backend.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	containersMux.Lock()
+	containers["proxied"] = &ContainerInfo{
+		ID:      "proxied",
+		Token:   "s3cret",
+		Network: &NetworkInfo{Mode: networkBridge, IPAddress: host},
+	}
+	containersMux.Unlock()
+	defer func() {
+		containersMux.Lock()
+		delete(containers, "proxied")
+		containersMux.Unlock()
+	}()
+
+	e := echo.New()
+	e.HTTPErrorHandler = handleError
+	e.Any(apiPrefix+"/containers/:id/proxy/:port/*", proxyContainer)
+	prefix := fmt.Sprintf("%s/containers/proxied/proxy/%s/", apiPrefix, port)
+
+	tests := []struct {
+		name       string
+		query      string
+		header     string
+		cookie     string
+		wantStatus int
+		wantCookie bool
+	}{
+		{name: "no token", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", query: "?token=guess", wantStatus: http.StatusUnauthorized},
+		{name: "wrong bearer token", header: "Bearer guess", wantStatus: http.StatusUnauthorized},
+		{name: "wrong cookie", cookie: "guess", wantStatus: http.StatusUnauthorized},
+		{name: "bearer token", header: "Bearer s3cret", wantStatus: http.StatusNoContent},
+		{name: "query token", query: "?token=s3cret&page=2", wantStatus: http.StatusNoContent, wantCookie: true},
+		{name: "cookie", cookie: "s3cret", wantStatus: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream = nil
+			req := httptest.NewRequest(http.MethodGet, prefix+"index.html"+tt.query, nil)
+			if tt.header != "" {
+				req.Header.Set(echo.HeaderAuthorization, tt.header)
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: proxyTokenCookie, Value: tt.cookie})
+			}
+			req.AddCookie(&http.Cookie{Name: "session", Value: "app"})
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusNoContent {
+				if upstream != nil {
+					t.Error("request reached the container without a valid token")
+				}
+				return
+			}
+			if upstream == nil {
+				t.Fatal("request did not reach the container")
+			}
+			if upstream.URL.Path != "/index.html" {
+				t.Errorf("upstream path = %q, want /index.html", upstream.URL.Path)
+			}
+			if upstream.URL.Query().Has("token") {
+				t.Errorf("upstream query %q still carries the token", upstream.URL.RawQuery)
+			}
+			if upstream.Header.Get(echo.HeaderAuthorization) != "" {
+				t.Error("upstream request still carries the Authorization header")
+			}
+			if _, err := upstream.Cookie(proxyTokenCookie); err == nil {
+				t.Error("upstream request still carries the token cookie")
+			}
+			if _, err := upstream.Cookie("session"); err != nil {
+				t.Error("upstream request lost the service's own cookie")
+			}
+
+			var set *http.Cookie
+			for _, cookie := range rec.Result().Cookies() {
+				if cookie.Name == proxyTokenCookie {
+					set = cookie
+				}
+			}
+			if !tt.wantCookie {
+				if set != nil {
+					t.Errorf("set cookie %v, want none", set)
+				}
+				return
+			}
+			if set == nil || set.Value != "s3cret" || set.Path != prefix || !set.HttpOnly {
+				t.Errorf("set cookie %v, want an HttpOnly token cookie for %s", set, prefix)
+			}
+		})
+	}
+}
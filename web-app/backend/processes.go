@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/sys/unix"
+)
+
+// clockTicks is USER_HZ, the unit of the CPU times in /proc/<pid>/stat,
+// which Linux fixes at 100 on every architecture the backend builds for.
+const clockTicks = 100
+
+// Process is a process running in a container as shown by top.
+type Process struct {
+	// PID and PPID as seen from the host
+	PID  int `json:"pid"`
+	PPID int `json:"ppid"`
+	// NSPID and NSPPID as seen from inside the container's PID namespace
+	NSPID  int    `json:"nsPid"`
+	NSPPID int    `json:"nsPpid"`
+	UID    int    `json:"uid"`
+	User   string `json:"user"`
+	State  string `json:"state"`
+	// CPU is the share of one CPU used over the process' lifetime, as
+	// reported by ps
+	CPU      float64    `json:"cpu"`
+	RSS      int64      `json:"rss"`
+	Command  string     `json:"command"`
+	Started  time.Time  `json:"started"`
+	Children []*Process `json:"children"`
+}
+
+// readProcess collects what /proc knows about a process.
+func readProcess(pid int, uptime float64, boot time.Time) (*Process, error) {
+	dir := fmt.Sprintf("/proc/%d", pid)
+	stat, err := os.ReadFile(dir + "/stat")
+	if err != nil {
+		return nil, err
+	}
+	// The command name is in parentheses and may itself contain them
+	open, end := bytes.IndexByte(stat, '('), bytes.LastIndexByte(stat, ')')
+	if open < 0 || end < open {
+		return nil, fmt.Errorf("malformed stat of process %d", pid)
+	}
+	comm := string(stat[open+1 : end])
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("malformed stat of process %d", pid)
+	}
+	p := &Process{PID: pid, State: fields[0], Children: []*Process{}}
+	p.PPID, _ = strconv.Atoi(fields[1])
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	start, _ := strconv.ParseUint(fields[19], 10, 64)
+	started := float64(start) / clockTicks
+	p.Started = boot.Add(time.Duration(started * float64(time.Second)))
+	if elapsed := uptime - started; elapsed > 0 {
+		p.CPU = float64(utime+stime) / clockTicks / elapsed * 100
+	}
+
+	status, err := os.Open(dir + "/status")
+	if err != nil {
+		return nil, err
+	}
+	defer status.Close()
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), ":")
+		values := strings.Fields(value)
+		if len(values) == 0 {
+			continue
+		}
+		switch key {
+		case "Uid":
+			// The effective user, like ps shows
+			if len(values) > 1 {
+				p.UID, _ = strconv.Atoi(values[1])
+			}
+		case "NSpid":
+			// The last entry is the PID in the innermost namespace
+			p.NSPID, _ = strconv.Atoi(values[len(values)-1])
+		case "VmRSS":
+			kb, _ := strconv.ParseInt(values[0], 10, 64)
+			p.RSS = kb * 1024
+		}
+	}
+
+	cmdline, _ := os.ReadFile(dir + "/cmdline")
+	p.Command = strings.TrimSpace(string(bytes.ReplaceAll(cmdline, []byte{0}, []byte{' '})))
+	if p.Command == "" {
+		// Zombies and kernel threads have no command line
+		p.Command = "[" + comm + "]"
+	}
+	return p, nil
+}
+
+// readProcesses reads every process of the host, keyed by PID.
+func readProcesses() (map[int]*Process, error) {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return nil, err
+	}
+	var uptime float64
+	if fields := strings.Fields(string(data)); len(fields) > 0 {
+		uptime, _ = strconv.ParseFloat(fields[0], 64)
+	}
+	boot := time.Now().Add(-time.Duration(uptime * float64(time.Second)))
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	procs := make(map[int]*Process)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		// Processes may exit while /proc is read
+		if p, err := readProcess(pid, uptime, boot); err == nil {
+			procs[pid] = p
+		}
+	}
+	return procs, nil
+}
+
+// rootPIDs returns the processes every other process of the container
+// descends from: the inits of native containers, which each start in a
+// PID namespace of their own, the commands of local containers, which
+// share the host's and adopt their orphans as subreapers instead,
+// processes restored by CRIU, or the inits the rootless sandbox started.
+func (info *ContainerInfo) rootPIDs(procs map[int]*Process) []int {
+	var roots []int
+	if info.sandbox != nil {
+		for pid, p := range procs {
+			if p.PPID == info.sandbox.Process.Pid {
+				roots = append(roots, pid)
+			}
+		}
+		return roots
+	}
+	info.processMu.Lock()
+	for cmd := range info.processes {
+		roots = append(roots, cmd.Process.Pid)
+	}
+	info.processMu.Unlock()
+	// The OCI process of an adopted container is no child of this backend
+	if oci := info.oci; oci != nil && !slices.Contains(roots, oci.Pid) {
+		if oci.refresh(); oci.Status != ociStopped {
+			roots = append(roots, oci.Pid)
+		}
+	}
+	return append(roots, info.restored...)
+}
+
+// processTree links the container's processes to their children and
+// returns the roots, sorted by PID.
+func (info *ContainerInfo) processTree(procs map[int]*Process) []*Process {
+	children := make(map[int][]*Process)
+	for _, p := range procs {
+		children[p.PPID] = append(children[p.PPID], p)
+	}
+
+	var link func(p *Process)
+	link = func(p *Process) {
+		for _, child := range children[p.PID] {
+			child.NSPPID = p.NSPID
+			p.Children = append(p.Children, child)
+			link(child)
+		}
+		sort.Slice(p.Children, func(i, j int) bool { return p.Children[i].PID < p.Children[j].PID })
+	}
+
+	roots := []*Process{}
+	for _, pid := range info.rootPIDs(procs) {
+		if p, ok := procs[pid]; ok {
+			link(p)
+			roots = append(roots, p)
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].PID < roots[j].PID })
+	return roots
+}
+
+// userNames maps the user IDs of the container's processes to names
+// from the container's /etc/passwd, or the host's for local containers.
+// Rootless containers see host IDs through the sandbox's ID mapping.
+func (info *ContainerInfo) userNames(roots []*Process) {
+	names := make(map[int]string)
+	if info.isolated() {
+		if f, err := openInContainer(info, "/etc/passwd", unix.O_RDONLY, 0); err == nil {
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				fields := strings.Split(scanner.Text(), ":")
+				if len(fields) < 3 {
+					continue
+				}
+				if uid, err := strconv.Atoi(fields[2]); err == nil {
+					names[uid] = fields[0]
+				}
+			}
+			f.Close()
+		}
+	}
+	var mappings []idMapping
+	if info.sandbox != nil {
+		mappings = readIDMappings(fmt.Sprintf("/proc/%d/uid_map", info.sandbox.Process.Pid))
+	}
+
+	var walk func(procs []*Process)
+	walk = func(procs []*Process) {
+		for _, p := range procs {
+			for _, m := range mappings {
+				if p.UID >= m.HostID && p.UID < m.HostID+m.Size {
+					p.UID = p.UID - m.HostID + m.ContainerID
+					break
+				}
+			}
+			name, ok := names[p.UID]
+			if !ok && !info.isolated() {
+				if u, err := user.LookupId(strconv.Itoa(p.UID)); err == nil {
+					name, ok = u.Username, true
+				}
+			}
+			if !ok {
+				name = strconv.Itoa(p.UID)
+			}
+			p.User = name
+			walk(p.Children)
+		}
+	}
+	walk(roots)
+}
+
+// readIDMappings parses a uid_map or gid_map as seen from the host.
+func readIDMappings(path string) []idMapping {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var mappings []idMapping
+	for _, line := range strings.Split(string(data), "\n") {
+		var m idMapping
+		if _, err := fmt.Sscan(line, &m.ContainerID, &m.HostID, &m.Size); err == nil {
+			mappings = append(mappings, m)
+		}
+	}
+	return mappings
+}
+
+func getContainerTop(c echo.Context) error {
+	containerId := c.Param("id")
+
+	containersMux.RLock()
+	containerInfo, exists := containers[containerId]
+	containersMux.RUnlock()
+
+	if !exists {
+		return errContainerNotFound
+	}
+
+	procs, err := readProcesses()
+	if err != nil {
+		return internalError("Failed to read processes: %v", err)
+	}
+	roots := containerInfo.processTree(procs)
+	containerInfo.userNames(roots)
+	return c.JSON(http.StatusOK, roots)
+}
+
+// SignalRequest names the signal to send, by name or number.
+type SignalRequest struct {
+	Signal string `json:"signal"`
+}
+
+type SignalResponse struct {
+	PID    int    `json:"pid"`
+	Signal string `json:"signal"`
+}
+
+// KillResponse lists the host PIDs of the processes signalled.
+type KillResponse struct {
+	Signal    string `json:"signal"`
+	Processes []int  `json:"processes"`
+}
+
+var errProcessNotFound = apiError(http.StatusNotFound, codeProcessNotFound, "Process not found in container")
+
+// containerProcesses returns every process of the container, parents
+// before their children.
+func (info *ContainerInfo) containerProcesses() ([]*Process, error) {
+	procs, err := readProcesses()
+	if err != nil {
+		return nil, err
+	}
+	var members []*Process
+	var walk func(procs []*Process)
+	walk = func(procs []*Process) {
+		for _, p := range procs {
+			members = append(members, p)
+			walk(p.Children)
+		}
+	}
+	walk(info.processTree(procs))
+	return members, nil
+}
+
+// openContainerProcesses pins the given processes with pidfds and keeps
+// those still in the container once pinned, so a PID reused in between
+// can not be signalled by mistake.
+func (info *ContainerInfo) openContainerProcesses(pids []int) (map[int]int, error) {
+	pidfds := make(map[int]int)
+	for _, pid := range pids {
+		if fd, err := unix.PidfdOpen(pid, 0); err == nil {
+			pidfds[pid] = fd
+		}
+	}
+	members, err := info.containerProcesses()
+	if err != nil {
+		closePidfds(pidfds)
+		return nil, err
+	}
+	member := make(map[int]bool, len(members))
+	for _, p := range members {
+		member[p.PID] = true
+	}
+	for pid, fd := range pidfds {
+		if !member[pid] {
+			unix.Close(fd)
+			delete(pidfds, pid)
+		}
+	}
+	return pidfds, nil
+}
+
+func closePidfds(pidfds map[int]int) {
+	for _, fd := range pidfds {
+		unix.Close(fd)
+	}
+}
+
+// runsBackend reports whether a process executes the backend binary, as
+// the inits of native and rootless containers do. They forward signals
+// to the learner's processes, which would then get them twice.
+func runsBackend(pid int) bool {
+	self, err := os.Stat("/proc/self/exe")
+	if err != nil {
+		return false
+	}
+	exe, err := os.Stat(fmt.Sprintf("/proc/%d/exe", pid))
+	return err == nil && os.SameFile(self, exe)
+}
+
+// signalProcess sends a signal to one process of a container, identified
+// by its host PID as reported by top.
+func signalProcess(c echo.Context) error {
+	containerId := c.Param("id")
+
+	containersMux.RLock()
+	containerInfo, exists := containers[containerId]
+	containersMux.RUnlock()
+
+	if !exists {
+		return errContainerNotFound
+	}
+
+	pid, err := strconv.Atoi(c.Param("pid"))
+	if err != nil || pid <= 0 {
+		return invalidField("pid", "must be a process ID")
+	}
+	var req SignalRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+	// Like kill(1), SIGTERM unless told otherwise
+	sig := unix.SIGTERM
+	if req.Signal != "" {
+		if sig, err = parseSignal(req.Signal); err != nil {
+			return invalidField("signal", err.Error())
+		}
+	}
+
+	pidfds, err := containerInfo.openContainerProcesses([]int{pid})
+	if err != nil {
+		return internalError("Failed to read processes: %v", err)
+	}
+	defer closePidfds(pidfds)
+	pidfd, ok := pidfds[pid]
+	if !ok {
+		return errProcessNotFound
+	}
+	if err := unix.PidfdSendSignal(pidfd, sig, nil, 0); err != nil {
+		if err == unix.ESRCH {
+			return errProcessNotFound
+		}
+		return internalError("Failed to send signal: %v", err)
+	}
+	return c.JSON(http.StatusOK, SignalResponse{PID: pid, Signal: unix.SignalName(sig)})
+}
+
+// killContainer sends a signal, SIGKILL by default, to every process of
+// a container. The container itself stays until it is deleted.
+func killContainer(c echo.Context) error {
+	containerId := c.Param("id")
+
+	containersMux.RLock()
+	containerInfo, exists := containers[containerId]
+	containersMux.RUnlock()
+
+	if !exists {
+		return errContainerNotFound
+	}
+
+	sig := unix.SIGKILL
+	if s := c.QueryParam("signal"); s != "" {
+		var err error
+		if sig, err = parseSignal(s); err != nil {
+			return invalidField("signal", err.Error())
+		}
+	}
+
+	members, err := containerInfo.containerProcesses()
+	if err != nil {
+		return internalError("Failed to read processes: %v", err)
+	}
+	var pids []int
+	for _, p := range members {
+		if !runsBackend(p.PID) {
+			pids = append(pids, p.PID)
+		}
+	}
+	pidfds, err := containerInfo.openContainerProcesses(pids)
+	if err != nil {
+		return internalError("Failed to read processes: %v", err)
+	}
+	defer closePidfds(pidfds)
+
+	// Parents go first so they do not exit on their own when their
+	// children die before being signalled themselves. Processes already
+	// gone, such as those the kernel killed along with the init of their
+	// PID namespace, count as signalled.
+	signalled := []int{}
+	for _, pid := range pids {
+		pidfd, ok := pidfds[pid]
+		if !ok {
+			continue
+		}
+		if err := unix.PidfdSendSignal(pidfd, sig, nil, 0); err == nil || err == unix.ESRCH {
+			signalled = append(signalled, pid)
+		}
+	}
+	sort.Ints(signalled)
+	return c.JSON(http.StatusOK, KillResponse{Signal: unix.SignalName(sig), Processes: signalled})
+}
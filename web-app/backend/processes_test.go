@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/sys/unix"
+)
+
+func TestReadProcess(t *testing.T) {
+	p, err := readProcess(os.Getpid(), 1e6, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.PID != os.Getpid() || p.PPID != os.Getppid() {
+		t.Errorf("PID %d PPID %d, want %d %d", p.PID, p.PPID, os.Getpid(), os.Getppid())
+	}
+	if p.UID != os.Geteuid() {
+		t.Errorf("UID = %d, want %d", p.UID, os.Geteuid())
+	}
+	if p.NSPID == 0 || p.RSS == 0 {
+		t.Errorf("NSPID %d RSS %d, want both set", p.NSPID, p.RSS)
+	}
+	if !strings.HasPrefix(p.Command, os.Args[0]) {
+		t.Errorf("command = %q, want it to start with %q", p.Command, os.Args[0])
+	}
+
+	if _, err := readProcess(-1, 0, time.Now()); err == nil {
+		t.Error("readProcess of a missing process succeeded")
+	}
+}
+
+func TestProcessTree(t *testing.T) {
+	procs := map[int]*Process{}
+	for _, p := range []*Process{
+		{PID: 1, PPID: 0, NSPID: 1},
+		{PID: 100, PPID: 1, NSPID: 100},
+		// The container's roots and their descendants
+		{PID: 200, PPID: 100, NSPID: 1},
+		{PID: 210, PPID: 200, NSPID: 2},
+		{PID: 205, PPID: 200, NSPID: 3},
+		{PID: 211, PPID: 210, NSPID: 4},
+		{PID: 300, PPID: 100, NSPID: 1},
+		// Another container
+		{PID: 400, PPID: 100, NSPID: 1},
+		{PID: 410, PPID: 400, NSPID: 2},
+	} {
+		p.Children = []*Process{}
+		procs[p.PID] = p
+	}
+
+	// Roots that exited since are left out
+	info := &ContainerInfo{restored: []int{300, 200, 999}}
+	roots := info.processTree(procs)
+
+	// Each process shows as PID/NSPPID followed by its children
+	var describe func(ps []*Process) string
+	describe = func(ps []*Process) string {
+		var parts []string
+		for _, p := range ps {
+			part := fmt.Sprintf("%d/%d", p.PID, p.NSPPID)
+			if len(p.Children) > 0 {
+				part += "(" + describe(p.Children) + ")"
+			}
+			parts = append(parts, part)
+		}
+		return strings.Join(parts, " ")
+	}
+	got := describe(roots)
+	want := "200/0(205/1 210/1(211/2)) 300/0"
+	if got != want {
+		t.Errorf("tree = %s, want %s", got, want)
+	}
+	if procs[410].NSPPID != 0 {
+		t.Error("linked a process of another container")
+	}
+}
+
+// startTestContainer runs script as the only root process of a container
+// registered under id, removed again when the test ends.
+func startTestContainer(t *testing.T, id, script string) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command("/bin/sh", "-c", script)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	containersMux.Lock()
+	containers[id] = &ContainerInfo{ID: id, restored: []int{cmd.Process.Pid}}
+	containersMux.Unlock()
+	t.Cleanup(func() {
+		containersMux.Lock()
+		delete(containers, id)
+		containersMux.Unlock()
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return cmd
+}
+
+func testEcho() *echo.Echo {
+	e := echo.New()
+	e.HTTPErrorHandler = handleError
+	e.Validator = requestValidator{}
+	e.POST(apiPrefix+"/containers/:id/processes/:pid/signal", signalProcess)
+	e.POST(apiPrefix+"/containers/:id/kill", killContainer)
+	return e
+}
+
+func TestSignalProcess(t *testing.T) {
+	e := testEcho()
+	tests := []struct {
+		name       string
+		pid        string // empty for the container's process
+		body       string
+		wantStatus int
+		wantSignal syscall.Signal
+	}{
+		{name: "default", body: `{}`, wantStatus: http.StatusOK, wantSignal: syscall.SIGTERM},
+		{name: "by name", body: `{"signal": "usr1"}`, wantStatus: http.StatusOK, wantSignal: syscall.SIGUSR1},
+		{name: "by number", body: `{"signal": "9"}`, wantStatus: http.StatusOK, wantSignal: syscall.SIGKILL},
+		{name: "unknown signal", body: `{"signal": "SIGWHAT"}`, wantStatus: http.StatusBadRequest},
+		{name: "malformed PID", pid: "abc", body: `{}`, wantStatus: http.StatusBadRequest},
+		{name: "process of another container", pid: strconv.Itoa(os.Getpid()), body: `{}`, wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := startTestContainer(t, "signalled", "sleep 30")
+			pid := tt.pid
+			if pid == "" {
+				pid = strconv.Itoa(cmd.Process.Pid)
+			}
+			req := httptest.NewRequest(http.MethodPost, apiPrefix+"/containers/signalled/processes/"+pid+"/signal", strings.NewReader(tt.body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var resp SignalResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.PID != cmd.Process.Pid || resp.Signal != unix.SignalName(tt.wantSignal) {
+				t.Errorf("response = %+v, want %d %s", resp, cmd.Process.Pid, unix.SignalName(tt.wantSignal))
+			}
+			cmd.Wait()
+			if status := cmd.ProcessState.Sys().(syscall.WaitStatus); !status.Signaled() || status.Signal() != tt.wantSignal {
+				t.Errorf("process ended with %v, want %v", status, tt.wantSignal)
+			}
+		})
+	}
+}
+
+func TestKillContainer(t *testing.T) {
+	e := testEcho()
+	cmd := startTestContainer(t, "killed", "sleep 30 & sleep 30 & wait")
+	containersMux.RLock()
+	info := containers["killed"]
+	containersMux.RUnlock()
+
+	// Wait for both children to show up
+	var members []*Process
+	for deadline := time.Now().Add(5 * time.Second); len(members) < 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("container has %d processes, want 3", len(members))
+		}
+		var err error
+		if members, err = info.containerProcesses(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, apiPrefix+"/containers/killed/kill?signal=TERM", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d %s, want 200", rec.Code, rec.Body)
+	}
+	var resp KillResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var want []int
+	for _, p := range members {
+		want = append(want, p.PID)
+	}
+	sort.Ints(want)
+	if resp.Signal != "SIGTERM" || !reflect.DeepEqual(resp.Processes, want) {
+		t.Errorf("response = %+v, want SIGTERM %v", resp, want)
+	}
+	cmd.Wait()
+	for _, pid := range want {
+		// Signals arrive asynchronously; dead orphans may stay zombies
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if p, err := readProcess(pid, 0, time.Now()); err != nil || p.State == "Z" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("process %d survived", pid)
+				break
+			}
+		}
+	}
+}
+
+func TestRunsBackend(t *testing.T) {
+	if !runsBackend(os.Getpid()) {
+		t.Error("runsBackend is false for the backend itself")
+	}
+	if runsBackend(os.Getppid()) {
+		t.Error("runsBackend is true for another program")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// runReaper periodically deletes containers that have gone without a
+// terminal for reaper.idleTimeout or outlived reaper.maxLifetime.
+func runReaper() {
+	if config.Reaper.IdleTimeout == 0 && config.Reaper.MaxLifetime == 0 {
+		return
+	}
+	ticker := time.NewTicker(config.Reaper.Interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		reapContainers(now)
+	}
+}
+
+func reapContainers(now time.Time) {
+	reasons := make(map[*ContainerInfo]string)
+	containersMux.Lock()
+	for id, info := range containers {
+		if reason := info.reapReason(now); reason != "" {
+			reasons[info] = reason
+			delete(containers, id)
+		}
+	}
+	containersMux.Unlock()
+
+	for info, reason := range reasons {
+		log.Printf("Reaping container %s: %s", info.ID, reason)
+		if reason == "expired" {
+			info.notifyTerminals(TerminalMessage{
+				Type: "error",
+				Data: "The container is being deleted because it reached its maximum lifetime",
+			})
+		}
+		destroyContainer(info, map[string]string{"reason": reason})
+	}
+}
+
+// reapReason says why the container is due for deletion, if it is.
+func (info *ContainerInfo) reapReason(now time.Time) string {
+	if max := config.Reaper.MaxLifetime; max > 0 && now.Sub(info.CreatedAt) > max {
+		return "expired"
+	}
+	info.terminalMu.Lock()
+	defer info.terminalMu.Unlock()
+	if idle := config.Reaper.IdleTimeout; idle > 0 && !info.idleSince.IsZero() && now.Sub(info.idleSince) > idle {
+		return "idle"
+	}
+	return ""
+}
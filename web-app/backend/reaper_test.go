@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReapReason(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		idleTimeout time.Duration
+		maxLifetime time.Duration
+		age         time.Duration
+		idleFor     time.Duration // zero while a terminal is attached
+		want        string
+	}{
+		{name: "reaper disabled", age: 48 * time.Hour, idleFor: 24 * time.Hour},
+		{name: "young and attached", idleTimeout: time.Hour, maxLifetime: 4 * time.Hour, age: time.Hour},
+		{name: "idle within the timeout", idleTimeout: time.Hour, age: 2 * time.Hour, idleFor: 30 * time.Minute},
+		{name: "idle past the timeout", idleTimeout: time.Hour, age: 2 * time.Hour, idleFor: 90 * time.Minute, want: "idle"},
+		{name: "attached past the idle timeout", idleTimeout: time.Hour, age: 5 * time.Hour},
+		{name: "past the lifetime", maxLifetime: 4 * time.Hour, age: 5 * time.Hour, want: "expired"},
+		{name: "attached past the lifetime", idleTimeout: time.Hour, maxLifetime: 4 * time.Hour, age: 5 * time.Hour, want: "expired"},
+		{name: "expiry over idleness", idleTimeout: time.Hour, maxLifetime: 4 * time.Hour, age: 5 * time.Hour, idleFor: 2 * time.Hour, want: "expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = defaultConfig()
+			config.Reaper.IdleTimeout = tt.idleTimeout
+			config.Reaper.MaxLifetime = tt.maxLifetime
+
+			info := &ContainerInfo{CreatedAt: now.Add(-tt.age)}
+			if tt.idleFor != 0 {
+				info.idleSince = now.Add(-tt.idleFor)
+			}
+			if got := info.reapReason(now); got != tt.want {
+				t.Errorf("reapReason = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Container drivers. The local driver runs shells directly on the host,
+// the native driver isolates them in namespaces on their own root
+// filesystem.
+const (
+	driverLocal  = "local"
+	driverNative = "native"
+)
+
+// containerInitCommand is the argument the backend re-executes itself
+// with to become PID 1 of a container and prepare its root filesystem
+// from inside its new namespaces. The init runs containerSetupCommand to
+// execute the container's command. The setup is passed as JSON in
+// containerSetupEnv.
+const (
+	containerInitCommand  = "init"
+	containerSetupCommand = "container-setup"
+	containerSetupEnv     = "_LCW_CONTAINER_SETUP"
+)
+
+// Namespaces every native container process gets of its own
+const containerCloneFlags = syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC
+
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+var containerDriver = defaultDriver()
+
+// defaultDriver picks the native driver whenever the backend has the
+// privileges to mount filesystems, and the rootless driver when it can
+// get them in a user namespace.
+func defaultDriver() string {
+	if os.Geteuid() == 0 {
+		return driverNative
+	}
+	if userNamespacesAvailable() {
+		return driverRootless
+	}
+	return driverLocal
+}
+
+// rootfsDir holds hand-made root filesystems for images that are not in
+// the image store, one directory per image.
+func rootfsDir() string {
+	return filepath.Join(config.Backend.StateDir, "rootfs")
+}
+
+// resolveImage finds the read-only lower layers for an image, topmost
+// first. Images in the store resolve to their unpacked layers; otherwise
+// the reference is flattened into a directory name under rootfsDir, e.g.
+// "ubuntu:22.04" -> "ubuntu_22.04". The digest is empty for the latter.
+func resolveImage(image string) (digest string, lowers []string, err error) {
+	if img, ok := imageStore.Resolve(image); ok {
+		return img.Digest, imageStore.LayerDirs(img), nil
+	}
+	path, err := imageRootfs(image)
+	if err != nil {
+		return "", nil, err
+	}
+	return "", []string{path}, nil
+}
+
+// imageRootfs is the hand-made root filesystem of an image.
+func imageRootfs(image string) (string, error) {
+	name := strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(image)
+	path := filepath.Join(rootfsDir(), name)
+	if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+		return "", fmt.Errorf("image %s is not in the image store and has no root filesystem at %s", image, path)
+	}
+	return path, nil
+}
+
+// imageLayers returns the lower layers of the container's overlay. The
+// image is looked up by what the container was created from, as its
+// reference may have been moved to another image since.
+func (info *ContainerInfo) imageLayers() ([]string, error) {
+	if info.ImageDigest == "" {
+		path, err := imageRootfs(info.Image)
+		return []string{path}, err
+	}
+	img, ok := imageStore.Resolve(info.ImageDigest)
+	if !ok {
+		return nil, fmt.Errorf("image %s is no longer in the image store", info.ImageDigest)
+	}
+	return imageStore.LayerDirs(img), nil
+}
+
+func (info *ContainerInfo) rootfsPath() string {
+	return filepath.Join(containerDir(info.ID), "merged")
+}
+
+// mountContainerRootfs merges the image layers with a per-container
+// upper directory so every change the learner makes stays inside the
+// container.
+func mountContainerRootfs(info *ContainerInfo) error {
+	options, err := overlayOptions(info)
+	if err != nil {
+		return err
+	}
+	// Device nodes the container creates in its filesystem stay unusable
+	if err := syscall.Mount("overlay", info.rootfsPath(), "overlay", syscall.MS_NODEV, options); err != nil {
+		return fmt.Errorf("failed to mount overlay: %w", err)
+	}
+	return nil
+}
+
+// overlayOptions looks up the layers of the image the container was
+// created from and creates the upper, work and mount point directories
+// of its overlay.
+func overlayOptions(info *ContainerInfo) (string, error) {
+	lowers, err := info.imageLayers()
+	if err != nil {
+		return "", err
+	}
+
+	dir := containerDir(info.ID)
+	upper := filepath.Join(dir, "upper")
+	work := filepath.Join(dir, "work")
+	for _, d := range []string{upper, work, info.rootfsPath()} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowers, ":"), upper, work), nil
+}
+
+func unmountContainerRootfs(info *ContainerInfo) error {
+	err := syscall.Unmount(info.rootfsPath(), syscall.MNT_DETACH)
+	if err != nil && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOENT) {
+		return err
+	}
+	return nil
+}
+
+// containerSetup is what the re-executed backend needs to enter the
+// container's root filesystem and run a command there. Without a Rootfs
+// the command stays on the host and only the security profile applies.
+type containerSetup struct {
+	Rootfs   string         `json:"rootfs,omitempty"`
+	Hostname string         `json:"hostname,omitempty"`
+	Netns    string         `json:"netns,omitempty"`
+	Cgroup   string         `json:"cgroup,omitempty"`
+	Cwd      string         `json:"cwd"`
+	Args     []string       `json:"args"`
+	Env      []string       `json:"env"`
+	Security *setupSecurity `json:"security,omitempty"`
+	// Subreaper makes the command adopt its orphaned descendants, which
+	// outside a PID namespace would go to the host's init
+	Subreaper bool `json:"subreaper,omitempty"`
+}
+
+// nativeCommand runs args in fresh mount, PID, UTS and IPC namespaces
+// rooted at the container's merged filesystem. The network namespace is
+// shared by all of the container's processes and joined during setup.
+// Rootless containers get their namespaces from the sandbox instead.
+func nativeCommand(ctx context.Context, info *ContainerInfo, env, args []string) *exec.Cmd {
+	setup := containerSetup{
+		Rootfs:   info.rootfsPath(),
+		Hostname: info.hostname(),
+		Cwd:      info.workingDir(),
+		Args:     args,
+		Env:      env,
+		Security: info.security,
+	}
+	if info.Driver == driverRootless {
+		// The sandbox already holds the network namespace
+		return attachCommand(ctx, info, setup)
+	}
+	if info.Network.Mode != networkHost {
+		setup.Netns = info.netnsPath()
+	}
+	if cg := info.processCgroup(); cg != nil {
+		setup.Cgroup = cg.Path
+	}
+
+	data, _ := json.Marshal(setup)
+	cmd := exec.CommandContext(ctx, "/proc/self/exe", containerInitCommand)
+	cmd.Env = []string{containerSetupEnv + "=" + string(data)}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: containerCloneFlags}
+	return cmd
+}
+
+// setupCommand re-executes the backend to run the container setup.
+func setupCommand(ctx context.Context, setup containerSetup) *exec.Cmd {
+	data, _ := json.Marshal(setup)
+	cmd := exec.CommandContext(ctx, "/proc/self/exe", containerSetupCommand)
+	cmd.Env = []string{containerSetupEnv + "=" + string(data)}
+	return cmd
+}
+
+func (info *ContainerInfo) hostname() string {
+	id := info.ID
+	if i := strings.LastIndex(id, "-"); i >= 0 {
+		id = id[i+1:]
+	}
+	if len(id) > 12 {
+		id = id[len(id)-12:]
+	}
+	return "container-" + id
+}
+
+// runContainerSetup is the last stage before the container's command: it
+// applies the security profile and executes the command. Native
+// containers reach it through their init; the local driver runs it
+// directly. It never returns on success.
+func runContainerSetup() {
+	runtime.LockOSThread()
+
+	setup := readContainerSetup("container setup")
+	if err := os.Chdir(setup.Cwd); err != nil {
+		log.Fatalf("container setup: %v", err)
+	}
+
+	path, err := lookPath(setup.Args[0], setup.Env)
+	if err != nil {
+		log.Fatalf("container setup: %v", err)
+	}
+	if setup.Security != nil {
+		if err := applySecurity(setup.Security, setup.Cwd); err != nil {
+			log.Fatalf("container setup: %v", err)
+		}
+	}
+	// The setting survives the exec
+	if setup.Subreaper {
+		if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+			log.Fatalf("container setup: failed to become a subreaper: %v", err)
+		}
+	}
+	if err := syscall.Exec(path, setup.Args, setup.Env); err != nil {
+		log.Fatalf("container setup: exec %s: %v", path, err)
+	}
+}
+
+func readContainerSetup(stage string) *containerSetup {
+	var setup containerSetup
+	if err := json.Unmarshal([]byte(os.Getenv(containerSetupEnv)), &setup); err != nil {
+		log.Fatalf("%s: invalid configuration: %v", stage, err)
+	}
+	if len(setup.Args) == 0 {
+		log.Fatalf("%s: no command to run", stage)
+	}
+	return &setup
+}
+
+// setupRootfs makes mount propagation private, mounts fresh /proc, /sys
+// and /dev inside rootfs and pivots into it.
+func setupRootfs(rootfs string) error {
+	// Keep our mounts from leaking back into the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make / private: %w", err)
+	}
+
+	// pivot_root requires the new root to be a mount point
+	if err := syscall.Mount(rootfs, rootfs, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind mount rootfs: %w", err)
+	}
+
+	if err := mountPseudoFilesystems(rootfs); err != nil {
+		return err
+	}
+
+	return pivotRoot(rootfs)
+}
+
+func mountPseudoFilesystems(rootfs string) error {
+	mounts := []struct {
+		source, target, fstype string
+		flags                  uintptr
+		data                   string
+	}{
+		{"proc", "proc", "proc", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, ""},
+		{"sysfs", "sys", "sysfs", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_RDONLY, ""},
+		{"tmpfs", "dev", "tmpfs", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_STRICTATIME, "mode=755,size=65536k"},
+		{"devpts", "dev/pts", "devpts", syscall.MS_NOSUID | syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620"},
+		{"shm", "dev/shm", "tmpfs", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, "mode=1777,size=65536k"},
+	}
+	for _, m := range mounts {
+		target := filepath.Join(rootfs, m.target)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		err := syscall.Mount(m.source, target, m.fstype, m.flags, m.data)
+		if err == syscall.EPERM && m.fstype == "sysfs" {
+			// A user namespace may only mount sysfs for a network
+			// namespace it owns, which it does not with host networking
+			err = syscall.Mount("/sys", target, "", syscall.MS_BIND|syscall.MS_REC, "")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to mount %s: %w", m.target, err)
+		}
+	}
+
+	return populateDev(filepath.Join(rootfs, "dev"))
+}
+
+// populateDev provides the standard device nodes and links in dev. Device
+// nodes are bind mounted from the host, which also works where mknod is
+// not permitted and keeps them usable on the nodev /dev. Entries that
+// already exist are left alone.
+func populateDev(dev string) error {
+	for _, name := range []string{"null", "zero", "full", "random", "urandom", "tty"} {
+		target := filepath.Join(dev, name)
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		f.Close()
+		if err := syscall.Mount("/dev/"+name, target, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to bind /dev/%s: %w", name, err)
+		}
+	}
+
+	links := map[string]string{
+		"ptmx":   "pts/ptmx",
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dev, name)); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func pivotRoot(rootfs string) error {
+	oldRoot := filepath.Join(rootfs, ".pivot_root")
+	if err := os.MkdirAll(oldRoot, 0700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(rootfs, oldRoot); err != nil {
+		return fmt.Errorf("pivot_root failed: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Unmount("/.pivot_root", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to detach old root: %w", err)
+	}
+	return os.Remove("/.pivot_root")
+}
+
+// lookPath resolves a command against the PATH of the container's
+// environment rather than the backend's.
+func lookPath(name string, env []string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
+	path := defaultPath
+	for _, kv := range env {
+		if value, ok := strings.CutPrefix(kv, "PATH="); ok {
+			path = value
+		}
+	}
+	for _, dir := range filepath.SplitList(path) {
+		candidate := filepath.Join(dir, name)
+		if fi, err := os.Stat(candidate); err == nil && !fi.IsDir() && fi.Mode()&0111 != 0 {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%s: executable file not found in $PATH", name)
+}
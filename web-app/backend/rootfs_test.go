@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookPath(t *testing.T) {
+	dir := t.TempDir()
+	for name, mode := range map[string]os.FileMode{"tool": 0755, "data": 0644} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := "PATH=" + filepath.Join(dir, "missing") + ":" + dir
+
+	tests := []struct {
+		name    string
+		env     []string
+		want    string
+		wantErr bool
+	}{
+		{name: "tool", env: []string{"HOME=/root", path}, want: filepath.Join(dir, "tool")},
+		{name: "/bin/true", env: []string{path}, want: "/bin/true"},
+		{name: "./relative", env: []string{path}, want: "./relative"},
+		{name: "data", env: []string{path}, wantErr: true},
+		{name: "subdir", env: []string{path}, wantErr: true},
+		{name: "tool", env: []string{"HOME=/root"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := lookPath(tt.name, tt.env)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("lookPath(%q, %q) = %q, want an error", tt.name, tt.env, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("lookPath(%q, %q) = %q, %v, want %q", tt.name, tt.env, got, err, tt.want)
+		}
+	}
+}
+
+func TestHostname(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"abc123", "container-abc123"},
+		{"01-process-management-1a2b3c", "container-1a2b3c"},
+		{"3f2a9c0d4b1e5f6a7b8c9d0e1f2a3b4c", "container-9d0e1f2a3b4c"},
+	}
+	for _, tt := range tests {
+		info := &ContainerInfo{ID: tt.id}
+		if got := info.hostname(); got != tt.want {
+			t.Errorf("hostname of %s = %s, want %s", tt.id, got, tt.want)
+		}
+	}
+}
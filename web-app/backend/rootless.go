@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The rootless driver runs every container inside a user namespace, so
+// the backend needs no privileges of its own. A sandbox process owns the
+// container's user, mount and network namespaces and starts the
+// container's processes on behalf of the backend, since a multithreaded
+// Go program can not join a user namespace itself.
+const (
+	driverRootless = "rootless"
+
+	containerSandboxCommand = "container-sandbox"
+	containerAttachCommand  = "container-attach"
+	containerSandboxEnv     = "_LCW_SANDBOX"
+
+	// The sandbox re-executes itself once its ID mappings are in place,
+	// which gives it a full set of capabilities inside the namespace
+	sandboxMappedStage = "mapped"
+)
+
+// userNamespacesAvailable reports whether unprivileged users may create
+// user namespaces on this host.
+func userNamespacesAvailable() bool {
+	for _, knob := range []string{"/proc/sys/kernel/unprivileged_userns_clone", "/proc/sys/user/max_user_namespaces"} {
+		data, err := os.ReadFile(knob)
+		if err == nil && strings.TrimSpace(string(data)) == "0" {
+			return false
+		}
+	}
+	_, err := os.Stat("/proc/self/ns/user")
+	return err == nil
+}
+
+// idMapping is one line of /proc/<pid>/uid_map or gid_map.
+type idMapping struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// subordinateIDs finds the range /etc/subuid or /etc/subgid delegates to
+// a user, who may be listed by name or by ID.
+func subordinateIDs(path, name string, id int) (start, count int, ok bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 || (fields[0] != name && fields[0] != strconv.Itoa(id)) {
+			continue
+		}
+		start, err1 := strconv.Atoi(fields[1])
+		count, err2 := strconv.Atoi(fields[2])
+		if err1 == nil && err2 == nil && count > 0 {
+			return start, count, true
+		}
+	}
+	return 0, 0, false
+}
+
+// idMappings maps the container's root to the backend's user and, when
+// newuidmap and newgidmap can delegate them, the user's subordinate IDs
+// to container IDs 1 and up. Without them only a single ID is mapped.
+func idMappings() (uids, gids []idMapping) {
+	uid, gid := os.Geteuid(), os.Getegid()
+	uids = []idMapping{{ContainerID: 0, HostID: uid, Size: 1}}
+	gids = []idMapping{{ContainerID: 0, HostID: gid, Size: 1}}
+
+	if _, err := exec.LookPath("newuidmap"); err != nil {
+		return uids, gids
+	}
+	if _, err := exec.LookPath("newgidmap"); err != nil {
+		return uids, gids
+	}
+	name := strconv.Itoa(uid)
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	uidStart, uidCount, ok := subordinateIDs("/etc/subuid", name, uid)
+	if !ok {
+		return uids, gids
+	}
+	gidStart, gidCount, ok := subordinateIDs("/etc/subgid", name, uid)
+	if !ok {
+		return uids, gids
+	}
+	uids = append(uids, idMapping{ContainerID: 1, HostID: uidStart, Size: uidCount})
+	gids = append(gids, idMapping{ContainerID: 1, HostID: gidStart, Size: gidCount})
+	return uids, gids
+}
+
+// writeIDMappings installs the mappings of the process pid. Single-ID
+// maps of our own IDs may be written directly; anything else goes
+// through the setuid newuidmap and newgidmap helpers.
+func writeIDMappings(pid int, uids, gids []idMapping) error {
+	if len(uids) == 1 && len(gids) == 1 {
+		procDir := fmt.Sprintf("/proc/%d", pid)
+		// Unprivileged gid maps require setgroups to be denied
+		if err := os.WriteFile(filepath.Join(procDir, "setgroups"), []byte("deny"), 0); err != nil {
+			return err
+		}
+		for file, m := range map[string]idMapping{"uid_map": uids[0], "gid_map": gids[0]} {
+			line := fmt.Sprintf("%d %d %d\n", m.ContainerID, m.HostID, m.Size)
+			if err := os.WriteFile(filepath.Join(procDir, file), []byte(line), 0); err != nil {
+				return fmt.Errorf("failed to write %s: %w", file, err)
+			}
+		}
+		return nil
+	}
+
+	for helper, mappings := range map[string][]idMapping{"newuidmap": uids, "newgidmap": gids} {
+		args := []string{strconv.Itoa(pid)}
+		for _, m := range mappings {
+			args = append(args, strconv.Itoa(m.ContainerID), strconv.Itoa(m.HostID), strconv.Itoa(m.Size))
+		}
+		if output, err := exec.Command(helper, args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s failed: %v: %s", helper, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// sandboxConfig tells the sandbox how to assemble the container's root.
+type sandboxConfig struct {
+	Overlay  string `json:"overlay"`
+	Merged   string `json:"merged"`
+	Socket   string `json:"socket"`
+	Loopback bool   `json:"loopback"`
+}
+
+// sandboxRequest is sent by attach clients over the sandbox socket: first
+// an operation, then any signals to forward to the process it started.
+type sandboxRequest struct {
+	Op     string          `json:"op,omitempty"`
+	Setup  json.RawMessage `json:"setup,omitempty"`
+	Signal int             `json:"signal,omitempty"`
+}
+
+type sandboxReply struct {
+	ExitCode int    `json:"exitCode"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Operations understood by the sandbox
+const (
+	sandboxRun    = "run"
+	sandboxRemove = "remove"
+)
+
+func (info *ContainerInfo) sandboxSocket() string {
+	return filepath.Join(containerDir(info.ID), "sandbox.sock")
+}
+
+// sandboxRoot reaches the sandbox's mount namespace, where the overlay
+// is mounted, from the host.
+func (info *ContainerInfo) sandboxRoot() string {
+	return fmt.Sprintf("/proc/%d/root", info.sandbox.Process.Pid)
+}
+
+// startSandbox launches the process that holds a rootless container's
+// namespaces and waits until its root filesystem is mounted.
+func startSandbox(info *ContainerInfo) error {
+	options, err := overlayOptions(info)
+	if err != nil {
+		return err
+	}
+	config := sandboxConfig{
+		Overlay:  options,
+		Merged:   info.rootfsPath(),
+		Socket:   info.sandboxSocket(),
+		Loopback: info.Network.Mode != networkHost,
+	}
+	data, _ := json.Marshal(config)
+
+	syncR, syncW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer syncW.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		syncR.Close()
+		return err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command("/proc/self/exe", containerSandboxCommand)
+	cmd.Env = []string{containerSandboxEnv + "=" + string(data)}
+	cmd.ExtraFiles = []*os.File{syncR, readyW}
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS}
+	if config.Loopback {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	err = cmd.Start()
+	syncR.Close()
+	readyW.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start sandbox: %w", err)
+	}
+	info.sandbox = cmd
+	// The sandbox forks every process of the container, which inherit
+	// its cgroup
+	if cg := info.processCgroup(); cg != nil {
+		if err := cg.addProcess(cmd.Process.Pid); err != nil {
+			log.Printf("Container %s: running without a cgroup: %v", info.ID, err)
+		}
+	}
+
+	uids, gids := idMappings()
+	if err := writeIDMappings(cmd.Process.Pid, uids, gids); err != nil {
+		return fmt.Errorf("failed to map IDs: %w", err)
+	}
+	syncW.Close()
+
+	status, _ := io.ReadAll(readyR)
+	if msg := string(status); msg != "ok" {
+		if msg == "" {
+			msg = "sandbox exited"
+		}
+		return fmt.Errorf("failed to set up sandbox: %s", msg)
+	}
+	return nil
+}
+
+// stopSandbox removes what the container wrote, which may be owned by
+// subordinate IDs the backend can not delete itself, and ends the
+// sandbox together with every process in it.
+func stopSandbox(info *ContainerInfo) error {
+	if info.sandbox == nil {
+		return nil
+	}
+	conn, err := net.Dial("unixpacket", info.sandboxSocket())
+	if err == nil {
+		err = func() error {
+			defer conn.Close()
+			data, _ := json.Marshal(sandboxRequest{Op: sandboxRemove})
+			if _, err := conn.Write(data); err != nil {
+				return err
+			}
+			buf := make([]byte, 4096)
+			n, err := conn.Read(buf)
+			if err != nil {
+				return err
+			}
+			var reply sandboxReply
+			if err := json.Unmarshal(buf[:n], &reply); err != nil {
+				return err
+			}
+			if reply.Error != "" {
+				return errors.New(reply.Error)
+			}
+			return nil
+		}()
+	}
+	info.sandbox.Process.Kill()
+	info.sandbox.Wait()
+	info.sandbox = nil
+	return err
+}
+
+// attachCommand runs a container process through the sandbox. The attach
+// client passes its standard streams on, forwards signals and exits with
+// the process' exit code, so callers can treat it like the container's
+// init.
+func attachCommand(ctx context.Context, info *ContainerInfo, setup containerSetup) *exec.Cmd {
+	data, _ := json.Marshal(setup)
+	cmd := exec.CommandContext(ctx, "/proc/self/exe", containerAttachCommand, info.sandboxSocket())
+	cmd.Env = []string{containerSetupEnv + "=" + string(data)}
+	return cmd
+}
+
+// runContainerSandbox is the entry point of the sandbox process.
+func runContainerSandbox() {
+	ready := os.NewFile(4, "ready")
+	fail := func(format string, args ...any) {
+		fmt.Fprintf(ready, format, args...)
+		os.Exit(1)
+	}
+
+	if len(os.Args) < 3 || os.Args[2] != sandboxMappedStage {
+		// Block until the backend has written our ID mappings
+		sync := os.NewFile(3, "sync")
+		io.Copy(io.Discard, sync)
+		sync.Close()
+		err := syscall.Exec("/proc/self/exe", []string{os.Args[0], containerSandboxCommand, sandboxMappedStage}, os.Environ())
+		fail("exec: %v", err)
+	}
+
+	var config sandboxConfig
+	if err := json.Unmarshal([]byte(os.Getenv(containerSandboxEnv)), &config); err != nil {
+		fail("invalid configuration: %v", err)
+	}
+
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		fail("failed to make / private: %v", err)
+	}
+	// Overlay mounts in a user namespace keep their xattrs in user.*
+	if err := syscall.Mount("overlay", config.Merged, "overlay", 0, config.Overlay+",userxattr"); err != nil {
+		fail("failed to mount overlay: %v", err)
+	}
+	if config.Loopback {
+		nl, err := openNetlink()
+		if err != nil {
+			fail("%v", err)
+		}
+		if err := nl.SetUp("lo"); err != nil {
+			fail("failed to bring up loopback: %v", err)
+		}
+		nl.Close()
+	}
+
+	os.Remove(config.Socket)
+	listener, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: config.Socket, Net: "unixpacket"})
+	if err != nil {
+		fail("%v", err)
+	}
+	ready.WriteString("ok")
+	ready.Close()
+
+	for {
+		conn, err := listener.AcceptUnix()
+		if err != nil {
+			log.Fatalf("container sandbox: %v", err)
+		}
+		go serveSandbox(conn, &config)
+	}
+}
+
+// serveSandbox handles a single attach client.
+func serveSandbox(conn *net.UnixConn, config *sandboxConfig) {
+	defer conn.Close()
+	reply := func(r sandboxReply) {
+		data, _ := json.Marshal(r)
+		conn.Write(data)
+	}
+
+	buf := make([]byte, 1<<20)
+	oob := make([]byte, unix.CmsgSpace(3*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return
+	}
+	var fds []int
+	if msgs, err := unix.ParseSocketControlMessage(oob[:oobn]); err == nil && len(msgs) > 0 {
+		fds, _ = unix.ParseUnixRights(&msgs[0])
+	}
+	var files []*os.File
+	for _, fd := range fds {
+		files = append(files, os.NewFile(uintptr(fd), "stdio"))
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var req sandboxRequest
+	if err := json.Unmarshal(buf[:n], &req); err != nil {
+		reply(sandboxReply{Error: err.Error()})
+		return
+	}
+
+	switch req.Op {
+	case sandboxRemove:
+		var errs []error
+		if err := syscall.Unmount(config.Merged, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL {
+			errs = append(errs, err)
+		}
+		dir := filepath.Dir(config.Merged)
+		for _, d := range []string{"upper", "work"} {
+			errs = append(errs, os.RemoveAll(filepath.Join(dir, d)))
+		}
+		if err := errors.Join(errs...); err != nil {
+			reply(sandboxReply{Error: err.Error()})
+			return
+		}
+		reply(sandboxReply{})
+
+	case sandboxRun:
+		if len(files) != 3 {
+			reply(sandboxReply{Error: "expected the standard streams"})
+			return
+		}
+		exitR, exitW, err := os.Pipe()
+		if err != nil {
+			reply(sandboxReply{Error: err.Error()})
+			return
+		}
+		defer exitR.Close()
+		cmd := exec.Command("/proc/self/exe", containerInitCommand)
+		cmd.Env = []string{containerSetupEnv + "=" + string(req.Setup)}
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = files[0], files[1], files[2]
+		reportExit(cmd, exitW)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Cloneflags: containerCloneFlags,
+			Setsid:     true,
+			Pdeathsig:  syscall.SIGKILL,
+		}
+		err = cmd.Start()
+		exitW.Close()
+		if err != nil {
+			reply(sandboxReply{Error: err.Error()})
+			return
+		}
+
+		// Forward signals until the client goes away, which kills the process
+		go func() {
+			msg := make([]byte, 4096)
+			for {
+				n, err := conn.Read(msg)
+				if err != nil || n == 0 {
+					cmd.Process.Kill()
+					return
+				}
+				var r sandboxRequest
+				if json.Unmarshal(msg[:n], &r) == nil && r.Signal != 0 {
+					cmd.Process.Signal(syscall.Signal(r.Signal))
+				}
+			}
+		}()
+
+		code, reported := readExitCode(exitR)
+		cmd.Wait()
+		if !reported {
+			code = exitCode(cmd.ProcessState)
+		}
+		reply(sandboxReply{ExitCode: code})
+
+	default:
+		reply(sandboxReply{Error: fmt.Sprintf("unknown operation %q", req.Op)})
+	}
+}
+
+// runContainerAttach is the entry point of the attach client.
+func runContainerAttach() {
+	if len(os.Args) < 3 {
+		log.Fatalf("container attach: no sandbox socket")
+	}
+	conn, err := net.DialUnix("unixpacket", nil, &net.UnixAddr{Name: os.Args[2], Net: "unixpacket"})
+	if err != nil {
+		log.Fatalf("container attach: %v", err)
+	}
+
+	// A terminal can only be the controlling terminal of one session, so
+	// give it up for the container process to take over. Doing so hangs
+	// up our own process group.
+	if _, err := unix.IoctlGetTermios(0, unix.TCGETS); err == nil {
+		signal.Ignore(syscall.SIGHUP)
+		unix.IoctlSetInt(0, unix.TIOCNOTTY, 0)
+	}
+
+	req, _ := json.Marshal(sandboxRequest{Op: sandboxRun, Setup: json.RawMessage(os.Getenv(containerSetupEnv))})
+	if _, _, err := conn.WriteMsgUnix(req, unix.UnixRights(0, 1, 2), nil); err != nil {
+		log.Fatalf("container attach: %v", err)
+	}
+
+	signals := make(chan os.Signal, 8)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			data, _ := json.Marshal(sandboxRequest{Signal: int(sig.(syscall.Signal))})
+			conn.Write(data)
+		}
+	}()
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		log.Fatalf("container attach: sandbox went away: %v", err)
+	}
+	var reply sandboxReply
+	if err := json.Unmarshal(buf[:n], &reply); err != nil {
+		log.Fatalf("container attach: %v", err)
+	}
+	if reply.Error != "" {
+		log.Fatalf("container attach: %s", reply.Error)
+	}
+	writeExitCode(reply.ExitCode)
+	os.Exit(reply.ExitCode)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSubordinateIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subuid")
+	contents := "alice:100000:65536\n" +
+		"broken line\n" +
+		"carol:200000:0\n" +
+		"carol:abc:65536\n" +
+		"  1001:300000:1000  \n" +
+		"dave:400000:65536\n"
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		id        int
+		wantStart int
+		wantCount int
+		wantOK    bool
+	}{
+		{name: "alice", id: 1000, wantStart: 100000, wantCount: 65536, wantOK: true},
+		{name: "bob", id: 1001, wantStart: 300000, wantCount: 1000, wantOK: true},
+		{name: "carol", id: 1002},
+		{name: "dave", id: 1003, wantStart: 400000, wantCount: 65536, wantOK: true},
+		{name: "erin", id: 1004},
+	}
+	for _, tt := range tests {
+		start, count, ok := subordinateIDs(path, tt.name, tt.id)
+		if start != tt.wantStart || count != tt.wantCount || ok != tt.wantOK {
+			t.Errorf("subordinateIDs(%s, %d) = %d, %d, %v, want %d, %d, %v",
+				tt.name, tt.id, start, count, ok, tt.wantStart, tt.wantCount, tt.wantOK)
+		}
+	}
+
+	if _, _, ok := subordinateIDs(filepath.Join(t.TempDir(), "missing"), "alice", 1000); ok {
+		t.Error("subordinateIDs found a range in a missing file")
+	}
+}
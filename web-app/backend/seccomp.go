@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// seccompProfile uses the JSON format of Docker's seccomp profiles, so
+// existing profiles can be loaded as they are.
+type seccompProfile struct {
+	DefaultAction   string        `json:"defaultAction"`
+	DefaultErrnoRet *uint32       `json:"defaultErrnoRet,omitempty"`
+	Syscalls        []seccompRule `json:"syscalls"`
+}
+
+type seccompRule struct {
+	Names    []string      `json:"names,omitempty"`
+	Name     string        `json:"name,omitempty"`
+	Action   string        `json:"action"`
+	ErrnoRet *uint32       `json:"errnoRet,omitempty"`
+	Args     []seccompArg  `json:"args,omitempty"`
+	Includes seccompFilter `json:"includes"`
+	Excludes seccompFilter `json:"excludes"`
+	Comment  string        `json:"comment,omitempty"`
+}
+
+// seccompArg compares a syscall argument; all args of a rule must match.
+type seccompArg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo"`
+	Op       string `json:"op"`
+}
+
+// seccompFilter makes a rule conditional on the container's capabilities
+// or the host architecture.
+type seccompFilter struct {
+	Caps   []string `json:"caps,omitempty"`
+	Arches []string `json:"arches,omitempty"`
+}
+
+// bpfClassMask selects the instruction class of a BPF opcode
+const bpfClassMask = 0x07
+
+// Offsets into struct seccomp_data
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArgs = 16
+)
+
+// defaultSeccompProfile is a deny-list that blocks what Docker's default
+// profile blocks, leaving namespace and mount syscalls to containers that
+// were granted CAP_SYS_ADMIN, as the namespaces and filesystem sections
+// need them.
+func defaultSeccompProfile() *seccompProfile {
+	eperm := uint32(unix.EPERM)
+	enosys := uint32(unix.ENOSYS)
+	deny := func(caps []string, names ...string) seccompRule {
+		rule := seccompRule{Names: names, Action: "SCMP_ACT_ERRNO", ErrnoRet: &eperm}
+		rule.Excludes.Caps = caps
+		return rule
+	}
+
+	profile := &seccompProfile{
+		DefaultAction: "SCMP_ACT_ALLOW",
+		Syscalls: []seccompRule{
+			deny(nil, "kexec_load", "kexec_file_load", "create_module", "get_kernel_syms",
+				"query_module", "nfsservctl", "uselib", "ustat", "sysfs", "_sysctl",
+				"vm86", "vm86old", "lookup_dcookie", "add_key", "keyctl", "request_key",
+				"userfaultfd"),
+			deny([]string{"CAP_SYS_ADMIN"}, "mount", "umount", "umount2", "pivot_root",
+				"unshare", "setns", "swapon", "swapoff", "quotactl", "fanotify_init",
+				"name_to_handle_at", "mount_setattr", "move_mount", "open_tree",
+				"fsopen", "fsconfig", "fsmount", "fspick"),
+			deny([]string{"CAP_DAC_READ_SEARCH"}, "open_by_handle_at"),
+			deny([]string{"CAP_SYS_MODULE"}, "init_module", "finit_module", "delete_module"),
+			deny([]string{"CAP_SYS_TIME"}, "settimeofday", "stime", "clock_settime", "clock_adjtime"),
+			deny([]string{"CAP_SYS_BOOT"}, "reboot"),
+			deny([]string{"CAP_SYS_RAWIO"}, "iopl", "ioperm"),
+			deny([]string{"CAP_SYS_PACCT"}, "acct"),
+			deny([]string{"CAP_SYS_NICE"}, "mbind", "set_mempolicy", "move_pages"),
+			deny([]string{"CAP_SYSLOG"}, "syslog"),
+			deny([]string{"CAP_BPF"}, "bpf"),
+			deny([]string{"CAP_PERFMON"}, "perf_event_open"),
+		},
+	}
+
+	// Creating namespaces through clone needs CAP_SYS_ADMIN, like in
+	// Docker. clone3 passes its flags in memory where seccomp can not
+	// look, so it reports ENOSYS and the C library falls back to clone.
+	flagArg := uint(0)
+	if runtime.GOARCH == "s390x" {
+		flagArg = 1
+	}
+	for _, flag := range []uint64{unix.CLONE_NEWNS, unix.CLONE_NEWUTS, unix.CLONE_NEWIPC,
+		unix.CLONE_NEWUSER, unix.CLONE_NEWPID, unix.CLONE_NEWNET, unix.CLONE_NEWCGROUP} {
+		rule := deny([]string{"CAP_SYS_ADMIN"}, "clone")
+		rule.Args = []seccompArg{{Index: flagArg, Value: flag, ValueTwo: flag, Op: "SCMP_CMP_MASKED_EQ"}}
+		profile.Syscalls = append(profile.Syscalls, rule)
+	}
+	clone3 := deny([]string{"CAP_SYS_ADMIN"}, "clone3")
+	clone3.ErrnoRet = &enosys
+	profile.Syscalls = append(profile.Syscalls, clone3)
+
+	return profile
+}
+
+func loadSeccompProfile(path string) (*seccompProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var profile seccompProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile %s: %w", path, err)
+	}
+	return &profile, nil
+}
+
+func seccompAction(action string, errnoRet *uint32) (uint32, error) {
+	switch action {
+	case "SCMP_ACT_ALLOW":
+		return unix.SECCOMP_RET_ALLOW, nil
+	case "SCMP_ACT_ERRNO":
+		errno := uint32(unix.EPERM)
+		if errnoRet != nil {
+			errno = *errnoRet
+		}
+		return unix.SECCOMP_RET_ERRNO | (errno & unix.SECCOMP_RET_DATA), nil
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return unix.SECCOMP_RET_KILL_THREAD, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return unix.SECCOMP_RET_KILL_PROCESS, nil
+	case "SCMP_ACT_TRAP":
+		return unix.SECCOMP_RET_TRAP, nil
+	case "SCMP_ACT_LOG":
+		return unix.SECCOMP_RET_LOG, nil
+	}
+	return 0, fmt.Errorf("unsupported seccomp action %q", action)
+}
+
+// appliesTo evaluates a rule's includes and excludes for a container with
+// the given capabilities.
+func (r *seccompRule) appliesTo(caps map[string]bool) bool {
+	for _, c := range r.Includes.Caps {
+		if !caps[c] {
+			return false
+		}
+	}
+	for _, c := range r.Excludes.Caps {
+		if caps[c] {
+			return false
+		}
+	}
+	if len(r.Includes.Arches) > 0 && !containsString(r.Includes.Arches, runtime.GOARCH) {
+		return false
+	}
+	if containsString(r.Excludes.Arches, runtime.GOARCH) {
+		return false
+	}
+	return true
+}
+
+// compileSeccomp turns a profile into a classic BPF program. Rules are
+// checked in order and the first whose syscall and arguments match
+// decides. Syscalls unknown on this architecture are skipped, as
+// libseccomp does.
+func compileSeccomp(profile *seccompProfile, caps map[string]bool) ([]unix.SockFilter, error) {
+	defaultAction, err := seccompAction(profile.DefaultAction, profile.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := func(code uint16, k uint32) unix.SockFilter {
+		return unix.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+		return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+	load := func(offset uint32) unix.SockFilter {
+		return stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offset)
+	}
+	jeq := func(k uint32, jt, jf uint8) unix.SockFilter {
+		return jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, k, jt, jf)
+	}
+
+	// Processes of other architectures, and x32 syscalls on amd64, must
+	// not slip past a filter written for our syscall numbers
+	prog := []unix.SockFilter{
+		load(seccompDataArch),
+		jeq(seccompArch, 1, 0),
+		stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_KILL_PROCESS),
+	}
+	if runtime.GOARCH == "amd64" {
+		prog = append(prog,
+			load(seccompDataNr),
+			jump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, 0x40000000, 0, 1),
+			stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ERRNO|uint32(unix.EPERM)),
+		)
+	}
+
+	for _, rule := range profile.Syscalls {
+		if !rule.appliesTo(caps) {
+			continue
+		}
+		action, err := seccompAction(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		names := rule.Names
+		if rule.Name != "" {
+			names = append(names, rule.Name)
+		}
+
+		for _, name := range names {
+			nr, ok := syscallNumbers[name]
+			if !ok {
+				continue
+			}
+
+			// Each block jumps to its own end when it does not match;
+			// the placeholder offsets are patched once its length is known
+			const next = 0xff
+			block := []unix.SockFilter{load(seccompDataNr), jeq(uint32(nr), 0, next)}
+			for _, arg := range rule.Args {
+				checks, err := compileSeccompArg(arg, load, jeq, stmt)
+				if err != nil {
+					return nil, fmt.Errorf("syscall %s: %w", name, err)
+				}
+				block = append(block, checks...)
+			}
+			block = append(block, stmt(unix.BPF_RET|unix.BPF_K, action))
+
+			for i := range block {
+				if block[i].Code&bpfClassMask != unix.BPF_JMP {
+					continue
+				}
+				offset := len(block) - i - 1
+				if offset > 0xfe {
+					return nil, fmt.Errorf("syscall %s: rule too long", name)
+				}
+				if block[i].Jt == next {
+					block[i].Jt = uint8(offset)
+				}
+				if block[i].Jf == next {
+					block[i].Jf = uint8(offset)
+				}
+			}
+			prog = append(prog, block...)
+		}
+	}
+
+	prog = append(prog, stmt(unix.BPF_RET|unix.BPF_K, defaultAction))
+	if len(prog) > 4096 {
+		return nil, fmt.Errorf("seccomp program of %d instructions exceeds the kernel limit", len(prog))
+	}
+	return prog, nil
+}
+
+// compileSeccompArg emits the checks for one 64-bit argument as two
+// 32-bit comparisons, jumping to the end of the rule (0xff) on mismatch.
+func compileSeccompArg(arg seccompArg,
+	load func(uint32) unix.SockFilter,
+	jeq func(uint32, uint8, uint8) unix.SockFilter,
+	stmt func(uint16, uint32) unix.SockFilter,
+) ([]unix.SockFilter, error) {
+	if arg.Index > 5 {
+		return nil, fmt.Errorf("invalid argument index %d", arg.Index)
+	}
+	lo := uint32(seccompDataArgs + 8*arg.Index)
+	hi := lo + 4
+	if runtime.GOARCH != "amd64" && runtime.GOARCH != "arm64" {
+		return nil, fmt.Errorf("argument filters are not supported on %s", runtime.GOARCH)
+	}
+
+	and := func(mask uint32) unix.SockFilter {
+		return stmt(unix.BPF_ALU|unix.BPF_AND|unix.BPF_K, mask)
+	}
+	const next = 0xff
+
+	switch arg.Op {
+	case "SCMP_CMP_EQ":
+		return []unix.SockFilter{
+			load(lo), jeq(uint32(arg.Value), 0, next),
+			load(hi), jeq(uint32(arg.Value>>32), 0, next),
+		}, nil
+	case "SCMP_CMP_NE":
+		return []unix.SockFilter{
+			load(lo), jeq(uint32(arg.Value), 0, 2),
+			load(hi), jeq(uint32(arg.Value>>32), next, 0),
+		}, nil
+	case "SCMP_CMP_MASKED_EQ":
+		return []unix.SockFilter{
+			load(lo), and(uint32(arg.Value)), jeq(uint32(arg.ValueTwo), 0, next),
+			load(hi), and(uint32(arg.Value >> 32)), jeq(uint32(arg.ValueTwo>>32), 0, next),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported comparison %q", arg.Op)
+}
+
+// installSeccomp loads the filter for every thread of the process, so it
+// holds no matter which thread ends up calling execve.
+func installSeccomp(filter []unix.SockFilter) error {
+	if len(filter) == 0 {
+		return nil
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER,
+		unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("failed to install seccomp filter: %w", errno)
+	}
+	return nil
+}
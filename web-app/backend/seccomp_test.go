@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/binary"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// runSeccomp interprets the subset of classic BPF compileSeccomp emits
+// against a struct seccomp_data and returns the filter's verdict.
+func runSeccomp(t *testing.T, prog []unix.SockFilter, arch uint32, nr uintptr, args [6]uint64) uint32 {
+	t.Helper()
+	data := make([]byte, seccompDataArgs+8*len(args))
+	binary.LittleEndian.PutUint32(data[seccompDataNr:], uint32(nr))
+	binary.LittleEndian.PutUint32(data[seccompDataArch:], arch)
+	for i, arg := range args {
+		binary.LittleEndian.PutUint64(data[seccompDataArgs+8*i:], arg)
+	}
+
+	var acc uint32
+	for pc := 0; pc < len(prog); pc++ {
+		ins := prog[pc]
+		switch ins.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			acc = binary.LittleEndian.Uint32(data[ins.K:])
+		case unix.BPF_ALU | unix.BPF_AND | unix.BPF_K:
+			acc &= ins.K
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
+			if acc == ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+			if acc >= ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case unix.BPF_RET | unix.BPF_K:
+			return ins.K
+		default:
+			t.Fatalf("unexpected instruction %#x at %d", ins.Code, pc)
+		}
+	}
+	t.Fatalf("program ran off its end")
+	return 0
+}
+
+func TestCompileSeccompDefaultProfile(t *testing.T) {
+	if runtime.GOARCH != "amd64" && runtime.GOARCH != "arm64" {
+		t.Skipf("no syscall table for %s", runtime.GOARCH)
+	}
+	eperm := unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+	enosys := unix.SECCOMP_RET_ERRNO | uint32(unix.ENOSYS)
+	tests := []struct {
+		name    string
+		caps    []string
+		arch    uint32
+		syscall string
+		args    [6]uint64
+		want    uint32
+	}{
+		{name: "allowed syscall", syscall: "getpid", want: unix.SECCOMP_RET_ALLOW},
+		{name: "always denied", syscall: "kexec_load", want: eperm},
+		{name: "always denied with CAP_SYS_ADMIN", caps: []string{"CAP_SYS_ADMIN"}, syscall: "keyctl", want: eperm},
+		{name: "mount", syscall: "mount", want: eperm},
+		{name: "mount with CAP_SYS_ADMIN", caps: []string{"CAP_SYS_ADMIN"}, syscall: "mount", want: unix.SECCOMP_RET_ALLOW},
+		{name: "module with another capability", caps: []string{"CAP_SYS_ADMIN"}, syscall: "init_module", want: eperm},
+		{name: "clone of a thread", syscall: "clone", args: [6]uint64{unix.CLONE_VM | unix.CLONE_THREAD}, want: unix.SECCOMP_RET_ALLOW},
+		{name: "clone into a user namespace", syscall: "clone", args: [6]uint64{unix.CLONE_NEWUSER | unix.CLONE_VM}, want: eperm},
+		{name: "clone into a PID namespace", syscall: "clone", args: [6]uint64{unix.CLONE_NEWPID}, want: eperm},
+		{name: "clone flag in the upper half", syscall: "clone", args: [6]uint64{1<<32 | unix.CLONE_NEWNET}, want: eperm},
+		{name: "clone into a namespace with CAP_SYS_ADMIN", caps: []string{"CAP_SYS_ADMIN"}, syscall: "clone", args: [6]uint64{unix.CLONE_NEWNS}, want: unix.SECCOMP_RET_ALLOW},
+		{name: "clone3", syscall: "clone3", want: enosys},
+		{name: "foreign architecture", arch: seccompArch + 1, syscall: "getpid", want: unix.SECCOMP_RET_KILL_PROCESS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caps := make(map[string]bool)
+			for _, c := range tt.caps {
+				caps[c] = true
+			}
+			prog, err := compileSeccomp(defaultSeccompProfile(), caps)
+			if err != nil {
+				t.Fatalf("compileSeccomp: %v", err)
+			}
+			nr, ok := syscallNumbers[tt.syscall]
+			if !ok {
+				t.Fatalf("unknown syscall %s", tt.syscall)
+			}
+			arch := tt.arch
+			if arch == 0 {
+				arch = seccompArch
+			}
+			if got := runSeccomp(t, prog, arch, nr, tt.args); got != tt.want {
+				t.Errorf("%s = %#x, want %#x", tt.syscall, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileSeccompX32(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("x32 syscalls only exist on amd64")
+	}
+	prog, err := compileSeccomp(&seccompProfile{DefaultAction: "SCMP_ACT_ALLOW"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := runSeccomp(t, prog, seccompArch, 0x40000000|syscallNumbers["getpid"], [6]uint64{}); got != unix.SECCOMP_RET_ERRNO|uint32(unix.EPERM) {
+		t.Errorf("x32 getpid = %#x, want EPERM", got)
+	}
+}
+
+func TestCompileSeccompArgs(t *testing.T) {
+	if runtime.GOARCH != "amd64" && runtime.GOARCH != "arm64" {
+		t.Skipf("no syscall table for %s", runtime.GOARCH)
+	}
+	errno := uint32(unix.EACCES)
+	deny := unix.SECCOMP_RET_ERRNO | errno
+	tests := []struct {
+		name string
+		arg  seccompArg
+		// values of argument 1 and the verdict for each
+		values []uint64
+		want   []uint32
+	}{
+		{
+			name:   "equal",
+			arg:    seccompArg{Index: 1, Value: 1<<32 | 7, Op: "SCMP_CMP_EQ"},
+			values: []uint64{1<<32 | 7, 7, 2<<32 | 7, 8},
+			want:   []uint32{deny, unix.SECCOMP_RET_ALLOW, unix.SECCOMP_RET_ALLOW, unix.SECCOMP_RET_ALLOW},
+		},
+		{
+			name:   "not equal",
+			arg:    seccompArg{Index: 1, Value: 1<<32 | 7, Op: "SCMP_CMP_NE"},
+			values: []uint64{1<<32 | 7, 7, 2<<32 | 7, 1<<32 | 8},
+			want:   []uint32{unix.SECCOMP_RET_ALLOW, deny, deny, deny},
+		},
+		{
+			name:   "masked equal",
+			arg:    seccompArg{Index: 1, Value: 0xf0, ValueTwo: 0x30, Op: "SCMP_CMP_MASKED_EQ"},
+			values: []uint64{0x30, 0x3f, 1<<40 | 0x35, 0x70, 0},
+			want:   []uint32{deny, deny, deny, unix.SECCOMP_RET_ALLOW, unix.SECCOMP_RET_ALLOW},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := &seccompProfile{
+				DefaultAction: "SCMP_ACT_ALLOW",
+				Syscalls: []seccompRule{{
+					Names:    []string{"not_a_syscall", "ioctl"},
+					Action:   "SCMP_ACT_ERRNO",
+					ErrnoRet: &errno,
+					Args:     []seccompArg{tt.arg},
+				}},
+			}
+			prog, err := compileSeccomp(profile, nil)
+			if err != nil {
+				t.Fatalf("compileSeccomp: %v", err)
+			}
+			for i, value := range tt.values {
+				got := runSeccomp(t, prog, seccompArch, syscallNumbers["ioctl"], [6]uint64{0, value})
+				if got != tt.want[i] {
+					t.Errorf("ioctl with %#x = %#x, want %#x", value, got, tt.want[i])
+				}
+			}
+			// Other syscalls and other arguments are left alone
+			if got := runSeccomp(t, prog, seccompArch, syscallNumbers["read"], [6]uint64{0, tt.values[0]}); got != unix.SECCOMP_RET_ALLOW {
+				t.Errorf("read = %#x, want it allowed", got)
+			}
+		})
+	}
+}
+
+func TestCompileSeccompErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile seccompProfile
+		wantErr string
+	}{
+		{
+			name:    "unsupported default action",
+			profile: seccompProfile{DefaultAction: "SCMP_ACT_NOTIFY"},
+			wantErr: "unsupported seccomp action",
+		},
+		{
+			name: "unsupported rule action",
+			profile: seccompProfile{DefaultAction: "SCMP_ACT_ALLOW", Syscalls: []seccompRule{
+				{Names: []string{"getpid"}, Action: "SCMP_ACT_TRACE"},
+			}},
+			wantErr: "unsupported seccomp action",
+		},
+		{
+			name: "argument index",
+			profile: seccompProfile{DefaultAction: "SCMP_ACT_ALLOW", Syscalls: []seccompRule{
+				{Names: []string{"getpid"}, Action: "SCMP_ACT_ERRNO", Args: []seccompArg{{Index: 6, Op: "SCMP_CMP_EQ"}}},
+			}},
+			wantErr: "invalid argument index",
+		},
+		{
+			name: "comparison",
+			profile: seccompProfile{DefaultAction: "SCMP_ACT_ALLOW", Syscalls: []seccompRule{
+				{Names: []string{"getpid"}, Action: "SCMP_ACT_ERRNO", Args: []seccompArg{{Op: "SCMP_CMP_GT"}}},
+			}},
+			wantErr: "unsupported comparison",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileSeccomp(&tt.profile, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("compileSeccomp = %v, want an error about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// SecurityProfile restricts what processes in a section's container may
+// do. Capabilities start from Docker's default set plus the ones the
+// template requires, then AddCapabilities and DropCapabilities apply.
+type SecurityProfile struct {
+	AddCapabilities  []string `json:"addCapabilities"`
+	DropCapabilities []string `json:"dropCapabilities"`
+	// Seccomp is empty for the default profile, "unconfined" to disable
+	// filtering, or the path of a Docker-format JSON profile relative to
+	// the section's content directory
+	Seccomp         string `json:"seccomp"`
+	NoNewPrivileges *bool  `json:"noNewPrivileges"`
+	ReadOnlyRootfs  bool   `json:"readOnlyRootfs"`
+}
+
+const seccompUnconfined = "unconfined"
+
+// defaultCapabilities is the set Docker grants containers by default.
+var defaultCapabilities = []string{
+	"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_FSETID", "CAP_FOWNER", "CAP_MKNOD",
+	"CAP_NET_RAW", "CAP_SETGID", "CAP_SETUID", "CAP_SETFCAP", "CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE", "CAP_SYS_CHROOT", "CAP_KILL", "CAP_AUDIT_WRITE",
+}
+
+// setupSecurity is the resolved profile handed to the container setup.
+type setupSecurity struct {
+	Capabilities    []uint            `json:"capabilities"`
+	Seccomp         []unix.SockFilter `json:"seccomp,omitempty"`
+	NoNewPrivileges bool              `json:"noNewPrivileges"`
+	ReadOnlyRootfs  bool              `json:"readOnlyRootfs"`
+}
+
+// capabilitySet works out the capability names a container ends up with.
+func (tmpl *ContainerTemplate) capabilitySet() (map[string]bool, error) {
+	caps := make(map[string]bool)
+	add := func(names []string) error {
+		for _, name := range names {
+			if _, ok := capabilityByName(name); !ok {
+				return fmt.Errorf("unknown capability %q", name)
+			}
+			caps[canonicalCapability(name)] = true
+		}
+		return nil
+	}
+	if err := add(defaultCapabilities); err != nil {
+		return nil, err
+	}
+	if err := add(tmpl.Capabilities); err != nil {
+		return nil, err
+	}
+	if err := add(tmpl.Security.AddCapabilities); err != nil {
+		return nil, err
+	}
+	for _, name := range tmpl.Security.DropCapabilities {
+		if _, ok := capabilityByName(name); !ok {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+		delete(caps, canonicalCapability(name))
+	}
+	return caps, nil
+}
+
+// resolveSecurity compiles a template's profile for the container setup.
+func resolveSecurity(tmpl *ContainerTemplate) (*setupSecurity, error) {
+	caps, err := tmpl.capabilitySet()
+	if err != nil {
+		return nil, err
+	}
+
+	security := &setupSecurity{
+		NoNewPrivileges: tmpl.Security.NoNewPrivileges == nil || *tmpl.Security.NoNewPrivileges,
+		ReadOnlyRootfs:  tmpl.Security.ReadOnlyRootfs,
+	}
+	for name := range caps {
+		capability, _ := capabilityByName(name)
+		security.Capabilities = append(security.Capabilities, capability)
+	}
+	sort.Slice(security.Capabilities, func(i, j int) bool { return security.Capabilities[i] < security.Capabilities[j] })
+
+	profile, err := tmpl.loadSeccomp()
+	if err != nil {
+		return nil, err
+	}
+	if profile != nil {
+		if security.Seccomp, err = compileSeccomp(profile, caps); err != nil {
+			return nil, err
+		}
+	}
+	return security, nil
+}
+
+// loadSeccomp returns the template's seccomp profile, nil when it runs
+// unconfined.
+func (tmpl *ContainerTemplate) loadSeccomp() (*seccompProfile, error) {
+	switch tmpl.Security.Seccomp {
+	case seccompUnconfined:
+		return nil, nil
+	case "":
+		return defaultSeccompProfile(), nil
+	}
+	return loadSeccompProfile(filepath.Join(config.Backend.ContentDir, tmpl.SectionID, tmpl.Security.Seccomp))
+}
+
+// applySecurity runs last in the container setup, right before exec.
+// Without no_new_privs installing a seccomp filter needs CAP_SYS_ADMIN, so
+// the filter then goes in before capabilities are dropped; otherwise it
+// goes in as late as possible so fewer of our own syscalls are filtered.
+func applySecurity(security *setupSecurity, workDir string) error {
+	if security.ReadOnlyRootfs {
+		if err := readOnlyRootfs(workDir); err != nil {
+			return err
+		}
+	}
+
+	if security.NoNewPrivileges {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("failed to set no_new_privs: %w", err)
+		}
+	} else if err := installSeccomp(security.Seccomp); err != nil {
+		return err
+	}
+
+	// Only root has capabilities to give up
+	if os.Geteuid() == 0 {
+		if err := limitCapabilities(security.Capabilities); err != nil {
+			return err
+		}
+	}
+
+	if security.NoNewPrivileges {
+		return installSeccomp(security.Seccomp)
+	}
+	return nil
+}
+
+// readOnlyRootfs remounts / read-only. The working directory stays
+// writable through a bind mount of its own and /tmp becomes a tmpfs.
+func readOnlyRootfs(workDir string) error {
+	if err := syscall.Mount(workDir, workDir, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to keep %s writable: %w", workDir, err)
+	}
+	if err := os.MkdirAll("/tmp", 01777); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777,size=65536k"); err != nil {
+		return fmt.Errorf("failed to mount /tmp: %w", err)
+	}
+	// A bind remount sets every flag, keep the rootfs nodev
+	if err := syscall.Mount("", "/", "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("failed to make rootfs read-only: %w", err)
+	}
+	// Step onto the writable mount that now covers the working directory
+	return os.Chdir(workDir)
+}
+
+// limitCapabilities shrinks the bounding set and makes keep the permitted,
+// effective, inheritable and ambient sets, so the capabilities survive
+// exec even for non-root users.
+func limitCapabilities(keep []uint) error {
+	return applyCapabilities(capabilitySets{
+		Bounding:    keep,
+		Effective:   keep,
+		Permitted:   keep,
+		Inheritable: keep,
+		Ambient:     keep,
+	})
+}
+
+// capabilitySets holds the capability numbers of each of a process' sets.
+type capabilitySets struct {
+	Bounding    []uint `json:"bounding"`
+	Effective   []uint `json:"effective"`
+	Permitted   []uint `json:"permitted"`
+	Inheritable []uint `json:"inheritable"`
+	Ambient     []uint `json:"ambient"`
+}
+
+func applyCapabilities(sets capabilitySets) error {
+	bounding := make(map[uint]bool)
+	for _, capability := range sets.Bounding {
+		bounding[capability] = true
+	}
+	lastCap := uint(0)
+	for _, capability := range capabilityNames {
+		lastCap = max(lastCap, capability)
+	}
+	for capability := uint(0); capability <= lastCap; capability++ {
+		if bounding[capability] {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(capability), 0, 0, 0); err != nil && err != unix.EINVAL {
+			return fmt.Errorf("failed to drop capability %d from the bounding set: %w", capability, err)
+		}
+	}
+
+	var data [2]unix.CapUserData
+	for _, capability := range sets.Effective {
+		data[capability/32].Effective |= 1 << (capability % 32)
+	}
+	for _, capability := range sets.Permitted {
+		data[capability/32].Permitted |= 1 << (capability % 32)
+	}
+	for _, capability := range sets.Inheritable {
+		data[capability/32].Inheritable |= 1 << (capability % 32)
+	}
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	if err := unix.Capset(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to set capabilities: %w", err)
+	}
+
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return err
+	}
+	for _, capability := range sets.Ambient {
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(capability), 0, 0); err != nil && err != unix.EINVAL {
+			return fmt.Errorf("failed to raise ambient capability %d: %w", capability, err)
+		}
+	}
+	return nil
+}
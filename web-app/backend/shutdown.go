@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// containerRecordFile holds what a container left running on shutdown
+// needs to be adopted by the next backend.
+const containerRecordFile = "container.json"
+
+// containerRecord is the part of a container's state that is not in its
+// directory or the OCI runtime's state.
+type containerRecord struct {
+	*ContainerInfo
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty"`
+	Restored   []int       `json:"restored,omitempty"`
+	Limits     LimitEvents `json:"limits"`
+}
+
+// serverCtx is the base of every request's context. It is cancelled when
+// shutdown begins so event streams and followed logs end.
+var serverCtx, cancelServerCtx = context.WithCancel(context.Background())
+
+// terminalSessions counts the terminal handlers still running.
+var terminalSessions sync.WaitGroup
+
+// shutdownNotice is the last message attached terminals receive.
+var shutdownNotice = TerminalMessage{Type: "error", Data: "The server is shutting down"}
+
+// endSessions ends the connections http.Server.Shutdown does not wait
+// for: streams that only end with their request, and hijacked terminals.
+func endSessions() {
+	cancelServerCtx()
+
+	containersMux.RLock()
+	defer containersMux.RUnlock()
+	for _, info := range containers {
+		info.terminalMu.Lock()
+		for t := range info.terminals {
+			t.close(shutdownNotice)
+		}
+		info.terminalMu.Unlock()
+	}
+}
+
+// shutdown stops the server, then stops every container or, with
+// server.keepContainers, saves it for the next start. Rootless containers live
+// in a sandbox that dies with the backend, so they are always stopped.
+func shutdown(e *echo.Echo) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Server.ShutdownTimeout)
+	defer cancel()
+
+	// Listeners are closed first, then requests in flight are waited for
+	if err := shutdownServers(ctx, e); err != nil {
+		log.Printf("Failed to shut down server: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		terminalSessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Terminals still open after %v", config.Server.ShutdownTimeout)
+	}
+
+	containersMux.Lock()
+	infos := make([]*ContainerInfo, 0, len(containers))
+	for id, info := range containers {
+		infos = append(infos, info)
+		delete(containers, id)
+	}
+	containersMux.Unlock()
+
+	var wg sync.WaitGroup
+	for _, info := range infos {
+		if config.Server.KeepContainers && info.Driver != driverRootless {
+			err := info.saveRecord()
+			if err == nil {
+				info.release()
+				log.Printf("Left container %s running", info.ID)
+				continue
+			}
+			log.Printf("Failed to save container %s, stopping it: %v", info.ID, err)
+		}
+		wg.Add(1)
+		go func(info *ContainerInfo) {
+			defer wg.Done()
+			destroyContainer(info, nil)
+		}(info)
+	}
+	wg.Wait()
+	log.Println("Server stopped")
+}
+
+func (info *ContainerInfo) saveRecord() error {
+	data, err := json.MarshalIndent(containerRecord{
+		ContainerInfo: info,
+		Checkpoint:    info.checkpoint,
+		Restored:      info.restored,
+		Limits:        info.limitEvents(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(containerDir(info.ID), containerRecordFile)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// release lets go of what the backend holds for a container it leaves
+// running. The output an OCI process writes once the backend has exited
+// has no reader.
+func (info *ContainerInfo) release() {
+	if info.stopLimitWatch != nil {
+		info.stopLimitWatch()
+	}
+	unpublishPorts(info)
+	info.logs.close()
+}
+
+// adoptContainers takes over the containers the previous backend left
+// running. Containers that cannot be adopted are cleaned up.
+func adoptContainers() {
+	paths, _ := filepath.Glob(filepath.Join(config.Backend.StateDir, "containers", "*", containerRecordFile))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		os.Remove(path)
+		if err != nil {
+			log.Printf("Failed to read %s: %v", path, err)
+			continue
+		}
+		var record containerRecord
+		if err := json.Unmarshal(data, &record); err != nil || record.ContainerInfo == nil {
+			log.Printf("Failed to read %s: invalid record", path)
+			continue
+		}
+		info := record.ContainerInfo
+		info.idleSince = time.Now()
+		info.checkpoint = record.Checkpoint
+		info.limits = record.Limits
+		for _, pid := range record.Restored {
+			// CRIU restored processes are not children of the backend
+			if syscall.Kill(pid, 0) == nil {
+				info.restored = append(info.restored, pid)
+			}
+		}
+
+		if err := info.adopt(); err != nil {
+			log.Printf("Failed to adopt container %s: %v", info.ID, err)
+			if err := cleanupContainer(info); err != nil {
+				log.Printf("Failed to clean up container %s: %v", info.ID, err)
+			}
+			continue
+		}
+		containersMux.Lock()
+		containers[info.ID] = info
+		containersMux.Unlock()
+		log.Printf("Adopted container %s", info.ID)
+	}
+}
+
+// adopt restores what the backend holds for a container: its log,
+// security profile, published ports and OCI process.
+func (info *ContainerInfo) adopt() error {
+	if info.Template == nil || info.Network == nil {
+		return errors.New("incomplete record")
+	}
+	logs, err := openContainerLog(containerDir(info.ID))
+	if err != nil {
+		return err
+	}
+	info.logs = logs
+
+	security, err := resolveSecurity(info.Template)
+	if err != nil {
+		return err
+	}
+	security.ReadOnlyRootfs = security.ReadOnlyRootfs && info.isolated()
+	info.security = security
+
+	if info.Driver == driverNative {
+		// A reboot takes the overlay with it
+		var root, merged syscall.Stat_t
+		if syscall.Stat(containerDir(info.ID), &root) != nil || syscall.Stat(info.rootfsPath(), &merged) != nil || root.Dev == merged.Dev {
+			return errors.New("root filesystem is not mounted")
+		}
+		if err := publishPorts(info); err != nil {
+			return err
+		}
+	}
+
+	if ctr, err := loadOCIContainer(ociStateRoot(), info.ID); err == nil {
+		info.oci = ctr
+	}
+	if info.isolated() {
+		cg := &cgroup{Path: filepath.Join("/", containerCgroupPath(info.ID))}
+		if _, err := os.Stat(cg.dirs()[0]); err == nil {
+			info.cgroup = cg
+			if err := info.watchLimits(cg); err != nil {
+				log.Printf("Container %s: failed to watch cgroup limits: %v", info.ID, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAdoptSavedContainers(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = defaultConfig()
+	config.Backend.StateDir = t.TempDir()
+
+	alive := exec.Command("sleep", "30")
+	if err := alive.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		alive.Process.Kill()
+		alive.Wait()
+	}()
+	dead := exec.Command("true")
+	if err := dead.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	oomKill := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	info := &ContainerInfo{
+		ID:        "kept",
+		SectionID: "01-process-management",
+		Image:     "ubuntu:22.04",
+		Driver:    driverLocal,
+		Status:    "running",
+		CreatedAt: time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC),
+		Template:  &ContainerTemplate{},
+		Network:   &NetworkInfo{Mode: networkHost},
+		Token:     "s3cret",
+		restored:  []int{alive.Process.Pid, dead.Process.Pid},
+		limits:    LimitEvents{OOMKills: 2, LastOOMKill: &oomKill},
+	}
+	if err := os.MkdirAll(containerDir(info.ID), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := info.saveRecord(); err != nil {
+		t.Fatal(err)
+	}
+	// A record that can not be adopted is dropped
+	broken := filepath.Join(config.Backend.StateDir, "containers", "broken", containerRecordFile)
+	os.MkdirAll(filepath.Dir(broken), 0755)
+	if err := os.WriteFile(broken, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		containersMux.Lock()
+		delete(containers, info.ID)
+		containersMux.Unlock()
+	}()
+
+	adoptContainers()
+
+	containersMux.RLock()
+	adopted, ok := containers[info.ID]
+	_, brokenAdopted := containers["broken"]
+	containersMux.RUnlock()
+	if !ok {
+		t.Fatal("container was not adopted")
+	}
+	defer adopted.logs.close()
+	if brokenAdopted {
+		t.Error("broken record was adopted")
+	}
+	for _, path := range []string{broken, filepath.Join(containerDir(info.ID), containerRecordFile)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind", path)
+		}
+	}
+
+	if adopted.SectionID != info.SectionID || adopted.Image != info.Image || adopted.Token != info.Token ||
+		!adopted.CreatedAt.Equal(info.CreatedAt) || adopted.Network.Mode != networkHost {
+		t.Errorf("adopted %+v, want %+v", adopted, info)
+	}
+	if !reflect.DeepEqual(adopted.restored, []int{alive.Process.Pid}) {
+		t.Errorf("restored processes = %v, want only the live %d", adopted.restored, alive.Process.Pid)
+	}
+	if limits := adopted.limitEvents(); limits.OOMKills != 2 || limits.LastOOMKill == nil || !limits.LastOOMKill.Equal(oomKill) {
+		t.Errorf("limits = %+v, want those saved", limits)
+	}
+	if adopted.logs == nil || adopted.security == nil {
+		t.Error("adopted container has no log or security profile")
+	}
+	if adopted.idleSince.IsZero() {
+		t.Error("adopted container is not idle, so the reaper would never collect it")
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// templateFileName is the file a section directory can ship to declare
+// the container it wants learners to work in.
+const templateFileName = "container.json"
+
+// ContainerTemplate describes the environment a section's container is
+// launched with.
+type ContainerTemplate struct {
+	SectionID    string          `json:"sectionId"`
+	Image        string          `json:"image"`
+	Shell        string          `json:"shell"`
+	WorkingDir   string          `json:"workingDir"`
+	Env          []string        `json:"env"`
+	Files        []TemplateFile  `json:"files"`
+	Capabilities []string        `json:"capabilities"`
+	Network      string          `json:"network"`
+	Startup      string          `json:"startup"`
+	Security     SecurityProfile `json:"security"`
+	Hooks        *ociHooks       `json:"hooks,omitempty"`
+}
+
+// TemplateFile is a file pre-installed into the container's working
+// directory before the learner gets a shell.
+type TemplateFile struct {
+	Path    string      `json:"path"`
+	Content string      `json:"content"`
+	Mode    os.FileMode `json:"mode"`
+}
+
+const defaultImage = "linux-containers-env:latest"
+
+func getSectionTemplates() map[string]ContainerTemplate {
+	return map[string]ContainerTemplate{
+		"01-process-management": {},
+		"02-namespaces": {
+			Capabilities: []string{"CAP_SYS_ADMIN"},
+		},
+		"03-cgroups": {
+			Capabilities: []string{"CAP_SYS_ADMIN"},
+		},
+		"04-filesystem-isolation": {
+			Capabilities: []string{"CAP_SYS_ADMIN", "CAP_SYS_CHROOT"},
+		},
+		"05-container-images": {
+			Capabilities: []string{"CAP_SYS_ADMIN"},
+		},
+		"06-network-virtualization": {
+			Capabilities: []string{"CAP_NET_ADMIN", "CAP_NET_RAW"},
+			Network:      networkBridge,
+		},
+		"07-security-capabilities": {
+			// Learners inspect capabilities from an unprivileged, locked
+			// down shell
+			Security: SecurityProfile{
+				DropCapabilities: []string{"CAP_NET_RAW", "CAP_MKNOD", "CAP_AUDIT_WRITE"},
+				ReadOnlyRootfs:   true,
+			},
+		},
+		"08-container-runtime": {
+			Capabilities: []string{"CAP_SYS_ADMIN"},
+		},
+		"09-advanced-concepts": {
+			Capabilities: []string{"CAP_SYS_ADMIN", "CAP_KILL"},
+		},
+		"10-orchestration-basics": {
+			Capabilities: []string{"CAP_SYS_ADMIN", "CAP_NET_ADMIN"},
+			Network:      networkBridge,
+		},
+	}
+}
+
+// loadSectionTemplate returns the template for a section. A template
+// registered by committing a container takes precedence over a
+// container.json in the section's content directory, which in turn takes
+// precedence over the built-in defaults.
+func loadSectionTemplate(sectionID string) (*ContainerTemplate, error) {
+	builtin, known := getSectionTemplates()[sectionID]
+	if !known {
+		return nil, fmt.Errorf("unknown section %q", sectionID)
+	}
+	tmpl := builtin
+
+	registered, err := loadRegisteredTemplate(sectionID)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(config.Backend.ContentDir, sectionID, templateFileName))
+	if registered != nil {
+		tmpl = *registered
+	} else if err == nil {
+		tmpl = ContainerTemplate{}
+		if err := json.Unmarshal(data, &tmpl); err != nil {
+			return nil, fmt.Errorf("invalid %s for section %s: %w", templateFileName, sectionID, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	tmpl.SectionID = sectionID
+	if tmpl.Image == "" {
+		tmpl.Image = defaultImage
+	}
+	if tmpl.Shell == "" {
+		tmpl.Shell = config.Shell.Path
+	}
+	if tmpl.Network == "" {
+		tmpl.Network = networkNone
+	}
+	if !validNetworkMode(tmpl.Network) {
+		return nil, fmt.Errorf("invalid network mode %q", tmpl.Network)
+	}
+	for _, f := range tmpl.Files {
+		if !filepath.IsLocal(f.Path) {
+			return nil, fmt.Errorf("template file %q must be a relative path inside the working directory", f.Path)
+		}
+	}
+	if _, err := tmpl.capabilitySet(); err != nil {
+		return nil, err
+	}
+	if tmpl.Security.Seccomp != "" && tmpl.Security.Seccomp != seccompUnconfined && !filepath.IsLocal(tmpl.Security.Seccomp) {
+		return nil, fmt.Errorf("seccomp profile %q must be a relative path inside the section directory", tmpl.Security.Seccomp)
+	}
+
+	if err := resolveTemplateHooks(&tmpl); err != nil {
+		return nil, err
+	}
+
+	return &tmpl, nil
+}
+
+// resolveTemplateHooks makes host hook paths relative to the section
+// directory absolute and bounds every hook by a timeout. Hooks that run
+// inside the container need absolute paths as seen from there.
+func resolveTemplateHooks(tmpl *ContainerTemplate) error {
+	if tmpl.Hooks == nil {
+		return nil
+	}
+	sectionDir, err := filepath.Abs(filepath.Join(config.Backend.ContentDir, tmpl.SectionID))
+	if err != nil {
+		return err
+	}
+	for _, kind := range hookKinds {
+		hooks := tmpl.Hooks.list(kind)
+		for i := range hooks {
+			hook := &hooks[i]
+			inContainer := kind == hookCreateContainer || kind == hookStartContainer
+			if !inContainer && !filepath.IsAbs(hook.Path) {
+				if !filepath.IsLocal(hook.Path) {
+					return fmt.Errorf("%s hook %q must be inside the section directory", kind, hook.Path)
+				}
+				hook.Path = filepath.Join(sectionDir, hook.Path)
+			}
+			if hook.Timeout == nil {
+				timeout := int(config.Timeouts.Hook / time.Second)
+				hook.Timeout = &timeout
+			}
+		}
+	}
+	return tmpl.Hooks.validate()
+}
+
+func containerDir(containerID string) string {
+	return filepath.Join(config.Backend.StateDir, "containers", containerID)
+}
+
+// workingDir is where the container's shell starts, as seen from inside
+// the container. Relative template paths are resolved against the
+// container's workspace.
+func (info *ContainerInfo) workingDir() string {
+	dir := info.Template.WorkingDir
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	if info.isolated() {
+		return filepath.Join("/workspace", dir)
+	}
+	return filepath.Join(containerDir(info.ID), "workspace", dir)
+}
+
+// isolated reports whether the container has a root filesystem of its own.
+func (info *ContainerInfo) isolated() bool {
+	return info.Driver == driverNative || info.Driver == driverRootless
+}
+
+// hostPath translates a path inside the container to the host.
+func (info *ContainerInfo) hostPath(path string) string {
+	switch info.Driver {
+	case driverNative:
+		return filepath.Join(info.rootfsPath(), path)
+	case driverRootless:
+		return filepath.Join(info.sandboxRoot(), info.rootfsPath(), path)
+	}
+	return path
+}
+
+// environ is the environment every process started in the container sees.
+// Native containers do not inherit the backend's environment.
+func (info *ContainerInfo) environ() []string {
+	var env []string
+	if info.isolated() {
+		env = []string{"PATH=" + defaultPath, "HOME=/root"}
+	} else {
+		env = os.Environ()
+	}
+	env = append(env,
+		"TERM="+config.Shell.Term,
+		fmt.Sprintf("SECTION_ID=%s", info.SectionID),
+		"PS1="+config.Shell.Prompt,
+	)
+	return append(env, info.Template.Env...)
+}
+
+// containerCommand builds a command that runs inside the container's
+// environment. Both drivers go through the container setup so the
+// security profile is applied before the command is executed.
+func containerCommand(ctx context.Context, info *ContainerInfo, name string, args ...string) *exec.Cmd {
+	return containerCommandEnv(ctx, info, info.environ(), append([]string{name}, args...))
+}
+
+// containerCommandEnv is containerCommand with an explicit environment.
+func containerCommandEnv(ctx context.Context, info *ContainerInfo, env, args []string) *exec.Cmd {
+	if info.isolated() {
+		return nativeCommand(ctx, info, env, args)
+	}
+	return setupCommand(ctx, containerSetup{
+		Cwd:       info.workingDir(),
+		Args:      args,
+		Env:       env,
+		Security:  info.security,
+		Subreaper: true,
+	})
+}
+
+// prepareContainer applies a template to a freshly created container:
+// it checks required capabilities, sets up the root filesystem of native
+// containers, installs the template's files and runs its startup script.
+// The template's hooks run around these steps as the runtime spec
+// orders them; any failure up to startContainer fails the container.
+func prepareContainer(info *ContainerInfo) error {
+	tmpl := info.Template
+
+	// Rootless containers get every capability within their user namespace
+	var missing []string
+	for _, name := range tmpl.Capabilities {
+		if info.Driver != driverRootless && !hasCapability(name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("backend lacks capabilities required by section %s: %s",
+			info.SectionID, strings.Join(missing, ", "))
+	}
+
+	if err := os.MkdirAll(containerDir(info.ID), 0755); err != nil {
+		return err
+	}
+	logs, err := openContainerLog(containerDir(info.ID))
+	if err != nil {
+		return err
+	}
+	info.logs = logs
+
+	security, err := resolveSecurity(tmpl)
+	if err != nil {
+		return err
+	}
+	// A read-only root only makes sense on the container's own rootfs
+	security.ReadOnlyRootfs = security.ReadOnlyRootfs && info.isolated()
+	info.security = security
+
+	if info.isolated() {
+		if err := info.setupCgroup(); err != nil {
+			if info.Driver == driverNative {
+				return err
+			}
+			log.Printf("Container %s: running without a cgroup: %v", info.ID, err)
+		}
+	}
+
+	// A restored filesystem has to be in place before the overlay is mounted
+	if info.checkpoint != nil {
+		if err := info.restoreFilesystem(); err != nil {
+			return err
+		}
+	}
+
+	if info.Driver == driverNative {
+		if err := mountContainerRootfs(info); err != nil {
+			return err
+		}
+		if err := setupNetwork(info); err != nil {
+			return fmt.Errorf("failed to set up network: %w", err)
+		}
+		if info.Network.Mode != networkHost {
+			if err := writeNetworkFiles(info); err != nil {
+				return err
+			}
+		}
+		if err := publishPorts(info); err != nil {
+			return err
+		}
+	}
+	if info.Driver == driverRootless {
+		if err := startSandbox(info); err != nil {
+			return err
+		}
+		if info.Network.Mode != networkHost {
+			if err := writeNetworkFiles(info); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := info.runTemplateHooks(hookPrestart, ociCreating); err != nil {
+		return err
+	}
+	if err := info.runTemplateHooks(hookCreateRuntime, ociCreating); err != nil {
+		return err
+	}
+
+	// A restored container already holds the files and whatever the
+	// startup script did, possibly changed by the learner since
+	files := tmpl.Files
+	if info.checkpoint != nil {
+		files = nil
+	}
+	if err := info.writeTemplateFiles(files); err != nil {
+		return err
+	}
+
+	if err := info.runTemplateHooks(hookCreateContainer, ociCreating); err != nil {
+		return err
+	}
+	if err := info.runTemplateHooks(hookStartContainer, ociCreated); err != nil {
+		return err
+	}
+
+	if tmpl.Startup != "" && info.checkpoint == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), config.Timeouts.StartupScript)
+		defer cancel()
+
+		// The script's output goes to the container's log, its errors
+		// into the error as well
+		var stderr bytes.Buffer
+		stdoutLog, stderrLog := info.logs.stream("stdout"), info.logs.stream("stderr")
+		cmd := containerCommand(ctx, info, tmpl.Shell, "-c", tmpl.Startup)
+		cmd.Stdout, cmd.Stderr = stdoutLog, io.MultiWriter(stderrLog, &stderr)
+		err := cmd.Run()
+		stdoutLog.Close()
+		stderrLog.Close()
+		if err != nil {
+			return fmt.Errorf("startup script failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+	}
+
+	// Everything up to here is the template's doing, not the learner's
+	return info.recordBaseline()
+}
+
+// writeTemplateFiles creates the working directory and installs files in
+// it. Paths are resolved inside the container's root, so symlinks an
+// image or a committed template placed there can not lead to the host.
+func (info *ContainerInfo) writeTemplateFiles(files []TemplateFile) error {
+	root := info.filesystemRoot()
+	if !info.isolated() {
+		// The working directory of local containers is a host path
+		root = "/"
+	}
+	rootf, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer rootf.Close()
+	rootfd := int(rootf.Fd())
+
+	dir := info.workingDir()
+	if err := mkdirAllInRoot(rootfd, dir); err != nil {
+		return fmt.Errorf("failed to create working directory %s: %w", dir, err)
+	}
+	for _, f := range files {
+		mode := f.Mode
+		if mode == 0 {
+			mode = 0644
+		}
+		if err := writeFileInRoot(rootfd, filepath.Join(dir, f.Path), []byte(f.Content), mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupCgroup creates the container's cgroup and the leaf its processes
+// join, restricting the devices they may use, and watches the cgroup for
+// limits being hit.
+func (info *ContainerInfo) setupCgroup() error {
+	cg, err := createCgroup(containerCgroupPath(info.ID), config.defaultResources(nil))
+	if err != nil {
+		return err
+	}
+	leaf, err := createCgroup(cg.leaf(cgroupProcessesLeaf).Path, nil)
+	if err != nil {
+		cg.remove()
+		return err
+	}
+	// Rootless processes cannot open host devices from their user
+	// namespace, native ones are real root
+	if info.Driver == driverNative {
+		if err := leaf.restrictDevices(); err != nil {
+			leaf.remove()
+			cg.remove()
+			return err
+		}
+	}
+	info.cgroup = cg
+	if err := info.watchLimits(cg); err != nil {
+		log.Printf("Container %s: failed to watch cgroup limits: %v", info.ID, err)
+	}
+	return nil
+}
+
+// processCgroup is the cgroup the container's processes join, if it has
+// one.
+func (info *ContainerInfo) processCgroup() *cgroup {
+	if info.cgroup == nil {
+		return nil
+	}
+	return info.cgroup.leaf(cgroupProcessesLeaf)
+}
+
+// cleanupContainer releases everything prepareContainer set up.
+func cleanupContainer(info *ContainerInfo) error {
+	info.killRestored()
+	// poststop hooks still find the container's filesystem and network
+	if err := info.runTemplateHooks(hookPoststop, ociStopped); err != nil {
+		log.Printf("Container %s: %v", info.ID, err)
+	}
+	if info.Driver == driverRootless {
+		if err := stopSandbox(info); err != nil {
+			log.Printf("Failed to clean up sandbox of container %s: %v", info.ID, err)
+		}
+	}
+	if info.stopLimitWatch != nil {
+		info.stopLimitWatch()
+	}
+	if info.oci != nil {
+		info.oci.refresh()
+		if err := info.oci.delete(true); err != nil {
+			log.Printf("Failed to delete OCI container %s: %v", info.ID, err)
+		}
+	}
+	if info.Driver == driverNative {
+		unpublishPorts(info)
+		if err := teardownNetwork(info); err != nil {
+			log.Printf("Failed to tear down network of container %s: %v", info.ID, err)
+		}
+		if err := unmountContainerRootfs(info); err != nil {
+			return err
+		}
+	}
+	if cg := info.cgroup; cg != nil {
+		if err := errors.Join(cg.leaf(cgroupProcessesLeaf).removeExited(), cg.removeExited()); err != nil {
+			log.Printf("Failed to remove cgroup of container %s: %v", info.ID, err)
+		}
+		info.cgroup = nil
+	}
+	if info.logs != nil {
+		info.logs.close()
+	}
+	return os.RemoveAll(containerDir(info.ID))
+}
@@ -1,6 +1,7 @@
 import { useState, useEffect } from 'react'
 import { Link } from 'react-router-dom'
 import { Play, BookOpen, Clock, BarChart3 } from 'lucide-react'
+import { apiService } from '../services/api'
 
 interface LearningPath {
   id: string
@@ -29,9 +30,7 @@ export default function HomePage() {
 
   const fetchLearningPaths = async () => {
     try {
-      const response = await fetch('http://localhost:8080/api/learning-paths')
-      const data = await response.json()
-      setLearningPaths(data)
+      setLearningPaths(await apiService.getLearningPaths())
     } catch (error) {
       console.error('Failed to fetch learning paths:', error)
     } finally {
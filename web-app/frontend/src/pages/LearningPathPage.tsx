@@ -1,6 +1,7 @@
 import { useState, useEffect } from 'react'
 import { useParams, Link } from 'react-router-dom'
 import { ArrowLeft, CheckCircle, Lock, Play, Clock, BookOpen } from 'lucide-react'
+import { apiService } from '../services/api'
 
 interface LearningPath {
   id: string
@@ -32,9 +33,7 @@ export default function LearningPathPage() {
 
   const fetchLearningPath = async (id: string) => {
     try {
-      const response = await fetch(`http://localhost:8080/api/learning-paths/${id}`)
-      const data = await response.json()
-      setLearningPath(data)
+      setLearningPath(await apiService.getLearningPath(id))
     } catch (error) {
       console.error('Failed to fetch learning path:', error)
     } finally {
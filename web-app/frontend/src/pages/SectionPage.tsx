@@ -3,6 +3,7 @@ import { useParams, Link } from 'react-router-dom'
 import { ArrowLeft, Terminal, Play, Square, RefreshCw, BookOpen } from 'lucide-react'
 import { Terminal as XTerm } from '@xterm/xterm'
 import { FitAddon } from '@xterm/addon-fit'
+import { apiService } from '../services/api'
 
 interface Section {
   id: string
@@ -55,9 +56,7 @@ export default function SectionPage() {
 
   const fetchSection = async (pathId: string, sectionId: string) => {
     try {
-      const response = await fetch(`http://localhost:8080/api/learning-paths/${pathId}/sections/${sectionId}`)
-      const data = await response.json()
-      setSection(data)
+      setSection(await apiService.getSection(pathId, sectionId))
     } catch (error) {
       console.error('Failed to fetch section:', error)
     } finally {
@@ -66,20 +65,11 @@ export default function SectionPage() {
   }
 
   const startContainer = async () => {
+    if (!sectionId) return
+
     setContainerStatus('starting')
     try {
-      const response = await fetch('http://localhost:8080/api/containers/create', {
-        method: 'POST',
-        headers: {
-          'Content-Type': 'application/json',
-        },
-        body: JSON.stringify({
-          sectionId: sectionId,
-          image: 'linux-containers-env:latest'
-        })
-      })
-      
-      const data = await response.json()
+      const data = await apiService.createContainer(sectionId)
       setContainerId(data.containerId)
       setContainerStatus('running')
     } catch (error) {
@@ -92,9 +82,7 @@ export default function SectionPage() {
     if (!containerId) return
     
     try {
-      await fetch(`http://localhost:8080/api/containers/${containerId}`, {
-        method: 'DELETE'
-      })
+      await apiService.deleteContainer(containerId)
       
       setContainerId(null)
       setContainerStatus('stopped')
@@ -145,8 +133,7 @@ export default function SectionPage() {
     fitAddon.current = fit
 
     // Connect to WebSocket
-    const wsUrl = `ws://localhost:8080/api/terminal/${containerId}/ws`
-    const socket = new WebSocket(wsUrl)
+    const socket = new WebSocket(apiService.terminalUrl(containerId))
     socketRef.current = socket
 
     socket.onopen = () => {
@@ -161,6 +148,8 @@ export default function SectionPage() {
           terminal.write(message.data)
         } else if (message.type === 'error') {
           terminal.writeln(`\r\n\x1b[31mError: ${message.data}\x1b[0m\r\n`)
+        } else if (message.type === 'exit') {
+          terminal.writeln(`\r\n\x1b[33mProcess exited with code ${message.data}\x1b[0m`)
         }
       } catch (error) {
         console.error('Failed to parse WebSocket message:', error)
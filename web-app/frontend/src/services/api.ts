@@ -1,5 +1,8 @@
 const API_BASE_URL = 'http://localhost:8080'
 
+// Versioned API, described by the OpenAPI document at /api/v1/openapi.json
+const API_URL = `${API_BASE_URL}/api/v1`
+
 export interface LearningPath {
   id: string
   title: string
@@ -17,70 +20,126 @@ export interface Section {
   status: 'locked' | 'available' | 'completed'
 }
 
+export interface PortMapping {
+  containerPort: number
+  hostPort?: number
+  hostIp?: string
+  protocol?: 'tcp'
+}
+
+export interface ContainerRequest {
+  sectionId: string
+  image?: string
+  network?: 'none' | 'bridge' | 'host'
+  ports?: PortMapping[]
+}
+
+export interface ContainerResponse {
+  containerId: string
+  status: string
+  image: string
+  token: string
+  ports: PortMapping[] | null
+}
+
+export interface NetworkInfo {
+  mode: string
+  ipAddress?: string
+  prefixLength?: number
+  gateway?: string
+  bridge?: string
+  hostInterface?: string
+}
+
 export interface Container {
   id: string
-  status: 'running' | 'stopped' | 'error'
+  status: string
+  sectionId: string
   image: string
+  driver: string
+  network: NetworkInfo
+  ports: PortMapping[] | null
+  createdAt: string
+  restoredFrom?: string
+}
+
+export interface StatusMessage {
+  message: string
+}
+
+export interface FieldError {
+  field: string
+  message: string
+}
+
+// ApiError is thrown for every failed request, carrying the error
+// envelope's machine-readable code
+export class ApiError extends Error {
+  status: number
+  code: string
+  details: FieldError[]
+
+  constructor(status: number, code: string, message: string, details: FieldError[] = []) {
+    super(message)
+    this.name = 'ApiError'
+    this.status = status
+    this.code = code
+    this.details = details
+  }
 }
 
 class ApiService {
-  async getLearningPaths(): Promise<LearningPath[]> {
-    const response = await fetch(`${API_BASE_URL}/api/learning-paths`)
+  private async request<T>(path: string, init?: RequestInit): Promise<T> {
+    const response = await fetch(`${API_URL}${path}`, init)
     if (!response.ok) {
-      throw new Error('Failed to fetch learning paths')
+      const body = await response.json().catch(() => null)
+      const error = body?.error
+      throw new ApiError(
+        response.status,
+        error?.code ?? 'internal_error',
+        error?.message ?? response.statusText,
+        error?.details,
+      )
     }
     return response.json()
   }
 
+  async getLearningPaths(): Promise<LearningPath[]> {
+    return this.request('/learning-paths')
+  }
+
   async getLearningPath(id: string): Promise<LearningPath> {
-    const response = await fetch(`${API_BASE_URL}/api/learning-paths/${id}`)
-    if (!response.ok) {
-      throw new Error('Failed to fetch learning path')
-    }
-    return response.json()
+    return this.request(`/learning-paths/${id}`)
   }
 
   async getSection(pathId: string, sectionId: string): Promise<Section> {
-    const response = await fetch(`${API_BASE_URL}/api/learning-paths/${pathId}/sections/${sectionId}`)
-    if (!response.ok) {
-      throw new Error('Failed to fetch section')
-    }
-    return response.json()
+    return this.request(`/learning-paths/${pathId}/sections/${sectionId}`)
   }
 
-  async createContainer(sectionId: string): Promise<{ containerId: string; status: string }> {
-    const response = await fetch(`${API_BASE_URL}/api/containers/create`, {
+  async createContainer(sectionId: string): Promise<ContainerResponse> {
+    // The section's template picks the image
+    const req: ContainerRequest = { sectionId }
+    return this.request('/containers/create', {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
       },
-      body: JSON.stringify({
-        sectionId,
-        image: 'linux-containers-env:latest'
-      })
+      body: JSON.stringify(req),
     })
-    if (!response.ok) {
-      throw new Error('Failed to create container')
-    }
-    return response.json()
   }
 
   async getContainer(containerId: string): Promise<Container> {
-    const response = await fetch(`${API_BASE_URL}/api/containers/${containerId}`)
-    if (!response.ok) {
-      throw new Error('Failed to get container status')
-    }
-    return response.json()
+    return this.request(`/containers/${containerId}`)
   }
 
-  async deleteContainer(containerId: string): Promise<{ message: string }> {
-    const response = await fetch(`${API_BASE_URL}/api/containers/${containerId}`, {
-      method: 'DELETE'
+  async deleteContainer(containerId: string): Promise<StatusMessage> {
+    return this.request(`/containers/${containerId}`, {
+      method: 'DELETE',
     })
-    if (!response.ok) {
-      throw new Error('Failed to delete container')
-    }
-    return response.json()
+  }
+
+  terminalUrl(containerId: string): string {
+    return `${API_URL.replace(/^http/, 'ws')}/terminal/${containerId}/ws`
   }
 }
 